@@ -0,0 +1,128 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "strings"
+
+    "filippo.io/age"
+)
+
+// The age format, https://age-encryption.org/v1, of -encrypt age, written and
+// read by filippo.io/age.
+const (
+    ageVersionLine = "age-encryption.org/v1"
+    // ageMaxWorkFactor bounds the scrypt work factor of the files that
+    // -decrypt accepts: 20 takes 1GB of memory.
+    ageMaxWorkFactor = 20
+)
+
+// ageWorkFactor is the log2 of the scrypt cost of passphrase-encrypted files,
+// the default of age.
+var ageWorkFactor = 18
+
+// parseAgeKeys reads the X25519 identities, AGE-SECRET-KEY-1..., and
+// recipients, age1..., of a key file, one per line with # comments, as
+// written by age-keygen. Identities also encrypt to their recipient.
+func parseAgeKeys(keyFile, text string) (*fileKey, error) {
+    k := &fileKey{}
+    for i, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        switch {
+        case strings.HasPrefix(line, "AGE-SECRET-KEY-1"):
+            identity, e := age.ParseX25519Identity(line)
+            if e != nil {
+                return nil, fmt.Errorf("%s:%d: invalid age key: %v", keyFile, i+1, e)
+            }
+            k.identities = append(k.identities, identity)
+            k.recipients = append(k.recipients, identity.Recipient())
+        case strings.HasPrefix(line, "age1"):
+            recipient, e := age.ParseX25519Recipient(line)
+            if e != nil {
+                return nil, fmt.Errorf("%s:%d: invalid age key: %v", keyFile, i+1, e)
+            }
+            k.recipients = append(k.recipients, recipient)
+        default:
+            return nil, fmt.Errorf("%s:%d: not an age key", keyFile, i+1)
+        }
+    }
+    if k.recipients == nil {
+        return nil, fmt.Errorf("%s has no age keys", keyFile)
+    }
+    return k, nil
+}
+
+// ageEncrypt writes r to w encrypted for the recipients of k or, with a
+// passphrase, for its scrypt key.
+func ageEncrypt(w io.Writer, r *bufio.Reader, k *fileKey) error {
+    recipients := k.recipients
+    if k.passphrase != "" {
+        // Every file gets a scrypt recipient of its own, with a new salt:
+        // age wraps the file key with a zero nonce, which is only safe when
+        // no two files share the key derived from the salt.
+        recipient, e := age.NewScryptRecipient(k.passphrase)
+        if e != nil {
+            return e
+        }
+        recipient.SetWorkFactor(ageWorkFactor)
+        recipients = []age.Recipient{recipient}
+    }
+    if recipients == nil {
+        return errors.New("no age key")
+    }
+    aw, e := age.Encrypt(w, recipients...)
+    if e != nil {
+        return e
+    }
+    if _, e := io.Copy(aw, r); e != nil {
+        return e
+    }
+    return aw.Close()
+}
+
+func ageDecrypt(w io.Writer, r *bufio.Reader, k *fileKey) error {
+    identities := k.identities
+    if k.passphrase != "" {
+        identity, e := age.NewScryptIdentity(k.passphrase)
+        if e != nil {
+            return e
+        }
+        identity.SetMaxWorkFactor(ageMaxWorkFactor)
+        identities = []age.Identity{identity}
+    }
+    if identities == nil {
+        return errors.New("no age identity")
+    }
+    ar, e := age.Decrypt(r, identities...)
+    if e != nil {
+        return e
+    }
+    _, e = io.Copy(w, ar)
+    return e
+}
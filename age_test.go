@@ -0,0 +1,217 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/base64"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "filippo.io/age"
+)
+
+// ageTestKey is a key file of an identity and its recipient, as written by
+// age-keygen.
+const ageTestKey = "# public key: age1rcx57z8xy6sxuelu38nwck3qsfgxsynga5gfuwnfwc653wyzx55q6fp32p\n" +
+    "AGE-SECRET-KEY-1ER9GZWDMPW9P2FY5PS0S84MPGTHT43FT7EQJP68WC8N4ZL5YGVXQ9L2KJD\n"
+
+func ageTestFileKey(t *testing.T) *fileKey {
+    t.Helper()
+    keyFile := filepath.Join(t.TempDir(), "key.txt")
+    if e := os.WriteFile(keyFile, []byte(ageTestKey), 0600); e != nil {
+        t.Fatal(e)
+    }
+    k, e := readKeyFile(keyFile)
+    if e != nil {
+        t.Fatal(e)
+    }
+    return k
+}
+
+func TestAgeReference(t *testing.T) {
+    // "gopy age test\n" encrypted by age to the recipient of ageTestKey, and
+    // with the passphrase "correct horse" and work factor 10.
+    files := map[string]string{
+        "x25519": "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSAwZVNBRUpIUERDRVVLSjhwcU9vMno4UVZOTmhDNDcyOTBlYWxXQWFFWEVn" +
+            "CmFmTFRkTGdGcjFNT05UalJGcHFhdFBia1dmeFQ3eDU4NHdpMy9JTmp4UVEKLS0tIHh3MnYyTW52TDJ1bUZNOWo3Yk9PSVlIZTBnK094" +
+            "cVZjRXRzcWtCemI4VlkKg0zdfWU6QRvWFNW05lBW2z8foMaC2vPLiZd/pUvAPsdA2r9ZUUvgTbrhtRR5ig==",
+        "scrypt": "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IHNjcnlwdCAxbWhMeXBPQlIwNnptcG9oSWxDdjV3IDEwCno2Y29pLzZURkRiNklWdVA3" +
+            "QXJtQUxxOXJ3eStoYU5paEltOGR1YUdaSlkKLS0tIDgrcFFoTlk1Qlg4Vi80RnlKeHVldzBZUGVwVFkrZGZRbWY3TlRNUE16WFkKnAX5" +
+            "JtOyi+xZj+22WL7z0E5Q/hAe/0wIaDqVs1CEqJ5QyUSTGOA0HEUyyksK2Q==",
+    }
+    keys := map[string]*fileKey{"x25519": ageTestFileKey(t), "scrypt": {passphrase: "correct horse"}}
+    dir := t.TempDir()
+    for name, encoded := range files {
+        data, e := base64.StdEncoding.DecodeString(encoded)
+        if e != nil {
+            t.Fatal(e)
+        }
+        src, dest := filepath.Join(dir, name+".age"), filepath.Join(dir, name)
+        if e := os.WriteFile(src, data, 0644); e != nil {
+            t.Fatal(e)
+        }
+        if e := plainIO.decryptFile(src, dest, "age", keys[name]); e != nil {
+            t.Errorf("decryptFile() of the %s file = %v", name, e)
+        } else if got := readFile(t, dest); got != "gopy age test\n" {
+            t.Errorf("decryptFile() of the %s file = %q", name, got)
+        }
+    }
+    if e := plainIO.decryptFile(filepath.Join(dir, "scrypt.age"), filepath.Join(dir, "wrong"), "age",
+        &fileKey{passphrase: "wrong horse"}); e == nil {
+        t.Error("decryptFile() with a wrong passphrase succeeded")
+    }
+}
+
+func TestAgeRoundTrip(t *testing.T) {
+    defer func(workFactor int) { ageWorkFactor = workFactor }(ageWorkFactor)
+    ageWorkFactor = 10
+    keys := map[string]*fileKey{
+        "x25519": ageTestFileKey(t),
+        "scrypt": {passphrase: "correct horse"},
+    }
+    dir := t.TempDir()
+    for name, k := range keys {
+        for _, size := range []int{0, 1, encryptionChunkSize, 2 * encryptionChunkSize, 2*encryptionChunkSize + 5} {
+            plain := make([]byte, size)
+            rand.Read(plain)
+            src, enc, dec := filepath.Join(dir, "src"), filepath.Join(dir, name+".age"), filepath.Join(dir, "dec")
+            if e := os.WriteFile(src, plain, 0644); e != nil {
+                t.Fatal(e)
+            }
+            if e := plainIO.encryptFile(src, enc, "age", k); e != nil {
+                t.Fatal(e)
+            }
+            if e := plainIO.decryptFile(enc, dec, "age", k); e != nil {
+                t.Fatalf("decryptFile() of %d bytes with %s = %v", size, name, e)
+            }
+            if got := readFile(t, dec); got != string(plain) {
+                t.Errorf("%d bytes with %s decrypted to %d bytes", size, name, len(got))
+            }
+        }
+    }
+    identity, e := age.NewScryptIdentity("correct horse")
+    if e != nil {
+        t.Fatal(e)
+    }
+    data, e := os.ReadFile(filepath.Join(dir, "scrypt.age"))
+    if e != nil {
+        t.Fatal(e)
+    }
+    if _, e := age.Decrypt(bytes.NewReader(data), identity); e != nil {
+        t.Errorf("age.Decrypt() of a passphrase-encrypted file = %v", e)
+    }
+    // The file key of each file is wrapped with a zero nonce, so no two files
+    // may share the salt of their scrypt stanza.
+    again := filepath.Join(dir, "again.age")
+    if e := plainIO.encryptFile(filepath.Join(dir, "src"), again, "age", keys["scrypt"]); e != nil {
+        t.Fatal(e)
+    }
+    stanza := func(data string) string {
+        return strings.SplitN(data, "\n", 3)[1]
+    }
+    if first, second := stanza(string(data)), stanza(readFile(t, again)); first == second {
+        t.Errorf("two files encrypted with the same stanza %s", first)
+    }
+}
+
+func TestAgeRejectsTampering(t *testing.T) {
+    k := ageTestFileKey(t)
+    dir := t.TempDir()
+    src, enc := filepath.Join(dir, "src"), filepath.Join(dir, "src.age")
+    if e := os.WriteFile(src, bytes.Repeat([]byte("a"), 2*encryptionChunkSize), 0644); e != nil {
+        t.Fatal(e)
+    }
+    if e := plainIO.encryptFile(src, enc, "age", k); e != nil {
+        t.Fatal(e)
+    }
+    data, e := os.ReadFile(enc)
+    if e != nil {
+        t.Fatal(e)
+    }
+    chunk := encryptionChunkSize + 16
+    payload := len(data) - 2*chunk
+    header := bytes.Index(data, []byte("\n--- ")) + 1
+    flipped := append([]byte{}, data...)
+    flipped[len(flipped)-1] ^= 1
+    mac := append([]byte{}, data...)
+    mac[header+4] ^= 1
+    stanza := append([]byte{}, data...)
+    stanza[len(ageVersionLine)+len("\n-> X25519 ")] ^= 1
+    cases := map[string][]byte{
+        "flipped":            flipped,
+        "modified MAC":       mac,
+        "modified stanza":    stanza,
+        "truncated in chunk": data[:len(data)-encryptionChunkSize/2],
+        "truncated at chunk": data[:payload+chunk],
+        "truncated header":   data[:header],
+        "truncated nonce":    data[:payload-8],
+        "dropped chunk":      append(append([]byte{}, data[:payload]...), data[payload+chunk:]...),
+    }
+    for name, tampered := range cases {
+        path := filepath.Join(dir, name+".age")
+        if e := os.WriteFile(path, tampered, 0644); e != nil {
+            t.Fatal(e)
+        }
+        if e := plainIO.decryptFile(path, filepath.Join(dir, name), "age", k); e == nil {
+            t.Errorf("decryptFile() of a %s file succeeded", name)
+        }
+        if _, e := os.Stat(filepath.Join(dir, name)); e == nil {
+            t.Errorf("decryptFile() of a %s file left a file", name)
+        }
+    }
+    identity, e := age.GenerateX25519Identity()
+    if e != nil {
+        t.Fatal(e)
+    }
+    other := &fileKey{identities: []age.Identity{identity}}
+    if e := plainIO.decryptFile(enc, filepath.Join(dir, "other"), "age", other); e == nil {
+        t.Error("decryptFile() with another identity succeeded")
+    }
+    if e := plainIO.decryptFile(enc, filepath.Join(dir, "gcm"), "aes-gcm", &fileKey{key: make([]byte, 32)}); e == nil {
+        t.Error("decryptFile() of an age file as aes-gcm succeeded")
+    }
+}
+
+func TestCopyEncryptAge(t *testing.T) {
+    k := ageTestFileKey(t)
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "bb"})
+    encrypted := t.TempDir()
+    copyForTest(t, encrypted, writeManifestFile(t, src), copyOptions{encrypt: "age", key: k})
+    if got := readFile(t, filepath.Join(encrypted, "src", "sub", "b.txt.age")); !strings.HasPrefix(got, ageVersionLine+"\n") {
+        t.Errorf("encrypted file = %q", got)
+    }
+    if _, e := os.Stat(filepath.Join(encrypted, "src", "a.txt")); e == nil {
+        t.Error("a.txt was copied unencrypted")
+    }
+    restored := t.TempDir()
+    copyForTest(t, restored, writeManifestFile(t, filepath.Join(encrypted, "src")), copyOptions{decrypt: true, key: k})
+    for name, want := range map[string]string{"a.txt": "a", "sub/b.txt": "bb"} {
+        if got := readFile(t, filepath.Join(restored, "src", filepath.FromSlash(name))); got != want {
+            t.Errorf("%s = %q, want %q", name, got, want)
+        }
+    }
+}
@@ -0,0 +1,622 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Entry is a file or directory found by List.
+type Entry struct {
+    Root    string
+    Path    string
+    Size    int64
+    Dir     bool
+    ModTime time.Time
+}
+
+// ListOptions configures List. Patterns match the name or the whole path of
+// an entry, and a zero MaxSize means no limit. With FS, Directories are paths
+// in it and default to its root.
+type ListOptions struct {
+    FS          fs.FS
+    Directories []string
+    Recursive   bool
+    NoFiles     bool
+    NoDirs      bool
+    Include     []string
+    Exclude     []string
+    MinSize     int64
+    MaxSize     int64
+    // Filters are further filters every entry kept must match.
+    Filters []Filter
+    // OnEntry is called for every entry kept, as soon as it is found.
+    OnEntry func(Entry)
+    // OnError is called for every entry the walk cannot read. When it is nil,
+    // entries that cannot be read for lack of permission, or that vanished,
+    // are left out and any other error ends the listing.
+    OnError  ErrorHandler
+    Progress ProgressFunc
+    Events   *EventBus
+    // Logger gets the log of the listing, which is discarded when it is nil.
+    Logger *slog.Logger
+}
+
+// filters composes the patterns and sizes of o with its Filters.
+func (o ListOptions) filters() []Filter {
+    filters := []Filter{}
+    if len(o.Include) > 0 {
+        filters = append(filters, GlobFilter(o.Include...))
+    }
+    if len(o.Exclude) > 0 {
+        filters = append(filters, Not(GlobFilter(o.Exclude...)))
+    }
+    if o.MinSize > 0 || o.MaxSize > 0 {
+        filters = append(filters, SizeFilter(o.MinSize, o.MaxSize))
+    }
+    return append(filters, o.Filters...)
+}
+
+// Filter decides which entries List and Copy keep.
+type Filter interface {
+    Match(Entry) bool
+}
+
+// FilterFunc is a Filter that calls the function.
+type FilterFunc func(Entry) bool
+
+func (f FilterFunc) Match(entry Entry) bool {
+    return f(entry)
+}
+
+// GlobFilter matches entries whose name or path matches one of patterns.
+func GlobFilter(patterns ...string) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        return matchesAny(entry.Path, patterns)
+    })
+}
+
+// RegexFilter matches entries whose path, with slashes, matches re.
+func RegexFilter(re *regexp.Regexp) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        return re.MatchString(filepath.ToSlash(entry.Path))
+    })
+}
+
+// SizeFilter matches entries of min to max bytes, a zero max meaning no
+// limit.
+func SizeFilter(min, max int64) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        return entry.Size >= min && (max == 0 || entry.Size <= max)
+    })
+}
+
+// AgeFilter matches entries modified at least min and at most max ago, a
+// zero max meaning no limit.
+func AgeFilter(min, max time.Duration) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        age := time.Since(entry.ModTime)
+        return age >= min && (max == 0 || age <= max)
+    })
+}
+
+// MimeFilter matches local files whose content type, as detected from their
+// first bytes, matches one of types, e.g. "image/*".
+func MimeFilter(types ...string) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        if entry.Dir {
+            return false
+        }
+        mime := fileType(entry.Path, true, plainIO)
+        for _, t := range types {
+            if matched, _ := path.Match(t, mime); matched {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+// Not matches entries that f does not match.
+func Not(f Filter) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        return !f.Match(entry)
+    })
+}
+
+// AnyOf matches entries that one of filters matches.
+func AnyOf(filters ...Filter) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        for _, f := range filters {
+            if f.Match(entry) {
+                return true
+            }
+        }
+        return false
+    })
+}
+
+// AllOf matches entries that every filter matches.
+func AllOf(filters ...Filter) Filter {
+    return FilterFunc(func(entry Entry) bool {
+        for _, f := range filters {
+            if !f.Match(entry) {
+                return false
+            }
+        }
+        return true
+    })
+}
+
+// entryCollector is the entryWriter of List, which keeps the entries in
+// memory instead of writing a manifest.
+type entryCollector struct {
+    ctx      context.Context
+    opts     ListOptions
+    filter   Filter
+    progress ProgressFunc
+    entries  []Entry
+    files    int
+    bytes    int64
+}
+
+func newEntryCollector(ctx context.Context, opts ListOptions) *entryCollector {
+    return &entryCollector{ctx: ctx, opts: opts, filter: AllOf(opts.filters()...),
+        progress: opts.Progress.with(opts.Events)}
+}
+
+func (c *entryCollector) add(entry Entry) {
+    if c.opts.OnEntry != nil {
+        c.opts.OnEntry(entry)
+    }
+    c.entries = append(c.entries, entry)
+    if !entry.Dir {
+        c.files++
+        c.bytes += entry.Size
+    }
+    c.progress.report(Event{Kind: EntryFound, Path: entry.Path, Files: c.files, Bytes: c.bytes})
+}
+
+func (c *entryCollector) done() {
+    c.progress.report(Event{Kind: Done, Files: c.files, Bytes: c.bytes, TotalFiles: c.files, TotalBytes: c.bytes})
+}
+
+func (c *entryCollector) begin() error {
+    return nil
+}
+
+func (c *entryCollector) writeEntry(root string, i fileInfo) error {
+    if e := c.ctx.Err(); e != nil {
+        return e
+    }
+    entry := Entry{Root: root, Path: i.file, Size: i.size}
+    if info, e := os.Lstat(i.file); e == nil {
+        entry.Dir, entry.ModTime = info.IsDir(), info.ModTime()
+    }
+    if c.filter.Match(entry) {
+        c.add(entry)
+    }
+    return nil
+}
+
+func (c *entryCollector) end() error {
+    return nil
+}
+
+// List lists the directories of opts without the command-line flags, for
+// programs built with gopy. Entries found before an error or the
+// cancellation of ctx are returned with it.
+func List(ctx context.Context, opts ListOptions) ([]Entry, error) {
+    if opts.FS != nil {
+        return listFS(ctx, opts)
+    }
+    if len(opts.Directories) == 0 {
+        return nil, errors.New("no directory to list")
+    }
+    for _, dir := range opts.Directories {
+        if !isCloud(dir) && !isDirectory(dir) {
+            return nil, fmt.Errorf("%s does not exist or is not a directory", dir)
+        }
+    }
+    c := newEntryCollector(ctx, opts)
+    w := newWalker(opts.OnError)
+    w.setLogger(runLogger(opts.Logger))
+    l := &lister{w: c, links: map[fileID]bool{}, walker: w}
+    for _, dir := range opts.Directories {
+        root := ""
+        if len(opts.Directories) > 1 {
+            root = dir
+        }
+        c.progress.report(Event{Kind: ScanStarted, Path: dir})
+        list := l.list
+        if isCloud(dir) {
+            list = l.listStorage
+        }
+        if e := list(dir, root, opts.Recursive, opts.NoFiles, opts.NoDirs); e != nil {
+            return c.entries, e
+        }
+    }
+    c.done()
+    return c.entries, nil
+}
+
+// listFS lists the directories of opts.FS. Directory sizes are the total of
+// the files below them, as for local directories.
+func listFS(ctx context.Context, opts ListOptions) ([]Entry, error) {
+    dirs := opts.Directories
+    if len(dirs) == 0 {
+        dirs = []string{"."}
+    }
+    c := newEntryCollector(ctx, opts)
+    w := newWalker(opts.OnError)
+    w.setLogger(runLogger(opts.Logger))
+    unreadable := w.unreadable
+    for _, dir := range dirs {
+        root := ""
+        if len(dirs) > 1 {
+            root = dir
+        }
+        c.progress.report(Event{Kind: ScanStarted, Path: dir})
+        found := []Entry{}
+        sizes := map[string]int64{}
+        e := fs.WalkDir(opts.FS, dir, func(name string, d fs.DirEntry, e error) error {
+            if e != nil {
+                if !unreadable.add(name, e) {
+                    return e
+                }
+                return nil
+            }
+            if e := ctx.Err(); e != nil {
+                return e
+            }
+            info, e := d.Info()
+            if e != nil {
+                if !unreadable.add(name, e) {
+                    return e
+                }
+                return nil
+            }
+            if !d.IsDir() {
+                for p := name; p != dir; {
+                    p = path.Dir(p)
+                    sizes[p] += info.Size()
+                }
+            }
+            if opts.Recursive || path.Dir(name) == dir && name != dir {
+                found = append(found, Entry{Root: root, Path: name, Size: info.Size(), Dir: d.IsDir(),
+                    ModTime: info.ModTime()})
+            }
+            return nil
+        })
+        for _, entry := range found {
+            if entry.Dir {
+                entry.Size = sizes[entry.Path]
+            }
+            if ((entry.Dir && !opts.NoDirs) || (!entry.Dir && !opts.NoFiles)) && c.filter.Match(entry) {
+                c.add(entry)
+            }
+        }
+        if e != nil {
+            return c.entries, e
+        }
+    }
+    c.done()
+    return c.entries, nil
+}
+
+// CopyOptions configures Copy. Shard and Shards select a share of the
+// files like -shard, and a zero MaxSize means no limit. With Source, the
+// manifests list paths in it, and the files are written to Dest, or to
+// Directory when Dest is nil. With Sync, files are copied unless the
+// destination has them with the same size and modification time, which
+// Copy gives them when Dest is a ChtimesFS. Sync with Delete and Source needs
+// a Dest that is a RemoveFS.
+type CopyOptions struct {
+    Manifests []string
+    Directory string
+    Source    fs.FS
+    Dest      WritableFS
+    Sync      bool
+    Delete    bool
+    DryRun    bool
+    MinSize   int64
+    MaxSize   int64
+    Shard     int
+    Shards    int
+    Retries   int
+    Downloads int
+    // Filters are further filters every file copied must match.
+    Filters []Filter
+    // OnFile is called after every file copied, with its destination path
+    // relative to Directory.
+    OnFile func(path string, size int64)
+    // OnError is called for every source entry the walk cannot read, like
+    // ListOptions.OnError. Entries gone past are counted as failed.
+    OnError  ErrorHandler
+    Progress ProgressFunc
+    Events   *EventBus
+    // Logger gets the log of the copy, including the errors of the files
+    // that fail, which is discarded when it is nil.
+    Logger *slog.Logger
+}
+
+func (o CopyOptions) filter() Filter {
+    filters := o.Filters
+    if o.MinSize > 0 || o.MaxSize > 0 {
+        filters = append([]Filter{SizeFilter(o.MinSize, o.MaxSize)}, filters...)
+    }
+    if len(filters) == 0 {
+        return nil
+    }
+    return AllOf(filters...)
+}
+
+// Report is the outcome of Copy.
+type Report struct {
+    FilesScanned int
+    Directories  int
+    TotalBytes   int64
+    FilesCopied  int
+    BytesCopied  int64
+    Skipped      int
+    Failed       int
+    Elapsed      time.Duration
+}
+
+// Copy copies the manifests of opts without the command-line flags, for
+// programs built with gopy. It stops between files when ctx is cancelled.
+// Files that fail are counted in the report, and errors that end the run,
+// like an unwritable destination, are returned with the report so far.
+func Copy(ctx context.Context, opts CopyOptions) (Report, error) {
+    if opts.Dest != nil && opts.Source == nil {
+        return Report{}, errors.New("a destination file system needs a source file system")
+    }
+    if opts.Source != nil && opts.Dest == nil && opts.Directory != "" {
+        opts.Dest = DirFS(opts.Directory)
+    }
+    if _, ok := opts.Dest.(RemoveFS); opts.Source != nil && opts.Sync && opts.Delete && !ok {
+        return Report{}, errors.New("deleting from a destination file system needs a RemoveFS")
+    }
+    if (opts.Directory == "" && opts.Dest == nil) || len(opts.Manifests) == 0 {
+        return Report{}, errors.New("a destination directory and at least one manifest are needed")
+    }
+    for _, manifest := range opts.Manifests {
+        if _, e := os.Lstat(manifest); e != nil {
+            return Report{}, e
+        }
+    }
+    if opts.Shards > 0 && (opts.Shard < 1 || opts.Shard > opts.Shards) {
+        return Report{}, fmt.Errorf("invalid shard: %d/%d", opts.Shard, opts.Shards)
+    }
+    progress := opts.Progress.with(opts.Events)
+    if opts.Source != nil {
+        return copyFS(ctx, opts, progress)
+    }
+    start := time.Now()
+    log := runLogger(opts.Logger)
+    w := newWalker(opts.OnError)
+    w.setLogger(log)
+    result, e := copyManifests(opts.Directory, opts.Manifests, copyOptions{
+        sync:       opts.Sync,
+        delete:     opts.Sync && opts.Delete,
+        yes:        true,
+        dryRun:     opts.DryRun,
+        match:      opts.filter(),
+        shard:      opts.Shard,
+        shards:     opts.Shards,
+        retries:    opts.Retries,
+        retryDelay: time.Second,
+        downloads:  max(opts.Downloads, 1),
+        ctx:        ctx,
+        onCopied:   opts.OnFile,
+        progress:   progress,
+        walker:     w,
+        fio:        newFileIO(1<<20, log),
+        logger:     log,
+        stdout:     io.Discard,
+        printError: func(msg interface{}) { log.Error("error", "error", fmt.Sprint(msg)) },
+    })
+    report := Report{
+        FilesScanned: result.scanned,
+        Directories:  result.dirs,
+        TotalBytes:   result.totalBytes,
+        FilesCopied:  result.files,
+        BytesCopied:  result.bytes,
+        Skipped:      result.skipped,
+        Failed:       result.failed,
+        Elapsed:      time.Since(start),
+    }
+    report.done(progress)
+    if e != nil {
+        return report, e
+    }
+    return report, ctx.Err()
+}
+
+func (r Report) done(progress ProgressFunc) {
+    progress.report(Event{Kind: Done, Files: r.FilesCopied, Bytes: r.BytesCopied, TotalFiles: r.FilesScanned,
+        TotalBytes: r.TotalBytes})
+}
+
+// copyFS copies the entries of the manifests from opts.Source to opts.Dest.
+// Like copy, an entry is copied under its base name.
+func copyFS(ctx context.Context, opts CopyOptions, progress ProgressFunc) (Report, error) {
+    start := time.Now()
+    report := Report{}
+    log := runLogger(opts.Logger)
+    fail := func(path string, e error) {
+        log.Error("error", "error", e.Error())
+        report.Failed++
+        progress.report(Event{Kind: Error, Path: path, Err: e})
+    }
+    shard := copyOptions{shard: opts.Shard, shards: opts.Shards}
+    filter := opts.filter()
+    entries, e := readManifests(opts.Manifests, log)
+    if e != nil {
+        return report, e
+    }
+    // As with copy, seen holds every path of the sources, including the files
+    // left out, which Delete keeps, and roots the directories of the manifests.
+    seen, roots, unreadable := map[string]bool{}, []string{}, 0
+    for _, entry := range entries {
+        root := path.Clean(filepath.ToSlash(entry.Path))
+        progress.report(Event{Kind: ScanStarted, Path: root})
+        e := fs.WalkDir(opts.Source, root, func(name string, d fs.DirEntry, e error) error {
+            if e != nil {
+                unreadable++
+                fail(name, e)
+                return nil
+            }
+            if e := ctx.Err(); e != nil {
+                return e
+            }
+            rel := name
+            if root != "." {
+                rel = path.Join(path.Base(root), strings.TrimPrefix(name, root))
+            }
+            seen[rel] = true
+            if d.IsDir() {
+                if name == root {
+                    roots = append(roots, rel)
+                }
+                report.Directories++
+                if opts.DryRun {
+                    return nil
+                }
+                if e := opts.Dest.MkdirAll(rel, 0755); e != nil {
+                    fail(rel, e)
+                    return fs.SkipDir
+                }
+                return nil
+            }
+            info, e := d.Info()
+            if e != nil {
+                fail(name, e)
+                return nil
+            }
+            if (filter != nil && !filter.Match(Entry{Path: name, Size: info.Size(), ModTime: info.ModTime()})) ||
+                !inShard(rel, shard) {
+                return nil
+            }
+            report.FilesScanned++
+            report.TotalBytes += info.Size()
+            progress.report(Event{Kind: FileStarted, Path: rel, Files: report.FilesCopied, Bytes: report.BytesCopied})
+            if prev, e := fs.Stat(opts.Dest, rel); opts.Sync && e == nil && isCopyOf(prev, info) {
+                log.Debug("file_skipped", "path", rel, "reason", "up to date")
+                report.Skipped++
+                return nil
+            }
+            if !opts.DryRun {
+                if e := copyFileFS(opts.Source, opts.Dest, name, rel); e != nil {
+                    fail(rel, e)
+                    return nil
+                }
+                if dest, ok := opts.Dest.(ChtimesFS); ok && opts.Sync {
+                    if e := dest.Chtimes(rel, info.ModTime(), info.ModTime()); e != nil {
+                        fail(rel, e)
+                        return nil
+                    }
+                }
+            }
+            log.Info("file_copied", "path", rel, "size", info.Size())
+            report.FilesCopied++
+            report.BytesCopied += info.Size()
+            if opts.OnFile != nil {
+                opts.OnFile(rel, info.Size())
+            }
+            progress.report(Event{Kind: FileCopied, Path: rel, Size: info.Size(), Files: report.FilesCopied,
+                Bytes: report.BytesCopied})
+            return nil
+        })
+        if e != nil {
+            report.Elapsed = time.Since(start)
+            report.done(progress)
+            return report, e
+        }
+    }
+    if opts.Sync && opts.Delete && unreadable > 0 {
+        log.Error("error", "error", fmt.Sprintf("%d source paths could not be read, so nothing is deleted", unreadable))
+    } else if opts.Sync && opts.Delete {
+        deleteExtraneousFS(opts.Dest.(RemoveFS), roots, seen, opts.DryRun, log, fail)
+    }
+    report.Elapsed = time.Since(start)
+    report.done(progress)
+    return report, nil
+}
+
+// deleteExtraneousFS removes from dest the entries below roots that are not
+// in keep, like deleteExtraneous, or only logs them with dryRun.
+func deleteExtraneousFS(dest RemoveFS, roots []string, keep map[string]bool, dryRun bool, log *slog.Logger,
+    fail func(string, error)) {
+    extraneous := []string{}
+    for _, root := range roots {
+        fs.WalkDir(dest, root, func(name string, d fs.DirEntry, e error) error {
+            if e != nil || keep[name] {
+                return nil
+            }
+            extraneous = append(extraneous, name)
+            if d.IsDir() {
+                return fs.SkipDir
+            }
+            return nil
+        })
+    }
+    for _, name := range extraneous {
+        if dryRun {
+            log.Info("delete_skipped", "path", name, "reason", "dry run")
+            continue
+        }
+        if e := dest.RemoveAll(name); e != nil {
+            fail(name, e)
+            continue
+        }
+        log.Info("file_deleted", "path", name)
+    }
+}
+
+func copyFileFS(src fs.FS, dest WritableFS, name, rel string) error {
+    in, e := src.Open(name)
+    if e != nil {
+        return e
+    }
+    defer in.Close()
+    out, e := dest.Create(rel)
+    if e != nil {
+        return e
+    }
+    if _, e := io.Copy(out, in); e != nil {
+        out.Close()
+        return e
+    }
+    return out.Close()
+}
@@ -0,0 +1,333 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+type zipDestination struct {
+    f   *os.File
+    w   *zip.Writer
+    fio *fileIO
+}
+
+func newZipDestination(path string, fio *fileIO) (*zipDestination, error) {
+    if dir := filepath.Dir(path); dir != "" {
+        os.MkdirAll(dir, 0755)
+    }
+    f, e := os.Create(path)
+    if e != nil {
+        return nil, e
+    }
+    return &zipDestination{f, zip.NewWriter(f), fio}, nil
+}
+
+func (d *zipDestination) makeDir(rel string, info os.FileInfo) error {
+    header, e := zip.FileInfoHeader(info)
+    if e != nil {
+        return e
+    }
+    header.Name = filepath.ToSlash(rel) + "/"
+    header.Method = zip.Store
+    _, e = d.w.CreateHeader(header)
+    return e
+}
+
+func (d *zipDestination) writeFile(src, rel string, info os.FileInfo) error {
+    header, e := zip.FileInfoHeader(info)
+    if e != nil {
+        return e
+    }
+    header.Name = filepath.ToSlash(rel)
+    header.Method = zip.Deflate
+    w, e := d.w.CreateHeader(header)
+    if e != nil {
+        return e
+    }
+    srcFile, e := d.fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+    _, e = d.fio.copyBuffered(w, srcFile)
+    return e
+}
+
+func (d *zipDestination) close() error {
+    if e := d.w.Close(); e != nil {
+        d.f.Close()
+        return e
+    }
+    return d.f.Close()
+}
+
+type tarDestination struct {
+    f   *os.File
+    gz  *gzip.Writer
+    w   *tar.Writer
+    fio *fileIO
+}
+
+func newTarDestination(path string, compress bool, fio *fileIO) (*tarDestination, error) {
+    if dir := filepath.Dir(path); dir != "" {
+        os.MkdirAll(dir, 0755)
+    }
+    f, e := os.Create(path)
+    if e != nil {
+        return nil, e
+    }
+    d := &tarDestination{f: f, fio: fio}
+    if compress {
+        d.gz = gzip.NewWriter(f)
+        d.w = tar.NewWriter(d.gz)
+    } else {
+        d.w = tar.NewWriter(f)
+    }
+    return d, nil
+}
+
+func (d *tarDestination) makeDir(rel string, info os.FileInfo) error {
+    header, e := tar.FileInfoHeader(info, "")
+    if e != nil {
+        return e
+    }
+    header.Name = filepath.ToSlash(rel) + "/"
+    return d.w.WriteHeader(header)
+}
+
+func (d *tarDestination) writeFile(src, rel string, info os.FileInfo) error {
+    header, e := tar.FileInfoHeader(info, "")
+    if e != nil {
+        return e
+    }
+    header.Name = filepath.ToSlash(rel)
+    srcFile, e := d.fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+    if e := d.w.WriteHeader(header); e != nil {
+        return e
+    }
+    _, e = d.fio.copyBuffered(d.w, srcFile)
+    return e
+}
+
+func (d *tarDestination) close() error {
+    e := d.w.Close()
+    if d.gz != nil {
+        if ge := d.gz.Close(); e == nil {
+            e = ge
+        }
+    }
+    if fe := d.f.Close(); e == nil {
+        e = fe
+    }
+    return e
+}
+
+var archiveFormats = []string{"zip", "tar", "tar.gz"}
+
+func isArchiveFormat(format string) bool {
+    for _, f := range archiveFormats {
+        if f == format {
+            return true
+        }
+    }
+    return false
+}
+
+func detectArchiveFormat(path string) string {
+    lower := strings.ToLower(path)
+    switch {
+    case strings.HasSuffix(lower, ".zip"):
+        return "zip"
+    case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+        return "tar.gz"
+    case strings.HasSuffix(lower, ".tar"):
+        return "tar"
+    }
+    return ""
+}
+
+func extractPath(dir, name string) (string, error) {
+    dest := filepath.Join(dir, filepath.FromSlash(name))
+    rel, e := filepath.Rel(dir, dest)
+    if e != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("illegal path in archive: %s", name)
+    }
+    return dest, nil
+}
+
+func extractEntry(dest string, r io.Reader, mode os.FileMode, modTime time.Time) error {
+    os.MkdirAll(filepath.Dir(dest), 0755)
+    f, e := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+    if e != nil {
+        return e
+    }
+    if _, e := cliIO.copyBuffered(f, r); e != nil {
+        f.Close()
+        return e
+    }
+    if e := f.Close(); e != nil {
+        return e
+    }
+    return os.Chtimes(dest, modTime, modTime)
+}
+
+type extractor struct {
+    dir          string
+    differential bool
+    written      []string
+    unchanged    []string
+}
+
+func (x *extractor) unchangedEntry(dest string, size int64, modTime time.Time) bool {
+    fi, e := os.Stat(dest)
+    return e == nil && fi.Mode().IsRegular() && fi.Size() == size &&
+        fi.ModTime().Truncate(time.Second).Equal(modTime.Truncate(time.Second))
+}
+
+func (x *extractor) file(name string, size int64, mode os.FileMode, modTime time.Time,
+    open func() (io.ReadCloser, error)) error {
+    dest, e := extractPath(x.dir, name)
+    if e != nil {
+        return e
+    }
+    if x.differential && x.unchangedEntry(dest, size, modTime) {
+        x.unchanged = append(x.unchanged, dest)
+        return nil
+    }
+    r, e := open()
+    if e != nil {
+        return e
+    }
+    defer r.Close()
+    if e := extractEntry(dest, r, mode, modTime); e != nil {
+        return e
+    }
+    x.written = append(x.written, dest)
+    return nil
+}
+
+func (x *extractor) extractZip(archivePath string) error {
+    r, e := zip.OpenReader(archivePath)
+    if e != nil {
+        return e
+    }
+    defer r.Close()
+    for _, f := range r.File {
+        if f.FileInfo().IsDir() {
+            dest, e := extractPath(x.dir, f.Name)
+            if e != nil {
+                return e
+            }
+            os.MkdirAll(dest, 0755)
+            continue
+        }
+        if e := x.file(f.Name, int64(f.UncompressedSize64), f.Mode(), f.Modified, f.Open); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func (x *extractor) extractTar(archivePath string, compressed bool) error {
+    f, e := os.Open(archivePath)
+    if e != nil {
+        return e
+    }
+    defer f.Close()
+    var r io.Reader = f
+    if compressed {
+        gz, e := gzip.NewReader(f)
+        if e != nil {
+            return e
+        }
+        defer gz.Close()
+        r = gz
+    }
+    tr := tar.NewReader(r)
+    open := func() (io.ReadCloser, error) {
+        return ioutil.NopCloser(tr), nil
+    }
+    for {
+        header, e := tr.Next()
+        if e == io.EOF {
+            return nil
+        }
+        if e != nil {
+            return e
+        }
+        switch header.Typeflag {
+        case tar.TypeDir:
+            dest, e := extractPath(x.dir, header.Name)
+            if e != nil {
+                return e
+            }
+            os.MkdirAll(dest, 0755)
+        case tar.TypeReg:
+            e := x.file(header.Name, header.Size, os.FileMode(header.Mode), header.ModTime, open)
+            if e != nil {
+                return e
+            }
+        }
+    }
+}
+
+func runExtract(archivePath, directoryPath, format string, differential bool) {
+    if format == "" {
+        format = detectArchiveFormat(archivePath)
+    }
+    os.MkdirAll(directoryPath, 0755)
+    x := &extractor{dir: directoryPath, differential: differential}
+    var e error
+    switch format {
+    case "zip":
+        e = x.extractZip(archivePath)
+    case "tar":
+        e = x.extractTar(archivePath, false)
+    case "tar.gz":
+        e = x.extractTar(archivePath, true)
+    default:
+        e = fmt.Errorf("unknown archive format: %s", archivePath)
+    }
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    if differential {
+        for _, path := range x.written {
+            fmt.Println("Restored:", path)
+        }
+        fmt.Printf("%d files restored, %d unchanged\n", len(x.written), len(x.unchanged))
+    }
+}
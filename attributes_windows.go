@@ -0,0 +1,165 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "syscall"
+    "unsafe"
+)
+
+const preservedAttributes = syscall.FILE_ATTRIBUTE_READONLY | syscall.FILE_ATTRIBUTE_HIDDEN |
+    syscall.FILE_ATTRIBUTE_SYSTEM | syscall.FILE_ATTRIBUTE_ARCHIVE
+
+// longPath returns path with the \\?\ prefix, which lifts the 260 character
+// limit of the Windows API for the calls that os does not make itself.
+func longPath(path string) string {
+    if strings.HasPrefix(path, `\\?\`) {
+        return path
+    }
+    abs, e := filepath.Abs(path)
+    if e != nil {
+        return path
+    }
+    if strings.HasPrefix(abs, `\\`) {
+        return `\\?\UNC\` + abs[2:]
+    }
+    return `\\?\` + abs
+}
+
+// isLink reports whether info is a symbolic link, a junction or another
+// reparse point.
+func isLink(info os.FileInfo) bool {
+    if info.Mode()&(os.ModeSymlink|os.ModeIrregular) != 0 {
+        return true
+    }
+    data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+    return ok && data.FileAttributes&syscall.FILE_ATTRIBUTE_REPARSE_POINT != 0
+}
+
+// makeWritable clears the read-only attribute of an existing path, which
+// would otherwise prevent replacing it.
+func makeWritable(path string) {
+    p, e := syscall.UTF16PtrFromString(longPath(path))
+    if e != nil {
+        return
+    }
+    if attrs, e := syscall.GetFileAttributes(p); e == nil && attrs&syscall.FILE_ATTRIBUTE_READONLY != 0 {
+        syscall.SetFileAttributes(p, attrs&^syscall.FILE_ATTRIBUTE_READONLY)
+    }
+}
+
+// copyAttributes gives dest the creation time and the read-only, hidden,
+// system and archive attributes of info, and with streams the alternate
+// data streams of src.
+func copyAttributes(src, dest string, info os.FileInfo, streams bool) error {
+    if streams {
+        if e := copyStreams(src, dest); e != nil {
+            return e
+        }
+    }
+    p, e := syscall.UTF16PtrFromString(longPath(dest))
+    if e != nil {
+        return e
+    }
+    if data, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+        h, e := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+            nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+        if e != nil {
+            return e
+        }
+        e = syscall.SetFileTime(h, &data.CreationTime, nil, nil)
+        syscall.CloseHandle(h)
+        if e != nil {
+            return e
+        }
+        attrs, e := syscall.GetFileAttributes(p)
+        if e != nil {
+            return e
+        }
+        return syscall.SetFileAttributes(p, attrs&^preservedAttributes|data.FileAttributes&preservedAttributes)
+    }
+    return nil
+}
+
+var (
+    kernel32         = syscall.NewLazyDLL("kernel32.dll")
+    findFirstStreamW = kernel32.NewProc("FindFirstStreamW")
+    findNextStreamW  = kernel32.NewProc("FindNextStreamW")
+)
+
+type win32FindStreamData struct {
+    size int64
+    name [syscall.MAX_PATH + 36]uint16
+}
+
+// copyStreams copies the alternate data streams of src, such as
+// Zone.Identifier, to dest.
+func copyStreams(src, dest string) error {
+    p, e := syscall.UTF16PtrFromString(longPath(src))
+    if e != nil {
+        return e
+    }
+    var data win32FindStreamData
+    h, _, e := findFirstStreamW.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&data)), 0)
+    if syscall.Handle(h) == syscall.InvalidHandle {
+        if e == syscall.ERROR_HANDLE_EOF {
+            return nil
+        }
+        return e
+    }
+    defer syscall.FindClose(syscall.Handle(h))
+    for {
+        // Stream names look like ":name:$DATA", the unnamed one is "::$DATA".
+        name := strings.TrimSuffix(syscall.UTF16ToString(data.name[:]), ":$DATA")
+        if name != ":" && name != "" {
+            if e := copyStream(src+name, dest+name); e != nil {
+                return e
+            }
+        }
+        if r, _, e := findNextStreamW.Call(h, uintptr(unsafe.Pointer(&data))); r == 0 {
+            if e == syscall.ERROR_HANDLE_EOF {
+                return nil
+            }
+            return e
+        }
+    }
+}
+
+func copyStream(src, dest string) error {
+    in, e := os.Open(src)
+    if e != nil {
+        return e
+    }
+    defer in.Close()
+    out, e := os.Create(dest)
+    if e != nil {
+        return e
+    }
+    if _, e := copyBuffered(out, in); e != nil {
+        out.Close()
+        return e
+    }
+    return out.Close()
+}
@@ -0,0 +1,82 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "path/filepath"
+    "testing"
+)
+
+func TestBlake3(t *testing.T) {
+    // Inputs of the BLAKE3 test vectors, bytes 0, 1, ..., 250, 0, 1, ..., of
+    // one block, several chunks and a tree of many.
+    for n, want := range map[int]string{
+        0:      "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+        1:      "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213",
+        1025:   "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444",
+        102400: "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085",
+    } {
+        input := make([]byte, n)
+        for i := range input {
+            input[i] = byte(i % 251)
+        }
+        h := hashAlgorithms["blake3"]()
+        for _, size := range []int{n, 1, 64, 1000} {
+            h.Reset()
+            for p := input; len(p) > 0; p = p[min(size, len(p)):] {
+                h.Write(p[:min(size, len(p))])
+            }
+            if got := hex.EncodeToString(h.Sum(nil)); got != want {
+                t.Errorf("BLAKE3 of %d bytes in %d-byte writes = %s, want %s", n, size, got, want)
+            }
+        }
+        // Sum leaves the state untouched.
+        h.Write([]byte{0})
+        h.Sum(nil)
+        if got := hex.EncodeToString(h.Sum(nil)); got == want {
+            t.Errorf("BLAKE3 of %d bytes ignored a later write", n)
+        }
+    }
+}
+
+func TestVerifyTreesBlake3(t *testing.T) {
+    dir := t.TempDir()
+    src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+    writeFiles(t, src, map[string]string{"same.txt": "same", "differs.txt": "source"})
+    writeFiles(t, dest, map[string]string{"same.txt": "same", "differs.txt": "target"})
+    report := filepath.Join(dir, "report.json")
+    if count := runVerifyTrees(src, dest, "blake3", 2, report); count != 1 {
+        t.Fatalf("got %d mismatches, want 1", count)
+    }
+    var m mismatch
+    if e := json.Unmarshal([]byte(readFile(t, report)), &m); e != nil {
+        t.Fatal(e)
+    }
+    want := mismatch{"differs.txt", "content differs",
+        "7d1aa223722b2aaa89b92fc6b2ef0baa709c01eab9f8494b1de5c335f2750707",
+        "ff2f93d50d44841205d987fb24ba10d956ecb35998a4931f7bef74e6319cce0a"}
+    if m != want {
+        t.Errorf("got %+v, want %+v", m, want)
+    }
+}
@@ -0,0 +1,161 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+type browser struct {
+    dir    string
+    sizes  map[string]int64
+    marked map[string]int64
+    walker *walker
+}
+
+// entries returns the entries of the current directory, largest first. Sizes
+// are computed the first time a directory is shown.
+func (b *browser) entries() ([]fileInfo, error) {
+    fi, e := ioutil.ReadDir(b.dir)
+    if e != nil {
+        return nil, e
+    }
+    entries := []fileInfo{}
+    for _, info := range fi {
+        path := filepath.Join(b.dir, info.Name())
+        size, ok := b.sizes[path]
+        if !ok {
+            if size, e = b.walker.getSize(path); e != nil {
+                return nil, e
+            }
+            b.sizes[path] = size
+        }
+        entries = append(entries, fileInfo{path, size})
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].size > entries[j].size
+    })
+    return entries, nil
+}
+
+func (b *browser) show(entries []fileInfo) {
+    fmt.Println()
+    fmt.Println(b.dir)
+    for i, entry := range entries {
+        mark, name := " ", filepath.Base(entry.file)
+        if _, ok := b.marked[entry.file]; ok {
+            mark = "*"
+        }
+        if isDirectory(entry.file) {
+            name += string(filepath.Separator)
+        }
+        fmt.Printf("%s %4d  %10s  %s\n", mark, i+1, formatSize(entry.size), name)
+    }
+    fmt.Println("<n> open, .. up, m <n> mark, w write marked, q quit")
+}
+
+func (b *browser) write(outputFile string) error {
+    paths := []string{}
+    for path := range b.marked {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    f, e := os.Create(outputFile)
+    if e != nil {
+        return e
+    }
+    defer f.Close()
+    w := &textEntryWriter{w: f}
+    for _, path := range paths {
+        if e := w.writeEntry("", fileInfo{path, b.marked[path]}); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+// runBrowse lets the user walk the tree below dir, largest entries first,
+// and writes the entries they mark to outputFile as a manifest for copy.
+func runBrowse(dir, outputFile string, input io.Reader) {
+    dir, _ = filepath.Abs(dir)
+    b := &browser{dir, map[string]int64{}, map[string]int64{}, cliWalker}
+    in := bufio.NewScanner(input)
+    for {
+        entries, e := b.entries()
+        if e != nil {
+            printError(e)
+            b.dir = filepath.Dir(b.dir)
+            continue
+        }
+        b.show(entries)
+        fmt.Print("> ")
+        if !in.Scan() {
+            return
+        }
+        fields := strings.Fields(in.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        index := func(s string) (fileInfo, bool) {
+            n, e := strconv.Atoi(s)
+            if e != nil || n < 1 || n > len(entries) {
+                printError("no entry " + s)
+                return fileInfo{}, false
+            }
+            return entries[n-1], true
+        }
+        switch fields[0] {
+        case "q":
+            return
+        case "..":
+            b.dir = filepath.Dir(b.dir)
+        case "m":
+            for _, s := range fields[1:] {
+                if entry, ok := index(s); ok {
+                    if _, marked := b.marked[entry.file]; marked {
+                        delete(b.marked, entry.file)
+                    } else {
+                        b.marked[entry.file] = entry.size
+                    }
+                }
+            }
+        case "w":
+            if e := b.write(outputFile); e != nil {
+                printError(e)
+            } else {
+                fmt.Printf("Wrote %d entries to %s\n", len(b.marked), outputFile)
+            }
+        default:
+            if entry, ok := index(fields[0]); ok && isDirectory(entry.file) {
+                b.dir = entry.file
+            }
+        }
+    }
+}
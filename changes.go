@@ -0,0 +1,226 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+const lastRunFileName = ".gopy-last-run"
+
+// readLastRun returns the start time of the last complete sync to
+// directoryPath, or the zero time when there was none.
+func readLastRun(directoryPath string) time.Time {
+    data, e := ioutil.ReadFile(filepath.Join(directoryPath, lastRunFileName))
+    if e != nil {
+        return time.Time{}
+    }
+    t, e := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+    if e != nil {
+        return time.Time{}
+    }
+    return t
+}
+
+func writeLastRun(directoryPath string, t time.Time) error {
+    return ioutil.WriteFile(filepath.Join(directoryPath, lastRunFileName),
+        []byte(t.Format(time.RFC3339Nano)+"\n"), 0644)
+}
+
+const changeJournalName = ".gopy-changes"
+
+// changeJournal records, while serve runs, the paths that change below the
+// sources of a scheduled sync with -since-last-run, so that the sync walks
+// only those. Since is when the watch was complete: the journal stands in
+// for a walk only if it covers everything since the last run.
+type changeJournal struct {
+    Since   time.Time            `json:"since"`
+    Changes map[string]time.Time `json:"changes"`
+
+    path string
+    w    *watcher
+}
+
+// startChangeJournal watches the sources of manifest and keeps the journal
+// of directoryPath up to date until serve exits.
+func startChangeJournal(manifest, directoryPath string) error {
+    entries, e := readManifests([]string{manifest}, logger)
+    if e != nil {
+        return e
+    }
+    w, e := newWatcher()
+    if e != nil {
+        return e
+    }
+    j := &changeJournal{Changes: map[string]time.Time{}, path: filepath.Join(directoryPath, changeJournalName), w: w}
+    for _, entry := range entries {
+        if isDirectory(entry.Path) {
+            j.watchTree(entry.Path)
+        } else if e := w.add(filepath.Dir(entry.Path)); e != nil {
+            printError(e)
+        }
+    }
+    j.Since = time.Now()
+    if e := j.save(); e != nil {
+        return e
+    }
+    go j.record(directoryPath)
+    return nil
+}
+
+func (j *changeJournal) watchTree(dir string) {
+    filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err == nil && info.IsDir() {
+            if e := j.w.add(path); e != nil {
+                printError(e)
+            }
+        }
+        return nil
+    })
+}
+
+func (j *changeJournal) record(directoryPath string) {
+    for {
+        paths, all, e := j.w.wait()
+        if e != nil {
+            printError(e)
+            os.Remove(j.path)
+            return
+        }
+        for _, path := range paths {
+            if info, e := os.Lstat(path); e == nil && info.IsDir() {
+                j.watchTree(path)
+            }
+        }
+        j.update(paths, all, time.Now(), readLastRun(directoryPath))
+        if e := j.save(); e != nil {
+            printError(e)
+        }
+    }
+}
+
+// update records paths as changed at now, or starts the journal again at now
+// when all says that changes were lost, and forgets the changes before
+// lastRun.
+func (j *changeJournal) update(paths []string, all bool, now, lastRun time.Time) {
+    if all {
+        // Changes were lost, so the next sync has to walk everything.
+        j.Since = now
+        j.Changes = map[string]time.Time{}
+    }
+    for _, path := range paths {
+        j.Changes[path] = now
+    }
+    for path, t := range j.Changes {
+        if t.Before(lastRun) {
+            delete(j.Changes, path)
+        }
+    }
+}
+
+func (j *changeJournal) save() error {
+    data, e := json.Marshal(j)
+    if e != nil {
+        return e
+    }
+    tmp := j.path + ".tmp"
+    if e := ioutil.WriteFile(tmp, data, 0644); e != nil {
+        return e
+    }
+    return os.Rename(tmp, j.path)
+}
+
+// readChangeJournal returns the paths that changed since lastRun, without
+// those below another of them, if the journal of directoryPath covers that
+// whole time.
+func readChangeJournal(directoryPath string, lastRun time.Time) ([]string, bool) {
+    data, e := ioutil.ReadFile(filepath.Join(directoryPath, changeJournalName))
+    if e != nil || lastRun.IsZero() {
+        return nil, false
+    }
+    var j changeJournal
+    if e := json.Unmarshal(data, &j); e != nil || j.Since.IsZero() || j.Since.After(lastRun) {
+        return nil, false
+    }
+    paths := []string{}
+    for path, t := range j.Changes {
+        if !t.Before(lastRun) {
+            paths = append(paths, path)
+        }
+    }
+    sort.Strings(paths)
+    changed := []string{}
+    for _, path := range paths {
+        if len(changed) == 0 || !isWithin(path, changed[len(changed)-1]) {
+            changed = append(changed, path)
+        }
+    }
+    return changed, true
+}
+
+// walkChangedPaths walks the paths of sources that a change journal lists
+// instead of the whole sources.
+func (w *walker) walkChangedPaths(sources, paths []string, junk []string, fn func(item copyItem)) error {
+    scanProgress.walking.Store(true)
+    defer scanProgress.walking.Store(false)
+    for _, path := range paths {
+        if _, e := os.Lstat(path); e != nil {
+            continue
+        }
+        for _, source := range sources {
+            if isWithin(path, source) {
+                if e := w.walkCopySource(source, path, junk, fn); e != nil {
+                    return e
+                }
+                break
+            }
+        }
+    }
+    return nil
+}
+
+// startScheduleJournal starts a change journal for a scheduled sync job with
+// -since-last-run, where the manifest and directory are given by the job.
+func startScheduleJournal(sched *schedule) {
+    if sched.request.Command != "sync" {
+        return
+    }
+    c, e := readConfig(sched.request.Options["config"])
+    if e != nil {
+        return
+    }
+    options := c.Jobs[sched.request.Options["job"]]
+    manifest, _ := options["input"].(string)
+    directory, _ := options["directory"].(string)
+    if options["since-last-run"] != true || manifest == "" || directory == "" || !isDirectory(directory) {
+        return
+    }
+    if e := startChangeJournal(manifest, directory); e != nil {
+        logger.Info("change_journal_unavailable", "job", sched.request.Options["job"], "reason", e.Error())
+    }
+}
@@ -0,0 +1,159 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestChangeJournal(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a": "a", "sub/b": "b"})
+    manifest := writeManifestFile(t, src)
+    dest := t.TempDir()
+    if e := startChangeJournal(manifest, dest); e != nil {
+        t.Skip(e)
+    }
+    copyForTest(t, dest, manifest, copyOptions{sync: true, sinceLast: true})
+    if e := os.WriteFile(filepath.Join(src, "sub", "c"), []byte("c"), 0644); e != nil {
+        t.Fatal(e)
+    }
+    var paths []string
+    for deadline := time.Now().Add(5 * time.Second); len(paths) == 0 && time.Now().Before(deadline); {
+        time.Sleep(50 * time.Millisecond)
+        paths, _ = readChangeJournal(dest, readLastRun(dest))
+    }
+    if len(paths) != 1 || paths[0] != filepath.Join(src, "sub", "c") {
+        t.Fatalf("readChangeJournal() = %v", paths)
+    }
+    result, e := copyManifests(dest, []string{manifest}, copyOptions{sync: true, sinceLast: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.files != 1 {
+        t.Errorf("sync scanned %d files, want only the changed one", result.files)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "sub", "c")); got != "c" {
+        t.Errorf("sub/c = %q", got)
+    }
+    if _, ok := readChangeJournal(dest, time.Now().Add(-time.Hour)); ok {
+        t.Error("journal started after the last run was used")
+    }
+}
+
+func writeChangeJournalForTest(t *testing.T, dir string, j changeJournal) {
+    t.Helper()
+    j.path = filepath.Join(dir, changeJournalName)
+    if e := j.save(); e != nil {
+        t.Fatal(e)
+    }
+}
+
+func TestReadChangeJournal(t *testing.T) {
+    src, dest := t.TempDir(), t.TempDir()
+    lastRun := time.Now().Add(-time.Hour)
+    a, b, c := filepath.Join(src, "a"), filepath.Join(src, "a", "b"), filepath.Join(src, "c")
+    writeChangeJournalForTest(t, dest, changeJournal{Since: lastRun.Add(-time.Hour), Changes: map[string]time.Time{
+        b: lastRun.Add(time.Minute), a: lastRun.Add(2 * time.Minute), c: lastRun.Add(time.Minute),
+        filepath.Join(src, "old"): lastRun.Add(-time.Minute)}})
+    paths, ok := readChangeJournal(dest, lastRun)
+    if !ok || strings.Join(paths, " ") != a+" "+c {
+        t.Errorf("readChangeJournal() = %v, %v, want [%s %s]", paths, ok, a, c)
+    }
+    if _, ok := readChangeJournal(dest, time.Time{}); ok {
+        t.Error("journal used without a last run")
+    }
+    if _, ok := readChangeJournal(t.TempDir(), lastRun); ok {
+        t.Error("missing journal used")
+    }
+    // A journal started after the last run missed the changes in between.
+    writeChangeJournalForTest(t, dest, changeJournal{Since: lastRun.Add(time.Second), Changes: map[string]time.Time{}})
+    if _, ok := readChangeJournal(dest, lastRun); ok {
+        t.Error("stale journal used")
+    }
+    writeFiles(t, dest, map[string]string{changeJournalName: "{"})
+    if _, ok := readChangeJournal(dest, lastRun); ok {
+        t.Error("corrupt journal used")
+    }
+}
+
+func TestChangeJournalOverflow(t *testing.T) {
+    dest := t.TempDir()
+    start := time.Now().Add(-time.Hour)
+    lastRun := start.Add(time.Minute)
+    j := &changeJournal{Since: start, Changes: map[string]time.Time{}, path: filepath.Join(dest, changeJournalName)}
+    j.update([]string{"before"}, false, start.Add(time.Second), start)
+    j.update([]string{"after"}, false, lastRun.Add(time.Second), lastRun)
+    if len(j.Changes) != 1 || j.Changes["after"].IsZero() {
+        t.Errorf("changes = %v, want only those after the last run", j.Changes)
+    }
+    lost := lastRun.Add(time.Minute)
+    j.update(nil, true, lost, lastRun)
+    if !j.Since.Equal(lost) || len(j.Changes) != 0 {
+        t.Errorf("after an overflow the journal starts at %v with %v", j.Since, j.Changes)
+    }
+    if e := j.save(); e != nil {
+        t.Fatal(e)
+    }
+    if _, ok := readChangeJournal(dest, lastRun); ok {
+        t.Error("journal used after changes were lost")
+    }
+    // The next sync walks everything, and the journal covers the one after.
+    if paths, ok := readChangeJournal(dest, lost.Add(time.Second)); !ok || len(paths) != 0 {
+        t.Errorf("readChangeJournal() after the next sync = %v, %v", paths, ok)
+    }
+}
+
+func TestSyncFallsBackToWalk(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a": "a", "sub/b": "b", "sub/c": "c"})
+    manifest := writeManifestFile(t, src)
+    lastRun := time.Now().Add(-time.Hour)
+    for _, c := range []struct {
+        name  string
+        since time.Time
+        want  int
+    }{
+        {"journal", lastRun.Add(-time.Minute), 1},
+        {"stale journal", lastRun.Add(time.Minute), 3},
+    } {
+        // The destination is as the last run left it.
+        dest := t.TempDir()
+        copyForTest(t, dest, manifest, copyOptions{})
+        if e := writeLastRun(dest, lastRun); e != nil {
+            t.Fatal(e)
+        }
+        writeChangeJournalForTest(t, dest, changeJournal{Since: c.since,
+            Changes: map[string]time.Time{filepath.Join(src, "a"): time.Now()}})
+        result, e := copyManifests(dest, []string{manifest}, copyOptions{sync: true, sinceLast: true})
+        if e != nil {
+            t.Fatal(e)
+        }
+        if result.scanned != c.want || result.failed != 0 {
+            t.Errorf("%s: sync scanned %d files with %d failed, want %d", c.name, result.scanned, result.failed, c.want)
+        }
+    }
+}
@@ -0,0 +1,120 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// manifestRoot returns the directory the entries of a manifest were listed
+// from: their common parent, or the first entry for recursive listings.
+func manifestRoot(entries []jsonEntry) (string, bool) {
+    if len(entries) == 0 {
+        return "", false
+    }
+    root := entries[0].Path
+    if len(entries) == 1 {
+        return filepath.Dir(root), false
+    }
+    for _, entry := range entries {
+        for !isWithin(entry.Path, root) && filepath.Dir(root) != root {
+            root = filepath.Dir(root)
+        }
+    }
+    return root, root == entries[0].Path
+}
+
+// runCheck verifies that every entry of the manifest at inputPath exists with
+// the same size and, when the manifest has checksums, the same SHA-256.
+// With directoryPath, the entries are looked up there instead of where they
+// were listed. Files that are not in a recursive manifest are reported as
+// extra. It returns the number of problems found.
+func runCheck(inputPath, directoryPath string) int {
+    entries, e := readManifest(inputPath, logger)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    root, recursive := manifestRoot(entries)
+    if directoryPath == "" {
+        directoryPath = root
+    }
+    problems := 0
+    report := func(kind, path, reason string) {
+        if reason != "" {
+            fmt.Printf("%s: %s (%s)\n", kind, path, reason)
+        } else {
+            fmt.Printf("%s: %s\n", kind, path)
+        }
+        problems++
+    }
+    listed := map[string]bool{}
+    for _, entry := range entries {
+        rel, e := filepath.Rel(root, entry.Path)
+        if e != nil {
+            report("Missing", entry.Path, e.Error())
+            continue
+        }
+        path := filepath.Join(directoryPath, rel)
+        listed[path] = true
+        fi, e := os.Stat(path)
+        if e != nil {
+            report("Missing", path, "")
+            continue
+        }
+        if fi.IsDir() {
+            continue
+        }
+        if entry.approximate {
+            if fmt.Sprintf("%.2f", float64(fi.Size())/1024000) != fmt.Sprintf("%.2f", float64(entry.Size)/1024000) {
+                report("Corrupted", path, "size differs")
+            }
+            continue
+        }
+        if fi.Size() != entry.Size {
+            report("Corrupted", path, fmt.Sprintf("size %d, expected %d", fi.Size(), entry.Size))
+            continue
+        }
+        if entry.SHA256 != "" {
+            if sum, e := cliIO.hashFile(path); e != nil {
+                report("Corrupted", path, e.Error())
+            } else if sum != entry.SHA256 {
+                report("Corrupted", path, "checksum differs")
+            }
+        }
+    }
+    if recursive {
+        filepath.Walk(directoryPath,
+            func(path string, info os.FileInfo, err error) error {
+                if err == nil && !listed[path] {
+                    report("Extra", path, "")
+                    if info.IsDir() {
+                        return filepath.SkipDir
+                    }
+                }
+                return nil
+            })
+    }
+    fmt.Printf("Entries checked: %d, problems: %d\n", len(entries), problems)
+    return problems
+}
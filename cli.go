@@ -0,0 +1,1640 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "crypto/rand"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Exit codes, see README.md.
+const (
+    exitSuccess     = 0
+    exitUsage       = 1
+    exitPartial     = 2
+    exitIOError     = 3
+    exitInterrupted = 130
+)
+
+func printUsage() {
+    if activeCommand != nil {
+        fmt.Println("Usage:", os.Args[0], activeCommand.name, "[options]")
+        activeFlags.PrintDefaults()
+        return
+    }
+    fmt.Println("Usage:", os.Args[0], "<command> [options]")
+    fmt.Println()
+    fmt.Println("Commands:")
+    for _, c := range commands {
+        fmt.Printf("  %-14s%s\n", c.name, c.description)
+    }
+    fmt.Println()
+    fmt.Printf("Run \"%s <command> -help\" for the options of a command.\n", os.Args[0])
+}
+
+func printUsageAndExit(exitCode int) {
+    printUsage()
+    os.Exit(exitCode)
+}
+
+var copyFlag = new(bool)
+
+var inputFile = new(string)
+
+var copyInputs scheduleList
+
+var listFlag = new(bool)
+
+var directoryPath = new(string)
+
+var listDirectories stringList
+
+var outputFile = new(string)
+
+var noDirFlag = new(bool)
+
+var noFileFlag = new(bool)
+
+var recursiveFlag = new(bool)
+
+var skipJunkFlag = new(bool)
+
+var junkPatterns = new(string)
+
+var warnOver = new(string)
+
+var warnReport = new(string)
+
+var warnOverSize int64
+
+// cliWalker holds the walk settings of the command line, which List and Copy
+// do not share.
+var cliWalker = newWalker(nil)
+
+// cliIO holds how the command line reads and writes files, which Copy does
+// not share either.
+var cliIO = newFileIO(1<<20, logger)
+
+// listSettings are the -find-empty, -text-only, -checksum and related flags
+// of -list.
+var listSettings listFilters
+
+var archiveFormat = new(string)
+
+var priorityClasses = new(string)
+
+var extractFlag = new(bool)
+
+var syncFlag = new(bool)
+
+var deleteFlag = new(bool)
+
+var yesFlag = new(bool)
+
+var compressFormat = new(string)
+
+var decompressFlag = new(bool)
+
+var checkpointFile = new(string)
+
+var dedupMode = new(string)
+
+var watchFlag = new(bool)
+
+var twoPhaseFlag = new(bool)
+
+var readOnlySourceFlag = new(bool)
+
+var watchInterval = new(time.Duration)
+
+var configFile = new(string)
+
+var jobName = new(string)
+
+var profileName = new(string)
+
+var helpFlag = new(bool)
+
+var differentialFlag = new(bool)
+
+var dryRunFlag = new(bool)
+
+var listFormat = new(string)
+
+var replayFlag = new(bool)
+
+var undoFlag = new(bool)
+
+var journalFile = new(string)
+
+var lockPath = new(string)
+
+var stopAtFree = new(string)
+
+var stopAtFreeSize int64
+
+var summaryFormat = new(string)
+
+var softDeleteFlag = new(bool)
+
+var deletedRetention = new(time.Duration)
+
+var maxChangePercent = new(float64)
+
+var forceFlag = new(bool)
+
+var pricePerGB = new(float64)
+
+var pricePer1kRequests = new(float64)
+
+var verboseFlag = new(bool)
+
+var veryVerboseFlag = new(bool)
+
+var quietFlag = new(bool)
+
+var sinceLastRunFlag = new(bool)
+
+var logFormat = new(string)
+
+var logFile = new(string)
+
+var verifyTreesFlag = new(bool)
+
+var verifyTrees []string
+
+var hashAlgorithm = new(string)
+
+var jobs = new(int)
+
+var reportFile = new(string)
+
+var retries = new(int)
+
+var tuneFlag = new(bool)
+
+var saveJob = new(string)
+
+var fsyncFlag = new(bool)
+
+var filterScript = new(string)
+
+var sparseFlag = new(bool)
+
+var hardLinksFlag = new(bool)
+
+var oneFileSystemFlag = new(bool)
+
+var preHookFlag = new(string)
+
+var postHookFlag = new(string)
+
+var s3Endpoint = new(string)
+
+var sshClient = new(string)
+
+var s3PartSizeFlag = new(string)
+
+var s3Concurrency = new(int)
+
+var notifyWebhook = new(string)
+
+var notifyEmail = new(string)
+
+var notifyOn = new(string)
+
+var onFileHook = new(string)
+
+var diffFlag = new(bool)
+
+var diffManifests []string
+
+var diffFormat = new(string)
+
+var manifestFlag = new(bool)
+
+var manifestArgs []string
+
+var includePatterns = new(string)
+
+var excludePatterns = new(string)
+
+var minSizeFlag = new(string)
+
+var maxSizeFlag = new(string)
+
+var manifestMinSize int64
+
+var manifestMaxSize int64
+
+var shardCount = new(int)
+
+var checksumFlag = new(bool)
+
+var checkFlag = new(bool)
+
+var templateText = new(string)
+
+var browseFlag = new(bool)
+
+var browseDirectory []string
+
+var duFlag = new(bool)
+
+var duDirectories []string
+
+var duDepth = new(int)
+
+var byExtension = new(string)
+
+var reportErrors = new(bool)
+
+var heartbeatInterval = new(time.Duration)
+
+var maxOpenFiles = new(int)
+
+var copyOrder = new(string)
+
+var noIgnoreFlag = new(bool)
+
+var textOnlyFlag = new(bool)
+
+var findEmptyFlag = new(bool)
+
+var backupDir = new(string)
+
+var backupSuffix = new(string)
+
+var versionedMode = new(string)
+
+var linkDest = new(string)
+
+var deleteEmptyFlag = new(bool)
+
+var binaryOnlyFlag = new(bool)
+
+var byMimeFlag = new(bool)
+
+var metricsFile = new(string)
+
+var metricsAddr = new(string)
+
+var serveFlag = new(bool)
+
+var listenAddr = new(string)
+
+var grpcAddr = new(string)
+
+var serveToken = new(string)
+
+var serveConcurrency = new(int)
+
+var serveState = new(string)
+
+var serveSchedules scheduleList
+
+var scheduleHistory = new(int)
+
+var fleetFlag = new(bool)
+
+var fleetCommand []string
+
+var rootsFile = new(string)
+
+var jobFlag = new(bool)
+
+var jobArgs []string
+
+var retryDelay = new(time.Duration)
+
+var downloadJobs = new(int)
+
+var deltaFlag = new(bool)
+
+var inPlaceFlag = new(bool)
+
+var encryptMode = new(string)
+
+var decryptFlag = new(bool)
+
+var keyFile = new(string)
+
+var encryption *fileKey
+
+var snapshotFlag = new(bool)
+
+var snapshotDirectory []string
+
+var restoreFlag = new(bool)
+
+var restoreArgs []string
+
+var repository = new(string)
+
+var listStateFile = new(string)
+
+var noCacheFlag = new(bool)
+
+var bufferSize = new(string)
+
+var preallocateFlag = new(bool)
+
+var maxBytes = new(string)
+
+var maxBytesSize int64
+
+var maxFiles = new(int)
+
+var copyMinSize = new(string)
+
+var copyMinSizeBytes int64
+
+var copyMaxSize = new(string)
+
+var copyMaxSizeBytes int64
+
+var shardFlag = new(string)
+
+var copyShard, copyShards int
+
+var streamsFlag = new(bool)
+
+var linksFlag = new(string)
+
+var normalizeForm = new(string)
+
+var caseCollision = new(string)
+
+var renameFlags scheduleList
+
+var flattenFlag = new(bool)
+
+var flattenCollision = new(string)
+
+var renameRules []renameRule
+
+var pathNormalization = ""
+
+type stringList []string
+
+func (l *stringList) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+    *l = append(*l, splitList(value)...)
+    return nil
+}
+
+// scheduleList collects a repeated flag whose values may contain commas.
+type scheduleList []string
+
+func (l *scheduleList) String() string {
+    return strings.Join(*l, "; ")
+}
+
+func (l *scheduleList) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
+
+type command struct {
+    name        string
+    description string
+    op          *bool
+    register    func(fs *flag.FlagSet)
+}
+
+var commands = []command{
+    {"list", "list files and directories into a manifest", listFlag, registerListFlags},
+    {"copy", "copy the files and directories of a manifest", copyFlag, registerCopyFlags},
+    {"sync", "copy only new or changed files of a manifest", syncFlag, registerSyncFlags},
+    {"extract", "extract a zip, tar or tar.gz archive", extractFlag, registerExtractFlags},
+    {"replay", "apply the operations of a copy or sync journal to another destination", replayFlag, registerReplayFlags},
+    {"undo", "revert the last copy or sync into a directory, where possible", undoFlag, registerUndoFlags},
+    {"verify-trees", "compare the checksums of the files of two directories", verifyTreesFlag, registerVerifyTreesFlags},
+    {"tune", "measure the sources and destination of a manifest and recommend copy options", tuneFlag, registerTuneFlags},
+    {"job", "export a job of the config file to a bundle or import one", jobFlag, registerJobFlags},
+    {"fleet", "run a command once for each of many root directories", fleetFlag, registerFleetFlags},
+    {"diff", "report entries added, removed or changed in size between two manifests", diffFlag, registerDiffFlags},
+    {"manifest", "merge, filter or split manifests without reading the files they list", manifestFlag, registerManifestFlags},
+    {"check", "verify that the files of a manifest exist with the same size and checksum", checkFlag, registerCheckFlags},
+    {"browse", "browse a directory by size and mark entries to write a manifest", browseFlag, registerBrowseFlags},
+    {"du", "report the size of directories up to a depth", duFlag, registerDuFlags},
+    {"serve", "run list and copy jobs requested over an HTTP or gRPC API", serveFlag, registerServeFlags},
+    {"snapshot", "store a deduplicated snapshot of a directory in a repository", snapshotFlag, registerSnapshotFlags},
+    {"restore", "restore a snapshot of a repository to a directory", restoreFlag, registerSnapshotFlags},
+}
+
+var activeCommand *command
+
+var activeFlags = flag.CommandLine
+
+func registerCommonFlags(fs *flag.FlagSet) {
+    fs.BoolVar(readOnlySourceFlag, "assert-readonly-source", false,
+        "open sources read-only without updating access times and refuse to write inside them - optional")
+    fs.StringVar(configFile, "config", defaultConfigFile, "JSON or YAML config file with named jobs - optional")
+    fs.StringVar(jobName, "job", "", "run the named job from the config file - optional")
+    fs.StringVar(profileName, "profile", "",
+        "apply the named profile of the config file, after the options of the command line and job - optional")
+    fs.BoolVar(helpFlag, "help", false, "help")
+    fs.BoolVar(verboseFlag, "v", false, "log every file copied or skipped - optional")
+    fs.BoolVar(veryVerboseFlag, "vv", false, "log directories and unchanged files too - optional")
+    fs.BoolVar(quietFlag, "quiet", false, "only log errors - optional")
+    fs.StringVar(logFormat, "log-format", "text", "log format (text, json) - optional")
+    fs.StringVar(logFile, "log-file", "", "append the log to this file instead of stderr - optional")
+    fs.StringVar(colorMode, "color", "auto", "color terminal output (auto, always, never), auto honors NO_COLOR - optional")
+    fs.IntVar(maxOpenFiles, "max-open-files", 0,
+        "files kept open at the same time by concurrent copies and hashes, 0 derives it from the descriptor limit - optional")
+}
+
+func registerListFlags(fs *flag.FlagSet) {
+    fs.Var(&listDirectories, "directory",
+        "directory to list, may be repeated or comma-separated, or given as arguments - mandatory")
+    fs.StringVar(outputFile, "output", "", "output file, - for stdout - mandatory")
+    registerStorageFlags(fs, false)
+    fs.StringVar(byExtension, "by-extension", "",
+        "print the number and size of files per extension at the end (table, csv, json) - optional")
+    fs.BoolVar(byMimeFlag, "mime", false, "group files by detected MIME type instead (with -by-extension) - optional")
+    fs.BoolVar(reportErrors, "report-errors", false, "print the paths that could not be read after the summary - optional")
+    fs.StringVar(highlightOver, "highlight-over", "1GB", "highlight files larger than this size in colored output - optional")
+    fs.StringVar(listFormat, "format", "text", "output format (text, ndjson, sql, sqlite, template) - optional")
+    fs.StringVar(templateText, "template", "",
+        "Go template of each line, with .Root, .Path, .Size, .ModTime, .IsDir and human, e.g. '{{.Path}}\\t{{.Size}}' - optional")
+    fs.BoolVar(checksumFlag, "checksum", false, "include the SHA-256 checksum of every file (with -format ndjson, sql or sqlite) - optional")
+    fs.IntVar(jobs, "checksum-jobs", 0, "number of files hashed concurrently (with -checksum), 0 uses one per CPU - optional")
+    fs.StringVar(listStateFile, "state", "",
+        "file the checksums are kept in between listings, so that only changed files are hashed again (with -checksum) - optional")
+    fs.StringVar(summaryFormat, "summary", "text", "summary printed at the end (text, json, none) - optional")
+    fs.BoolVar(noDirFlag, "nodir", false, "don't include directories - optional")
+    fs.BoolVar(noFileFlag, "nofile", false, "don't include files - optional")
+    fs.BoolVar(findEmptyFlag, "find-empty", false, "only include zero-byte files and empty directories - optional")
+    fs.BoolVar(deleteEmptyFlag, "delete-empty", false,
+        "delete the empty directories found, and the parents they leave empty (with -find-empty) - optional")
+    fs.BoolVar(yesFlag, "yes", false, "delete without asking for a confirmation (with -delete-empty) - optional")
+    fs.BoolVar(textOnlyFlag, "text-only", false, "only include the files whose content is text - optional")
+    fs.BoolVar(binaryOnlyFlag, "binary-only", false, "only include the files whose content is binary - optional")
+    fs.BoolVar(recursiveFlag, "recursive", false, "recursive - optional")
+    fs.StringVar(normalizeForm, "normalize", "", "Unicode normalization form (nfc, nfd) of the paths written to the manifest - optional")
+    fs.StringVar(linksFlag, "links", "", "what to do with symbolic links and junctions (skip, follow), "+
+        "by default they are listed and not followed - optional")
+    fs.StringVar(checkpointFile, "checkpoint", "", "checkpoint file to resume an interrupted listing (with -recursive) - optional")
+    fs.BoolVar(oneFileSystemFlag, "one-file-system", false, "don't descend into directories on other file systems - optional")
+    fs.BoolVar(noCacheFlag, "no-cache", false, "compute directory sizes without the cache of previous runs - optional")
+    fs.BoolVar(noIgnoreFlag, "no-ignore", false, "list the files excluded by "+ignoreFileName+" files too - optional")
+    fs.DurationVar(heartbeatInterval, "heartbeat", 0, "print the progress of the scan this often, e.g. 30s - optional")
+    registerHookFlags(fs)
+}
+
+func registerHookFlags(fs *flag.FlagSet) {
+    fs.StringVar(preHookFlag, "pre-hook", "", "shell command run before the operation, which is aborted if it fails - optional")
+    fs.StringVar(postHookFlag, "post-hook", "", "shell command run after the operation, even when it fails - optional")
+    fs.StringVar(notifyWebhook, "notify-webhook", "", "URL the outcome of the operation is posted to as JSON - optional")
+    fs.StringVar(notifyEmail, "notify-email", "",
+        "comma-separated addresses the outcome is mailed to, with the smtp settings of the config file - optional")
+    fs.StringVar(notifyOn, "notify-on", "always", "when to notify (always, failure) - optional")
+}
+
+func registerCopyFlags(fs *flag.FlagSet) {
+    fs.Var(&copyInputs, "input", "input manifest file or directory of manifests, may be repeated - mandatory")
+    fs.StringVar(directoryPath, "directory", "", "destination directory - mandatory")
+    fs.BoolVar(skipJunkFlag, "skip-junk", false, "skip OS junk files - optional")
+    fs.StringVar(normalizeForm, "normalize", "", "Unicode normalization form (nfc, nfd) of the paths created in the destination - optional")
+    fs.StringVar(linksFlag, "links", "", "what to do with symbolic links and junctions (skip, follow, recreate), "+
+        "by default they are copied as files - optional")
+    fs.Var(&renameFlags, "rename",
+        "rule rewriting destination paths, s/regexp/replacement/[g], strip:N or prefix:dir, may be repeated - optional")
+    fs.BoolVar(flattenFlag, "flatten", false, "copy all files directly into the destination, without subdirectories - optional")
+    fs.StringVar(flattenCollision, "flatten-collision", "number",
+        "what to do with files of the same name (with -flatten): add a number or a hash of the path, or skip - optional")
+    fs.StringVar(caseCollision, "case-collision", "",
+        "what to do with paths differing only by case, for case-insensitive destinations (rename, skip, fail) - optional")
+    fs.StringVar(junkPatterns, "junk", strings.Join(defaultJunkPatterns, ","),
+        "comma-separated junk file patterns (with -skip-junk) - optional")
+    fs.StringVar(warnOver, "warn-over", "", "report files larger than this size, e.g. 10GB - optional")
+    fs.StringVar(copyMinSize, "copy-min-size", "", "skip files smaller than this size, e.g. 1KB - optional")
+    fs.StringVar(copyMaxSize, "copy-max-size", "", "skip files larger than this size, e.g. 4GB - optional")
+    fs.StringVar(shardFlag, "shard", "",
+        "copy only share i of N, as i/N, of the files, so that N machines can copy the same manifest - optional")
+    fs.StringVar(warnReport, "warn-report", "", "large-file report file, default stdout (with -warn-over) - optional")
+    fs.StringVar(backupDir, "backup", "", "move destination files about to be overwritten into this directory - optional")
+    fs.StringVar(backupSuffix, "backup-suffix", "",
+        "keep destination files about to be overwritten under their name with this suffix, e.g. .bak - optional")
+    fs.StringVar(linkDest, "link-dest", "",
+        "hard link the files unchanged since this previous copy from it instead of copying them - optional")
+    fs.StringVar(versionedMode, "versioned", "", "never overwrite destination files but keep their previous versions "+
+        "as name.v1, name.v2... (number) or in a "+versionsDirName+"/<time> directory (time) - optional")
+    fs.BoolVar(noIgnoreFlag, "no-ignore", false, "copy the files excluded by "+ignoreFileName+" files too - optional")
+    fs.StringVar(copyOrder, "order", "as-listed",
+        "order files are copied in (as-listed, largest-first, smallest-first), within -priority classes - optional")
+    fs.StringVar(priorityClasses, "priority", "",
+        "priority classes copied first, classes separated by ';' and patterns by ',', e.g. \"*.db;*.doc,*.pdf\" - optional")
+    fs.StringVar(dedupMode, "dedup", "",
+        "skip or hard link (skip, link) files whose content already exists in the destination - optional")
+    fs.BoolVar(twoPhaseFlag, "two-phase", false,
+        "stage and verify all files in a hidden directory before moving them into place - optional")
+    fs.BoolVar(watchFlag, "watch", false, "keep running and copy new or changed files - optional")
+    fs.DurationVar(watchInterval, "watch-interval", 2*time.Second, "how often sources are rescanned (with -watch) where inotify is unavailable - optional")
+    fs.StringVar(summaryFormat, "summary", "text", "summary printed at the end (text, json, none) - optional")
+    fs.StringVar(maxBytes, "max-bytes", "", "skip the files that would take the copied bytes over this size, e.g. 50GB - optional")
+    fs.IntVar(maxFiles, "max-files", 0, "skip the files after this many are copied, 0 for no limit - optional")
+    fs.StringVar(stopAtFree, "stop-at-free", "",
+        "stop, resumably, when free space on the destination would drop below this size, e.g. 10GB - optional")
+    fs.StringVar(journalFile, "journal", "", "record copy, mkdir and delete operations to this journal file - optional")
+    fs.StringVar(lockPath, "lock", "",
+        "lock file held while copying, by default "+lockFileName+" in a local destination directory or next to an archive - optional")
+    fs.StringVar(metricsAddr, "metrics-addr", "",
+        "serve Prometheus metrics at /metrics on this address, e.g. :9100, mostly useful with -watch - optional")
+    fs.StringVar(metricsFile, "metrics-file", "", "write throughput metrics of the run as JSON to this file - optional")
+    fs.BoolVar(dryRunFlag, "dry-run", false, "report what would be copied without writing anything - optional")
+    fs.BoolVar(forceFlag, "force", false,
+        "copy even when the destination has not enough free space, and sync even when -max-change is exceeded - optional")
+    fs.StringVar(filterScript, "filter-script", "",
+        "command or .star script that decides, for each file, to include, exclude or rename it, see README.md - optional")
+    fs.BoolVar(oneFileSystemFlag, "one-file-system", false, "don't descend into directories on other file systems - optional")
+    registerHookFlags(fs)
+    fs.StringVar(onFileHook, "on-file-hook", "", "shell command run after each file is copied - optional")
+    fs.BoolVar(hardLinksFlag, "hard-links", false,
+        "recreate hard links between copied files instead of copying their content again - optional")
+    fs.BoolVar(sparseFlag, "sparse", false, "keep holes and blocks of zeros of copied files sparse - optional")
+    fs.BoolVar(preallocateFlag, "preallocate", false,
+        "reserve the size of each file in the destination before writing it - optional")
+    fs.BoolVar(streamsFlag, "streams", false, "copy the alternate data streams of files on Windows - optional")
+    fs.BoolVar(fsyncFlag, "fsync", false, "flush each copied file to disk before moving it into place - optional")
+    fs.StringVar(bufferSize, "buffer-size", "1MB", "size of the buffer files are copied through - optional")
+    fs.IntVar(retries, "retries", 0, "retry a file this many times when copying it fails with a transient error - optional")
+    fs.DurationVar(retryDelay, "retry-delay", time.Second, "delay before the first retry, doubled on each retry - optional")
+    fs.DurationVar(heartbeatInterval, "heartbeat", 0, "print the progress of the scan of the sources this often, e.g. 30s - optional")
+    fs.IntVar(downloadJobs, "download-jobs", 4, "number of http(s) entries of the manifest downloaded at the same time - optional")
+    fs.Float64Var(pricePerGB, "price-gb-month", 0, "destination storage price per GB-month for cost estimates - optional")
+    fs.Float64Var(pricePer1kRequests, "price-1k-requests", 0,
+        "destination price per 1000 write requests for cost estimates - optional")
+    if activeCommand == nil || activeCommand.name == "copy" {
+        fs.StringVar(archiveFormat, "archive", "",
+            "write an archive (zip, tar, tar.gz) at directory instead of copying - optional")
+        fs.StringVar(compressFormat, "compress", "", "compress each copied file (gzip, zstd) - optional")
+        fs.BoolVar(decompressFlag, "decompress", false, "decompress copied .gz and .zst files - optional")
+        fs.StringVar(encryptMode, "encrypt", "",
+            "encrypt each copied file (aes-gcm, age) with -key-file or the GOPY_PASSPHRASE variable - optional")
+        fs.BoolVar(decryptFlag, "decrypt", false, "decrypt copied .enc and .age files - optional")
+        fs.StringVar(keyFile, "key-file", "",
+            "file with the 32 byte key, or the age keys, of -encrypt and -decrypt - optional")
+        fs.StringVar(sshClient, "ssh-command", "ssh", "ssh client, with its options, for user@host:/path remotes - optional")
+    }
+    registerStorageFlags(fs, true)
+}
+
+// registerStorageFlags registers the flags of the cloud storages for the
+// commands that take s3://, az:// or gs:// directories, with those of
+// uploads for the commands that write to them.
+func registerStorageFlags(fs *flag.FlagSet, uploads bool) {
+    fs.StringVar(s3Endpoint, "s3-endpoint", "",
+        "endpoint of an S3-compatible service for s3://bucket/prefix directories, default AWS - optional")
+    if uploads {
+        fs.StringVar(s3PartSizeFlag, "s3-part-size", "16MB", "size of the parts of multipart uploads to s3:// - optional")
+        fs.IntVar(s3Concurrency, "s3-concurrency", 4, "number of parts of a file uploaded to s3:// at the same time - optional")
+    }
+}
+
+func registerSyncFlags(fs *flag.FlagSet) {
+    registerCopyFlags(fs)
+    fs.BoolVar(deleteFlag, "delete", false, "delete destination files that are not in the sources - optional")
+    fs.BoolVar(yesFlag, "yes", false, "delete without asking for a confirmation (with -delete) - optional")
+    fs.BoolVar(softDeleteFlag, "soft-delete", false,
+        "move deleted files to a dated "+deletedDirName+" directory in the destination instead (with -delete) - optional")
+    fs.Float64Var(maxChangePercent, "max-change", 50,
+        "abort when more than this percentage of the destination files would be deleted or overwritten, 0 disables - optional")
+    fs.BoolVar(sinceLastRunFlag, "since-last-run", false,
+        "only copy files modified since the last complete sync to the same directory - optional")
+    fs.BoolVar(deltaFlag, "delta", false,
+        "rebuild files that already exist in the destination from their unchanged blocks and the changes, "+
+            "which only saves writes with -inplace or on file systems with reflinks - optional")
+    fs.BoolVar(inPlaceFlag, "inplace", false,
+        "with -delta, write the changed blocks into the destination files instead of new files - optional")
+    fs.DurationVar(deletedRetention, "soft-delete-retention", 30*24*time.Hour,
+        "how long soft-deleted files are kept before they are purged (with -soft-delete) - optional")
+}
+
+func registerExtractFlags(fs *flag.FlagSet) {
+    fs.StringVar(inputFile, "input", "", "archive file - mandatory")
+    fs.StringVar(directoryPath, "directory", "", "destination directory - mandatory")
+    fs.StringVar(archiveFormat, "archive", "", "archive format (zip, tar, tar.gz), default from the file name - optional")
+    fs.BoolVar(differentialFlag, "differential", false,
+        "only write files that are missing or differ in size or modification time, and report them - optional")
+    fs.StringVar(bufferSize, "buffer-size", "1MB", "size of the buffer files are copied through - optional")
+}
+
+func registerReplayFlags(fs *flag.FlagSet) {
+    fs.StringVar(inputFile, "input", "", "journal file - mandatory")
+    fs.StringVar(directoryPath, "directory", "", "destination directory - mandatory")
+}
+
+func registerUndoFlags(fs *flag.FlagSet) {
+    fs.StringVar(directoryPath, "directory", "", "destination directory - mandatory")
+}
+
+func registerVerifyTreesFlags(fs *flag.FlagSet) {
+    fs.StringVar(hashAlgorithm, "hash", "sha256", "hash algorithm (md5, sha1, sha256, sha512, blake3) - optional")
+    fs.IntVar(jobs, "jobs", 0, "number of files hashed concurrently, 0 uses one per CPU - optional")
+    fs.StringVar(reportFile, "report", "", "write the mismatches as JSON lines to this file - optional")
+    registerStorageFlags(fs, false)
+}
+
+func registerTuneFlags(fs *flag.FlagSet) {
+    fs.StringVar(inputFile, "input", "", "input manifest file - mandatory")
+    fs.StringVar(directoryPath, "directory", "", "destination directory - mandatory")
+    fs.StringVar(saveJob, "save", "", "save the recommended options to this job in the config file - optional")
+}
+
+func registerJobFlags(fs *flag.FlagSet) {
+    fs.StringVar(inputFile, "input", "", "bundle file to import (for import) - mandatory")
+    fs.StringVar(outputFile, "output", "", "bundle file to export to, default stdout (for export) - optional")
+    fs.BoolVar(forceFlag, "force", false, "replace an existing job (for import) - optional")
+}
+
+func registerFleetFlags(fs *flag.FlagSet) {
+    fs.StringVar(rootsFile, "roots", "", "file with one root directory per line - mandatory")
+    fs.IntVar(jobs, "jobs", 0, "number of roots processed concurrently, 0 uses one per CPU - optional")
+    fs.StringVar(reportFile, "report", "", "write the result of every root as JSON lines to this file - optional")
+}
+
+func registerServeFlags(fs *flag.FlagSet) {
+    fs.StringVar(listenAddr, "listen", "127.0.0.1:8080", "address the HTTP API listens on - optional")
+    fs.StringVar(grpcAddr, "grpc-listen", "", "address the gRPC API listens on, e.g. 127.0.0.1:9090 - optional")
+    fs.StringVar(serveToken, "token", "",
+        "Bearer token of every request when the config file has no tenants, generated and printed when empty - optional")
+    fs.IntVar(serveConcurrency, "concurrency", 2, "number of jobs run at the same time - optional")
+    fs.StringVar(serveState, "state", "gopy-jobs.json", "file the jobs are kept in across restarts, empty to keep them in memory - optional")
+    fs.Var(&serveSchedules, "schedule",
+        "run a job of the config file on a cron schedule, as \"minute hour day month weekday command job\", may be repeated - optional")
+    fs.IntVar(scheduleHistory, "history", 10, "number of runs kept for every schedule - optional")
+}
+
+func registerSnapshotFlags(fs *flag.FlagSet) {
+    fs.StringVar(repository, "repository", "", "directory the chunks and snapshots are kept in - mandatory")
+}
+
+func registerDuFlags(fs *flag.FlagSet) {
+    fs.IntVar(duDepth, "depth", 1, "deepest level of directories reported, 0 for only the given ones - optional")
+    fs.BoolVar(oneFileSystemFlag, "one-file-system", false, "don't descend into directories on other file systems - optional")
+    fs.BoolVar(noCacheFlag, "no-cache", false, "compute directory sizes without the cache of previous runs - optional")
+}
+
+func registerBrowseFlags(fs *flag.FlagSet) {
+    fs.StringVar(outputFile, "output", "marked.txt", "manifest file the marked entries are written to - optional")
+    fs.BoolVar(noCacheFlag, "no-cache", false, "compute directory sizes without the cache of previous runs - optional")
+}
+
+func registerCheckFlags(fs *flag.FlagSet) {
+    fs.StringVar(inputFile, "input", "", "manifest file - mandatory")
+    fs.StringVar(directoryPath, "directory", "",
+        "check this directory instead of the listed one, e.g. a copy of it - optional")
+}
+
+func registerDiffFlags(fs *flag.FlagSet) {
+    fs.StringVar(diffFormat, "format", "text", "output format (text, json) - optional")
+}
+
+func registerManifestFlags(fs *flag.FlagSet) {
+    fs.StringVar(outputFile, "output", "",
+        "manifest file written, default stdout, or the name the shards are numbered after (for split) - optional")
+    fs.StringVar(includePatterns, "include", "", "comma-separated patterns of the entries kept (for filter) - optional")
+    fs.StringVar(excludePatterns, "exclude", "", "comma-separated patterns of the entries left out (for filter) - optional")
+    fs.StringVar(minSizeFlag, "min-size", "", "smallest size of the entries kept, e.g. 10MB (for filter) - optional")
+    fs.StringVar(maxSizeFlag, "max-size", "", "largest size of the entries kept, e.g. 1GB (for filter) - optional")
+    fs.IntVar(shardCount, "shards", 2, "number of manifests written (for split) - optional")
+}
+
+func registerLegacyFlags(fs *flag.FlagSet) {
+    fs.BoolVar(copyFlag, "copy", false, "copy operation (deprecated, use the copy command)")
+    fs.BoolVar(listFlag, "list", false, "list operation (deprecated, use the list command)")
+    fs.BoolVar(extractFlag, "extract", false, "extract operation (deprecated, use the extract command)")
+    fs.StringVar(inputFile, "input", "", "input file (for copy & extract) - mandatory")
+    fs.StringVar(directoryPath, "directory", "", "directory (for list, copy & extract) - mandatory")
+    fs.StringVar(archiveFormat, "archive", "",
+        "write an archive (zip, tar, tar.gz) at directory instead of copying (for copy) or archive format (for extract) - optional")
+    fs.StringVar(outputFile, "output", "", "output file (for list) - mandatory")
+    fs.BoolVar(noDirFlag, "nodir", false, "don't include directories (for list) - optional")
+    fs.BoolVar(noFileFlag, "nofile", false, "don't include files (for list) - optional")
+    fs.BoolVar(recursiveFlag, "recursive", false, "recursive (for list) - optional")
+    fs.StringVar(checkpointFile, "checkpoint", "", "checkpoint file to resume an interrupted listing (for recursive list) - optional")
+    fs.BoolVar(skipJunkFlag, "skip-junk", false, "skip OS junk files (for copy) - optional")
+    fs.StringVar(junkPatterns, "junk", strings.Join(defaultJunkPatterns, ","),
+        "comma-separated junk file patterns (for copy with -skip-junk) - optional")
+    fs.StringVar(warnOver, "warn-over", "", "report files larger than this size, e.g. 10GB (for copy) - optional")
+    fs.StringVar(warnReport, "warn-report", "", "large-file report file, default stdout (for copy with -warn-over) - optional")
+    fs.StringVar(priorityClasses, "priority", "",
+        "priority classes copied first, classes separated by ';' and patterns by ',', e.g. \"*.db;*.doc,*.pdf\" (for copy) - optional")
+    fs.StringVar(compressFormat, "compress", "", "compress each copied file (gzip, zstd) (for copy) - optional")
+    fs.BoolVar(decompressFlag, "decompress", false, "decompress copied .gz and .zst files (for copy) - optional")
+    fs.StringVar(dedupMode, "dedup", "",
+        "skip or hard link (skip, link) files whose content already exists in the destination (for copy) - optional")
+    fs.BoolVar(twoPhaseFlag, "two-phase", false,
+        "stage and verify all files in a hidden directory before moving them into place (for copy) - optional")
+    fs.BoolVar(watchFlag, "watch", false, "keep running and copy new or changed files (for copy) - optional")
+    fs.DurationVar(watchInterval, "watch-interval", 2*time.Second,
+        "how often sources are rescanned (for copy with -watch) where inotify is unavailable - optional")
+}
+
+func findCommand(name string) *command {
+    for i := range commands {
+        if commands[i].name == name {
+            return &commands[i]
+        }
+    }
+    return nil
+}
+
+func parseCommandLine(args []string) {
+    if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+        activeCommand = findCommand(args[0])
+        if activeCommand == nil {
+            printErrorAndExit("unknown command: " + args[0], exitUsage)
+        }
+        activeFlags = flag.NewFlagSet(activeCommand.name, flag.ExitOnError)
+        activeFlags.Usage = printUsage
+        activeCommand.register(activeFlags)
+        registerCommonFlags(activeFlags)
+        activeFlags.Parse(args[1:])
+        *activeCommand.op = true
+        if *listFlag {
+            listDirectories = append(listDirectories, activeFlags.Args()...)
+        }
+        if *verifyTreesFlag {
+            verifyTrees = activeFlags.Args()
+        }
+        if *jobFlag {
+            jobArgs = activeFlags.Args()
+        }
+        if *fleetFlag {
+            fleetCommand = activeFlags.Args()
+        }
+        if *diffFlag {
+            diffManifests = activeFlags.Args()
+        }
+        if *manifestFlag {
+            manifestArgs = activeFlags.Args()
+        }
+        if *browseFlag {
+            browseDirectory = activeFlags.Args()
+        }
+        if *duFlag {
+            duDirectories = activeFlags.Args()
+        }
+        if *snapshotFlag {
+            snapshotDirectory = activeFlags.Args()
+        }
+        if *restoreFlag {
+            restoreArgs = activeFlags.Args()
+        }
+        return
+    }
+    flag.Usage = printUsage
+    registerLegacyFlags(flag.CommandLine)
+    registerCommonFlags(flag.CommandLine)
+    flag.CommandLine.Parse(args)
+    if *directoryPath != "" {
+        listDirectories = stringList{*directoryPath}
+    }
+    for _, name := range []string{"copy", "list", "extract"} {
+        if f := flag.Lookup(name); f != nil && f.Value.String() == "true" {
+            fmt.Fprintf(os.Stderr, "Warning: -%s is deprecated, use \"%s %s\" instead\n", name, os.Args[0], name)
+        }
+    }
+}
+
+// parseArgs parses and checks the command line, exiting with usage on
+// errors.
+func parseArgs(args []string) {
+    options := optionNames()
+    parseCommandLine(args)
+
+    if *helpFlag {
+        printUsageAndExit(exitSuccess)
+    }
+
+    *configFile = findConfigFile(*configFile)
+    if *jobName != "" {
+        if e := applyConfig(activeFlags, *configFile, *jobName); e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+    }
+    if *profileName != "" {
+        if e := applyProfile(activeFlags, *configFile, *profileName, options); e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+    }
+
+    operations := 0
+    for _, c := range commands {
+        if *c.op {
+            operations++
+        }
+    }
+    if operations != 1 {
+        printUsageAndExit(exitUsage)
+    }
+
+    cliIO.readOnly = *readOnlySourceFlag
+    if *noIgnoreFlag {
+        cliWalker.ignore = nil
+    }
+    if *maxOpenFiles < 0 {
+        printErrorAndExit("-max-open-files cannot be negative", exitUsage)
+    }
+    // Some descriptors are left for logs, sockets and the standard streams.
+    if limit := openFileLimit(); *maxOpenFiles == 0 && limit > 0 {
+        cliIO.budget = newFileBudget(max(limit-64, 4))
+    } else if *maxOpenFiles > 0 {
+        cliIO.budget = newFileBudget(max(*maxOpenFiles, 2))
+    }
+    cliIO.sync = *fsyncFlag
+    cliIO.sparse = *sparseFlag
+    cliIO.preallocate = *preallocateFlag
+    cliWalker.oneFileSystem = *oneFileSystemFlag
+    if *linksFlag != "" && *linksFlag != "skip" && *linksFlag != "follow" && (*linksFlag != "recreate" || *listFlag) {
+        printErrorAndExit("unsupported -links policy: " + *linksFlag, exitUsage)
+    }
+    cliWalker.links = *linksFlag
+    if *normalizeForm != "" && *normalizeForm != "nfc" && *normalizeForm != "nfd" {
+        printErrorAndExit("unsupported normalization form: " + *normalizeForm, exitUsage)
+    }
+    pathNormalization = *normalizeForm
+    if *caseCollision != "" && *caseCollision != "rename" && *caseCollision != "skip" && *caseCollision != "fail" {
+        printErrorAndExit("unsupported -case-collision policy: " + *caseCollision, exitUsage)
+    }
+    if *bufferSize != "" {
+        size, e := parseSize(*bufferSize)
+        if e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+        if size < 1 || size > 1<<30 {
+            printErrorAndExit("-buffer-size must be between 1B and 1GB", exitUsage)
+        }
+        cliIO.buffers = newFileIO(int(size), logger).buffers
+    }
+    if (*listFlag || *duFlag || *browseFlag) && !*noCacheFlag {
+        cliWalker.sizes = openSizeCache()
+    }
+    if *quietFlag && (*verboseFlag || *veryVerboseFlag) {
+        printErrorAndExit("-quiet cannot be combined with -v or -vv", exitUsage)
+    }
+    if e := setLogOutput(*logFormat, *logFile); e != nil {
+        printErrorAndExit(e, exitUsage)
+    }
+    setLogLevel(*quietFlag, *verboseFlag, *veryVerboseFlag)
+    cliWalker.setLogger(logger)
+    cliIO.logger = logger
+
+    if *notifyOn != "" && *notifyOn != "always" && *notifyOn != "failure" {
+        printErrorAndExit("unsupported -notify-on: " + *notifyOn, exitUsage)
+    }
+    if *notifyEmail != "" {
+        if _, e := readSMTPConfig(*configFile); e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+    }
+
+    validSummary := false
+    for _, f := range summaryFormats {
+        validSummary = validSummary || f == *summaryFormat
+    }
+    if !validSummary {
+        printErrorAndExit("unsupported summary format: " + *summaryFormat, exitUsage)
+    }
+
+    if *colorMode != "auto" && *colorMode != "always" && *colorMode != "never" {
+        printErrorAndExit("unsupported color mode: " + *colorMode, exitUsage)
+    }
+
+    if *archiveFormat != "" && !isArchiveFormat(*archiveFormat) {
+        printErrorAndExit("unsupported archive format: " + *archiveFormat, exitUsage)
+    }
+
+    if *copyFlag || *syncFlag {
+        if len(copyInputs) > 0 {
+            *inputFile = copyInputs[0]
+        } else if *inputFile != "" {
+            copyInputs = scheduleList{*inputFile}
+        }
+        if *inputFile == "" || *directoryPath == "" {
+            printUsageAndExit(exitUsage)
+        }
+        for _, input := range copyInputs {
+            if !fileExists(input) {
+                printErrorAndExit(input + " does not exist", exitUsage)
+            }
+        }
+        if *compressFormat != "" {
+            if _, ok := compressionSuffixes[*compressFormat]; !ok {
+                printErrorAndExit("unsupported compression: " + *compressFormat, exitUsage)
+            }
+            if *archiveFormat != "" || *decompressFlag {
+                printErrorAndExit("-compress cannot be combined with -archive or -decompress", exitUsage)
+            }
+        }
+        if *dedupMode != "" {
+            if *dedupMode != "skip" && *dedupMode != "link" {
+                printErrorAndExit("unsupported dedup mode: " + *dedupMode, exitUsage)
+            }
+            if *archiveFormat != "" || *compressFormat != "" || *decompressFlag {
+                printErrorAndExit("-dedup cannot be combined with -archive, -compress or -decompress", exitUsage)
+            }
+        }
+        // Staged files are verified against their sources, so they must be
+        // plain copies.
+        if *twoPhaseFlag && (*archiveFormat != "" || *compressFormat != "" || *decompressFlag || *dedupMode != "" ||
+            *encryptMode != "" || *decryptFlag || *deltaFlag) {
+            printErrorAndExit("-two-phase cannot be combined with -archive, -compress, -decompress, -dedup, -encrypt, "+
+                "-decrypt or -delta", exitUsage)
+        }
+        if *hardLinksFlag && (*archiveFormat != "" || *compressFormat != "" || *decompressFlag || *twoPhaseFlag) {
+            printErrorAndExit("-hard-links cannot be combined with -archive, -compress, -decompress or -two-phase", exitUsage)
+        }
+        if *linksFlag == "recreate" && (*archiveFormat != "" || isCloud(*directoryPath) || isRemote(*directoryPath)) {
+            printErrorAndExit("-links recreate cannot be combined with -archive or an s3://, az://, gs:// or remote directory",
+                exitUsage)
+        }
+        if *preallocateFlag && *sparseFlag {
+            printErrorAndExit("-preallocate cannot be combined with -sparse", exitUsage)
+        }
+        if *journalFile != "" && (*archiveFormat != "" || *compressFormat != "" || *decompressFlag) {
+            printErrorAndExit("-journal cannot be combined with -archive, -compress or -decompress", exitUsage)
+        }
+        if *watchFlag && (*archiveFormat != "" || *dedupMode != "" || *twoPhaseFlag || *filterScript != "") {
+            printErrorAndExit("-watch cannot be combined with -archive, -dedup, -two-phase or -filter-script", exitUsage)
+        }
+        if *warnOver != "" {
+            size, e := parseSize(*warnOver)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            warnOverSize = size
+        }
+        if *retries < 0 {
+            printErrorAndExit("-retries cannot be negative", exitUsage)
+        }
+        if *downloadJobs < 1 {
+            printErrorAndExit("-download-jobs must be at least 1", exitUsage)
+        }
+        if *maxBytes != "" {
+            size, e := parseSize(*maxBytes)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            maxBytesSize = size
+        }
+        if *copyMinSize != "" {
+            size, e := parseSize(*copyMinSize)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            copyMinSizeBytes = size
+        }
+        if *copyMaxSize != "" {
+            size, e := parseSize(*copyMaxSize)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            copyMaxSizeBytes = size
+        }
+        if copyMaxSizeBytes > 0 && copyMinSizeBytes > copyMaxSizeBytes {
+            printErrorAndExit("-copy-min-size cannot be larger than -copy-max-size", exitUsage)
+        }
+        if *shardFlag != "" {
+            var e error
+            if copyShard, copyShards, e = parseShard(*shardFlag); e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+        }
+        if *maxFiles < 0 {
+            printErrorAndExit("-max-files cannot be negative", exitUsage)
+        }
+        if *linkDest != "" && (*archiveFormat != "" || *compressFormat != "" || *decompressFlag || *encryptMode != "" ||
+            *decryptFlag || *deltaFlag || isCloud(*directoryPath) || isRemote(*directoryPath)) {
+            printErrorAndExit("-link-dest needs a local destination directory of plain copies, without -delta", exitUsage)
+        }
+        if *inPlaceFlag && !*deltaFlag {
+            printErrorAndExit("-inplace needs -delta", exitUsage)
+        }
+        if *versionedMode != "" && *versionedMode != "number" && *versionedMode != "time" {
+            printErrorAndExit("unsupported -versioned mode: " + *versionedMode, exitUsage)
+        }
+        if *versionedMode != "" && (*backupDir != "" || *backupSuffix != "") {
+            printErrorAndExit("-versioned cannot be used with -backup or -backup-suffix", exitUsage)
+        }
+        if (*backupDir != "" || *backupSuffix != "" || *versionedMode != "") &&
+            (*archiveFormat != "" || isCloud(*directoryPath) || isRemote(*directoryPath)) {
+            printErrorAndExit("-backup, -backup-suffix and -versioned need a local destination directory", exitUsage)
+        }
+        if *copyOrder != "as-listed" && *copyOrder != "largest-first" && *copyOrder != "smallest-first" {
+            printErrorAndExit("unsupported -order: " + *copyOrder, exitUsage)
+        }
+        if *flattenCollision != "number" && *flattenCollision != "hash" && *flattenCollision != "skip" {
+            printErrorAndExit("unsupported -flatten-collision strategy: " + *flattenCollision, exitUsage)
+        }
+        for _, value := range renameFlags {
+            rule, e := parseRenameRule(value)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            renameRules = append(renameRules, rule)
+        }
+        if *stopAtFree != "" {
+            size, e := parseSize(*stopAtFree)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            stopAtFreeSize = size
+        }
+        if *encryptMode != "" || *decryptFlag {
+            if _, ok := encryptionSuffixes[*encryptMode]; *encryptMode != "" && !ok {
+                printErrorAndExit("unsupported encryption: " + *encryptMode, exitUsage)
+            }
+            if *encryptMode != "" && *decryptFlag || *archiveFormat != "" || *compressFormat != "" || *decompressFlag ||
+                isCloud(*directoryPath) || isRemote(*directoryPath) {
+                printErrorAndExit("-encrypt and -decrypt cannot be combined with each other, -archive, -compress, "+
+                    "-decompress or an s3://, az://, gs:// or remote directory", exitUsage)
+            }
+            if *keyFile != "" {
+                k, e := readKeyFile(*keyFile)
+                if e != nil {
+                    printErrorAndExit(e, exitUsage)
+                }
+                if *encryptMode == "aes-gcm" && k.key == nil || *encryptMode == "age" && k.recipients == nil {
+                    printErrorAndExit(*keyFile+" has no "+*encryptMode+" key", exitUsage)
+                }
+                encryption = k
+            } else if passphrase := os.Getenv("GOPY_PASSPHRASE"); passphrase != "" {
+                encryption = &fileKey{passphrase: passphrase, salt: make([]byte, 16)}
+                if _, e := rand.Read(encryption.salt); e != nil {
+                    printErrorAndExit(e, exitIOError)
+                }
+            } else {
+                printErrorAndExit("-encrypt and -decrypt need -key-file or the GOPY_PASSPHRASE variable", exitUsage)
+            }
+        }
+        if isCloud(*directoryPath) || isRemote(*directoryPath) {
+            if *syncFlag && isRemote(*directoryPath) {
+                printErrorAndExit("sync does not support remote directories", exitUsage)
+            }
+            if *syncFlag && (*deleteFlag || *deltaFlag || *sinceLastRunFlag) {
+                printErrorAndExit("sync to an s3://, az:// or gs:// directory cannot be combined with -delete, -delta or "+
+                    "-since-last-run", exitUsage)
+            }
+            if *archiveFormat != "" || *compressFormat != "" || *decompressFlag || *dedupMode != "" || *twoPhaseFlag ||
+                *hardLinksFlag || *sparseFlag || *stopAtFree != "" || *journalFile != "" || *watchFlag {
+                printErrorAndExit("an s3://, az://, gs:// or remote directory cannot be combined with -archive, -compress, "+
+                    "-decompress, -dedup, -two-phase, -hard-links, -sparse, -stop-at-free, -journal or -watch", exitUsage)
+            }
+        }
+        if isCloud(*directoryPath) {
+            if e := checkCloud(*directoryPath); e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+        }
+        if isS3(*directoryPath) {
+            size, e := parseSize(*s3PartSizeFlag)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            // S3 parts, but the last, must be at least 5MB.
+            if size < 5*1024*1024 {
+                printErrorAndExit("-s3-part-size must be at least 5MB", exitUsage)
+            }
+            s3PartSize = size
+            if *s3Concurrency < 1 {
+                printErrorAndExit("-s3-concurrency must be at least 1", exitUsage)
+            }
+        }
+    } else if *extractFlag || *replayFlag {
+        if *inputFile == "" || *directoryPath == "" {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(*inputFile) {
+            printErrorAndExit(*inputFile + " does not exist", exitUsage)
+        }
+    } else if *undoFlag {
+        if *directoryPath == "" {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(filepath.Join(*directoryPath, undoJournalName)) {
+            printErrorAndExit(*directoryPath + " has no journal of a previous run", exitUsage)
+        }
+    } else if *duFlag {
+        if len(duDirectories) == 0 {
+            printUsageAndExit(exitUsage)
+        }
+        for _, dir := range duDirectories {
+            if !isDirectory(dir) {
+                printErrorAndExit(dir + " does not exist or is not a directory", exitUsage)
+            }
+        }
+        if *duDepth < 0 {
+            printErrorAndExit("-depth cannot be negative", exitUsage)
+        }
+    } else if *snapshotFlag {
+        if *repository == "" || len(snapshotDirectory) != 1 {
+            printUsageAndExit(exitUsage)
+        }
+        if !isDirectory(snapshotDirectory[0]) {
+            printErrorAndExit(snapshotDirectory[0] + " does not exist or is not a directory", exitUsage)
+        }
+    } else if *restoreFlag {
+        if *repository == "" || len(restoreArgs) != 2 {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(snapshotPath(*repository, restoreArgs[0])) {
+            printErrorAndExit("unknown snapshot: " + restoreArgs[0], exitUsage)
+        }
+    } else if *serveFlag {
+        if *serveConcurrency < 1 {
+            printErrorAndExit("-concurrency must be at least 1", exitUsage)
+        }
+        if *scheduleHistory < 1 {
+            printErrorAndExit("-history must be at least 1", exitUsage)
+        }
+        for _, spec := range serveSchedules {
+            if _, e := parseSchedule(spec, *configFile); e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+        }
+    } else if *browseFlag {
+        if len(browseDirectory) != 1 {
+            printUsageAndExit(exitUsage)
+        }
+        if !isDirectory(browseDirectory[0]) {
+            printErrorAndExit(browseDirectory[0] + " does not exist or is not a directory", exitUsage)
+        }
+    } else if *checkFlag {
+        if *inputFile == "" {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(*inputFile) {
+            printErrorAndExit(*inputFile + " does not exist", exitUsage)
+        }
+        if *directoryPath != "" && !isDirectory(*directoryPath) {
+            printErrorAndExit(*directoryPath + " does not exist or is not a directory", exitUsage)
+        }
+    } else if *diffFlag {
+        if len(diffManifests) != 2 {
+            printUsageAndExit(exitUsage)
+        }
+        for _, manifest := range diffManifests {
+            if !fileExists(manifest) {
+                printErrorAndExit(manifest + " does not exist", exitUsage)
+            }
+        }
+        if *diffFormat != "text" && *diffFormat != "json" {
+            printErrorAndExit("unsupported format: " + *diffFormat, exitUsage)
+        }
+    } else if *manifestFlag {
+        if len(manifestArgs) < 2 {
+            printUsageAndExit(exitUsage)
+        }
+        switch manifestArgs[0] {
+        case "merge":
+        case "filter":
+            var e error
+            if *minSizeFlag != "" {
+                if manifestMinSize, e = parseSize(*minSizeFlag); e != nil {
+                    printErrorAndExit(e, exitUsage)
+                }
+            }
+            if *maxSizeFlag != "" {
+                if manifestMaxSize, e = parseSize(*maxSizeFlag); e != nil {
+                    printErrorAndExit(e, exitUsage)
+                }
+            }
+        case "split":
+            if *shardCount < 1 {
+                printErrorAndExit("-shards must be at least 1", exitUsage)
+            }
+            if *outputFile == "" && isDirectory(manifestArgs[1]) {
+                printErrorAndExit("split needs -output when it reads a directory of manifests", exitUsage)
+            }
+        default:
+            printErrorAndExit("unknown manifest action: " + manifestArgs[0], exitUsage)
+        }
+        for _, manifest := range manifestArgs[1:] {
+            if !fileExists(manifest) {
+                printErrorAndExit(manifest + " does not exist", exitUsage)
+            }
+        }
+    } else if *fleetFlag {
+        if *rootsFile == "" || len(fleetCommand) == 0 {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(*rootsFile) {
+            printErrorAndExit(*rootsFile + " does not exist", exitUsage)
+        }
+        if c := findCommand(fleetCommand[0]); c == nil || c.op == fleetFlag {
+            printErrorAndExit("fleet cannot run: " + fleetCommand[0], exitUsage)
+        }
+        if *jobs < 0 {
+            printErrorAndExit("-jobs cannot be negative", exitUsage)
+        }
+        if *jobs == 0 {
+            *jobs = runtime.NumCPU()
+        }
+    } else if *jobFlag {
+        if len(jobArgs) == 0 {
+            printUsageAndExit(exitUsage)
+        }
+        switch jobArgs[0] {
+        case "export":
+            if len(jobArgs) != 2 {
+                printUsageAndExit(exitUsage)
+            }
+        case "import":
+            if len(jobArgs) != 1 || *inputFile == "" {
+                printUsageAndExit(exitUsage)
+            }
+            if !fileExists(*inputFile) {
+                printErrorAndExit(*inputFile + " does not exist", exitUsage)
+            }
+        default:
+            printErrorAndExit("unknown job action: " + jobArgs[0], exitUsage)
+        }
+    } else if *tuneFlag {
+        if *inputFile == "" || *directoryPath == "" {
+            printUsageAndExit(exitUsage)
+        }
+        if !fileExists(*inputFile) {
+            printErrorAndExit(*inputFile + " does not exist", exitUsage)
+        }
+        if !isDirectory(*directoryPath) {
+            printErrorAndExit(*directoryPath + " does not exist or is not a directory", exitUsage)
+        }
+    } else if *verifyTreesFlag {
+        if len(verifyTrees) != 2 {
+            printUsageAndExit(exitUsage)
+        }
+        for _, dir := range verifyTrees {
+            if isCloud(dir) {
+                if e := checkCloud(dir); e != nil {
+                    printErrorAndExit(e, exitUsage)
+                }
+                continue
+            }
+            if !isDirectory(dir) {
+                printErrorAndExit(dir + " does not exist or is not a directory", exitUsage)
+            }
+        }
+        if _, ok := hashAlgorithms[*hashAlgorithm]; !ok {
+            printErrorAndExit("unsupported hash algorithm: " + *hashAlgorithm, exitUsage)
+        }
+        if *jobs < 0 {
+            printErrorAndExit("-jobs cannot be negative", exitUsage)
+        }
+        if *jobs == 0 {
+            *jobs = runtime.NumCPU()
+        }
+    } else if *listFlag {
+        if *outputFile == "" || len(listDirectories) == 0 {
+            printUsageAndExit(exitUsage)
+        }
+        if *outputFile == "-" && *checkpointFile != "" {
+            printErrorAndExit("-checkpoint cannot be used with -output -", exitUsage)
+        }
+        if *highlightOver != "" {
+            size, e := parseSize(*highlightOver)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            highlightOverSize = size
+        }
+        if *byExtension != "" && *byExtension != "table" && *byExtension != "csv" && *byExtension != "json" {
+            printErrorAndExit("unsupported report format: " + *byExtension, exitUsage)
+        }
+        entryTemplate = *templateText
+        if *listFormat == "sqlite" {
+            if *outputFile == "-" {
+                printErrorAndExit("-format sqlite needs an -output file", exitUsage)
+            }
+            if *checkpointFile != "" {
+                printErrorAndExit("-checkpoint cannot be used with -format sqlite", exitUsage)
+            }
+        } else if _, e := newEntryWriter(ioutil.Discard, *listFormat, nil); e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+        if *checksumFlag && *listFormat != "ndjson" && *listFormat != "sql" && *listFormat != "sqlite" {
+            printErrorAndExit("-checksum needs -format ndjson, sql or sqlite", exitUsage)
+        }
+        if *deleteEmptyFlag && !*findEmptyFlag {
+            printErrorAndExit("-delete-empty needs -find-empty", exitUsage)
+        }
+        listSettings = listFilters{findEmpty: *findEmptyFlag, deleteEmpty: *deleteEmptyFlag}
+        if *textOnlyFlag && *binaryOnlyFlag {
+            printErrorAndExit("-text-only and -binary-only cannot be used together", exitUsage)
+        } else if *textOnlyFlag {
+            listSettings.content = "text"
+        } else if *binaryOnlyFlag {
+            listSettings.content = "binary"
+        }
+        if *jobs < 0 {
+            printErrorAndExit("-checksum-jobs cannot be negative", exitUsage)
+        }
+        if *checksumFlag {
+            listSettings.sums = &checksummer{jobs: *jobs}
+            if *jobs == 0 {
+                listSettings.sums.jobs = runtime.NumCPU()
+            }
+        }
+        if *listStateFile != "" {
+            if !*checksumFlag {
+                printErrorAndExit("-state needs -checksum", exitUsage)
+            }
+            state, e := readScanState(*listStateFile)
+            if e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            listSettings.sums.state = state
+        }
+        for _, dir := range listDirectories {
+            if isCloud(dir) {
+                if *checkpointFile != "" {
+                    printErrorAndExit("-checkpoint cannot be used with s3://, az:// or gs:// directories", exitUsage)
+                }
+                if listSettings.content != "" {
+                    printErrorAndExit("-text-only and -binary-only cannot be used with s3://, az:// or gs:// directories", exitUsage)
+                }
+                if listSettings.findEmpty {
+                    printErrorAndExit("-find-empty cannot be used with s3://, az:// or gs:// directories", exitUsage)
+                }
+                if e := checkCloud(dir); e != nil {
+                    printErrorAndExit(e, exitUsage)
+                }
+                continue
+            }
+            if !isDirectory(dir) {
+                printErrorAndExit(dir + " does not exist or is not a directory", exitUsage)
+            }
+            if cliIO.readOnly {
+                for _, path := range []string{*outputFile, *checkpointFile} {
+                    if path != "" && isWithin(path, dir) {
+                        printErrorAndExit(path + " is inside the read-only source " + dir, exitUsage)
+                    }
+                }
+            }
+        }
+    }
+}
+
+func handleInterrupt() {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        <-c
+        printErrorAndExit("interrupted", exitInterrupted)
+    }()
+}
+
+// Main runs the gopy command line.
+func Main() {
+    parseArgs(os.Args[1:])
+    handleInterrupt()
+    if *preHookFlag != "" {
+        if e := runHook(*preHookFlag); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }
+    postHook = *postHookFlag
+    notifyEnabled = *notifyWebhook != "" || *notifyEmail != ""
+    start := time.Now()
+    if *heartbeatInterval > 0 {
+        heartbeat(*heartbeatInterval)
+    }
+    if *listFlag {
+        s := runList(listDirectories, *outputFile, *listFormat, *noFileFlag, *noDirFlag, *recursiveFlag, *checkpointFile, listSettings)
+        printSummary(s, *summaryFormat, time.Since(start))
+        if *byExtension != "" {
+            printTypeReport(s.types, *byExtension)
+        }
+        if e := cliWalker.sizes.save(); e != nil {
+            printError(e)
+        }
+        if cliWalker.unreadable.count() > 0 {
+            if *reportErrors {
+                cliWalker.unreadable.report(os.Stdout)
+            } else {
+                fmt.Fprintf(os.Stderr, "Warning: %d paths could not be read, -report-errors lists them\n",
+                    cliWalker.unreadable.count())
+            }
+            exit(exitPartial)
+        }
+    } else if *copyFlag || *syncFlag {
+        opts := copyOptions{
+            warnOver:   warnOverSize,
+            archive:    *archiveFormat,
+            priorities: parsePriorityClasses(*priorityClasses),
+            compress:   *compressFormat,
+            decompress: *decompressFlag,
+            dedup:      *dedupMode,
+            twoPhase:   *twoPhaseFlag,
+            sync:       *syncFlag,
+            delete:     *syncFlag && *deleteFlag,
+            dryRun:     *dryRunFlag,
+            journal:    *journalFile,
+            stopAtFree: stopAtFreeSize,
+            softDelete: *softDeleteFlag,
+            yes:        *yesFlag,
+            retention:  *deletedRetention,
+            maxChange:  *maxChangePercent,
+            force:      *forceFlag,
+            sinceLast:  *syncFlag && *sinceLastRunFlag,
+            retries:    *retries,
+            retryDelay: *retryDelay,
+            downloads:  *downloadJobs,
+            delta:      *syncFlag && *deltaFlag,
+            inPlace:    *syncFlag && *deltaFlag && *inPlaceFlag,
+            encrypt:    *encryptMode,
+            decrypt:    *decryptFlag,
+            filter:     *filterScript,
+            hardLinks:  *hardLinksFlag,
+            onFile:     *onFileHook,
+            maxBytes:   maxBytesSize,
+            maxFiles:   *maxFiles,
+            streams:    *streamsFlag,
+            collision:  *caseCollision,
+            order:      *copyOrder,
+            backup:     *backupDir,
+            backupExt:  *backupSuffix,
+            numbered:   *versionedMode == "number",
+            linkDest:   *linkDest,
+            shard:      copyShard,
+            shards:     copyShards,
+            walker:     cliWalker,
+            fio:        cliIO,
+            rename:     renameRules,
+            normalize:  pathNormalization,
+            key:        encryption,
+        }
+        if *versionedMode == "time" {
+            opts.backup = filepath.Join(*directoryPath, versionsDirName, time.Now().UTC().Format("20060102T150405Z"))
+        }
+        if copyMinSizeBytes > 0 || copyMaxSizeBytes > 0 {
+            opts.match = SizeFilter(copyMinSizeBytes, copyMaxSizeBytes)
+        }
+        if *flattenFlag {
+            opts.flatten = *flattenCollision
+        }
+        if *skipJunkFlag {
+            opts.junk = splitList(*junkPatterns)
+        }
+        if path := *lockPath; path != "" || !(opts.dryRun || isCloud(*directoryPath) || isRemote(*directoryPath)) {
+            if path == "" && opts.archive != "" {
+                // An archive is a file, locked next to it.
+                if e := os.MkdirAll(filepath.Dir(*directoryPath), 0755); e != nil {
+                    printErrorAndExit(e, exitIOError)
+                }
+                path = *directoryPath + lockFileName
+            } else if path == "" {
+                if e := os.MkdirAll(*directoryPath, 0755); e != nil {
+                    printErrorAndExit(e, exitIOError)
+                }
+                path = filepath.Join(*directoryPath, lockFileName)
+            }
+            if e := acquireLock(path); e != nil {
+                printErrorAndExit(e, exitUsage)
+            }
+            absPath, _ := filepath.Abs(path)
+            cliWalker.excluded = append(cliWalker.excluded, absPath)
+        }
+        runEvents = NewEventBus()
+        runEvents.Subscribe(logSubscriber{})
+        runEvents.Subscribe(metricsSubscriber{*watchFlag})
+        if *notifyWebhook != "" {
+            runEvents.Subscribe(webhookSubscriber{})
+        }
+        opts.progress = ProgressFunc(nil).with(runEvents)
+        if *metricsAddr != "" {
+            serveMetrics(*metricsAddr)
+        }
+        if *watchFlag {
+            runWatch(*directoryPath, copyInputs, opts, *watchInterval)
+        }
+        result := runCopy(*directoryPath, copyInputs, opts)
+        if opts.dryRun {
+            fmt.Printf("%d files, %s would be copied\n", result.files, formatSize(result.bytes))
+        }
+        if p := (pricing{*pricePerGB, *pricePer1kRequests}); p.enabled() {
+            printCostEstimate(result, p)
+        }
+        operation := "copy"
+        if opts.sync {
+            operation = "sync"
+        }
+        s := result.summary(operation)
+        lastSummary = &s
+        done := Event{Kind: Done, Files: result.files, Bytes: result.bytes, TotalFiles: result.scanned,
+            TotalBytes: result.totalBytes}
+        if result.failed > 0 || result.overBudget > 0 {
+            done.Err = fmt.Errorf("%d files were not copied", result.failed+result.overBudget)
+        }
+        runEvents.Publish(done)
+        // The log lines of the files copied come before the summary.
+        closeRunEvents()
+        printSummary(s, *summaryFormat, time.Since(start))
+        if *metricsFile != "" {
+            if e := writeMetrics(*metricsFile, result.metrics(operation)); e != nil {
+                printError(e)
+            }
+        }
+        // The report matters most when some files failed.
+        if warnOverSize > 0 {
+            if e := writeLargeFileReport(*warnReport, result.large, warnOverSize); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+        }
+        if result.failed > 0 || result.overBudget > 0 {
+            exit(exitPartial)
+        }
+    } else if *extractFlag {
+        runExtract(*inputFile, *directoryPath, *archiveFormat, *differentialFlag)
+    } else if *replayFlag {
+        if runReplay(*inputFile, *directoryPath) > 0 {
+            exit(exitPartial)
+        }
+    } else if *undoFlag {
+        if e := acquireLock(filepath.Join(*directoryPath, lockFileName)); e != nil {
+            printErrorAndExit(e, exitUsage)
+        }
+        if runUndo(*directoryPath) > 0 {
+            exit(exitPartial)
+        }
+    } else if *serveFlag {
+        runServe(*listenAddr, *grpcAddr, *serveToken, *serveConcurrency, *serveState, serveSchedules, *scheduleHistory)
+    } else if *snapshotFlag {
+        if runSnapshot(*repository, snapshotDirectory[0]) > 0 {
+            exit(exitPartial)
+        }
+    } else if *restoreFlag {
+        if runRestore(*repository, restoreArgs[0], restoreArgs[1]) > 0 {
+            exit(exitPartial)
+        }
+    } else if *duFlag {
+        runDiskUsage(duDirectories, *duDepth)
+        if e := cliWalker.sizes.save(); e != nil {
+            printError(e)
+        }
+    } else if *browseFlag {
+        runBrowse(browseDirectory[0], *outputFile, os.Stdin)
+        if e := cliWalker.sizes.save(); e != nil {
+            printError(e)
+        }
+    } else if *checkFlag {
+        if runCheck(*inputFile, *directoryPath) > 0 {
+            exit(exitPartial)
+        }
+    } else if *diffFlag {
+        runDiff(diffManifests[0], diffManifests[1], *diffFormat)
+    } else if *manifestFlag {
+        runManifest(manifestArgs[0], manifestArgs[1:], *outputFile)
+    } else if *fleetFlag {
+        if runFleet(*rootsFile, fleetCommand, *jobs, *reportFile) > 0 {
+            exit(exitPartial)
+        }
+    } else if *jobFlag {
+        if jobArgs[0] == "export" {
+            runExportJob(*configFile, jobArgs[1], *outputFile)
+        } else {
+            runImportJob(*configFile, *inputFile, *forceFlag)
+        }
+    } else if *tuneFlag {
+        runTune(*inputFile, *directoryPath, *configFile, *saveJob)
+    } else if *verifyTreesFlag {
+        if runVerifyTrees(verifyTrees[0], verifyTrees[1], *hashAlgorithm, *jobs, *reportFile) > 0 {
+            exit(exitPartial)
+        }
+    }
+    exit(exitSuccess)
+}
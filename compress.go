@@ -0,0 +1,102 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io"
+    "strings"
+)
+
+var compressionSuffixes = map[string]string{"gzip": ".gz", "zstd": ".zst"}
+
+// compressionFormat returns the format of a file named with one of
+// compressionSuffixes, or "".
+func compressionFormat(name string) string {
+    for format, suffix := range compressionSuffixes {
+        if strings.HasSuffix(name, suffix) {
+            return format
+        }
+    }
+    return ""
+}
+
+func (fio *fileIO) compressFile(src, dest, format string) error {
+    if _, ok := compressionSuffixes[format]; !ok {
+        return fmt.Errorf("unsupported compression: %s", format)
+    }
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+
+    destFile, e := fio.createAtomic(dest)
+    if e != nil {
+        return e
+    }
+    var w io.WriteCloser = gzip.NewWriter(destFile)
+    if format == "zstd" {
+        if w, e = newZstdWriter(destFile); e != nil {
+            destFile.abort()
+            return e
+        }
+    }
+    if _, e := fio.copyBuffered(w, srcFile); e != nil {
+        destFile.abort()
+        return e
+    }
+    if e := w.Close(); e != nil {
+        destFile.abort()
+        return e
+    }
+    return destFile.commit()
+}
+
+func (fio *fileIO) decompressFile(src, dest, format string) error {
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+    var r io.ReadCloser
+    if format == "gzip" {
+        r, e = gzip.NewReader(srcFile)
+    } else {
+        r, e = newZstdReader(srcFile)
+    }
+    if e != nil {
+        return e
+    }
+    defer r.Close()
+
+    destFile, e := fio.createAtomic(dest)
+    if e != nil {
+        return e
+    }
+    if _, e := fio.copyBuffered(destFile, r); e != nil {
+        destFile.abort()
+        return e
+    }
+    return destFile.commit()
+}
@@ -0,0 +1,321 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+type config struct {
+    Jobs     map[string]map[string]interface{} `json:"jobs"`
+    Profiles map[string]map[string]interface{} `json:"profiles,omitempty"`
+    SMTP     *smtpConfig                       `json:"smtp,omitempty"`
+    Tenants  map[string]*tenant                `json:"tenants,omitempty"`
+}
+
+// defaultConfigFile is used unless -config is given. When it does not exist,
+// gopy.yaml or gopy.yml is read instead.
+const defaultConfigFile = "gopy.json"
+
+// findConfigFile returns the file that holds the config of configFile.
+func findConfigFile(configFile string) string {
+    if configFile != defaultConfigFile || fileExists(configFile) {
+        return configFile
+    }
+    for _, name := range []string{"gopy.yaml", "gopy.yml"} {
+        if fileExists(name) {
+            return name
+        }
+    }
+    return configFile
+}
+
+func readConfig(configFile string) (config, error) {
+    var c config
+    data, e := ioutil.ReadFile(configFile)
+    if e != nil {
+        return c, e
+    }
+    if e := unmarshalConfig(configFile, data, &c); e != nil {
+        return c, fmt.Errorf("%s: %v", configFile, e)
+    }
+    return c, nil
+}
+
+// unmarshalConfig decodes data as YAML when configFile is named so, and as
+// JSON otherwise.
+func unmarshalConfig(configFile string, data []byte, v interface{}) error {
+    if ext := strings.ToLower(filepath.Ext(configFile)); ext == ".yaml" || ext == ".yml" {
+        tree, e := parseYAML(data)
+        if e != nil {
+            return e
+        }
+        if data, e = json.Marshal(tree); e != nil {
+            return e
+        }
+    }
+    return json.Unmarshal(data, v)
+}
+
+func applyConfig(fs *flag.FlagSet, configFile, job string) error {
+    c, e := readConfig(configFile)
+    if e != nil {
+        return e
+    }
+    options, ok := c.Jobs[job]
+    if !ok {
+        return fmt.Errorf("job %s not found in %s", job, configFile)
+    }
+    return applyOptions(fs, options, "job "+job, nil)
+}
+
+// applyProfile applies a profile of the config file. A profile bundles the
+// settings of several commands, so its options that the running command does
+// not have are left out, unless no command has them.
+func applyProfile(fs *flag.FlagSet, configFile, profile string, known map[string]bool) error {
+    c, e := readConfig(configFile)
+    if e != nil {
+        return e
+    }
+    options, ok := c.Profiles[profile]
+    if !ok {
+        return fmt.Errorf("profile %s not found in %s", profile, configFile)
+    }
+    return applyOptions(fs, options, "profile "+profile, known)
+}
+
+// applyOptions sets the options that were not set yet, on the command line
+// or by a job. Unknown options are errors, except those in known.
+func applyOptions(fs *flag.FlagSet, options map[string]interface{}, source string, known map[string]bool) error {
+    explicit := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) {
+        explicit[f.Name] = true
+    })
+    for name, value := range options {
+        if fs.Lookup(name) == nil {
+            if (findCommand(name) != nil && fs != flag.CommandLine) || known[name] {
+                continue
+            }
+            return fmt.Errorf("unknown option %s in %s", name, source)
+        }
+        if explicit[name] {
+            continue
+        }
+        values, ok := value.([]interface{})
+        if !ok {
+            values = []interface{}{value}
+        }
+        for _, v := range values {
+            if e := fs.Set(name, fmt.Sprint(v)); e != nil {
+                return fmt.Errorf("invalid value for %s in %s: %v", name, source, e)
+            }
+        }
+    }
+    return nil
+}
+
+// optionNames returns the options of every command. Registering flags resets
+// them to their defaults, so it runs before the command line is parsed.
+func optionNames() map[string]bool {
+    names := map[string]bool{}
+    register := []func(*flag.FlagSet){registerCommonFlags, registerLegacyFlags}
+    for _, c := range commands {
+        register = append(register, c.register)
+    }
+    for _, r := range register {
+        fs := flag.NewFlagSet("", flag.ContinueOnError)
+        r(fs)
+        fs.VisitAll(func(f *flag.Flag) {
+            names[f.Name] = true
+        })
+    }
+    return names
+}
+
+// commandOptionNames returns the options of the command name, with the common
+// ones. Like optionNames, it resets them to their defaults.
+func commandOptionNames(name string) map[string]bool {
+    names := map[string]bool{}
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+    findCommand(name).register(fs)
+    registerCommonFlags(fs)
+    fs.VisitAll(func(f *flag.Flag) {
+        names[f.Name] = true
+    })
+    return names
+}
+
+// saveJobOptions merges options into job in configFile, or replaces the job,
+// creating either when they don't exist, and keeps the rest of the file. A
+// YAML file is written as YAML, with its comments.
+func saveJobOptions(configFile, job string, options map[string]interface{}, replace bool) error {
+    data, e := ioutil.ReadFile(configFile)
+    if e != nil && !os.IsNotExist(e) {
+        return e
+    }
+    if ext := strings.ToLower(filepath.Ext(configFile)); ext == ".yaml" || ext == ".yml" {
+        if data, e = setYAMLJob(data, job, options, replace); e != nil {
+            return fmt.Errorf("%s: %v", configFile, e)
+        }
+        return ioutil.WriteFile(configFile, data, 0644)
+    }
+    c := map[string]interface{}{}
+    if len(data) > 0 {
+        if e := unmarshalConfig(configFile, data, &c); e != nil {
+            return fmt.Errorf("%s: %v", configFile, e)
+        }
+    }
+    jobs, _ := c["jobs"].(map[string]interface{})
+    if jobs == nil {
+        jobs = map[string]interface{}{}
+        c["jobs"] = jobs
+    }
+    existing, _ := jobs[job].(map[string]interface{})
+    if existing == nil || replace {
+        existing = map[string]interface{}{}
+        jobs[job] = existing
+    }
+    for name, value := range options {
+        existing[name] = value
+    }
+    data, e = json.MarshalIndent(c, "", "    ")
+    if e != nil {
+        return e
+    }
+    return ioutil.WriteFile(configFile, append(data, '\n'), 0644)
+}
+
+type jobBundle struct {
+    Job     string                 `json:"job"`
+    Options map[string]interface{} `json:"options"`
+    Files   map[string][]byte      `json:"files"`
+}
+
+// bundledFiles returns the local files a job refers to: its manifest and the
+// files named in its filter script command.
+func bundledFiles(options map[string]interface{}) []string {
+    paths := []string{}
+    if input, ok := options["input"].(string); ok {
+        paths = append(paths, input)
+    }
+    if script, ok := options["filter-script"].(string); ok {
+        for _, arg := range strings.Fields(script) {
+            if fileExists(arg) && !isDirectory(arg) {
+                paths = append(paths, arg)
+            }
+        }
+    }
+    return paths
+}
+
+// runExportJob writes job of configFile, together with the files it refers to,
+// as a bundle to outputFile, or stdout when it is empty.
+func runExportJob(configFile, job, outputFile string) {
+    c, e := readConfig(configFile)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    options, ok := c.Jobs[job]
+    if !ok {
+        printErrorAndExit(fmt.Sprintf("job %s not found in %s", job, configFile), exitUsage)
+    }
+    bundle := jobBundle{job, options, map[string][]byte{}}
+    for _, path := range bundledFiles(options) {
+        if bundle.Files[path], e = ioutil.ReadFile(path); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }
+    data, e := json.MarshalIndent(bundle, "", "    ")
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    data = append(data, '\n')
+    if outputFile == "" {
+        os.Stdout.Write(data)
+    } else if e := ioutil.WriteFile(outputFile, data, 0644); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+}
+
+// runImportJob adds the job of bundleFile to configFile and writes the files of
+// the bundle next to configFile, prefixed with the job name.
+func runImportJob(configFile, bundleFile string, replace bool) {
+    data, e := ioutil.ReadFile(bundleFile)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    var bundle jobBundle
+    if e := json.Unmarshal(data, &bundle); e != nil {
+        printErrorAndExit(fmt.Errorf("%s: %v", bundleFile, e), exitIOError)
+    }
+    if bundle.Job == "" || bundle.Options == nil {
+        printErrorAndExit(bundleFile + " is not a job bundle", exitUsage)
+    }
+    // The job name prefixes the files written next to the config file.
+    if strings.ContainsAny(bundle.Job, `/\`) || strings.Contains(bundle.Job, "..") {
+        printErrorAndExit(fmt.Sprintf("%s: invalid job name %q", bundleFile, bundle.Job), exitUsage)
+    }
+    if c, e := readConfig(configFile); e == nil && !replace {
+        if _, ok := c.Jobs[bundle.Job]; ok {
+            printErrorAndExit(fmt.Sprintf("job %s already exists in %s, use -force to replace it",
+                bundle.Job, configFile), exitUsage)
+        }
+    }
+    renamed := map[string]string{}
+    paths := []string{}
+    for path := range bundle.Files {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    for _, path := range paths {
+        contents := bundle.Files[path]
+        local := filepath.Join(filepath.Dir(configFile), bundle.Job+"-"+filepath.Base(path))
+        if e := ioutil.WriteFile(local, contents, 0644); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        renamed[path] = local
+        fmt.Println("Wrote:", local)
+    }
+    if input, ok := bundle.Options["input"].(string); ok && renamed[input] != "" {
+        bundle.Options["input"] = renamed[input]
+    }
+    if script, ok := bundle.Options["filter-script"].(string); ok {
+        args := strings.Fields(script)
+        for i, arg := range args {
+            if renamed[arg] != "" {
+                args[i] = renamed[arg]
+            }
+        }
+        bundle.Options["filter-script"] = strings.Join(args, " ")
+    }
+    if e := saveJobOptions(configFile, bundle.Job, bundle.Options, true); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    fmt.Println("Imported job", bundle.Job, "into", configFile)
+}
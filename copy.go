@@ -0,0 +1,1260 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "context"
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/sha512"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "hash/fnv"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+
+    "lukechampine.com/blake3"
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+    "md5":    md5.New,
+    "sha1":   sha1.New,
+    "sha256": sha256.New,
+    "sha512": sha512.New,
+    "blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+func (fio *fileIO) hashFile(path string) (string, error) {
+    return fio.hashFileWith(path, sha256.New)
+}
+
+func (fio *fileIO) hashFileWith(path string, newHash func() hash.Hash) (string, error) {
+    fio.budget.acquire(1)
+    defer fio.budget.release(1)
+    f, e := fio.openSource(path)
+    if e != nil {
+        return "", e
+    }
+    defer f.Close()
+    h := newHash()
+    if _, e := fio.copyBuffered(h, f); e != nil {
+        return "", e
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type contentIndex struct {
+    bySize map[int64][]string
+    hashes map[string]string
+    fio    *fileIO
+}
+
+func newContentIndex(root string, fio *fileIO) *contentIndex {
+    index := &contentIndex{map[int64][]string{}, map[string]string{}, fio}
+    filepath.Walk(root,
+        func(path string, info os.FileInfo, err error) error {
+            if err == nil && info.Mode().IsRegular() {
+                index.add(path, info.Size())
+            }
+            return nil
+        })
+    return index
+}
+
+func (index *contentIndex) add(path string, size int64) {
+    index.bySize[size] = append(index.bySize[size], path)
+}
+
+func (index *contentIndex) hash(path string) string {
+    if h, ok := index.hashes[path]; ok {
+        return h
+    }
+    h, _ := index.fio.hashFile(path)
+    index.hashes[path] = h
+    return h
+}
+
+func (index *contentIndex) find(src string, size int64) (string, bool) {
+    candidates := index.bySize[size]
+    if len(candidates) == 0 {
+        return "", false
+    }
+    srcHash, e := index.fio.hashFile(src)
+    if e != nil {
+        return "", false
+    }
+    for _, candidate := range candidates {
+        if index.hash(candidate) == srcHash {
+            return candidate, true
+        }
+    }
+    return "", false
+}
+
+type copyOptions struct {
+    junk       []string
+    warnOver   int64
+    archive    string
+    priorities [][]string
+    compress   string
+    decompress bool
+    dedup      string
+    twoPhase   bool
+    sync       bool
+    delete     bool
+    dryRun     bool
+    journal    string
+    undo       *journal
+    stopAtFree int64
+    softDelete bool
+    retention  time.Duration
+    maxChange  float64
+    force      bool
+    sinceLast  bool
+    retries    int
+    retryDelay time.Duration
+    downloads  int
+    delta      bool
+    inPlace    bool
+    encrypt    string
+    decrypt    bool
+    filter     string
+    hardLinks  bool
+    onFile     string
+    maxBytes   int64
+    maxFiles   int
+    match      Filter
+    streams    bool
+    collision  string
+    flatten    string
+    order      string
+    backup     string
+    backupExt  string
+    numbered   bool
+    linkDest   string
+    shard      int
+    shards     int
+    yes        bool
+    ctx        context.Context
+    onCopied   func(rel string, size int64)
+    progress   ProgressFunc
+    walker     *walker
+    fio        *fileIO
+    rename     []renameRule
+    normalize  string
+    key        *fileKey
+    // logger, stdout and printError take the log, the files deleted or that
+    // would be copied or deleted, and the errors of the files that fail.
+    logger     *slog.Logger
+    stdout     io.Writer
+    printError func(msg interface{})
+}
+
+// withDefaults returns opts with what it leaves unset taken from the command
+// line: the log and the output, a walker and plain file I/O.
+func (o copyOptions) withDefaults() copyOptions {
+    if o.logger == nil {
+        o.logger = logger
+    }
+    if o.stdout == nil {
+        o.stdout = os.Stdout
+    }
+    if o.printError == nil {
+        o.printError = printError
+    }
+    if o.walker == nil {
+        o.walker = newWalker(nil)
+        o.walker.setLogger(o.logger)
+    }
+    if o.fio == nil {
+        o.fio = newFileIO(1<<20, o.logger)
+    }
+    return o
+}
+
+type copyResult struct {
+    large      []fileInfo
+    scanned    int
+    dirs       int
+    totalBytes int64
+    files      int
+    bytes      int64
+    skipped    int
+    failed     int
+    overBudget int
+    scanTime   time.Duration
+    copyTime   time.Duration
+    writeTime  time.Duration
+}
+
+// parseShard parses a -shard value, "i/N" with i counted from 1.
+func parseShard(s string) (int, int, error) {
+    i, n, ok := strings.Cut(s, "/")
+    shard, e1 := strconv.Atoi(i)
+    shards, e2 := strconv.Atoi(n)
+    if !ok || e1 != nil || e2 != nil || shards < 1 || shard < 1 || shard > shards {
+        return 0, 0, fmt.Errorf("invalid shard: %s, expected i/N with 1 <= i <= N", s)
+    }
+    return shard, shards, nil
+}
+
+// inShard tells whether a file belongs to the shard being copied. Files are
+// spread by a hash of their destination path, so every machine copying the
+// same manifest with a different shard gets a disjoint share of it.
+func inShard(rel string, opts copyOptions) bool {
+    if opts.shards <= 1 {
+        return true
+    }
+    h := fnv.New32a()
+    h.Write([]byte(filepath.ToSlash(rel)))
+    return int(h.Sum32()%uint32(opts.shards)) == opts.shard-1
+}
+
+type copyItem struct {
+    path string
+    rel  string
+    info os.FileInfo
+}
+
+func (w *walker) walkCopySources(sources []string, junk []string, fn func(item copyItem)) error {
+    scanProgress.walking.Store(true)
+    defer scanProgress.walking.Store(false)
+    for _, dir := range sources {
+        if e := w.walkCopySource(dir, dir, junk, fn); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+// walkCopySource walks start, which is dir or lies below it, naming every
+// item relative to the parent of dir.
+func (w *walker) walkCopySource(dir string, start string, junk []string, fn func(item copyItem)) error {
+    parent := filepath.Dir(filepath.Clean(dir))
+    var device uint64
+    return w.walkLinks(start,
+        func(path string, info os.FileInfo, err error) error {
+            if err != nil {
+                if !w.unreadable.add(path, err) {
+                    return err
+                }
+                if info == nil {
+                    return nil
+                }
+            }
+            if w.crossesFileSystem(path, info, start, &device) {
+                w.logger.Info("file_skipped", "path", path, "reason", "other file system")
+                return filepath.SkipDir
+            }
+            if isJunk(path, junk) {
+                w.logger.Info("file_skipped", "path", path, "reason", "junk")
+                if info.IsDir() {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            rel, e := filepath.Rel(parent, path)
+            if e != nil {
+                return e
+            }
+            fn(copyItem{path, rel, info})
+            return nil
+    })
+}
+
+type scriptFilter struct {
+    cmd  *exec.Cmd
+    in   io.WriteCloser
+    out  *bufio.Scanner
+    star *starProgram
+}
+
+type scriptCandidate struct {
+    Path    string    `json:"path"`
+    Rel     string    `json:"rel"`
+    Size    int64     `json:"size"`
+    ModTime time.Time `json:"mod_time"`
+}
+
+// startScriptFilter starts command, which is sent a JSON line for every
+// candidate file on its standard input and answers each with a line holding
+// "include", "exclude" or "rename <path>". A .star file is run in process
+// instead.
+func startScriptFilter(command string) (*scriptFilter, error) {
+    args := strings.Fields(command)
+    if len(args) == 0 {
+        return nil, fmt.Errorf("empty filter script")
+    }
+    if len(args) == 1 && strings.HasSuffix(args[0], ".star") {
+        star, e := loadStarProgram(args[0])
+        if e != nil {
+            return nil, e
+        }
+        return &scriptFilter{star: star}, nil
+    }
+    cmd := exec.Command(args[0], args[1:]...)
+    cmd.Stderr = os.Stderr
+    in, e := cmd.StdinPipe()
+    if e != nil {
+        return nil, e
+    }
+    out, e := cmd.StdoutPipe()
+    if e != nil {
+        return nil, e
+    }
+    if e := cmd.Start(); e != nil {
+        return nil, e
+    }
+    return &scriptFilter{cmd, in, bufio.NewScanner(out), nil}, nil
+}
+
+func (f *scriptFilter) decide(item copyItem) (string, bool, error) {
+    decision, e := f.ask(scriptCandidate{item.path, filepath.ToSlash(item.rel), item.info.Size(), item.info.ModTime()})
+    if e != nil {
+        return "", false, e
+    }
+    switch {
+    case decision == "include":
+        return item.rel, true, nil
+    case decision == "exclude":
+        return "", false, nil
+    case strings.HasPrefix(decision, "rename "):
+        rel := strings.TrimSpace(strings.TrimPrefix(decision, "rename "))
+        if _, e := extractPath(".", rel); e != nil {
+            return "", false, e
+        }
+        return filepath.FromSlash(rel), true, nil
+    }
+    return "", false, fmt.Errorf("invalid filter script decision for %s: %q", item.path, decision)
+}
+
+func (f *scriptFilter) ask(candidate scriptCandidate) (string, error) {
+    if f.star != nil {
+        return f.star.decision(candidate)
+    }
+    data, _ := json.Marshal(candidate)
+    if _, e := f.in.Write(append(data, '\n')); e != nil {
+        return "", fmt.Errorf("filter script: %v", e)
+    }
+    if !f.out.Scan() {
+        if e := f.out.Err(); e != nil {
+            return "", e
+        }
+        return "", fmt.Errorf("filter script exited without a decision for %s", candidate.Path)
+    }
+    return strings.TrimSpace(f.out.Text()), nil
+}
+
+func (f *scriptFilter) close() error {
+    if f.star != nil {
+        return nil
+    }
+    f.in.Close()
+    return f.cmd.Wait()
+}
+
+// copyManifests copies the entries of the manifests at inputPaths to
+// directoryPath. Failed files are counted in the result, while errors that
+// end the run are returned, as a runError when they are not I/O errors.
+func copyManifests(directoryPath string, inputPaths []string, opts copyOptions) (copyResult, error) {
+    start := time.Now()
+    result := copyResult{large: []fileInfo{}}
+    opts = opts.withDefaults()
+    fail := func(path string, e error) {
+        opts.printError(e)
+        result.failed++
+        opts.progress.report(Event{Kind: Error, Path: path, Err: e})
+    }
+    items := []copyItem{}
+    sources, remotes, downloads := []string{}, []string{}, []jsonEntry{}
+    entries, e := readManifests(inputPaths, opts.logger)
+    if e != nil {
+        return result, e
+    }
+    for _, entry := range entries {
+        if isURL(entry.Path) {
+            downloads = append(downloads, entry)
+        } else if isRemote(entry.Path) {
+            remotes = append(remotes, entry.Path)
+        } else {
+            sources = append(sources, entry.Path)
+        }
+    }
+    if len(remotes)+len(downloads) > 0 &&
+        (isRemote(directoryPath) || isCloud(directoryPath) || opts.archive != "" || opts.dryRun) {
+        return result, runError{errors.New(
+            "remote and URL sources can only be copied to a local directory, without -archive or -dry-run"), exitUsage}
+    }
+    if opts.fio.readOnly {
+        for _, source := range sources {
+            if isWithin(directoryPath, source) {
+                return result, runError{errors.New(directoryPath + " is inside the read-only source " + source), exitUsage}
+            }
+        }
+    }
+    if !isCloud(directoryPath) && !isRemote(directoryPath) {
+        opts.walker.excludeFromWalks(directoryPath, sources)
+        if !opts.dryRun && opts.archive == "" {
+            undo, e := openUndoJournal(directoryPath, opts.fio)
+            if e != nil {
+                return result, e
+            }
+            defer undo.close()
+            opts.undo = undo
+        }
+    }
+    dest, e := newDestination(directoryPath, opts)
+    if e != nil {
+        return result, e
+    }
+    var filter *scriptFilter
+    var filterErr, collisionErr error
+    if opts.filter != "" {
+        if filter, e = startScriptFilter(opts.filter); e != nil {
+            dest.close()
+            return result, e
+        }
+    }
+    roots := []string{}
+    dirs := []copyItem{}
+    seen := map[string]bool{}
+    scannedLinks := map[fileID]bool{}
+    cases := newCaseFolder(opts)
+    flat := map[string]string{}
+    // renamed holds the sources of the files renamed so far by their new paths.
+    renamed := map[string]string{}
+    skipsBefore := opts.walker.unreadable.skips()
+    opts.progress.report(Event{Kind: ScanStarted, Path: directoryPath})
+    walk := opts.walker.walkCopySources
+    if opts.sinceLast {
+        if paths, ok := readChangeJournal(directoryPath, readLastRun(directoryPath)); ok {
+            opts.logger.Info("change_journal_used", "paths", len(paths))
+            walk = func(sources []string, junk []string, fn func(item copyItem)) error {
+                return opts.walker.walkChangedPaths(sources, paths, junk, fn)
+            }
+        }
+    }
+    walkErr := walk(sources, opts.junk, func(item copyItem) {
+        if filterErr != nil || collisionErr != nil {
+            return
+        }
+        item.rel = normalizePath(item.rel, opts.normalize)
+        if len(opts.rename) > 0 {
+            rel, e := rewritePath(item.rel, opts.rename)
+            if e != nil {
+                fail(item.rel, e)
+                return
+            }
+            if rel == "" {
+                opts.logger.Debug("file_skipped", "path", item.rel, "reason", "renamed away")
+                return
+            }
+            if !item.info.IsDir() {
+                if existing, ok := renamed[rel]; ok {
+                    fail(item.rel, errors.New(item.path+" is renamed to "+rel+", like "+existing))
+                    return
+                }
+                renamed[rel] = item.path
+            }
+            item.rel = rel
+        }
+        if opts.flatten != "" {
+            if item.info.IsDir() {
+                return
+            }
+            rel, ok := flattenPath(item.rel, flat, opts)
+            if !ok {
+                return
+            }
+            item.rel = rel
+        }
+        if opts.collision != "" {
+            rel, ok, e := cases.resolve(item.rel, item.info.IsDir())
+            if e != nil {
+                collisionErr = e
+                return
+            }
+            if !ok {
+                return
+            }
+            item.rel = rel
+        }
+        if item.info.IsDir() {
+            seen[item.rel] = true
+            result.dirs++
+            if isRootItem(item, sources) {
+                roots = append(roots, item.rel)
+            }
+            dirs = append(dirs, item)
+            return
+        }
+        if entry := (Entry{Path: item.path, Size: item.info.Size(), ModTime: item.info.ModTime()}); opts.match != nil &&
+            !opts.match.Match(entry) {
+            // Kept as seen, so that sync -delete leaves its copy alone.
+            seen[item.rel] = true
+            opts.logger.Info("file_skipped", "path", item.rel, "reason", "filter")
+            return
+        }
+        if !inShard(item.rel, opts) {
+            seen[item.rel] = true
+            opts.logger.Debug("file_skipped", "path", item.rel, "reason", "other shard")
+            return
+        }
+        if filter != nil {
+            rel, include, e := filter.decide(item)
+            if e != nil {
+                filterErr = e
+                return
+            }
+            if !include {
+                opts.logger.Info("file_skipped", "path", item.rel, "reason", "filter script")
+                return
+            }
+            if rel != item.rel && !seen[filepath.Dir(rel)] {
+                parent, _ := os.Stat(filepath.Dir(item.path))
+                dirs = append(dirs, copyItem{filepath.Dir(item.path), filepath.Dir(rel), parent})
+                seen[filepath.Dir(rel)] = true
+            }
+            item.rel = rel
+        }
+        seen[item.rel] = true
+        if opts.warnOver > 0 && item.info.Size() > opts.warnOver {
+            filePath, _ := filepath.Abs(item.path)
+            result.large = append(result.large, fileInfo{filePath, item.info.Size()})
+        }
+        result.scanned++
+        if id, ok := hardLinkID(item.info); !ok || !scannedLinks[id] {
+            result.totalBytes += item.info.Size()
+            if ok {
+                scannedLinks[id] = true
+            }
+        }
+        items = append(items, item)
+        opts.progress.report(Event{Kind: EntryFound, Path: item.rel, Files: result.scanned, Bytes: result.totalBytes})
+    })
+    // Destination files of unreadable sources must not look extraneous.
+    unreadableSources := opts.walker.unreadable.skips() - skipsBefore
+    result.failed += unreadableSources
+    if filter != nil {
+        if e := filter.close(); e != nil && filterErr == nil {
+            filterErr = e
+        }
+    }
+    if walkErr != nil {
+        dest.close()
+        return result, walkErr
+    }
+    if collisionErr != nil {
+        dest.close()
+        return result, collisionErr
+    }
+    if filter != nil {
+        if filterErr != nil {
+            dest.close()
+            return result, fmt.Errorf("filter script: %v", filterErr)
+        }
+    }
+    if opts.sync && opts.maxChange > 0 && !opts.force {
+        changed, total := changeRate(directoryPath, roots, seen, items, opts.delete)
+        if total > 0 && float64(changed)*100/float64(total) > opts.maxChange {
+            dest.close()
+            return result, runError{fmt.Errorf("%d of %d destination files would be deleted or overwritten, "+
+                "which is more than %.0f%%, use -force to sync anyway", changed, total, opts.maxChange), exitUsage}
+        }
+    }
+    if !opts.force && !opts.dryRun && opts.stopAtFree == 0 && opts.compress == "" && opts.dedup == "" &&
+        !isCloud(directoryPath) && !isRemote(directoryPath) {
+        if needed, free, ok := spaceNeeded(directoryPath, items); ok && needed > free {
+            dest.close()
+            return result, runError{fmt.Errorf("%s of the manifest would be written to %s, which has only %s free, "+
+                "use -force to copy anyway", formatSize(needed), directoryPath, formatSize(free)), exitUsage}
+        }
+    }
+    result.scanTime = time.Since(start)
+    copyStart := time.Now()
+    for _, dir := range dirs {
+        opts.logger.Debug("dir_created", "path", dir.rel)
+        dest.makeDir(dir.rel, dir.info)
+    }
+    switch opts.order {
+    case "largest-first":
+        sort.SliceStable(items, func(i, j int) bool { return items[i].info.Size() > items[j].info.Size() })
+    case "smallest-first":
+        sort.SliceStable(items, func(i, j int) bool { return items[i].info.Size() < items[j].info.Size() })
+    }
+    if len(opts.priorities) > 0 {
+        sort.SliceStable(items, func(i, j int) bool {
+            return priorityOf(items[i].rel, opts.priorities) < priorityOf(items[j].rel, opts.priorities)
+        })
+    }
+    var index *contentIndex
+    if opts.dedup != "" {
+        index = newContentIndex(directoryPath, opts.fio)
+    }
+    var resume *resumeState
+    if opts.stopAtFree > 0 && opts.archive == "" && !opts.dryRun {
+        resume = loadResumeState(directoryPath)
+    }
+    var lastRun time.Time
+    if opts.sinceLast {
+        lastRun = readLastRun(directoryPath)
+    }
+    links := map[fileID]string{}
+    // Links are made next to the files dest writes, with the same backups
+    // and journal.
+    linker := &dirDestination{root: directoryPath, backupDir: opts.backup, backupExt: opts.backupExt,
+        numbered: opts.numbered, undo: opts.undo, fio: opts.fio}
+    stopped := false
+    for _, item := range items {
+        if opts.ctx != nil && opts.ctx.Err() != nil {
+            break
+        }
+        opts.progress.report(Event{Kind: FileStarted, Path: item.rel, Files: result.files, Bytes: result.bytes,
+            TotalFiles: len(items), TotalBytes: result.totalBytes})
+        if item.info.ModTime().Before(lastRun) {
+            opts.logger.Debug("file_skipped", "path", item.rel, "reason", "unchanged since last run")
+            result.skipped++
+            continue
+        }
+        if resume != nil && resume.isDone(directoryPath, item) {
+            opts.logger.Debug("file_skipped", "path", item.rel, "reason", "already copied")
+            result.skipped++
+            continue
+        }
+        if opts.sync && upToDate(dest, directoryPath, item) {
+            opts.logger.Debug("file_skipped", "path", item.rel, "reason", "up to date")
+            result.skipped++
+            continue
+        }
+        if (opts.maxFiles > 0 && result.files >= opts.maxFiles) ||
+            (opts.maxBytes > 0 && result.bytes+item.info.Size() > opts.maxBytes) {
+            opts.logger.Info("file_skipped", "path", item.rel, "reason", "over -max-bytes or -max-files")
+            result.skipped++
+            result.overBudget++
+            continue
+        }
+        if opts.stopAtFree > 0 && !opts.dryRun && belowWatermark(directoryPath, opts, item.info.Size()) {
+            stopped = true
+            break
+        }
+        if resume != nil {
+            resume.add(item.rel)
+        }
+        target := filepath.Join(directoryPath, item.rel)
+        if index != nil {
+            if existing, ok := index.find(item.path, item.info.Size()); ok {
+                if opts.dedup == "link" && existing != target && !opts.dryRun {
+                    if e := linker.link(existing, item.rel, false); e != nil {
+                        fail(item.rel, e)
+                        continue
+                    }
+                }
+                opts.logger.Info("file_skipped", "path", item.rel, "reason", "duplicate of "+existing)
+                result.skipped++
+                continue
+            }
+        }
+        var id fileID
+        linked := false
+        if opts.hardLinks {
+            id, linked = hardLinkID(item.info)
+        }
+        if existing, ok := links[id]; linked && ok {
+            if !opts.dryRun {
+                if e := linker.link(existing, item.rel, false); e != nil {
+                    fail(item.rel, e)
+                    continue
+                }
+            }
+            opts.logger.Info("file_linked", "path", item.rel, "target", existing)
+            result.files++
+            continue
+        }
+        // Like rsync --link-dest, an unchanged file shares its inode with the
+        // previous copy, which is fine as long as files are replaced, not
+        // rewritten in place.
+        if previous := filepath.Join(opts.linkDest, item.rel); opts.linkDest != "" && isUpToDate(item.info, previous) {
+            var e error
+            if !opts.dryRun {
+                e = linker.link(previous, item.rel, false)
+            }
+            if e == nil {
+                opts.logger.Info("file_linked", "path", item.rel, "target", previous)
+                result.files++
+                continue
+            }
+            opts.logger.Debug("file_not_linked", "path", item.rel, "error", e.Error())
+        }
+        if opts.walker.links == "recreate" && isLink(item.info) {
+            link, e := os.Readlink(item.path)
+            if e == nil && !opts.dryRun {
+                e = linker.link(link, item.rel, true)
+            }
+            if e != nil {
+                fail(item.rel, e)
+                continue
+            }
+            opts.logger.Info("file_linked", "path", item.rel, "target", link)
+            result.files++
+            continue
+        }
+        writeStart := time.Now()
+        e := writeWithRetry(dest, item, opts)
+        result.writeTime += time.Since(writeStart)
+        if e != nil {
+            fail(item.rel, e)
+            continue
+        }
+        if opts.onFile != "" && !opts.dryRun {
+            if e := runHook(opts.onFile, "GOPY_SOURCE="+item.path, "GOPY_PATH="+target,
+                "GOPY_SIZE="+strconv.FormatInt(item.info.Size(), 10)); e != nil {
+                opts.printError(e)
+            }
+        }
+        if linked {
+            links[id] = target
+        }
+        if index != nil {
+            index.add(target, item.info.Size())
+        }
+        result.files++
+        result.bytes += item.info.Size()
+        if opts.onCopied != nil {
+            opts.onCopied(item.rel, item.info.Size())
+        }
+        opts.progress.report(Event{Kind: FileCopied, Path: item.rel, Size: item.info.Size(), Files: result.files,
+            Bytes: result.bytes, TotalFiles: len(items), TotalBytes: result.totalBytes})
+    }
+    if e := dest.close(); e != nil {
+        return result, e
+    }
+    if opts.ctx != nil && opts.ctx.Err() != nil {
+        return result, nil
+    }
+    for _, remote := range remotes {
+        if e := fetchRemote(remote, directoryPath, opts, &result); e != nil {
+            fail(remote, e)
+        }
+    }
+    if len(downloads) > 0 {
+        downloadAll(downloads, directoryPath, opts, &result)
+    }
+    result.copyTime = time.Since(copyStart)
+    if stopped {
+        if resume != nil {
+            if e := resume.save(); e != nil {
+                opts.printError(e)
+            }
+        }
+        return result, runError{fmt.Errorf("free space on %s is below %s, re-run the same command to resume",
+            directoryPath, formatSize(opts.stopAtFree)), exitPartial}
+    }
+    if resume != nil {
+        resume.remove()
+    }
+    if result.overBudget > 0 {
+        opts.printError(fmt.Sprintf("%d files were not copied to stay within -max-bytes and -max-files", result.overBudget))
+    }
+    if opts.sinceLast && !opts.dryRun && result.failed == 0 {
+        if e := writeLastRun(directoryPath, start); e != nil {
+            opts.printError(e)
+        }
+    }
+    if opts.delete && unreadableSources > 0 {
+        opts.printError(fmt.Sprintf("%d source paths could not be read, so nothing is deleted", unreadableSources))
+    } else if opts.delete {
+        if opts.dryRun {
+            for _, path := range findExtraneous(directoryPath, roots, seen, protectedPatterns(opts)) {
+                fmt.Fprintln(opts.stdout, "Would delete:", path)
+            }
+        } else {
+            var j *journal
+            if opts.journal != "" {
+                if j, e = openJournal(opts.journal); e != nil {
+                    return result, e
+                }
+                defer j.close()
+            }
+            for _, path := range deleteExtraneous(directoryPath, roots, seen, opts) {
+                fmt.Fprintln(opts.stdout, "Deleted:", path)
+                if j != nil {
+                    rel, _ := filepath.Rel(directoryPath, path)
+                    j.record("delete", "", rel)
+                }
+            }
+        }
+    }
+    return result, nil
+}
+
+// runError is an error that ends a run, with the exit code the command line
+// reports it with.
+type runError struct {
+    error
+    code int
+}
+
+// runCopy is copyManifests for the command line, which exits on the errors
+// that end a run.
+func runCopy(directoryPath string, inputPaths []string, opts copyOptions) copyResult {
+    result, e := copyManifests(directoryPath, inputPaths, opts)
+    if e != nil {
+        code := exitIOError
+        var re runError
+        if errors.As(e, &re) {
+            code = re.code
+        }
+        printErrorAndExit(e, code)
+    }
+    return result
+}
+
+var transientErrors = []error{syscall.EBUSY, syscall.ETXTBSY, syscall.EAGAIN, syscall.EINTR,
+    syscall.ESTALE, syscall.ETIMEDOUT, syscall.EIO}
+
+func isTransient(e error) bool {
+    for _, t := range transientErrors {
+        if errors.Is(e, t) {
+            return true
+        }
+    }
+    var timeout interface{ Timeout() bool }
+    return errors.As(e, &timeout) && timeout.Timeout()
+}
+
+// writeWithRetry writes item to dest, retrying transient failures up to
+// opts.retries times with exponential backoff.
+func writeWithRetry(dest copyDestination, item copyItem, opts copyOptions) error {
+    delay := opts.retryDelay
+    for attempt := 0; ; attempt++ {
+        e := dest.writeFile(item.path, item.rel, item.info)
+        if e == nil || attempt >= opts.retries || !isTransient(e) {
+            return e
+        }
+        opts.logger.Warn("retrying", "path", item.rel, "error", e.Error(), "delay", delay)
+        time.Sleep(delay)
+        delay *= 2
+    }
+}
+
+const resumeFileName = ".gopy-resume"
+
+type resumeState struct {
+    path string
+    done map[string]bool
+}
+
+func loadResumeState(directoryPath string) *resumeState {
+    r := &resumeState{filepath.Join(directoryPath, resumeFileName), map[string]bool{}}
+    if data, e := ioutil.ReadFile(r.path); e == nil {
+        for _, rel := range strings.Split(string(data), "\n") {
+            if rel != "" {
+                r.done[rel] = true
+            }
+        }
+    }
+    return r
+}
+
+func (r *resumeState) isDone(directoryPath string, item copyItem) bool {
+    if !r.done[item.rel] {
+        return false
+    }
+    fi, e := os.Stat(filepath.Join(directoryPath, item.rel))
+    return e == nil && fi.Size() == item.info.Size()
+}
+
+func (r *resumeState) add(rel string) {
+    r.done[rel] = true
+}
+
+func (r *resumeState) save() error {
+    if len(r.done) == 0 {
+        return nil
+    }
+    rels := []string{}
+    for rel := range r.done {
+        rels = append(rels, rel)
+    }
+    sort.Strings(rels)
+    return ioutil.WriteFile(r.path, []byte(strings.Join(rels, "\n")+"\n"), 0644)
+}
+
+func (r *resumeState) remove() {
+    os.Remove(r.path)
+}
+
+// spaceNeeded returns the bytes that copying items to directoryPath would add,
+// less the files they replace, and the free space there, if it is known.
+func spaceNeeded(directoryPath string, items []copyItem) (int64, int64, bool) {
+    dir := directoryPath
+    for !isDirectory(dir) && filepath.Dir(dir) != dir {
+        dir = filepath.Dir(dir)
+    }
+    free, e := freeSpace(dir)
+    if e != nil {
+        return 0, 0, false
+    }
+    needed := int64(0)
+    for _, item := range items {
+        size := item.info.Size()
+        if fi, e := os.Stat(filepath.Join(directoryPath, item.rel)); e == nil && fi.Mode().IsRegular() {
+            size -= fi.Size()
+        }
+        if size > 0 {
+            needed += size
+        }
+    }
+    return needed, int64(free), true
+}
+
+func belowWatermark(directoryPath string, opts copyOptions, size int64) bool {
+    dir := directoryPath
+    if opts.archive != "" {
+        dir = filepath.Dir(directoryPath)
+    }
+    free, e := freeSpace(dir)
+    if e != nil {
+        return false
+    }
+    return int64(free)-size < opts.stopAtFree
+}
+
+func isRootItem(item copyItem, sources []string) bool {
+    for _, source := range sources {
+        if item.path == source {
+            return true
+        }
+    }
+    return false
+}
+
+func changeRate(directoryPath string, roots []string, seen map[string]bool, items []copyItem, delete bool) (int, int) {
+    sources := map[string]os.FileInfo{}
+    for _, item := range items {
+        sources[item.rel] = item.info
+    }
+    changed, total := 0, 0
+    for _, root := range roots {
+        filepath.Walk(filepath.Join(directoryPath, root),
+            func(path string, info os.FileInfo, err error) error {
+                if err != nil || !info.Mode().IsRegular() {
+                    return nil
+                }
+                total++
+                rel, _ := filepath.Rel(directoryPath, path)
+                if !seen[rel] {
+                    if delete {
+                        changed++
+                    }
+                } else if source, ok := sources[rel]; ok && !isUpToDate(source, path) {
+                    changed++
+                }
+                return nil
+            })
+    }
+    return changed, total
+}
+
+// upToDate tells whether the copy of item in dest, a storage or the
+// directory directoryPath, is up to date.
+func upToDate(dest copyDestination, directoryPath string, item copyItem) bool {
+    if d, ok := dest.(*storageDestination); ok {
+        return d.upToDate(item.rel, item.info)
+    }
+    return isUpToDate(item.info, filepath.Join(directoryPath, item.rel))
+}
+
+func isUpToDate(info os.FileInfo, target string) bool {
+    fi, e := os.Stat(target)
+    return e == nil && isCopyOf(fi, info)
+}
+
+// isCopyOf tells whether copied is an up-to-date copy of the file of info,
+// having its size and, as synced files are given, its modification time.
+func isCopyOf(copied, info os.FileInfo) bool {
+    return copied.Size() == info.Size() && copied.ModTime().Equal(info.ModTime())
+}
+
+// protectedPatterns are the patterns of destination files -delete keeps
+// although they are not in the sources: junk, and backups.
+func protectedPatterns(opts copyOptions) []string {
+    patterns := append([]string{lockFileName, undoJournalName}, opts.junk...)
+    if opts.backupExt != "" {
+        patterns = append(patterns, "*"+opts.backupExt)
+    }
+    if opts.numbered {
+        patterns = append(patterns, "*.v[0-9]*")
+    }
+    return patterns
+}
+
+func findExtraneous(directoryPath string, roots []string, keep map[string]bool, junk []string) []string {
+    extraneous := []string{}
+    for _, root := range roots {
+        filepath.Walk(filepath.Join(directoryPath, root),
+            func(path string, info os.FileInfo, err error) error {
+                if err != nil {
+                    return nil
+                }
+                rel, _ := filepath.Rel(directoryPath, path)
+                if keep[rel] || isJunk(path, junk) {
+                    return nil
+                }
+                extraneous = append(extraneous, path)
+                if info.IsDir() {
+                    return filepath.SkipDir
+                }
+                return nil
+            })
+    }
+    return extraneous
+}
+
+const deletedDirName = ".deleted"
+
+const versionsDirName = ".gopy-versions"
+
+// confirmDeletion shows what is about to be deleted and asks for a
+// confirmation on the terminal. Without a terminal nothing is deleted, so
+// unattended runs need -yes.
+func confirmDeletion(w *walker, paths []string) bool {
+    if len(paths) == 0 {
+        return true
+    }
+    var size int64
+    for _, path := range paths {
+        n, e := w.getSize(path)
+        if e != nil {
+            printError(e)
+            return false
+        }
+        size += n
+    }
+    fmt.Fprintf(os.Stderr, "%d paths (%s) would be deleted:\n", len(paths), formatSize(size))
+    for i, path := range paths {
+        if i == 10 {
+            fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(paths)-i)
+            break
+        }
+        fmt.Fprintln(os.Stderr, "  "+path)
+    }
+    unattended := "nothing was deleted without a confirmation, use -yes to delete without asking"
+    if fi, e := os.Stdin.Stat(); e != nil || fi.Mode()&os.ModeCharDevice == 0 {
+        printError(unattended)
+        return false
+    }
+    fmt.Fprint(os.Stderr, "Delete them? [y/N] ")
+    answer, e := bufio.NewReader(os.Stdin).ReadString('\n')
+    if e != nil && answer == "" {
+        // Like /dev/null, which is a character device too.
+        fmt.Fprintln(os.Stderr)
+        printError(unattended)
+        return false
+    }
+    answer = strings.ToLower(strings.TrimSpace(answer))
+    return answer == "y" || answer == "yes"
+}
+
+func deleteExtraneous(directoryPath string, roots []string, keep map[string]bool, opts copyOptions) []string {
+    deleted := []string{}
+    stagingDir := filepath.Join(directoryPath, deletedDirName, time.Now().Format("2006-01-02"))
+    extraneous := findExtraneous(directoryPath, roots, keep, protectedPatterns(opts))
+    if !opts.yes && !confirmDeletion(opts.walker, extraneous) {
+        return deleted
+    }
+    for _, path := range extraneous {
+        rel, _ := filepath.Rel(directoryPath, path)
+        staged := ""
+        if opts.softDelete {
+            staged = filepath.Join(stagingDir, rel)
+        }
+        if opts.undo != nil {
+            source := staged
+            if source != "" {
+                source, _ = filepath.Abs(source)
+            }
+            if e := opts.undo.record("delete", source, rel); e != nil {
+                opts.printError(e)
+                continue
+            }
+        }
+        var e error
+        if opts.softDelete {
+            os.MkdirAll(filepath.Dir(staged), 0755)
+            os.RemoveAll(staged)
+            e = os.Rename(path, staged)
+        } else {
+            e = os.RemoveAll(path)
+        }
+        if e != nil {
+            opts.printError(e)
+            continue
+        }
+        deleted = append(deleted, path)
+    }
+    if opts.softDelete {
+        purgeDeleted(directoryPath, opts.retention)
+    }
+    return deleted
+}
+
+func purgeDeleted(directoryPath string, retention time.Duration) {
+    deletedDir := filepath.Join(directoryPath, deletedDirName)
+    fi, e := ioutil.ReadDir(deletedDir)
+    if e != nil {
+        return
+    }
+    for _, info := range fi {
+        day, e := time.ParseInLocation("2006-01-02", info.Name(), time.Local)
+        if e != nil || !info.IsDir() {
+            continue
+        }
+        if time.Since(day.AddDate(0, 0, 1)) > retention {
+            if e := os.RemoveAll(filepath.Join(deletedDir, info.Name())); e != nil {
+                printError(e)
+            }
+        }
+    }
+}
+
+type fileState struct {
+    size    int64
+    modTime time.Time
+}
+
+// runWatch copies the sources again whenever they change. On Linux the
+// source directories are watched with inotify and only what changed is
+// rescanned; elsewhere everything is rescanned every interval.
+func runWatch(directoryPath string, inputPaths []string, opts copyOptions, interval time.Duration) {
+    opts = opts.withDefaults()
+    dest, e := newDestination(directoryPath, opts)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    w, e := newWatcher()
+    if e != nil {
+        logger.Debug("watch_polling", "reason", e.Error())
+    }
+    seen := map[string]fileState{}
+    copyChanged := func(item copyItem) {
+        if w != nil && item.info.IsDir() {
+            if e := w.add(item.path); e != nil {
+                printError(e)
+            }
+        }
+        state := fileState{item.info.Size(), item.info.ModTime()}
+        if prev, ok := seen[item.path]; ok && prev == state {
+            return
+        }
+        seen[item.path] = state
+        opts.progress.report(Event{Kind: EntryFound, Path: item.rel})
+        if item.info.IsDir() {
+            dest.makeDir(item.rel, item.info)
+        } else if !inShard(item.rel, opts) {
+            return
+        } else if e := dest.writeFile(item.path, item.rel, item.info); e != nil {
+            printError(e)
+            opts.progress.report(Event{Kind: Error, Path: item.rel, Err: e})
+        } else {
+            fmt.Println("Copied:", item.path)
+            opts.progress.report(Event{Kind: FileCopied, Path: item.rel, Size: item.info.Size()})
+        }
+    }
+    sources := []string{}
+    scan := func() {
+        sources = sources[:0]
+        entries, e := readManifests(inputPaths, logger)
+        if e != nil {
+            printError(e)
+        }
+        for _, entry := range entries {
+            sources = append(sources, entry.Path)
+        }
+        if w != nil {
+            for _, path := range append(append([]string{}, inputPaths...), sources...) {
+                dir := path
+                if info, e := os.Stat(path); e == nil && !info.IsDir() {
+                    dir = filepath.Dir(path)
+                }
+                if e := w.add(dir); e != nil {
+                    printError(e)
+                }
+            }
+        }
+        if e := opts.walker.walkCopySources(sources, opts.junk, copyChanged); e != nil {
+            printError(e)
+        }
+    }
+    scan()
+    for {
+        if w == nil {
+            time.Sleep(interval)
+            scan()
+            continue
+        }
+        paths, all, e := w.wait()
+        if e != nil {
+            printError(e)
+            w = nil
+            continue
+        }
+        for _, path := range paths {
+            for _, input := range inputPaths {
+                if isWithin(path, input) {
+                    all = true
+                }
+            }
+        }
+        if all {
+            scan()
+            continue
+        }
+        for _, path := range paths {
+            if _, e := os.Lstat(path); e != nil {
+                continue
+            }
+            for _, dir := range sources {
+                if isWithin(path, dir) {
+                    if e := opts.walker.walkCopySource(dir, path, opts.junk, copyChanged); e != nil {
+                        printError(e)
+                    }
+                    break
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,212 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+)
+
+func TestWalkCopySourceRelativePaths(t *testing.T) {
+    // The name of the source also appears higher up its path.
+    src := filepath.Join(t.TempDir(), "data", "x", "data")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "data/b.txt": "b"})
+    for _, dir := range []string{src, src + string(filepath.Separator)} {
+        rels := []string{}
+        e := newWalker(nil).walkCopySource(dir, dir, nil, func(item copyItem) {
+            rels = append(rels, filepath.ToSlash(item.rel))
+        })
+        if e != nil {
+            t.Fatal(e)
+        }
+        sort.Strings(rels)
+        if got := strings.Join(rels, " "); got != "data data/a.txt data/data data/data/b.txt" {
+            t.Errorf("%s: walked %s", dir, got)
+        }
+    }
+
+    dest := t.TempDir()
+    copyForTest(t, dest, writeManifestFile(t, src), copyOptions{})
+    if got := readFile(t, filepath.Join(dest, "data", "data", "b.txt")); got != "b" {
+        t.Errorf("copied b.txt = %q", got)
+    }
+    if _, e := os.Stat(filepath.Join(dest, "data", "x")); !os.IsNotExist(e) {
+        t.Errorf("files copied outside the source subtree: %v", e)
+    }
+}
+
+// blockTargetForTest makes rel in dest a directory holding a file, which no
+// link can be renamed over, and returns a check that it was left intact.
+func blockTargetForTest(t *testing.T, dest, rel string) func() {
+    t.Helper()
+    target := filepath.Join(dest, filepath.FromSlash(rel))
+    writeFiles(t, target, map[string]string{"keep.txt": "keep"})
+    return func() {
+        t.Helper()
+        if got := readFile(t, filepath.Join(target, "keep.txt")); got != "keep" {
+            t.Errorf("%s/keep.txt = %q after a failed link", rel, got)
+        }
+        entries, _ := os.ReadDir(filepath.Dir(target))
+        for _, entry := range entries {
+            if strings.Contains(entry.Name(), ".gopy-tmp") {
+                t.Errorf("temporary link %s left behind", entry.Name())
+            }
+        }
+    }
+}
+
+// copyFailingForTest copies manifest to dest and checks that one file failed.
+func copyFailingForTest(t *testing.T, dest, manifest string, opts copyOptions) {
+    t.Helper()
+    result, e := copyManifests(dest, []string{manifest}, opts)
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.failed != 1 {
+        t.Errorf("%d files failed, want the one whose link failed", result.failed)
+    }
+}
+
+func TestLinkFailureKeepsTarget(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{"target.txt": "keep", "new.txt": "new"})
+    d := &dirDestination{root: dir, backupExt: ".bak", fio: plainIO}
+    if e := d.link(filepath.Join(dir, "missing"), "target.txt", false); e == nil {
+        t.Fatal("link to a missing file succeeded")
+    }
+    if got := readFile(t, filepath.Join(dir, "target.txt")); got != "keep" {
+        t.Errorf("target.txt = %q after a failed link", got)
+    }
+    if _, e := os.Lstat(filepath.Join(dir, "target.txt.bak")); !os.IsNotExist(e) {
+        t.Errorf("target.txt backed up for a failed link: %v", e)
+    }
+    // A symbolic link can be made to anything, but not renamed over a
+    // directory.
+    check := blockTargetForTest(t, dir, "dir")
+    if e := d.link("new.txt", "dir", true); e == nil {
+        t.Error("symbolic link renamed over a directory")
+    }
+    check()
+    if e := d.link(filepath.Join(dir, "new.txt"), "target.txt", false); e != nil {
+        t.Fatal(e)
+    }
+    got, backup := readFile(t, filepath.Join(dir, "target.txt")), readFile(t, filepath.Join(dir, "target.txt.bak"))
+    if got != "new" || backup != "keep" {
+        t.Errorf("linked target.txt = %q with backup %q", got, backup)
+    }
+}
+
+func TestDedupLinkFailureKeepsTarget(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "same", "b.txt": "same"})
+    dest := t.TempDir()
+    check := blockTargetForTest(t, dest, "src/b.txt")
+    copyFailingForTest(t, dest, writeManifestFile(t, src), copyOptions{dedup: "link"})
+    check()
+}
+
+func TestHardLinkFailureKeepsTarget(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a"})
+    if e := os.Link(filepath.Join(src, "a.txt"), filepath.Join(src, "b.txt")); e != nil {
+        t.Skip(e)
+    }
+    dest := t.TempDir()
+    check := blockTargetForTest(t, dest, "src/b.txt")
+    copyFailingForTest(t, dest, writeManifestFile(t, src), copyOptions{hardLinks: true})
+    check()
+}
+
+func TestLinkDestFailureKeepsTarget(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+    manifest := writeManifestFile(t, src)
+    previous := t.TempDir()
+    copyForTest(t, previous, manifest, copyOptions{sync: true})
+    dest := t.TempDir()
+    check := blockTargetForTest(t, dest, "src/a.txt")
+    // Neither the link nor the copy it falls back to replace a directory.
+    copyFailingForTest(t, dest, manifest, copyOptions{linkDest: previous})
+    check()
+    linked, _ := os.Stat(filepath.Join(dest, "src", "b.txt"))
+    if old, e := os.Stat(filepath.Join(previous, "src", "b.txt")); e != nil || !os.SameFile(old, linked) {
+        t.Error("b.txt not linked to its previous copy")
+    }
+}
+
+func TestSymlinkFailureKeepsTarget(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a"})
+    if e := os.Symlink("a.txt", filepath.Join(src, "l")); e != nil {
+        t.Skip(e)
+    }
+    w := newWalker(nil)
+    w.links = "recreate"
+    dest := t.TempDir()
+    check := blockTargetForTest(t, dest, "src/l")
+    copyFailingForTest(t, dest, writeManifestFile(t, src), copyOptions{walker: w})
+    check()
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "a" {
+        t.Errorf("a.txt = %q", got)
+    }
+}
+
+func TestCompressDecompress(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    files := map[string]string{"a.txt": strings.Repeat("gopy ", 1000), "sub/b.txt": "b", "empty.txt": ""}
+    writeFiles(t, src, files)
+    manifest := writeManifestFile(t, src)
+    for format, suffix := range compressionSuffixes {
+        compressed := t.TempDir()
+        copyForTest(t, compressed, manifest, copyOptions{compress: format})
+        if info, e := os.Stat(filepath.Join(compressed, "src", "a.txt"+suffix)); e != nil || info.Size() > 500 {
+            t.Fatalf("%s: a.txt%s: %v", format, suffix, e)
+        }
+        plain := t.TempDir()
+        copyForTest(t, plain, writeManifestFile(t, filepath.Join(compressed, "src")), copyOptions{decompress: true})
+        for name, content := range files {
+            if got := readFile(t, filepath.Join(plain, "src", name)); got != content {
+                t.Errorf("%s: %s = %q", format, name, got)
+            }
+        }
+    }
+}
+
+// The fail policy ends the copy with an error rather than the process.
+func TestCaseCollisionFail(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"A.txt": "a", "a.txt": "b"})
+    if entries, _ := os.ReadDir(src); len(entries) != 2 {
+        t.Skip("the file system is case-insensitive")
+    }
+    dest := t.TempDir()
+    _, e := copyManifests(dest, []string{writeManifestFile(t, src)}, copyOptions{collision: "fail"})
+    if e == nil || !strings.Contains(e.Error(), "differ only by case") {
+        t.Errorf("copyManifests() = %v, want a case collision", e)
+    }
+    if entries, _ := os.ReadDir(filepath.Join(dest, "src")); len(entries) != 0 {
+        t.Errorf("%d files copied despite the collision", len(entries))
+    }
+}
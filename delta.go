@@ -0,0 +1,225 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "crypto/md5"
+    "io"
+    "os"
+)
+
+const deltaBlockSize = 64 << 10
+
+// rollingSum is the weak checksum of rsync, which can be moved along a file
+// one byte at a time.
+type rollingSum struct {
+    a, b uint32
+    n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+    r := rollingSum{n: uint32(len(block))}
+    for i, c := range block {
+        r.a += uint32(c)
+        r.b += uint32(len(block)-i) * uint32(c)
+    }
+    return r
+}
+
+func (r *rollingSum) roll(out, in byte) {
+    r.a += uint32(in) - uint32(out)
+    r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingSum) sum() uint32 {
+    return r.a&0xffff | r.b<<16
+}
+
+type blockSignature struct {
+    index  int
+    strong [md5.Size]byte
+}
+
+// fileSignature returns the weak and strong checksums of the full blocks of
+// a file.
+func fileSignature(f *os.File) (map[uint32][]blockSignature, error) {
+    signature := map[uint32][]blockSignature{}
+    buf := make([]byte, deltaBlockSize)
+    for index := 0; ; index++ {
+        if _, e := io.ReadFull(f, buf); e == io.EOF || e == io.ErrUnexpectedEOF {
+            return signature, nil
+        } else if e != nil {
+            return nil, e
+        }
+        weak := newRollingSum(buf).sum()
+        signature[weak] = append(signature[weak], blockSignature{index, md5.Sum(buf)})
+    }
+}
+
+// deltaOp is a part of the new content of a file: length bytes of the source
+// at offset, or a block of the old content when block is not negative.
+type deltaOp struct {
+    block  int
+    offset int64
+    length int64
+}
+
+// fileDelta finds the blocks of the old content, described by signature, in
+// src, and returns the operations that rebuild src from them.
+func fileDelta(src *os.File, signature map[uint32][]blockSignature) ([]deltaOp, error) {
+    ops := []deltaOp{}
+    literal := func(offset, end int64) {
+        if end <= offset {
+            return
+        }
+        if n := len(ops); n > 0 && ops[n-1].block < 0 && ops[n-1].offset+ops[n-1].length == offset {
+            ops[n-1].length += end - offset
+            return
+        }
+        ops = append(ops, deltaOp{-1, offset, end - offset})
+    }
+    r := bufio.NewReaderSize(src, 1<<20)
+    window := make([]byte, deltaBlockSize)
+    var start, literalStart int64
+    for {
+        n, e := io.ReadFull(r, window)
+        if e == io.EOF || e == io.ErrUnexpectedEOF {
+            literal(literalStart, start+int64(n))
+            return ops, nil
+        } else if e != nil {
+            return nil, e
+        }
+        sum := newRollingSum(window)
+        head := 0
+        for {
+            if candidates, ok := signature[sum.sum()]; ok {
+                block := append(append([]byte{}, window[head:]...), window[:head]...)
+                strong := md5.Sum(block)
+                matched := -1
+                for _, c := range candidates {
+                    if c.strong == strong {
+                        matched = c.index
+                        break
+                    }
+                }
+                if matched >= 0 {
+                    literal(literalStart, start)
+                    ops = append(ops, deltaOp{matched, start, deltaBlockSize})
+                    start += deltaBlockSize
+                    literalStart = start
+                    break
+                }
+            }
+            c, e := r.ReadByte()
+            if e == io.EOF {
+                literal(literalStart, start+deltaBlockSize)
+                return ops, nil
+            } else if e != nil {
+                return nil, e
+            }
+            sum.roll(window[head], c)
+            window[head] = c
+            head = (head + 1) % deltaBlockSize
+            start++
+        }
+    }
+}
+
+// deltaCopyFile updates dest to the content of src through a new file built
+// from the old blocks and the changes or, with inPlace, by rewriting only
+// what changed when the unchanged blocks did not move. The new file is
+// written in full unless the file system shares the old blocks with it. It
+// returns the number of bytes written.
+func (fio *fileIO) deltaCopyFile(src, dest string, inPlace bool) (int64, error) {
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return 0, e
+    }
+    defer srcFile.Close()
+    destFile, e := os.OpenFile(dest, os.O_RDWR, 0)
+    if e != nil {
+        return 0, e
+    }
+    defer destFile.Close()
+    signature, e := fileSignature(destFile)
+    if e != nil {
+        return 0, e
+    }
+    ops, e := fileDelta(srcFile, signature)
+    if e != nil {
+        return 0, e
+    }
+    // A file with other hard links is not changed in place, which would
+    // change them too.
+    info, e := destFile.Stat()
+    if e != nil {
+        return 0, e
+    }
+    if _, linked := hardLinkID(info); linked {
+        inPlace = false
+    }
+    var size int64
+    for _, op := range ops {
+        if op.block >= 0 && int64(op.block)*deltaBlockSize != size {
+            inPlace = false
+        }
+        size += op.length
+    }
+    var written int64
+    if inPlace {
+        for _, op := range ops {
+            if op.block < 0 {
+                n, e := fio.copyBuffered(io.NewOffsetWriter(destFile, op.offset), io.NewSectionReader(srcFile, op.offset, op.length))
+                written += n
+                if e != nil {
+                    return written, e
+                }
+            }
+        }
+        return written, destFile.Truncate(size)
+    }
+    tmp, e := fio.createAtomic(dest)
+    if e != nil {
+        return 0, e
+    }
+    for _, op := range ops {
+        var n int64
+        if op.block >= 0 {
+            // os.File.ReadFrom copies an old block with copy_file_range on
+            // Linux, which file systems with reflinks, such as Btrfs and XFS,
+            // share with the old file instead of writing it again where the
+            // block stays aligned.
+            if _, e = destFile.Seek(int64(op.block)*deltaBlockSize, io.SeekStart); e == nil {
+                n, e = tmp.ReadFrom(io.LimitReader(destFile, deltaBlockSize))
+            }
+        } else {
+            n, e = fio.copyBuffered(tmp, io.NewSectionReader(srcFile, op.offset, op.length))
+        }
+        written += n
+        if e != nil {
+            tmp.abort()
+            return written, e
+        }
+    }
+    return written, tmp.commit()
+}
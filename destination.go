@@ -0,0 +1,560 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// fileIO holds how the files of one operation are read and written: the
+// -assert-readonly-source, -fsync, -sparse, -preallocate, -buffer-size and
+// -max-open-files settings of the command line, and the defaults for Copy.
+type fileIO struct {
+    readOnly    bool
+    sync        bool
+    sparse      bool
+    preallocate bool
+    // budget is nil when open files are not bounded.
+    budget *fileBudget
+    // buffers reuses the buffers of copyBuffered across files.
+    buffers *sync.Pool
+    logger  *slog.Logger
+}
+
+func newFileIO(bufferSize int, logger *slog.Logger) *fileIO {
+    return &fileIO{
+        buffers: &sync.Pool{New: func() interface{} {
+            buf := make([]byte, bufferSize)
+            return &buf
+        }},
+        logger: logger,
+    }
+}
+
+// plainIO reads files with the defaults and logs nothing, for the filters of
+// programs built with gopy.
+var plainIO = newFileIO(1<<20, discardLogger)
+
+type atomicFile struct {
+    *os.File
+    dest string
+    sync bool
+}
+
+// createAtomic creates a temporary file next to dest that replaces dest only
+// when it is committed, so dest is never seen half-written.
+func (fio *fileIO) createAtomic(dest string) (*atomicFile, error) {
+    f, e := fio.openRetrying(dest, func() (*os.File, error) {
+        return ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".gopy-tmp-")
+    })
+    if e != nil {
+        return nil, e
+    }
+    if e := f.Chmod(0644); e != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return nil, e
+    }
+    return &atomicFile{f, dest, fio.sync}, nil
+}
+
+func (f *atomicFile) commit() error {
+    if f.sync {
+        if e := f.Sync(); e != nil {
+            f.abort()
+            return e
+        }
+    }
+    if e := f.Close(); e != nil {
+        os.Remove(f.Name())
+        return e
+    }
+    if e := os.Rename(f.Name(), f.dest); e != nil {
+        os.Remove(f.Name())
+        return e
+    }
+    if f.sync {
+        if dir, e := os.Open(filepath.Dir(f.dest)); e == nil {
+            dir.Sync()
+            dir.Close()
+        }
+    }
+    return nil
+}
+
+func (f *atomicFile) abort() {
+    f.Close()
+    os.Remove(f.Name())
+}
+
+// tempLink makes a hard link to, or with symbolic a symbolic link to,
+// oldname under a temporary name next to dest, to be renamed over it, and
+// returns that name.
+func tempLink(oldname, dest string, symbolic bool) (string, error) {
+    f, e := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".gopy-tmp-")
+    if e != nil {
+        return "", e
+    }
+    tmp := f.Name()
+    f.Close()
+    os.Remove(tmp)
+    if symbolic {
+        e = os.Symlink(oldname, tmp)
+    } else {
+        e = os.Link(oldname, tmp)
+    }
+    return tmp, e
+}
+
+func (fio *fileIO) copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+    buf := fio.buffers.Get().(*[]byte)
+    defer fio.buffers.Put(buf)
+    return io.CopyBuffer(dst, src, *buf)
+}
+
+func (fio *fileIO) copyFile(src, dest string) error {
+    fio.budget.acquire(2)
+    defer fio.budget.release(2)
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+
+    destFile, e := fio.createAtomic(dest)
+    if e != nil {
+        return e
+    }
+    if fio.sparse {
+        e = copySparse(destFile.File, srcFile)
+    } else if fio.preallocate {
+        e = fio.copyPreallocated(destFile.File, srcFile)
+    } else {
+        _, e = fio.copyBuffered(destFile, srcFile)
+    }
+    if e != nil {
+        destFile.abort()
+        return e
+    }
+    return destFile.commit()
+}
+
+// copySparse copies the data regions of src to dest and leaves holes in dest
+// wherever src has holes or blocks of zeros.
+func copySparse(dest, src *os.File) error {
+    fi, e := src.Stat()
+    if e != nil {
+        return e
+    }
+    regions, e := dataRegions(src, fi.Size())
+    if e != nil {
+        return e
+    }
+    buf := make([]byte, 64<<10)
+    zeros := make([]byte, len(buf))
+    for _, region := range regions {
+        for offset, end := region[0], region[0]+region[1]; offset < end; {
+            n, e := src.ReadAt(buf[:min(int64(len(buf)), end-offset)], offset)
+            if n > 0 && !bytes.Equal(buf[:n], zeros[:n]) {
+                if _, e := dest.WriteAt(buf[:n], offset); e != nil {
+                    return e
+                }
+            }
+            offset += int64(n)
+            if e == io.EOF {
+                break
+            } else if e != nil {
+                return e
+            }
+        }
+    }
+    return dest.Truncate(fi.Size())
+}
+
+// copyPreallocated reserves the size of src in dest before copying it, so
+// that a full destination fails the copy before anything is written.
+func (fio *fileIO) copyPreallocated(dest, src *os.File) error {
+    fi, e := src.Stat()
+    if e != nil {
+        return e
+    }
+    if fi.Size() > 0 {
+        if e := preallocate(dest, fi.Size()); e != nil {
+            return e
+        }
+    }
+    n, e := fio.copyBuffered(dest, src)
+    if e != nil {
+        return e
+    }
+    if n < fi.Size() {
+        return dest.Truncate(n)
+    }
+    return nil
+}
+
+type copyDestination interface {
+    makeDir(rel string, info os.FileInfo) error
+    writeFile(src, rel string, info os.FileInfo) error
+    close() error
+}
+
+type dirDestination struct {
+    root          string
+    compress      string
+    decompress    bool
+    preserveTimes bool
+    delta         bool
+    inPlace       bool
+    encrypt       string
+    decrypt       bool
+    streams       bool
+    backupDir     string
+    backupExt     string
+    numbered      bool
+    undo          *journal
+    key           *fileKey
+    fio           *fileIO
+}
+
+func (d *dirDestination) makeDir(rel string, info os.FileInfo) error {
+    path := filepath.Join(d.root, rel)
+    if _, e := os.Lstat(path); d.undo != nil && os.IsNotExist(e) {
+        if e := d.undo.record("mkdir", "", rel); e != nil {
+            return e
+        }
+    }
+    return os.MkdirAll(path, 0755)
+}
+
+// backupPath returns where the file at dest is moved before being
+// overwritten, or "" when it is not kept.
+func (d *dirDestination) backupPath(dest string) string {
+    if d.backupDir == "" && d.backupExt == "" && !d.numbered {
+        return ""
+    }
+    if existing, e := os.Lstat(dest); e != nil || !existing.Mode().IsRegular() {
+        return ""
+    }
+    if d.numbered {
+        for n := 1; ; n++ {
+            backup := dest + ".v" + strconv.Itoa(n)
+            if _, e := os.Lstat(backup); os.IsNotExist(e) {
+                return backup
+            }
+        }
+    }
+    if d.backupDir != "" {
+        rel, _ := filepath.Rel(d.root, dest)
+        return filepath.Join(d.backupDir, rel) + d.backupExt
+    }
+    return dest + d.backupExt
+}
+
+// backUp moves the file about to be overwritten at dest into the backup
+// directory or next to it with the backup suffix, replacing an older backup,
+// or, numbered, next to it as the next of its versions. With keep, dest is
+// copied instead, for a delta to be built from it or for it to stay until a
+// link is renamed over it.
+func (d *dirDestination) backUp(dest string, keep bool) error {
+    backup := d.backupPath(dest)
+    if backup == "" {
+        return nil
+    }
+    os.MkdirAll(filepath.Dir(backup), 0755)
+    makeWritable(backup)
+    if keep {
+        if e := d.fio.copyFile(dest, backup); e != nil {
+            return e
+        }
+    } else if e := os.Rename(dest, backup); e != nil {
+        // The backup directory may be on another file system.
+        if e := d.fio.copyFile(dest, backup); e != nil {
+            return e
+        }
+        os.Remove(dest)
+    }
+    d.fio.logger.Info("file_backed_up", "path", dest, "backup", backup)
+    return nil
+}
+
+func (d *dirDestination) writeFile(src, rel string, info os.FileInfo) error {
+    dest := filepath.Join(d.root, rel)
+    target, format, encrypted := dest, "", ""
+    if d.decompress {
+        format = compressionFormat(dest)
+    }
+    if d.decrypt {
+        encrypted = encryptionFormat(dest)
+    }
+    switch {
+    case d.compress != "":
+        target = dest + compressionSuffixes[d.compress]
+    case format != "":
+        target = strings.TrimSuffix(dest, compressionSuffixes[format])
+    case d.encrypt != "":
+        target = dest + encryptionSuffixes[d.encrypt]
+    case encrypted != "":
+        target = strings.TrimSuffix(dest, encryptionSuffixes[encrypted])
+    }
+    // Only plain copies are built from the blocks of the file they replace.
+    delta := false
+    if existing, e := os.Stat(dest); e == nil && d.delta && target == dest && existing.Mode().IsRegular() &&
+        existing.Size() >= 2*deltaBlockSize {
+        delta = true
+    }
+    if e := d.recordWrite(target); e != nil {
+        return e
+    }
+    if e := d.backUp(target, delta); e != nil {
+        return e
+    }
+    if d.compress != "" {
+        return d.fio.compressFile(src, dest+compressionSuffixes[d.compress], d.compress)
+    }
+    if format != "" {
+        return d.fio.decompressFile(src, target, format)
+    }
+    if d.encrypt != "" {
+        return d.fio.encryptFile(src, target, d.encrypt, d.key)
+    }
+    if encrypted != "" {
+        return d.fio.decryptFile(src, target, encrypted, d.key)
+    }
+    makeWritable(dest)
+    if delta {
+        written, e := d.fio.deltaCopyFile(src, dest, d.inPlace)
+        if e != nil {
+            return e
+        }
+        d.fio.logger.Debug("file_delta", "path", rel, "written", written, "size", info.Size())
+    } else if e := d.fio.copyFile(src, dest); e != nil {
+        return e
+    }
+    if d.preserveTimes {
+        if e := os.Chtimes(dest, info.ModTime(), info.ModTime()); e != nil {
+            return e
+        }
+    }
+    return copyAttributes(src, dest, info, d.streams)
+}
+
+// recordWrite records in the undo journal that target is about to be
+// created or overwritten, with the backup it is overwritten with.
+func (d *dirDestination) recordWrite(target string) error {
+    if d.undo == nil {
+        return nil
+    }
+    op, backup := "create", ""
+    if _, e := os.Lstat(target); e == nil {
+        op, backup = "overwrite", d.backupPath(target)
+        if backup != "" {
+            backup, _ = filepath.Abs(backup)
+        }
+    }
+    rel, _ := filepath.Rel(d.root, target)
+    return d.undo.record(op, backup, rel)
+}
+
+// link makes rel a hard link to, or with symbolic a symbolic link to,
+// oldname, journaled and backed up like a copied file.
+func (d *dirDestination) link(oldname, rel string, symbolic bool) error {
+    target := filepath.Join(d.root, rel)
+    // The target is only replaced by the rename, so that it is left as it
+    // was when any step fails.
+    tmp, e := tempLink(oldname, target, symbolic)
+    // Renaming a hard link over another link to the same file does nothing.
+    defer os.Remove(tmp)
+    if e != nil {
+        return e
+    }
+    if e := d.recordWrite(target); e != nil {
+        return e
+    }
+    if e := d.backUp(target, true); e != nil {
+        return e
+    }
+    return os.Rename(tmp, target)
+}
+
+func (d *dirDestination) close() error {
+    return nil
+}
+
+// dryRunDestination writes what would be copied to w.
+type dryRunDestination struct {
+    w io.Writer
+}
+
+func (d *dryRunDestination) makeDir(rel string, info os.FileInfo) error {
+    return nil
+}
+
+func (d *dryRunDestination) writeFile(src, rel string, info os.FileInfo) error {
+    fmt.Fprintln(d.w, "Would copy:", src)
+    return nil
+}
+
+func (d *dryRunDestination) close() error {
+    return nil
+}
+
+type stagedDestination struct {
+    root    string
+    staging *dirDestination
+    final   *dirDestination
+    dirs    []string
+    files   []copyItem
+}
+
+// newStagedDestination stages plain copies, with the times and attributes
+// given by opts, to be moved into root once verified. The files they replace
+// are backed up and the moves recorded in the undo journal as opts say.
+func newStagedDestination(root string, opts copyOptions) (*stagedDestination, error) {
+    staging := filepath.Join(root, fmt.Sprintf(".gopy-staging-%d", os.Getpid()))
+    if e := os.MkdirAll(staging, 0755); e != nil {
+        return nil, e
+    }
+    return &stagedDestination{root: root,
+        staging: &dirDestination{root: staging, preserveTimes: opts.sync, streams: opts.streams, fio: opts.fio},
+        final: &dirDestination{root: root, backupDir: opts.backup, backupExt: opts.backupExt, numbered: opts.numbered,
+            undo: opts.undo, fio: opts.fio}}, nil
+}
+
+func (d *stagedDestination) makeDir(rel string, info os.FileInfo) error {
+    d.dirs = append(d.dirs, rel)
+    return d.staging.makeDir(rel, info)
+}
+
+func (d *stagedDestination) writeFile(src, rel string, info os.FileInfo) error {
+    if e := d.staging.writeFile(src, rel, info); e != nil {
+        return e
+    }
+    d.files = append(d.files, copyItem{src, rel, info})
+    return nil
+}
+
+func (d *stagedDestination) verify() error {
+    for _, item := range d.files {
+        srcHash, e := d.staging.fio.hashFile(item.path)
+        if e != nil {
+            return e
+        }
+        stagedHash, e := d.staging.fio.hashFile(filepath.Join(d.staging.root, item.rel))
+        if e != nil {
+            return e
+        }
+        if srcHash != stagedHash {
+            return fmt.Errorf("staged copy of %s does not match the source", item.path)
+        }
+    }
+    return nil
+}
+
+func (d *stagedDestination) close() error {
+    defer os.RemoveAll(d.staging.root)
+    if e := d.verify(); e != nil {
+        return e
+    }
+    for _, rel := range d.dirs {
+        if e := d.final.makeDir(rel, nil); e != nil {
+            return e
+        }
+    }
+    for _, item := range d.files {
+        target := filepath.Join(d.root, item.rel)
+        if e := d.final.recordWrite(target); e != nil {
+            return e
+        }
+        if e := d.final.backUp(target, false); e != nil {
+            return e
+        }
+        if e := os.Rename(filepath.Join(d.staging.root, item.rel), target); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func newDestination(path string, opts copyOptions) (copyDestination, error) {
+    if opts.dryRun {
+        return &dryRunDestination{opts.stdout}, nil
+    }
+    if opts.journal != "" {
+        j, e := openJournal(opts.journal)
+        if e != nil {
+            return nil, e
+        }
+        opts.journal = ""
+        dest, e := newDestination(path, opts)
+        if e != nil {
+            j.close()
+            return nil, e
+        }
+        return &journalDestination{dest, j}, nil
+    }
+    if isCloud(path) {
+        st, e := openStorage(path)
+        if e != nil {
+            return nil, e
+        }
+        return &storageDestination{st, opts.fio}, nil
+    }
+    if isRemote(path) {
+        host, root := splitRemote(path)
+        c, e := dialSFTP(host)
+        if e != nil {
+            return nil, e
+        }
+        return &sftpDestination{c: c, root: root, fio: opts.fio, dirs: map[string]bool{}}, nil
+    }
+    switch opts.archive {
+    case "":
+        if e := os.MkdirAll(path, 0755); e != nil {
+            return nil, e
+        }
+        if opts.twoPhase {
+            return newStagedDestination(path, opts)
+        }
+        // Files linked from -link-dest are only found unchanged with the times
+        // of their sources.
+        return &dirDestination{path, opts.compress, opts.decompress, opts.sync || opts.linkDest != "", opts.delta,
+            opts.inPlace, opts.encrypt, opts.decrypt, opts.streams, opts.backup, opts.backupExt, opts.numbered, opts.undo,
+            opts.key, opts.fio}, nil
+    case "zip":
+        return newZipDestination(path, opts.fio)
+    case "tar":
+        return newTarDestination(path, false, opts.fio)
+    case "tar.gz":
+        return newTarDestination(path, true, opts.fio)
+    }
+    return nil, fmt.Errorf("unsupported archive format: %s", opts.archive)
+}
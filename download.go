@@ -0,0 +1,156 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+func isURL(path string) bool {
+    return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// downloadName returns the name a URL is downloaded to, the last element of
+// its path.
+func downloadName(rawURL string) string {
+    u, e := url.Parse(rawURL)
+    if e != nil || path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+        return "index.html"
+    }
+    return path.Base(u.Path)
+}
+
+// download fetches entry.Path to dest through a partial file, which a later
+// attempt resumes with a Range request, and checks its SHA-256 when the
+// manifest has one. It reports whether a failure is worth retrying.
+func download(client *http.Client, entry jsonEntry, dest string, fio *fileIO) (bool, error) {
+    part := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".gopy-part")
+    var offset int64
+    if info, e := os.Stat(part); e == nil {
+        offset = info.Size()
+    }
+    req, e := http.NewRequest(http.MethodGet, entry.Path, nil)
+    if e != nil {
+        return false, e
+    }
+    if offset > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+    resp, e := client.Do(req)
+    if e != nil {
+        return true, e
+    }
+    defer resp.Body.Close()
+    flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+    switch {
+    case resp.StatusCode == http.StatusPartialContent:
+    case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+        // The partial file is already complete.
+        resp.Body.Close()
+        flags = 0
+    case resp.StatusCode == http.StatusOK:
+        flags |= os.O_TRUNC
+    default:
+        return resp.StatusCode >= 500, fmt.Errorf("%s: %s", entry.Path, resp.Status)
+    }
+    if flags != 0 {
+        f, e := fio.openRetrying(part, func() (*os.File, error) { return os.OpenFile(part, flags, 0644) })
+        if e != nil {
+            return false, e
+        }
+        _, e = fio.copyBuffered(f, resp.Body)
+        if ce := f.Close(); e == nil {
+            e = ce
+        }
+        if e != nil {
+            return true, fmt.Errorf("%s: %v", entry.Path, e)
+        }
+    }
+    if entry.SHA256 != "" {
+        sum, e := fio.hashFile(part)
+        if e != nil {
+            return false, e
+        }
+        if sum != entry.SHA256 {
+            os.Remove(part)
+            return false, fmt.Errorf("%s: checksum mismatch, got %s", entry.Path, sum)
+        }
+    }
+    return false, os.Rename(part, dest)
+}
+
+// downloadAll downloads the URL entries into directoryPath, opts.downloads at
+// a time, retrying failures as -retries asks.
+func downloadAll(entries []jsonEntry, directoryPath string, opts copyOptions, result *copyResult) {
+    client := &http.Client{}
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    slots := make(chan struct{}, opts.downloads)
+    for _, entry := range entries {
+        wg.Add(1)
+        slots <- struct{}{}
+        go func(entry jsonEntry) {
+            defer wg.Done()
+            defer func() { <-slots }()
+            name := downloadName(entry.Path)
+            dest := filepath.Join(directoryPath, name)
+            delay := opts.retryDelay
+            var e error
+            for attempt := 0; ; attempt++ {
+                var retry bool
+                if retry, e = download(client, entry, dest, opts.fio); e == nil || !retry || attempt >= opts.retries {
+                    break
+                }
+                opts.logger.Warn("retrying", "path", name, "error", e.Error(), "delay", delay)
+                time.Sleep(delay)
+                delay *= 2
+            }
+            mu.Lock()
+            defer mu.Unlock()
+            result.scanned++
+            var info os.FileInfo
+            if e == nil {
+                info, e = os.Stat(dest)
+            }
+            if e != nil {
+                opts.printError(e)
+                result.failed++
+                opts.progress.report(Event{Kind: Error, Path: name, Err: e})
+                return
+            }
+            result.totalBytes += info.Size()
+            result.files++
+            result.bytes += info.Size()
+            opts.progress.report(Event{Kind: FileCopied, Path: name, Size: info.Size(), Files: result.files,
+                Bytes: result.bytes})
+        }(entry)
+    }
+    wg.Wait()
+}
@@ -0,0 +1,120 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+)
+
+// directorySizes returns the size of dir and of every directory below it up
+// to depth levels, computed in a single walk.
+func directorySizes(w *walker, dir string, depth int) (map[string]int64, error) {
+    sizes := map[string]int64{}
+    links := map[fileID]bool{}
+    if w.sizes != nil {
+        e := w.sizes.tree(dir, w, links, func(path string, info os.FileInfo, files int64) {
+            rel, _ := filepath.Rel(dir, path)
+            parts := strings.Split(rel, string(filepath.Separator))
+            if rel == "." {
+                parts = nil
+            }
+            if len(parts) <= depth {
+                sizes[path] = 0
+            }
+            ancestor := dir
+            sizes[ancestor] += files
+            for i := 0; i < len(parts) && i < depth; i++ {
+                ancestor = filepath.Join(ancestor, parts[i])
+                sizes[ancestor] += files
+            }
+        })
+        return sizes, e
+    }
+    var device uint64
+    e := filepath.Walk(dir,
+        func(path string, info os.FileInfo, err error) error {
+            if err != nil {
+                if !w.unreadable.add(path, err) {
+                    return err
+                }
+                if info == nil {
+                    return nil
+                }
+            }
+            if w.crossesFileSystem(path, info, dir, &device) {
+                return filepath.SkipDir
+            }
+            rel, _ := filepath.Rel(dir, path)
+            parts := strings.Split(rel, string(filepath.Separator))
+            if rel == "." {
+                parts = nil
+            }
+            if info.IsDir() {
+                if len(parts) <= depth {
+                    sizes[path] = 0
+                }
+                return nil
+            }
+            if id, ok := hardLinkID(info); ok {
+                if links[id] {
+                    return nil
+                }
+                links[id] = true
+            }
+            ancestor := dir
+            sizes[ancestor] += info.Size()
+            for i := 0; i < len(parts)-1 && i < depth; i++ {
+                ancestor = filepath.Join(ancestor, parts[i])
+                sizes[ancestor] += info.Size()
+            }
+            return nil
+        })
+    return sizes, e
+}
+
+// runDiskUsage prints the size of every directory of directories and below them
+// up to depth levels, with its share of the total.
+func runDiskUsage(directories []string, depth int) {
+    for _, dir := range directories {
+        dir = filepath.Clean(dir)
+        sizes, e := directorySizes(cliWalker, dir, depth)
+        if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        paths := []string{}
+        for path := range sizes {
+            paths = append(paths, path)
+        }
+        sort.Strings(paths)
+        for _, path := range paths {
+            percent := 100.0
+            if sizes[dir] > 0 {
+                percent = float64(sizes[path]) * 100 / float64(sizes[dir])
+            }
+            fmt.Printf("%10s %6.1f%%  %s\n", formatSize(sizes[path]), percent, path)
+        }
+    }
+}
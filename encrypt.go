@@ -0,0 +1,293 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "strings"
+    "sync"
+
+    "filippo.io/age"
+    "golang.org/x/crypto/pbkdf2"
+)
+
+const (
+    encryptionMagic     = "GOPYENC1"
+    encryptionChunkSize = 64 << 10
+)
+
+// encryptionSuffixes are the -encrypt formats with the suffix of their files.
+var encryptionSuffixes = map[string]string{"aes-gcm": ".enc", "age": ".age"}
+
+// encryptionFormat returns the format of a file named with one of
+// encryptionSuffixes, or "".
+func encryptionFormat(name string) string {
+    for format, suffix := range encryptionSuffixes {
+        if strings.HasSuffix(name, suffix) {
+            return format
+        }
+    }
+    return ""
+}
+
+// fileKey is the key of encrypted files: an AES-256 key or age X25519 keys
+// read from a key file, or a passphrase from which the key of each salt is
+// derived.
+type fileKey struct {
+    key        []byte
+    recipients []age.Recipient
+    identities []age.Identity
+    passphrase string
+    salt       []byte
+    mu         sync.Mutex
+    derived    map[string][]byte
+}
+
+func readKeyFile(keyFile string) (*fileKey, error) {
+    data, e := ioutil.ReadFile(keyFile)
+    if e != nil {
+        return nil, e
+    }
+    text := strings.TrimSpace(string(data))
+    if len(text) == 64 {
+        if key, e := hex.DecodeString(text); e == nil {
+            return &fileKey{key: key}, nil
+        }
+    }
+    if len(data) == 32 {
+        return &fileKey{key: data}, nil
+    }
+    if strings.Contains(text, "AGE-SECRET-KEY-1") || strings.Contains(text, "age1") {
+        return parseAgeKeys(keyFile, text)
+    }
+    return nil, fmt.Errorf("%s must contain a 32 byte key, raw or as 64 hex digits, or age keys", keyFile)
+}
+
+// derive returns the key named name, derived from the passphrase once.
+func (k *fileKey) derive(name string, derive func() []byte) []byte {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    if k.derived == nil {
+        k.derived = map[string][]byte{}
+    }
+    key, ok := k.derived[name]
+    if !ok {
+        key = derive()
+        k.derived[name] = key
+    }
+    return key
+}
+
+// forSalt returns the AES key of a file with salt, or nil without a key.
+func (k *fileKey) forSalt(salt []byte) []byte {
+    if k.passphrase == "" {
+        return k.key
+    }
+    return k.derive("pbkdf2:"+string(salt), func() []byte {
+        return pbkdf2.Key([]byte(k.passphrase), salt, 600000, 32, sha256.New)
+    })
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, e := aes.NewCipher(key)
+    if e != nil {
+        return nil, e
+    }
+    return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+    return binary.BigEndian.AppendUint32(append([]byte{}, prefix...), counter)
+}
+
+// encryptFile writes src to dest encrypted in format, aes-gcm or age.
+func (fio *fileIO) encryptFile(src, dest, format string, k *fileKey) error {
+    if _, ok := encryptionSuffixes[format]; !ok {
+        return fmt.Errorf("unsupported encryption: %s", format)
+    }
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+    destFile, e := fio.createAtomic(dest)
+    if e != nil {
+        return e
+    }
+    w := bufio.NewWriter(destFile)
+    r := bufio.NewReaderSize(srcFile, encryptionChunkSize+1)
+    if format == "age" {
+        e = ageEncrypt(w, r, k)
+    } else {
+        e = gcmEncrypt(w, r, k)
+    }
+    if e == nil {
+        e = w.Flush()
+    }
+    if e != nil {
+        destFile.abort()
+        return e
+    }
+    return destFile.commit()
+}
+
+// gcmEncrypt writes r to w encrypted with AES-256-GCM in chunks, each sealed
+// with its number and whether it is the last one, so that chunks cannot be
+// reordered or dropped.
+func gcmEncrypt(w io.Writer, r *bufio.Reader, k *fileKey) error {
+    salt, prefix := k.salt, make([]byte, 8)
+    if salt == nil {
+        salt = make([]byte, 16)
+    }
+    if _, e := rand.Read(prefix); e != nil {
+        return e
+    }
+    key := k.forSalt(salt)
+    if key == nil {
+        return errors.New("no aes-gcm key")
+    }
+    gcm, e := newGCM(key)
+    if e != nil {
+        return e
+    }
+    if _, e := w.Write(append(append([]byte(encryptionMagic), salt...), prefix...)); e != nil {
+        return e
+    }
+    return sealChunks(w, r, func(chunk []byte, counter uint64, last bool) []byte {
+        return gcm.Seal(nil, chunkNonce(prefix, uint32(counter)), chunk, gcmLastChunk(last))
+    })
+}
+
+func gcmLastChunk(last bool) []byte {
+    if last {
+        return []byte{1}
+    }
+    return []byte{0}
+}
+
+// sealChunks writes r to w in chunks of encryptionChunkSize sealed by seal,
+// which knows whether a chunk is the last one: a last chunk is only empty in
+// an empty file.
+func sealChunks(w io.Writer, r *bufio.Reader, seal func(chunk []byte, counter uint64, last bool) []byte) error {
+    buf := make([]byte, encryptionChunkSize)
+    for counter := uint64(0); ; counter++ {
+        n, e := io.ReadFull(r, buf)
+        if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+            return e
+        }
+        _, e = r.Peek(1)
+        if e != nil && e != io.EOF {
+            return e
+        }
+        last := e == io.EOF
+        if _, e := w.Write(seal(buf[:n], counter, last)); e != nil {
+            return e
+        }
+        if last {
+            return nil
+        }
+    }
+}
+
+// openChunks writes the chunks of r opened by open to w.
+func openChunks(w io.Writer, r *bufio.Reader, open func(chunk []byte, counter uint64, last bool) ([]byte, error)) error {
+    buf := make([]byte, encryptionChunkSize+gcmTagSize)
+    for counter := uint64(0); ; counter++ {
+        n, e := io.ReadFull(r, buf)
+        if e != nil && e != io.ErrUnexpectedEOF {
+            return errors.New("truncated")
+        }
+        _, e = r.Peek(1)
+        if e != nil && e != io.EOF {
+            return e
+        }
+        last := e == io.EOF
+        plain, e := open(buf[:n], counter, last)
+        if e != nil {
+            return errors.New("wrong key or corrupted")
+        }
+        if _, e := w.Write(plain); e != nil {
+            return e
+        }
+        if last {
+            return nil
+        }
+    }
+}
+
+// decryptFile writes src, encrypted in format, decrypted to dest.
+func (fio *fileIO) decryptFile(src, dest, format string, k *fileKey) error {
+    if _, ok := encryptionSuffixes[format]; !ok {
+        return fmt.Errorf("unsupported encryption: %s", format)
+    }
+    srcFile, e := fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer srcFile.Close()
+    destFile, e := fio.createAtomic(dest)
+    if e != nil {
+        return e
+    }
+    r := bufio.NewReaderSize(srcFile, encryptionChunkSize+gcmTagSize+1)
+    if format == "age" {
+        e = ageDecrypt(destFile, r, k)
+    } else {
+        e = gcmDecrypt(destFile, r, k)
+    }
+    if e != nil {
+        destFile.abort()
+        return fmt.Errorf("%s: %v", src, e)
+    }
+    return destFile.commit()
+}
+
+func gcmDecrypt(w io.Writer, r *bufio.Reader, k *fileKey) error {
+    header := make([]byte, len(encryptionMagic)+16+8)
+    if _, e := io.ReadFull(r, header); e != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+        return errors.New("not encrypted by gopy")
+    }
+    salt, prefix := header[len(encryptionMagic):len(encryptionMagic)+16], header[len(encryptionMagic)+16:]
+    key := k.forSalt(salt)
+    if key == nil {
+        return errors.New("no aes-gcm key")
+    }
+    gcm, e := newGCM(key)
+    if e != nil {
+        return e
+    }
+    return openChunks(w, r, func(chunk []byte, counter uint64, last bool) ([]byte, error) {
+        return gcm.Open(nil, chunkNonce(prefix, uint32(counter)), chunk, gcmLastChunk(last))
+    })
+}
+
+const gcmTagSize = 16
@@ -0,0 +1,287 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "context"
+    "sync"
+)
+
+// EventKind tells what an Event reports.
+type EventKind string
+
+const (
+    ScanStarted EventKind = "scan_started"
+    EntryFound  EventKind = "entry_found"
+    FileStarted EventKind = "file_started"
+    FileCopied  EventKind = "file_copied"
+    Error       EventKind = "error"
+    Done        EventKind = "done"
+)
+
+// Event reports the progress of List or Copy. Files and Bytes count the
+// files found while scanning and those copied while copying, out of
+// TotalFiles and TotalBytes once Copy knows them. Size is the size of the
+// file of a FileCopied event, and Err is set on Done when some files were
+// not copied.
+type Event struct {
+    Kind       EventKind
+    Path       string
+    Size       int64
+    Files      int
+    Bytes      int64
+    TotalFiles int
+    TotalBytes int64
+    Err        error
+}
+
+// ProgressFunc receives the events of List or Copy, e.g. to draw a progress
+// bar, in the goroutine that called them.
+type ProgressFunc func(Event)
+
+func (f ProgressFunc) report(event Event) {
+    if f != nil {
+        f(event)
+    }
+}
+
+// with returns a ProgressFunc that also publishes the events to bus.
+func (f ProgressFunc) with(bus *EventBus) ProgressFunc {
+    if bus == nil {
+        return f
+    }
+    return func(event Event) {
+        f.report(event)
+        bus.Publish(event)
+    }
+}
+
+// Subscriber is a consumer of the events of an EventBus.
+type Subscriber interface {
+    HandleEvent(Event)
+}
+
+// EventBus hands the events of List and Copy to several consumers, a logger,
+// a progress bar or a webhook, at the same time. Every consumer reads its
+// own queue, which grows as needed, so that a slow consumer never holds up
+// the run or the other consumers.
+type EventBus struct {
+    mu     sync.Mutex
+    queues []*eventQueue
+    wg     sync.WaitGroup
+}
+
+func NewEventBus() *EventBus {
+    return &EventBus{}
+}
+
+type eventQueue struct {
+    mu      sync.Mutex
+    cond    *sync.Cond
+    pending []Event
+    closed  bool
+}
+
+func newEventQueue() *eventQueue {
+    q := &eventQueue{}
+    q.cond = sync.NewCond(&q.mu)
+    return q
+}
+
+func (q *eventQueue) push(event Event) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if !q.closed {
+        q.pending = append(q.pending, event)
+        q.cond.Signal()
+    }
+}
+
+// pop waits for the next event, and returns false once the queue is closed
+// and empty.
+func (q *eventQueue) pop() (Event, bool) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for len(q.pending) == 0 && !q.closed {
+        q.cond.Wait()
+    }
+    if len(q.pending) == 0 {
+        return Event{}, false
+    }
+    event := q.pending[0]
+    q.pending = q.pending[1:]
+    return event, true
+}
+
+func (q *eventQueue) close() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.closed = true
+    q.cond.Signal()
+}
+
+func (b *EventBus) add() *eventQueue {
+    q := newEventQueue()
+    b.mu.Lock()
+    b.queues = append(b.queues, q)
+    b.mu.Unlock()
+    return q
+}
+
+// remove takes q off the bus and closes it.
+func (b *EventBus) remove(q *eventQueue) {
+    b.mu.Lock()
+    for i, other := range b.queues {
+        if other == q {
+            // Publish may still range over the old slice.
+            b.queues = append(b.queues[:i:i], b.queues[i+1:]...)
+            break
+        }
+    }
+    b.mu.Unlock()
+    q.close()
+}
+
+// Channel returns a channel receiving the events published from now on,
+// closed after the last of them once the bus is closed. Close does not wait
+// for the channel to be read: a reader that stops early cancels ctx, which
+// takes the channel off the bus and closes it without the events left.
+func (b *EventBus) Channel(ctx context.Context, size int) <-chan Event {
+    q := b.add()
+    events := make(chan Event, size)
+    stop := context.AfterFunc(ctx, q.close)
+    go func() {
+        defer close(events)
+        defer b.remove(q)
+        defer stop()
+        for {
+            event, ok := q.pop()
+            if !ok || ctx.Err() != nil {
+                return
+            }
+            select {
+            case events <- event:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return events
+}
+
+// Subscribe calls s with the events published from now on, in a goroutine
+// of its own.
+func (b *EventBus) Subscribe(s Subscriber) {
+    q := b.add()
+    b.wg.Add(1)
+    go func() {
+        defer b.wg.Done()
+        for {
+            event, ok := q.pop()
+            if !ok {
+                return
+            }
+            s.HandleEvent(event)
+        }
+    }()
+}
+
+// Publish queues event for every consumer, without waiting for them.
+func (b *EventBus) Publish(event Event) {
+    b.mu.Lock()
+    queues := b.queues
+    b.mu.Unlock()
+    for _, q := range queues {
+        q.push(event)
+    }
+}
+
+// Close ends the queues of the bus and waits until the subscribers have
+// handled every event.
+func (b *EventBus) Close() {
+    b.mu.Lock()
+    queues := b.queues
+    b.queues = nil
+    b.mu.Unlock()
+    for _, q := range queues {
+        q.close()
+    }
+    b.wg.Wait()
+}
+
+// logSubscriber writes the log lines of the events of a command-line run.
+type logSubscriber struct{}
+
+func (logSubscriber) HandleEvent(event Event) {
+    if event.Kind == FileCopied {
+        logger.Info("file_copied", "path", event.Path, "size", event.Size)
+    }
+}
+
+// metricsSubscriber counts the events of a command-line run for
+// -metrics-addr. With -watch, the files found are changes.
+type metricsSubscriber struct {
+    watch bool
+}
+
+func (s metricsSubscriber) HandleEvent(event Event) {
+    switch event.Kind {
+    case EntryFound:
+        if s.watch {
+            counters.watchEvents.Add(1)
+        }
+    case FileCopied:
+        counters.filesCopied.Add(1)
+        counters.bytesCopied.Add(event.Size)
+    case Error:
+        counters.errors.Add(1)
+    }
+}
+
+// webhookSubscriber posts the outcome of a command-line run to
+// -notify-webhook when the run is done.
+type webhookSubscriber struct{}
+
+func (webhookSubscriber) HandleEvent(event Event) {
+    if event.Kind != Done {
+        return
+    }
+    exitCode := exitSuccess
+    if event.Err != nil {
+        exitCode = exitPartial
+    }
+    webhookPosted = true
+    if e := postWebhook(exitCode); e != nil {
+        printError(e)
+    }
+}
+
+// runEvents is the bus of the events of a command-line copy or sync, which
+// exit closes so that its consumers are done before the process ends.
+var runEvents *EventBus
+
+func closeRunEvents() {
+    if runEvents != nil {
+        runEvents.Close()
+        runEvents = nil
+    }
+}
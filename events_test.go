@@ -0,0 +1,147 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "context"
+    "runtime"
+    "testing"
+    "time"
+)
+
+type countSubscriber struct {
+    events []Event
+}
+
+func (s *countSubscriber) HandleEvent(event Event) {
+    s.events = append(s.events, event)
+}
+
+func TestEventBusDoesNotWaitForReaders(t *testing.T) {
+    bus := NewEventBus()
+    s := &countSubscriber{}
+    bus.Subscribe(s)
+    events := bus.Channel(context.Background(), 0)
+    done := make(chan struct{})
+    go func() {
+        for i := 0; i < 1000; i++ {
+            bus.Publish(Event{Kind: FileCopied, Files: i + 1})
+        }
+        bus.Close()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Publish or Close waited for an unread channel")
+    }
+    if len(s.events) != 1000 || s.events[999].Files != 1000 {
+        t.Errorf("subscriber handled %d events", len(s.events))
+    }
+    n := 0
+    for range events {
+        n++
+    }
+    if n != 1000 {
+        t.Errorf("channel received %d events, want 1000", n)
+    }
+}
+
+// blockedSubscriber handles no event until release is closed.
+type blockedSubscriber struct {
+    release chan struct{}
+    events  []Event
+}
+
+func (s *blockedSubscriber) HandleEvent(event Event) {
+    <-s.release
+    s.events = append(s.events, event)
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+    bus := NewEventBus()
+    slow := &blockedSubscriber{release: make(chan struct{})}
+    bus.Subscribe(slow)
+    events := bus.Channel(context.Background(), 0)
+    published := make(chan struct{})
+    go func() {
+        for i := 0; i < 100; i++ {
+            bus.Publish(Event{Kind: FileCopied, Files: i + 1})
+        }
+        close(published)
+    }()
+    select {
+    case <-published:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Publish waited for a slow subscriber")
+    }
+    // The channel is read while the subscriber is still stuck.
+    for i := 1; i <= 100; i++ {
+        if event := <-events; event.Files != i {
+            t.Fatalf("channel received event %d, want %d", event.Files, i)
+        }
+    }
+    close(slow.release)
+    bus.Close()
+    if len(slow.events) != 100 || slow.events[99].Files != 100 {
+        t.Errorf("slow subscriber handled %d events", len(slow.events))
+    }
+    if _, ok := <-events; ok {
+        t.Error("channel not closed with the bus")
+    }
+}
+
+func TestEventBusAbandonedChannel(t *testing.T) {
+    before := runtime.NumGoroutine()
+    bus := NewEventBus()
+    ctx, cancel := context.WithCancel(context.Background())
+    events := bus.Channel(ctx, 0)
+    for i := 0; i < 10; i++ {
+        bus.Publish(Event{Kind: FileCopied, Files: i + 1})
+    }
+    if event := <-events; event.Files != 1 {
+        t.Fatalf("channel received event %d, want 1", event.Files)
+    }
+    cancel()
+    deadline := time.After(5 * time.Second)
+    for open := true; open; {
+        select {
+        case _, open = <-events:
+        case <-deadline:
+            t.Fatal("channel not closed after its context was cancelled")
+        }
+    }
+    bus.mu.Lock()
+    queues := len(bus.queues)
+    bus.mu.Unlock()
+    if queues != 0 {
+        t.Errorf("%d queues left on the bus after the channel was cancelled", queues)
+    }
+    // The bus is never closed, and nothing is left to wait on it.
+    bus.Publish(Event{Kind: Done})
+    for i := 0; runtime.NumGoroutine() > before; i++ {
+        if i == 100 {
+            t.Fatalf("%d goroutines left, %d before", runtime.NumGoroutine(), before)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
@@ -0,0 +1,55 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build linux || darwin || freebsd || dragonfly
+
+package gopy
+
+import (
+    "os"
+    "syscall"
+)
+
+// hardLinkID identifies the inode of a file with more than one hard link.
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok || info.IsDir() || st.Nlink < 2 {
+        return fileID{}, false
+    }
+    return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// dirID identifies a directory, whatever the path it is reached by.
+func dirID(info os.FileInfo) (fileID, bool) {
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return fileID{}, false
+    }
+    return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+func deviceID(info os.FileInfo) (uint64, bool) {
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return 0, false
+    }
+    return uint64(st.Dev), true
+}
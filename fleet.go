@@ -0,0 +1,139 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+type fleetResult struct {
+    Root     string  `json:"root"`
+    ExitCode int     `json:"exit_code"`
+    Elapsed  float64 `json:"elapsed_seconds"`
+    Output   string  `json:"output"`
+}
+
+// fleetArgs replaces {root}, {name} and {manifest} in args with the root
+// directory, its base name and a manifest file listing only the root.
+func fleetArgs(args []string, root, manifest string) []string {
+    r := strings.NewReplacer("{root}", root, "{name}", filepath.Base(root), "{manifest}", manifest)
+    expanded := make([]string, len(args))
+    for i, arg := range args {
+        expanded[i] = r.Replace(arg)
+    }
+    return expanded
+}
+
+func runFleetRoot(root string, args []string) fleetResult {
+    start := time.Now()
+    result := fleetResult{Root: root}
+    manifest, e := ioutil.TempFile("", "gopy-fleet-")
+    if e != nil {
+        result.ExitCode, result.Output = exitIOError, e.Error()
+        return result
+    }
+    defer os.Remove(manifest.Name())
+    fmt.Fprintf(manifest, "%s - %.2fMB\n", root, 0.0)
+    manifest.Close()
+
+    out, e := exec.Command(os.Args[0], fleetArgs(args, root, manifest.Name())...).CombinedOutput()
+    result.Output = string(out)
+    if exitError, ok := e.(*exec.ExitError); ok {
+        result.ExitCode = exitError.ExitCode()
+    } else if e != nil {
+        result.ExitCode, result.Output = exitIOError, e.Error()
+    }
+    result.Elapsed = time.Since(start).Seconds()
+    return result
+}
+
+// runFleet runs the gopy command args in a separate process for every root
+// directory listed in rootsFile, up to jobs at a time, prints the output of
+// each root as it finishes and returns the number of roots that failed.
+func runFleet(rootsFile string, args []string, jobs int, reportFile string) int {
+    data, e := ioutil.ReadFile(rootsFile)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    roots := []string{}
+    for _, line := range strings.Split(string(data), "\n") {
+        if root := strings.TrimSpace(line); root != "" && !strings.HasPrefix(root, "#") {
+            roots = append(roots, root)
+        }
+    }
+    var report *json.Encoder
+    if reportFile != "" {
+        f, e := os.Create(reportFile)
+        if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        defer f.Close()
+        report = json.NewEncoder(f)
+    }
+
+    results := make(chan fleetResult)
+    pending := make(chan string)
+    var wg sync.WaitGroup
+    for i := 0; i < jobs; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for root := range pending {
+                results <- runFleetRoot(root, args)
+            }
+        }()
+    }
+    go func() {
+        for _, root := range roots {
+            pending <- root
+        }
+        close(pending)
+        wg.Wait()
+        close(results)
+    }()
+
+    failed := 0
+    for result := range results {
+        status := "ok"
+        if result.ExitCode != exitSuccess {
+            status = fmt.Sprintf("failed with exit code %d", result.ExitCode)
+            failed++
+        }
+        fmt.Printf("== %s: %s (%.1fs)\n", result.Root, status, result.Elapsed)
+        fmt.Print(result.Output)
+        if report != nil {
+            if e := report.Encode(result); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+        }
+    }
+    fmt.Printf("Roots: %d, failed: %d\n", len(roots), failed)
+    return failed
+}
@@ -0,0 +1,309 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+// WritableFS is a file system Copy can write to, besides reading it like any
+// fs.FS.
+type WritableFS interface {
+    fs.FS
+    MkdirAll(name string, perm fs.FileMode) error
+    Create(name string) (io.WriteCloser, error)
+}
+
+// ChtimesFS is a WritableFS that can set the times of its files. Copy gives
+// the files it syncs to one the times of their sources, which later syncs
+// find them up to date by; the files of other file systems are copied again.
+type ChtimesFS interface {
+    WritableFS
+    Chtimes(name string, atime, mtime time.Time) error
+}
+
+// RemoveFS is a WritableFS that can remove files and directories. Copy with
+// Sync and Delete removes from one the entries the manifests no longer have.
+type RemoveFS interface {
+    WritableFS
+    RemoveAll(name string) error
+}
+
+type dirFS struct {
+    fs.FS
+    dir string
+}
+
+// DirFS returns the directory dir as a WritableFS.
+func DirFS(dir string) WritableFS {
+    return dirFS{os.DirFS(dir), dir}
+}
+
+func (d dirFS) MkdirAll(name string, perm fs.FileMode) error {
+    return os.MkdirAll(filepath.Join(d.dir, filepath.FromSlash(name)), perm)
+}
+
+func (d dirFS) Create(name string) (io.WriteCloser, error) {
+    return os.Create(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func (d dirFS) Chtimes(name string, atime, mtime time.Time) error {
+    return os.Chtimes(filepath.Join(d.dir, filepath.FromSlash(name)), atime, mtime)
+}
+
+func (d dirFS) RemoveAll(name string) error {
+    return os.RemoveAll(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+// MemFS is a WritableFS kept in memory, e.g. for tests. Directories holding
+// a file exist even if they were never made.
+type MemFS struct {
+    mu    sync.Mutex
+    files map[string]*memEntry
+}
+
+func NewMemFS() *MemFS {
+    return &MemFS{files: map[string]*memEntry{}}
+}
+
+// memEntry is both the fs.FileInfo and the fs.DirEntry of a file or
+// directory of a MemFS.
+type memEntry struct {
+    name    string
+    data    []byte
+    mode    fs.FileMode
+    modTime time.Time
+}
+
+func (e *memEntry) Name() string {
+    return e.name
+}
+
+func (e *memEntry) Size() int64 {
+    return int64(len(e.data))
+}
+
+func (e *memEntry) Mode() fs.FileMode {
+    return e.mode
+}
+
+func (e *memEntry) ModTime() time.Time {
+    return e.modTime
+}
+
+func (e *memEntry) IsDir() bool {
+    return e.mode.IsDir()
+}
+
+func (e *memEntry) Sys() interface{} {
+    return nil
+}
+
+func (e *memEntry) Type() fs.FileMode {
+    return e.mode.Type()
+}
+
+func (e *memEntry) Info() (fs.FileInfo, error) {
+    return e, nil
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+    if !fs.ValidPath(name) {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if e, ok := m.files[name]; ok && !e.IsDir() {
+        return &memReader{e, bytes.NewReader(e.data)}, nil
+    }
+    entries, dir := m.readDir(name)
+    if dir == nil {
+        return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+    }
+    return &memDir{dir, entries}, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+    f, e := m.Open(name)
+    if e != nil {
+        return nil, e
+    }
+    d, ok := f.(*memDir)
+    if !ok {
+        return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+    }
+    return d.ReadDir(-1)
+}
+
+// readDir returns the entries of the directory name, sorted by name, and
+// the directory itself, or nil if there is none.
+func (m *MemFS) readDir(name string) ([]fs.DirEntry, *memEntry) {
+    dir := m.files[name]
+    if name == "." {
+        dir = &memEntry{name: ".", mode: fs.ModeDir | 0755}
+    }
+    prefix := name + "/"
+    if name == "." {
+        prefix = ""
+    }
+    children := map[string]*memEntry{}
+    for p, e := range m.files {
+        if !strings.HasPrefix(p, prefix) {
+            continue
+        }
+        child := strings.TrimPrefix(p, prefix)
+        if i := strings.Index(child, "/"); i >= 0 {
+            child = child[:i]
+            if _, ok := children[child]; !ok {
+                children[child] = &memEntry{name: child, mode: fs.ModeDir | 0755}
+            }
+        } else {
+            children[child] = e
+        }
+    }
+    if dir == nil && len(children) > 0 {
+        dir = &memEntry{name: path.Base(name), mode: fs.ModeDir | 0755}
+    }
+    entries := []fs.DirEntry{}
+    for _, e := range children {
+        entries = append(entries, e)
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+    return entries, dir
+}
+
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for p := name; p != "." && p != "/"; p = path.Dir(p) {
+        if f, ok := m.files[p]; ok {
+            if !f.IsDir() {
+                return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+            }
+            continue
+        }
+        m.files[p] = &memEntry{name: path.Base(p), mode: fs.ModeDir | perm, modTime: time.Now()}
+    }
+    return nil
+}
+
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+    if !fs.ValidPath(name) || name == "." {
+        return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+    }
+    return &memFile{fs: m, name: name}, nil
+}
+
+func (m *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    f, ok := m.files[name]
+    if !ok {
+        return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+    }
+    f.modTime = mtime
+    return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+    if !fs.ValidPath(name) || name == "." {
+        return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for p := range m.files {
+        if p == name || strings.HasPrefix(p, name+"/") {
+            delete(m.files, p)
+        }
+    }
+    return nil
+}
+
+type memFile struct {
+    bytes.Buffer
+    fs   *MemFS
+    name string
+}
+
+func (f *memFile) Close() error {
+    f.fs.mu.Lock()
+    defer f.fs.mu.Unlock()
+    f.fs.files[f.name] = &memEntry{name: path.Base(f.name), data: f.Bytes(), mode: 0644, modTime: time.Now()}
+    return nil
+}
+
+type memReader struct {
+    entry *memEntry
+    *bytes.Reader
+}
+
+func (r *memReader) Stat() (fs.FileInfo, error) {
+    return r.entry, nil
+}
+
+func (r *memReader) Close() error {
+    return nil
+}
+
+type memDir struct {
+    entry   *memEntry
+    entries []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+    return d.entry, nil
+}
+
+func (d *memDir) Close() error {
+    return nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+    return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: syscall.EISDIR}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+    if n <= 0 {
+        entries := d.entries
+        d.entries = nil
+        return entries, nil
+    }
+    if len(d.entries) == 0 {
+        return nil, io.EOF
+    }
+    if n > len(d.entries) {
+        n = len(d.entries)
+    }
+    entries := d.entries[:n]
+    d.entries = d.entries[n:]
+    return entries, nil
+}
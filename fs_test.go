@@ -0,0 +1,169 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "context"
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "testing"
+    "testing/fstest"
+)
+
+func writeMemFS(t *testing.T, files map[string]string) *MemFS {
+    t.Helper()
+    m := NewMemFS()
+    for name, content := range files {
+        w, e := m.Create(name)
+        if e != nil {
+            t.Fatal(e)
+        }
+        w.Write([]byte(content))
+        w.Close()
+    }
+    return m
+}
+
+func TestMemFS(t *testing.T) {
+    m := writeMemFS(t, map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/deep/c.txt": "ccc"})
+    if e := m.MkdirAll("empty/dir", 0755); e != nil {
+        t.Fatal(e)
+    }
+    if e := fstest.TestFS(m, "a.txt", "sub/b.txt", "sub/deep/c.txt", "empty/dir"); e != nil {
+        t.Error(e)
+    }
+    if e := m.MkdirAll("a.txt/x", 0755); e == nil {
+        t.Error("MkdirAll() under a file succeeded")
+    }
+    if _, e := m.Open("missing"); !errors.Is(e, fs.ErrNotExist) {
+        t.Errorf("Open(missing) = %v, want not exist", e)
+    }
+}
+
+func TestMemFSConformance(t *testing.T) {
+    if e := fstest.TestFS(NewMemFS()); e != nil {
+        t.Errorf("empty: %v", e)
+    }
+    m := writeMemFS(t, map[string]string{"a.txt": "old", "x/y/z.txt": "z"})
+    if e := m.MkdirAll("x/y", 0700); e != nil {
+        t.Fatal(e)
+    }
+    w, _ := m.Create("a.txt")
+    w.Write([]byte("new"))
+    w.Close()
+    if e := fstest.TestFS(m, "a.txt", "x/y/z.txt"); e != nil {
+        t.Errorf("rewritten: %v", e)
+    }
+    if data, e := fs.ReadFile(m, "a.txt"); e != nil || string(data) != "new" {
+        t.Errorf("a.txt = %q, %v", data, e)
+    }
+    if _, e := m.Create("."); e == nil {
+        t.Error("Create(.) succeeded")
+    }
+}
+
+func TestDirFSConformance(t *testing.T) {
+    dir := t.TempDir()
+    d := DirFS(dir)
+    if e := d.MkdirAll("sub/deep", 0755); e != nil {
+        t.Fatal(e)
+    }
+    for name, content := range map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/deep/c.txt": "ccc"} {
+        w, e := d.Create(name)
+        if e != nil {
+            t.Fatal(e)
+        }
+        w.Write([]byte(content))
+        if e := w.Close(); e != nil {
+            t.Fatal(e)
+        }
+    }
+    if e := d.MkdirAll("empty", 0755); e != nil {
+        t.Fatal(e)
+    }
+    if e := fstest.TestFS(d, "a.txt", "sub/b.txt", "sub/deep/c.txt", "empty"); e != nil {
+        t.Error(e)
+    }
+    if data, e := os.ReadFile(filepath.Join(dir, "sub", "deep", "c.txt")); e != nil || string(data) != "ccc" {
+        t.Errorf("c.txt on disk = %q, %v", data, e)
+    }
+    if e := d.MkdirAll("a.txt/x", 0755); e == nil {
+        t.Error("MkdirAll() under a file succeeded")
+    }
+}
+
+// Files copied between the two are read back the same through either.
+func TestCopyBetweenFS(t *testing.T) {
+    src := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "bb"})
+    manifest := writeManifestFile(t, "src")
+    dest := DirFS(t.TempDir())
+    if _, e := Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Source: src, Dest: dest}); e != nil {
+        t.Fatal(e)
+    }
+    if e := fstest.TestFS(dest, "src/a.txt", "src/sub/b.txt"); e != nil {
+        t.Error(e)
+    }
+    back := NewMemFS()
+    if _, e := Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Source: dest, Dest: back}); e != nil {
+        t.Fatal(e)
+    }
+    if e := fstest.TestFS(back, "src/a.txt", "src/sub/b.txt"); e != nil {
+        t.Error(e)
+    }
+    if data, _ := fs.ReadFile(back, "src/sub/b.txt"); string(data) != "bb" {
+        t.Errorf("b.txt copied back = %q", data)
+    }
+}
+
+func TestSyncDeleteFS(t *testing.T) {
+    src := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "bb", "src/skip.log": "s"})
+    dest := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/old.txt": "o", "src/gone/c.txt": "c",
+        "src/skip.log": "kept", "other/d.txt": "d"})
+    manifest := writeManifestFile(t, "src")
+    opts := CopyOptions{Manifests: []string{manifest}, Source: src, Dest: dest, Sync: true, Delete: true,
+        Filters: []Filter{Not(GlobFilter("*.log"))}}
+    if _, e := Copy(context.Background(), CopyOptions{Manifests: opts.Manifests, Source: src, Dest: struct{ WritableFS }{dest},
+        Sync: true, Delete: true}); e == nil {
+        t.Error("Copy() with Delete to a file system that cannot remove succeeded")
+    }
+    dryRun := opts
+    dryRun.DryRun = true
+    if _, e := Copy(context.Background(), dryRun); e != nil {
+        t.Fatal(e)
+    }
+    if _, e := fs.Stat(dest, "src/old.txt"); e != nil {
+        t.Errorf("dry run deleted src/old.txt: %v", e)
+    }
+    if _, e := Copy(context.Background(), opts); e != nil {
+        t.Fatal(e)
+    }
+    if e := fstest.TestFS(dest, "src/a.txt", "src/sub/b.txt", "src/skip.log", "other/d.txt"); e != nil {
+        t.Error(e)
+    }
+    for _, name := range []string{"src/old.txt", "src/gone", "src/gone/c.txt"} {
+        if _, e := fs.Stat(dest, name); e == nil {
+            t.Errorf("%s was not deleted", name)
+        }
+    }
+}
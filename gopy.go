@@ -19,84 +19,521 @@
 // OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
 // WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 
-package main
+package gopy
 
 import (
-    "bufio"
-    "flag"
+    "encoding/json"
+    "errors"
     "fmt"
     "io"
     "io/ioutil"
+    "log/slog"
     "os"
     "path/filepath"
+    "sort"
+    "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
 )
 
+var defaultJunkPatterns = []string{"Thumbs.db", "desktop.ini", ".DS_Store", "~$*"}
+
 type fileInfo struct {
     file string
     size int64
 }
 
-func getSize(dir string) int64 {
+type fileID struct {
+    dev uint64
+    ino uint64
+}
+
+// ErrorAction is what a walk does with an entry it could not read.
+type ErrorAction int
+
+const (
+    // SkipError goes on with the walk without the entry.
+    SkipError ErrorAction = iota
+    // CollectError goes on without the entry, which is reported as unreadable.
+    CollectError
+    // AbortOnError ends the walk, and the operation, with the error.
+    AbortOnError
+)
+
+// ErrorHandler decides what to do with an entry a walk could not read. The
+// entry itself may be known, an unreadable directory, or not.
+type ErrorHandler func(path string, err error) ErrorAction
+
+// collectUnreadable is the ErrorHandler of the command line and of List and
+// Copy without one: entries that cannot be read for lack of permission, or
+// that vanished, are collected and any other error aborts.
+func collectUnreadable(path string, err error) ErrorAction {
+    if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+        return CollectError
+    }
+    return AbortOnError
+}
+
+// unreadablePaths collects the paths a walk could not read and was told to
+// go on past by onError.
+type unreadablePaths struct {
+    onError ErrorHandler
+    logger  *slog.Logger
+    mu      sync.Mutex
+    errors  map[string]string
+    skipped int
+}
+
+// add records e for path, if onError says so, and reports whether the walk
+// may go on past it.
+func (u *unreadablePaths) add(path string, e error) bool {
+    action := u.onError(path, e)
+    if action == AbortOnError {
+        return false
+    }
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    u.skipped++
+    if action == SkipError {
+        u.logger.Debug("file_skipped", "path", path, "reason", e.Error())
+        return true
+    }
+    if _, ok := u.errors[path]; !ok {
+        u.errors[path] = e.Error()
+        u.logger.Warn("file_unreadable", "path", path, "error", e.Error())
+    }
+    return true
+}
+
+// skips returns how many entries were gone past, counting those seen again.
+func (u *unreadablePaths) skips() int {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    return u.skipped
+}
+
+func (u *unreadablePaths) count() int {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    return len(u.errors)
+}
+
+func (u *unreadablePaths) report(w io.Writer) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    paths := make([]string, 0, len(u.errors))
+    for path := range u.errors {
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    fmt.Fprintf(w, "Unreadable paths: %d\n", len(paths))
+    for _, path := range paths {
+        fmt.Fprintf(w, "  %s\n", u.errors[path])
+    }
+}
+
+// walker holds the settings and the state the walks of one operation share,
+// so that concurrent List and Copy calls do not mix them.
+type walker struct {
+    unreadable *unreadablePaths
+    // ignore is nil with -no-ignore.
+    ignore *ignoreFiles
+    // links is the -links policy.
+    links         string
+    oneFileSystem bool
+    // excluded are left out of every walk, being written by the operation.
+    excluded []string
+    sizes    *sizeCache
+    logger   *slog.Logger
+}
+
+// newWalker returns a walker that reads the .gopyignore files and asks
+// onError, or collectUnreadable when it is nil, what to do with the entries
+// it cannot read.
+func newWalker(onError ErrorHandler) *walker {
+    if onError == nil {
+        onError = collectUnreadable
+    }
+    return &walker{
+        unreadable: &unreadablePaths{onError: onError, logger: logger, errors: map[string]string{}},
+        ignore:     &ignoreFiles{rules: map[string][]ignoreRule{}},
+        logger:     logger,
+    }
+}
+
+// setLogger makes the walks and the unreadable entries of w log to l.
+func (w *walker) setLogger(l *slog.Logger) {
+    w.logger, w.unreadable.logger = l, l
+}
+
+// getSize returns the size of the files below dir, or the error of an entry
+// the walk was told to abort on.
+func (w *walker) getSize(dir string) (int64, error) {
     size := int64(0)
-    filepath.Walk(dir,
+    links := map[fileID]bool{}
+    if w.sizes != nil && isDirectory(dir) {
+        e := w.sizes.tree(dir, w, links, func(path string, info os.FileInfo, files int64) {
+            size += info.Size() + files
+        })
+        return size, e
+    }
+    var device uint64
+    e := filepath.Walk(dir,
         func(path string, info os.FileInfo, err error) error {
+            if err != nil {
+                if !w.unreadable.add(path, err) {
+                    return err
+                }
+                if info == nil {
+                    return nil
+                }
+            }
+            if w.crossesFileSystem(path, info, dir, &device) {
+                return filepath.SkipDir
+            }
+            if id, ok := hardLinkID(info); ok {
+                if links[id] {
+                    return nil
+                }
+                links[id] = true
+            }
             size += info.Size()
             return nil
         })
-    return size
+    return size, e
 }
 
-func listFiles(dir string, noFile, noDir bool) ([]fileInfo, error) {
-    result := []fileInfo{}
-    if fi, e := ioutil.ReadDir(dir); e != nil {
-        return result, e
-    } else {
-        for _, info := range fi {
-            if (info.IsDir() && !noDir) || (!info.IsDir() && !noFile) {
-                filePath, _ := filepath.Abs(filepath.Join(dir, info.Name()))
-                size := getSize(filePath)
-                result = append(result, fileInfo{filePath, size})
+type sizeRecord struct {
+    ModTime int64    `json:"mtime"`
+    Files   int64    `json:"files"`
+    Dirs    []string `json:"dirs,omitempty"`
+}
+
+// sizeCache keeps, for every directory and its modification time, the size of
+// its files and the names of its subdirectories, so that an unchanged
+// directory is not read again. A file rewritten in place does not change the
+// modification time of its directory, which is what -no-cache is for.
+type sizeCache struct {
+    path    string
+    records map[string]sizeRecord
+    dirty   bool
+}
+
+func openSizeCache() *sizeCache {
+    dir, e := os.UserCacheDir()
+    if e != nil {
+        return nil
+    }
+    c := &sizeCache{path: filepath.Join(dir, "gopy", "sizes.json"), records: map[string]sizeRecord{}}
+    if data, e := ioutil.ReadFile(c.path); e == nil {
+        json.Unmarshal(data, &c.records)
+    }
+    return c
+}
+
+func (c *sizeCache) save() error {
+    if c == nil || !c.dirty {
+        return nil
+    }
+    data, e := json.Marshal(c.records)
+    if e != nil {
+        return e
+    }
+    os.MkdirAll(filepath.Dir(c.path), 0755)
+    f, e := cliIO.createAtomic(c.path)
+    if e != nil {
+        return e
+    }
+    if _, e := f.Write(data); e != nil {
+        f.abort()
+        return e
+    }
+    return f.commit()
+}
+
+// tree calls visit with every directory below dir, dir included, and the size
+// of its files, counting hard-linked files once with links. Directories with
+// hard-linked files are never cached, since links spans the whole tree, and
+// unreadable ones are left to w.
+func (c *sizeCache) tree(dir string, w *walker, links map[fileID]bool, visit func(path string, info os.FileInfo, files int64)) error {
+    var device uint64
+    var walkDir func(path string) error
+    walkDir = func(path string) error {
+        info, e := os.Lstat(path)
+        if e != nil {
+            return e
+        }
+        if w.crossesFileSystem(path, info, dir, &device) {
+            return nil
+        }
+        record, ok := c.records[path]
+        if !ok || record.ModTime != info.ModTime().UnixNano() {
+            fi, e := ioutil.ReadDir(path)
+            if e != nil {
+                if !w.unreadable.add(path, e) {
+                    return e
+                }
+                visit(path, info, 0)
+                return nil
+            }
+            record, ok = sizeRecord{ModTime: info.ModTime().UnixNano()}, true
+            for _, child := range fi {
+                if child.IsDir() {
+                    record.Dirs = append(record.Dirs, child.Name())
+                    continue
+                }
+                if id, linked := hardLinkID(child); linked {
+                    ok = false
+                    if links[id] {
+                        continue
+                    }
+                    links[id] = true
+                }
+                record.Files += child.Size()
+            }
+            if ok {
+                c.records[path], c.dirty = record, true
+            } else if _, cached := c.records[path]; cached {
+                delete(c.records, path)
+                c.dirty = true
+            }
+        }
+        visit(path, info, record.Files)
+        for _, name := range record.Dirs {
+            if e := walkDir(filepath.Join(path, name)); e != nil && !os.IsNotExist(e) {
+                return e
             }
         }
+        return nil
     }
-    return result, nil
+    return walkDir(dir)
 }
 
-func listFilesRecursively(dir string, noFile, noDir bool) ([]fileInfo, error) {
-    result := []fileInfo{}
-    e := filepath.Walk(dir,
-        func(path string, info os.FileInfo, err error) error {
-            if (info.IsDir() && !noDir) || (!info.IsDir() && !noFile) {
-                filePath, _ := filepath.Abs(path)
-                size := getSize(filePath)
-                result = append(result, fileInfo{filePath, size})
-            }
-            return nil
-        })
-    if e != nil {
-        return result, e
+func includeEntry(info os.FileInfo, noFile, noDir bool) bool {
+    return (info.IsDir() && !noDir) || (!info.IsDir() && !noFile)
+}
+
+// crossesFileSystem reports, with oneFileSystem, whether the directory path
+// is a mount point below root, whose device is recorded in device.
+func (w *walker) crossesFileSystem(path string, info os.FileInfo, root string, device *uint64) bool {
+    if !w.oneFileSystem || info == nil || !info.IsDir() {
+        return false
+    }
+    id, ok := deviceID(info)
+    if !ok {
+        return false
+    }
+    if path == root {
+        *device = id
+        return false
+    }
+    return id != *device
+}
+
+// excludeFromWalks excludes path from the walks when it is inside one of
+// dirs, which would otherwise list or copy the output of gopy into itself.
+func (w *walker) excludeFromWalks(path string, dirs []string) {
+    for _, dir := range dirs {
+        if isWithin(path, dir) {
+            absPath, _ := filepath.Abs(path)
+            fmt.Fprintf(os.Stderr, "Warning: %s is inside %s and is left out of it\n", path, dir)
+            w.excluded = append(w.excluded, absPath)
+            return
+        }
+    }
+}
+
+func (w *walker) isExcludedPath(path string) bool {
+    for _, excluded := range w.excluded {
+        if isWithin(path, excluded) {
+            return true
+        }
+    }
+    return false
+}
+
+// scanProgress is what the heartbeat reports of the walk going on.
+var scanProgress struct {
+    walking atomic.Bool
+    entries atomic.Int64
+    dir     atomic.Value
+}
+
+func trackScan(path string, info os.FileInfo) {
+    scanProgress.entries.Add(1)
+    if info != nil && info.IsDir() {
+        scanProgress.dir.Store(path)
     }
-    return result, nil
 }
 
-func printUsage() {
-    fmt.Println("Usage:", os.Args[0])
-    flag.PrintDefaults()
+// heartbeat prints, every interval while a walk is going on, how many entries
+// it has seen and the directory it is in, so that a scan of millions of files
+// does not look hung. With -v it is logged as well.
+func heartbeat(interval time.Duration) {
+    start := time.Now()
+    go func() {
+        for range time.Tick(interval) {
+            if !scanProgress.walking.Load() {
+                continue
+            }
+            entries, elapsed := scanProgress.entries.Load(), time.Since(start).Round(time.Second)
+            dir, _ := scanProgress.dir.Load().(string)
+            fmt.Fprintf(os.Stderr, "Scanning: %d entries in %s, now in %s\n", entries, elapsed, dir)
+            logger.Info("heartbeat", "entries", entries, "directory", dir, "elapsed_seconds", elapsed.Seconds())
+        }
+    }()
 }
 
-func printUsageAndExit(exitCode int) {
-    printUsage()
-    os.Exit(exitCode)
+// walkLinks walks root like filepath.Walk, but skips or follows the symbolic
+// links and junctions it meets as the links policy says. A followed directory is
+// reported below the path of its link, unless it is inside or above a
+// directory being walked, which would walk it twice or forever. Directories
+// are also told apart by device and inode where available, so that a link
+// back to one already walked is reported as a cycle whatever its path.
+func (w *walker) walkLinks(root string, fn filepath.WalkFunc) error {
+    walkFn := fn
+    fn = func(path string, info os.FileInfo, err error) error {
+        trackScan(path, info)
+        reason := ""
+        if len(w.excluded) > 0 && w.isExcludedPath(path) {
+            reason = "output of the operation"
+        } else if info != nil && w.ignore.ignored(root, path, info) {
+            reason = ignoreFileName
+        } else {
+            return walkFn(path, info, err)
+        }
+        w.logger.Info("file_skipped", "path", path, "reason", reason)
+        if info != nil && info.IsDir() {
+            return filepath.SkipDir
+        }
+        return nil
+    }
+    if w.links != "skip" && w.links != "follow" {
+        return filepath.Walk(root, fn)
+    }
+    walking := map[string]bool{}
+    visited := map[fileID]string{}
+    var walkTree func(dir, as string) error
+    walkTree = func(dir, as string) error {
+        if real, e := filepath.EvalSymlinks(dir); e == nil {
+            walking[real] = true
+            defer delete(walking, real)
+        }
+        return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+            shown := as + path[len(dir):]
+            if err == nil && info.IsDir() {
+                if id, ok := dirID(info); ok {
+                    visited[id] = path
+                }
+            }
+            if err != nil || !isLink(info) {
+                return fn(shown, info, err)
+            }
+            if w.links == "skip" {
+                w.logger.Info("file_skipped", "path", shown, "reason", "link")
+                return nil
+            }
+            target, e := os.Stat(path)
+            if e != nil {
+                return fn(shown, info, nil)
+            }
+            if !target.IsDir() {
+                return fn(shown, target, nil)
+            }
+            if id, ok := dirID(target); ok && visited[id] != "" {
+                if isWithin(path, visited[id]) {
+                    w.logger.Warn("directory_cycle", "path", shown, "target", visited[id])
+                } else {
+                    w.logger.Info("file_skipped", "path", shown, "reason", "link to a directory already walked")
+                }
+                return nil
+            }
+            real, e := filepath.EvalSymlinks(path)
+            if e != nil {
+                return fn(shown, info, e)
+            }
+            for walked := range walking {
+                if isWithin(real, walked) || isWithin(walked, real) {
+                    w.logger.Info("file_skipped", "path", shown, "reason", "link to a directory already walked")
+                    return nil
+                }
+            }
+            return walkTree(real, shown)
+        })
+    }
+    return walkTree(root, root)
 }
 
-func printError(msg interface{}) {
-    fmt.Println("Error:", msg)
+type walkEntry struct {
+    path string
+    info os.FileInfo
+    err  error
 }
 
-func printErrorAndExit(msg interface{}, exitCode int) {
-    printError(msg)
-    os.Exit(exitCode)
+// walk streams the entries below dir, including dir itself when recursive,
+// until the walk is finished or done is closed.
+func (w *walker) walk(dir string, recursive bool, done <-chan struct{}) <-chan walkEntry {
+    entries := make(chan walkEntry, 64)
+    send := func(entry walkEntry) bool {
+        select {
+        case entries <- entry:
+            return true
+        case <-done:
+            return false
+        }
+    }
+    go func() {
+        defer close(entries)
+        scanProgress.walking.Store(true)
+        defer scanProgress.walking.Store(false)
+        if !recursive {
+            fi, e := ioutil.ReadDir(dir)
+            if e != nil {
+                send(walkEntry{dir, nil, e})
+                return
+            }
+            for _, info := range fi {
+                filePath, _ := filepath.Abs(filepath.Join(dir, info.Name()))
+                trackScan(filePath, info)
+                if w.isExcludedPath(filePath) {
+                    w.logger.Info("file_skipped", "path", filePath, "reason", "output of the operation")
+                    continue
+                }
+                if w.ignore.ignored(dir, filepath.Join(dir, info.Name()), info) {
+                    w.logger.Info("file_skipped", "path", filePath, "reason", ignoreFileName)
+                    continue
+                }
+                if isLink(info) && w.links == "skip" {
+                    w.logger.Info("file_skipped", "path", filePath, "reason", "link")
+                    continue
+                }
+                if target, e := os.Stat(filePath); e == nil && isLink(info) && w.links == "follow" {
+                    info = target
+                }
+                if !send(walkEntry{filePath, info, nil}) {
+                    return
+                }
+            }
+            return
+        }
+        var device uint64
+        w.walkLinks(dir,
+            func(path string, info os.FileInfo, err error) error {
+                if w.crossesFileSystem(path, info, dir, &device) {
+                    w.logger.Info("file_skipped", "path", path, "reason", "other file system")
+                    return filepath.SkipDir
+                }
+                filePath, _ := filepath.Abs(path)
+                if !send(walkEntry{filePath, info, err}) {
+                    return io.EOF
+                }
+                return nil
+            })
+    }()
+    return entries
 }
 
 func isDirectory(path string) bool {
@@ -114,140 +551,162 @@ func isDirectory(path string) bool {
     return false
 }
 
-func fileExists(path string) bool {
-    f, e := os.Open(path)
-    if f == nil && e != nil {
-        return false
+func splitList(s string) []string {
+    result := []string{}
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            result = append(result, item)
+        }
     }
-    return true
+    return result
 }
 
-var copyFlag *bool
-var inputFile *string
-var listFlag *bool
-var directoryPath *string
-var outputFile *string
-var noDirFlag *bool
-var noFileFlag *bool
-var recursiveFlag *bool
-
-func init() {
-    copyFlag = flag.Bool("copy", false, "copy operation")
-    inputFile = flag.String("input", "", "input file (for copy) - mandatory")
-    listFlag = flag.Bool("list", false, "list operation")
-    directoryPath = flag.String("directory", "", "directory (for list & copy) - mandatory")
-    outputFile = flag.String("output", "", "output file (for list) - mandatory")
-    noDirFlag = flag.Bool("nodir", false, "don't include directories (for list) - optional")
-    noFileFlag = flag.Bool("nofile", false, "don't include files (for list) - optional")
-    recursiveFlag = flag.Bool("recursive", false, "recursive (for list) - optional")
-    helpFlag := flag.Bool("help", false, "help")
-
-    flag.Parse()
-
-    if *helpFlag {
-        printUsageAndExit(0)
+func matchesAny(path string, patterns []string) bool {
+    name := filepath.Base(path)
+    for _, pattern := range patterns {
+        if matched, _ := filepath.Match(pattern, name); matched {
+            return true
+        }
+        if matched, _ := filepath.Match(pattern, path); matched {
+            return true
+        }
     }
+    return false
+}
 
-    if *copyFlag && *listFlag {
-        printUsageAndExit(1)
-    }
+func isJunk(path string, patterns []string) bool {
+    return matchesAny(filepath.Base(path), patterns)
+}
 
-    if !*copyFlag && !*listFlag {
-        printUsageAndExit(1)
+func parsePriorityClasses(s string) [][]string {
+    result := [][]string{}
+    for _, class := range strings.Split(s, ";") {
+        if patterns := splitList(class); len(patterns) > 0 {
+            result = append(result, patterns)
+        }
     }
+    return result
+}
 
-    if *copyFlag {
-        if *inputFile == "" || *directoryPath == "" {
-            printUsageAndExit(1)
-        }
-        if !fileExists(*inputFile) {
-            printErrorAndExit(*inputFile + " does not exist", 1)
-        }
-    } else if *listFlag {
-        if *outputFile == "" || *directoryPath == "" {
-            printUsageAndExit(1)
-        }
-        if !isDirectory(*directoryPath) {
-            printErrorAndExit(*directoryPath + " does not exist or is not a directory", 1)
+func priorityOf(rel string, classes [][]string) int {
+    for i, patterns := range classes {
+        if matchesAny(filepath.ToSlash(rel), patterns) {
+            return i
         }
     }
+    return len(classes)
 }
 
-func List(directoryPath, outputFile string, noFileFlag, noDirFlag, recursiveFlag bool) {
-    var info []fileInfo
-    var e error
-    if recursiveFlag {
-        info, e = listFilesRecursively(directoryPath, noFileFlag, noDirFlag)
-    } else {
-        info, e = listFiles(directoryPath, noFileFlag, noDirFlag)
-    }
-    if e != nil {
-        printErrorAndExit(e, 1)
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+func parseSize(s string) (int64, error) {
+    str := strings.ToUpper(strings.TrimSpace(s))
+    multiplier := int64(1)
+    for i := len(sizeUnits) - 1; i >= 0; i-- {
+        unit := sizeUnits[i]
+        if strings.HasSuffix(str, unit) {
+            str = strings.TrimSpace(strings.TrimSuffix(str, unit))
+            for j := 0; j < i; j++ {
+                multiplier *= 1024
+            }
+            break
+        }
     }
-    f, e := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
-    if e != nil {
-        printErrorAndExit(e, 1)
+    value, e := strconv.ParseFloat(str, 64)
+    if e != nil || value < 0 {
+        return 0, fmt.Errorf("invalid size: %s", s)
     }
-    for _, i := range info {
-        // TODO: make a more human-readable size, e.g. KB, MB, GB, TB, and not just MB
-        fmt.Fprintf(f, "%s - %.2fMB\n", i.file, float64(i.size) / float64(1024000))
+    return int64(value * float64(multiplier)), nil
+}
+
+func formatSize(size int64) string {
+    value := float64(size)
+    i := 0
+    for value >= 1024 && i < len(sizeUnits)-1 {
+        value /= 1024
+        i++
     }
+    return fmt.Sprintf("%.2f%s", value, sizeUnits[i])
 }
 
-func copyFile(src, dest string) error {
-    srcFile, e := os.Open(src)
-    if e != nil {
-        return e
+func (fio *fileIO) openSource(path string) (*os.File, error) {
+    if fio.readOnly && oNoatime != 0 {
+        if f, e := os.OpenFile(path, os.O_RDONLY|oNoatime, 0); e == nil {
+            return f, nil
+        }
     }
-    defer srcFile.Close()
+    return fio.openRetrying(path, func() (*os.File, error) { return os.Open(path) })
+}
 
-    destFile, e := os.Create(dest)
-    if e != nil {
-        return e
+// openRetrying calls open again, after a growing delay, while it fails because
+// the process or the system has too many files open.
+func (fio *fileIO) openRetrying(path string, open func() (*os.File, error)) (*os.File, error) {
+    delay := 10 * time.Millisecond
+    for {
+        f, e := open()
+        if e == nil || (!errors.Is(e, syscall.EMFILE) && !errors.Is(e, syscall.ENFILE)) || delay > 2*time.Second {
+            return f, e
+        }
+        fio.logger.Warn("retrying", "path", path, "error", e.Error(), "delay", delay)
+        time.Sleep(delay)
+        delay *= 2
     }
-    defer destFile.Close()
+}
 
-    io.Copy(destFile, srcFile)
-    return nil
+// fileBudget bounds the files kept open by concurrent copies and hashes,
+// which wait for each other instead of failing with "too many open
+// files" under a low descriptor limit.
+type fileBudget struct {
+    mu   sync.Mutex
+    cond *sync.Cond
+    free int
 }
 
-func readTextFile(inputFile string) []string {
-    result := []string{}
-    f, _ := os.Open(inputFile)
-    defer f.Close()
-    r := bufio.NewReader(f)
-    line, e := r.ReadString('\n')
-    for e == nil {
-        trimmedLine := strings.TrimSpace(line)
-        endIdx := strings.LastIndex(trimmedLine, "-") - 1
-        result = append(result, trimmedLine[0:endIdx])
-        line, e = r.ReadString('\n')
+func newFileBudget(n int) *fileBudget {
+    b := &fileBudget{free: n}
+    b.cond = sync.NewCond(&b.mu)
+    return b
+}
+
+func (b *fileBudget) acquire(n int) {
+    if b == nil {
+        return
     }
-    return result
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    for b.free < n {
+        b.cond.Wait()
+    }
+    b.free -= n
 }
 
-func Copy(directoryPath, inputPath string) {
-    os.MkdirAll(directoryPath, 0755)
-    for _, dir := range readTextFile(inputPath) {
-        baseDir := filepath.Base(dir)
-        filepath.Walk(dir,
-            func(path string, info os.FileInfo, err error) error {
-                dest := filepath.Join(directoryPath, path[strings.Index(path, baseDir):])
-                if info.IsDir() {
-                    os.MkdirAll(dest, 0755)
-                } else {
-                    copyFile(path, dest)
-                }
-                return nil
-        })
+func (b *fileBudget) release(n int) {
+    if b == nil {
+        return
     }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.free += n
+    b.cond.Broadcast()
 }
 
-func main() {
-    if *listFlag {
-        List(*directoryPath, *outputFile, *noFileFlag, *noDirFlag, *recursiveFlag)
-    } else if *copyFlag {
-        Copy(*directoryPath, *inputFile)
+func isWithin(path, dir string) bool {
+    absPath, e := filepath.Abs(path)
+    if e != nil {
+        return false
     }
+    absDir, e := filepath.Abs(dir)
+    if e != nil {
+        return false
+    }
+    rel, e := filepath.Rel(absDir, absPath)
+    return e == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
+func fileExists(path string) bool {
+    f, e := os.Open(path)
+    if f == nil && e != nil {
+        return false
+    }
+    return true
+}
@@ -0,0 +1,1280 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+    t.Helper()
+    for name, content := range files {
+        path := filepath.Join(dir, filepath.FromSlash(name))
+        if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+            t.Fatal(e)
+        }
+        if e := os.WriteFile(path, []byte(content), 0644); e != nil {
+            t.Fatal(e)
+        }
+    }
+}
+
+func writeManifestFile(t *testing.T, paths ...string) string {
+    t.Helper()
+    entries := []jsonEntry{}
+    for _, path := range paths {
+        entries = append(entries, jsonEntry{Path: path})
+    }
+    manifest := filepath.Join(t.TempDir(), "manifest.json")
+    if e := writeManifest(manifest, entries); e != nil {
+        t.Fatal(e)
+    }
+    return manifest
+}
+
+func TestList(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{"a.txt": "a", "b.tmp": "b", "sub/c.txt": "cc"})
+    entries, e := List(context.Background(), ListOptions{Directories: []string{dir}, Recursive: true,
+        Exclude: []string{"*.tmp"}, NoDirs: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    names := []string{}
+    for _, entry := range entries {
+        rel, _ := filepath.Rel(dir, entry.Path)
+        names = append(names, filepath.ToSlash(rel))
+    }
+    sort.Strings(names)
+    if len(names) != 2 || names[0] != "a.txt" || names[1] != "sub/c.txt" {
+        t.Errorf("List() = %v, want [a.txt sub/c.txt]", names)
+    }
+}
+
+func TestListMissingDirectory(t *testing.T) {
+    if _, e := List(context.Background(), ListOptions{Directories: []string{filepath.Join(t.TempDir(), "no")}}); e == nil {
+        t.Error("List() of a missing directory succeeded")
+    }
+}
+
+func TestListersKeepTheirSettings(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{".gopyignore": "*.log\n", "a.txt": "text", "b.bin": "\x00", "c.log": "log",
+        "empty.txt": ""})
+    noIgnore := newWalker(nil)
+    noIgnore.ignore = nil
+    cases := []struct {
+        filters listFilters
+        walker  *walker
+        want    string
+    }{
+        {listFilters{content: "text"}, newWalker(nil), ".gopyignore a.txt empty.txt"},
+        {listFilters{content: "binary"}, noIgnore, "b.bin"},
+        {listFilters{findEmpty: true}, newWalker(nil), "empty.txt"},
+        {listFilters{}, noIgnore, ".gopyignore a.txt b.bin c.log empty.txt"},
+    }
+    var wg sync.WaitGroup
+    for _, c := range cases {
+        c := c
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            collector := newEntryCollector(context.Background(), ListOptions{})
+            l := &lister{listFilters: c.filters, w: collector, links: map[fileID]bool{}, walker: c.walker}
+            if e := l.list(dir, "", true, false, true); e != nil {
+                t.Error(e)
+                return
+            }
+            names := []string{}
+            for _, entry := range collector.entries {
+                names = append(names, filepath.Base(entry.Path))
+            }
+            sort.Strings(names)
+            if got := strings.Join(names, " "); got != c.want {
+                t.Errorf("%+v: listed %s, want %s", c.filters, got, c.want)
+            }
+        }()
+    }
+    wg.Wait()
+
+    for _, sums := range []*checksummer{nil, {jobs: 1}} {
+        var buf bytes.Buffer
+        w, _ := newEntryWriter(&buf, "ndjson", sums)
+        if e := w.writeEntry("", fileInfo{filepath.Join(dir, "a.txt"), 4}); e != nil {
+            t.Fatal(e)
+        }
+        if hashed := strings.Contains(buf.String(), `"sha256"`); hashed != (sums != nil) {
+            t.Errorf("checksums %v: wrote %s", sums != nil, buf.String())
+        }
+    }
+}
+
+func TestSQLEntryWriter(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{"a.txt": "abc", "it's.txt": ""})
+    modTime := time.Unix(1600000000, 0)
+    for _, name := range []string{"a.txt", "it's.txt"} {
+        if e := os.Chtimes(filepath.Join(dir, name), modTime, modTime); e != nil {
+            t.Fatal(e)
+        }
+    }
+    var buf bytes.Buffer
+    w, _ := newEntryWriter(&buf, "sql", &checksummer{jobs: 1})
+    if e := w.begin(); e != nil {
+        t.Fatal(e)
+    }
+    for _, name := range []string{"a.txt", "it's.txt", "missing"} {
+        if e := w.writeEntry("/r'", fileInfo{filepath.Join(dir, name), 3}); e != nil {
+            t.Fatal(e)
+        }
+    }
+    if e := w.end(); e != nil {
+        t.Fatal(e)
+    }
+    quoted := strings.ReplaceAll(dir, "'", "''")
+    for _, want := range []string{
+        "BEGIN TRANSACTION;\nCREATE TABLE IF NOT EXISTS files (root TEXT, path TEXT PRIMARY KEY,",
+        "INSERT OR REPLACE INTO files VALUES ('/r''', '" + filepath.Join(quoted, "a.txt") +
+            "', 3, 1600000000, 'ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad');\n",
+        "INSERT OR REPLACE INTO files VALUES ('/r''', '" + filepath.Join(quoted, "it''s.txt") +
+            "', 3, 1600000000, 'e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855');\n",
+        "INSERT OR REPLACE INTO files VALUES ('/r''', '" + filepath.Join(quoted, "missing") + "', 3, NULL, NULL);\n",
+    } {
+        if !strings.Contains(buf.String(), want) {
+            t.Errorf("script lacks %q:\n%s", want, buf.String())
+        }
+    }
+    if !strings.HasSuffix(buf.String(), "COMMIT;\n") {
+        t.Errorf("script does not commit:\n%s", buf.String())
+    }
+
+    if _, e := exec.LookPath("sqlite3"); e != nil {
+        t.Skip(e)
+    }
+    cmd := exec.Command("sqlite3", filepath.Join(t.TempDir(), "files.db"))
+    cmd.Stdin = strings.NewReader(buf.String() + "SELECT count(*), count(sha256) FROM files;\n")
+    if out, e := cmd.CombinedOutput(); e != nil || string(out) != "3|2\n" {
+        t.Errorf("sqlite3: %s %v", out, e)
+    }
+}
+
+func TestSQLiteList(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{"a.txt": "abc", "sub/it's.txt": ""})
+    db := filepath.Join(t.TempDir(), "files.db")
+    for i := 0; i < 2; i++ {
+        if out, code := runGopyForTest(t, "list", "-recursive", "-nodir", "-format", "sqlite", "-checksum",
+            "-output", db, dir); code != 0 {
+            t.Fatalf("list exited with %d: %s", code, out)
+        }
+    }
+    conn, e := sql.Open("sqlite", db)
+    if e != nil {
+        t.Fatal(e)
+    }
+    defer conn.Close()
+    var files, sums int
+    if e := conn.QueryRow("SELECT count(*), count(sha256) FROM files").Scan(&files, &sums); e != nil || files != 2 || sums != 2 {
+        t.Errorf("files = %d with %d checksums, %v, want 2 with 2", files, sums, e)
+    }
+    var size int64
+    var sum string
+    e = conn.QueryRow("SELECT size, sha256 FROM files WHERE path = ?", filepath.Join(dir, "a.txt")).Scan(&size, &sum)
+    if e != nil || size != 3 || sum != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+        t.Errorf("a.txt = %d %s, %v", size, sum, e)
+    }
+
+    if out, code := runGopyForTest(t, "list", "-format", "sqlite", "-output", "-", dir); code != exitUsage {
+        t.Errorf("list -format sqlite -output - exited with %d: %s", code, out)
+    }
+}
+
+func TestCopy(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "bb"})
+    dest := t.TempDir()
+    report, e := Copy(context.Background(), CopyOptions{Manifests: []string{writeManifestFile(t, src)}, Directory: dest})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if report.FilesCopied != 2 || report.BytesCopied != 3 || report.Failed != 0 {
+        t.Errorf("Copy() = %+v, want 2 files and 3 bytes copied", report)
+    }
+    if data, e := os.ReadFile(filepath.Join(dest, "src", "sub", "b.txt")); e != nil || string(data) != "bb" {
+        t.Errorf("copied file = %q, %v", data, e)
+    }
+}
+
+func TestCopyReturnsErrors(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a"})
+    dest := filepath.Join(t.TempDir(), "file")
+    writeFiles(t, filepath.Dir(dest), map[string]string{"file": "not a directory"})
+    if _, e := Copy(context.Background(), CopyOptions{Manifests: []string{writeManifestFile(t, src)}, Directory: dest}); e == nil {
+        t.Error("Copy() to a file succeeded")
+    }
+}
+
+// lockedDirForTest writes dir with a.txt and a locked directory holding b.txt,
+// and skips the test when the locked directory can still be read, as by root.
+func lockedDirForTest(t *testing.T) (dir, locked string) {
+    t.Helper()
+    dir = filepath.Join(t.TempDir(), "src")
+    writeFiles(t, dir, map[string]string{"a.txt": "a", "locked/b.txt": "b"})
+    locked = filepath.Join(dir, "locked")
+    if e := os.Chmod(locked, 0); e != nil {
+        t.Fatal(e)
+    }
+    t.Cleanup(func() { os.Chmod(locked, 0755) })
+    if _, e := os.ReadDir(locked); e == nil {
+        t.Skip("directories without permissions can be read")
+    }
+    return dir, locked
+}
+
+func abortOnError(path string, err error) ErrorAction {
+    return AbortOnError
+}
+
+func TestListOnError(t *testing.T) {
+    dir, locked := lockedDirForTest(t)
+    // The listing itself does not read the locked directory, but its size does.
+    for _, recursive := range []bool{true, false} {
+        var mu sync.Mutex
+        skipped := []string{}
+        skip := func(path string, err error) ErrorAction {
+            mu.Lock()
+            defer mu.Unlock()
+            skipped = append(skipped, path)
+            return SkipError
+        }
+        var wg sync.WaitGroup
+        var abortErr, skipErr error
+        var entries []Entry
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            _, abortErr = List(context.Background(), ListOptions{Directories: []string{dir}, Recursive: recursive,
+                OnError: abortOnError})
+        }()
+        go func() {
+            defer wg.Done()
+            entries, skipErr = List(context.Background(), ListOptions{Directories: []string{dir}, Recursive: recursive,
+                OnError: skip})
+        }()
+        wg.Wait()
+        if !errors.Is(abortErr, os.ErrPermission) {
+            t.Errorf("recursive %v: List() with AbortOnError = %v, want a permission error", recursive, abortErr)
+        }
+        if skipErr != nil {
+            t.Errorf("recursive %v: List() with SkipError = %v", recursive, skipErr)
+        }
+        if len(skipped) == 0 || skipped[0] != locked {
+            t.Errorf("recursive %v: skipped %v, want %s", recursive, skipped, locked)
+        }
+        found := false
+        for _, entry := range entries {
+            found = found || entry.Path == locked
+        }
+        if !found {
+            t.Errorf("recursive %v: the unreadable directory is not listed", recursive)
+        }
+    }
+}
+
+func TestCopyOnError(t *testing.T) {
+    dir, _ := lockedDirForTest(t)
+    manifest := writeManifestFile(t, dir)
+    report, e := Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Directory: t.TempDir()})
+    if e != nil || report.FilesCopied != 1 || report.Failed != 1 {
+        t.Errorf("Copy() = %+v, %v, want 1 file copied and 1 failed", report, e)
+    }
+    report, e = Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Directory: t.TempDir(),
+        OnError: abortOnError})
+    if !errors.Is(e, os.ErrPermission) || report.FilesCopied != 0 {
+        t.Errorf("Copy() with AbortOnError = %+v, %v, want a permission error and nothing copied", report, e)
+    }
+}
+
+func TestGetSizeOnError(t *testing.T) {
+    dir, locked := lockedDirForTest(t)
+    if size, e := newWalker(nil).getSize(dir); e != nil || size < 1 {
+        t.Errorf("getSize() = %d, %v", size, e)
+    }
+    if _, e := newWalker(abortOnError).getSize(dir); !errors.Is(e, os.ErrPermission) {
+        t.Errorf("getSize() with AbortOnError = %v, want a permission error", e)
+    }
+    w := newWalker(nil)
+    w.sizes = &sizeCache{records: map[string]sizeRecord{}}
+    if _, e := w.getSize(dir); e != nil || w.unreadable.count() != 1 {
+        t.Errorf("cached getSize() = %v with %d unreadable, want %s collected", e, w.unreadable.count(), locked)
+    }
+    w = newWalker(abortOnError)
+    w.sizes = &sizeCache{records: map[string]sizeRecord{}}
+    if _, e := w.getSize(dir); !errors.Is(e, os.ErrPermission) {
+        t.Errorf("cached getSize() with AbortOnError = %v, want a permission error", e)
+    }
+}
+
+func readFile(t *testing.T, path string) string {
+    t.Helper()
+    data, e := os.ReadFile(path)
+    if e != nil {
+        t.Fatal(e)
+    }
+    return string(data)
+}
+
+func copyForTest(t *testing.T, dest, manifest string, opts copyOptions) {
+    t.Helper()
+    result, e := copyManifests(dest, []string{manifest}, opts)
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.failed > 0 {
+        t.Fatalf("%d files failed", result.failed)
+    }
+}
+
+func TestUndo(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+    manifest := writeManifestFile(t, src)
+    dest := t.TempDir()
+    copyForTest(t, dest, manifest, copyOptions{sync: true})
+
+    writeFiles(t, src, map[string]string{"a.txt": "aaa"})
+    os.Remove(filepath.Join(src, "sub", "b.txt"))
+    copyForTest(t, dest, manifest, copyOptions{sync: true, delete: true, yes: true, softDelete: true,
+        retention: 24 * time.Hour, backupExt: ".bak"})
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "aaa" {
+        t.Fatalf("synced a.txt = %q", got)
+    }
+
+    if failed := runUndo(dest); failed != 0 {
+        t.Errorf("runUndo() = %d failed", failed)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "a" {
+        t.Errorf("restored a.txt = %q, want a", got)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "sub", "b.txt")); got != "b" {
+        t.Errorf("restored b.txt = %q, want b", got)
+    }
+    if _, e := os.Lstat(filepath.Join(dest, "src", "a.txt.bak")); !os.IsNotExist(e) {
+        t.Errorf("backup left after undo: %v", e)
+    }
+
+    if failed := runUndo(dest); failed != 0 {
+        t.Errorf("second runUndo() = %d failed", failed)
+    }
+    if _, e := os.Lstat(filepath.Join(dest, "src")); !os.IsNotExist(e) {
+        t.Errorf("copied directory left after undoing the first run: %v", e)
+    }
+}
+
+func TestTwoPhaseUndoAndBackup(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+    manifest := writeManifestFile(t, src)
+    dest := t.TempDir()
+    copyForTest(t, dest, manifest, copyOptions{twoPhase: true})
+    writeFiles(t, src, map[string]string{"a.txt": "aaa"})
+    later := time.Now().Add(time.Hour)
+    os.Chtimes(filepath.Join(src, "a.txt"), later, later)
+    copyForTest(t, dest, manifest, copyOptions{sync: true, twoPhase: true, backupExt: ".bak"})
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "aaa" {
+        t.Fatalf("synced a.txt = %q", got)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt.bak")); got != "a" {
+        t.Errorf("backup of a.txt = %q, want a", got)
+    }
+    if failed := runUndo(dest); failed != 0 {
+        t.Errorf("runUndo() = %d failed", failed)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "a" {
+        t.Errorf("restored a.txt = %q, want a", got)
+    }
+    if failed := runUndo(dest); failed != 0 {
+        t.Errorf("second runUndo() = %d failed", failed)
+    }
+    if _, e := os.Lstat(filepath.Join(dest, "src")); !os.IsNotExist(e) {
+        t.Errorf("staged directory left after undoing the first run: %v", e)
+    }
+}
+
+func TestUndoWithoutBackup(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a"})
+    manifest := writeManifestFile(t, src)
+    dest := t.TempDir()
+    copyForTest(t, dest, manifest, copyOptions{})
+    copyForTest(t, dest, manifest, copyOptions{})
+    if failed := runUndo(dest); failed != 1 {
+        t.Errorf("runUndo() = %d failed, want 1", failed)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "a.txt")); got != "a" {
+        t.Errorf("a.txt = %q, want it left alone", got)
+    }
+}
+
+func TestUndoDedupLink(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"dup.txt": "same"})
+    dest := t.TempDir()
+    writeFiles(t, dest, map[string]string{"existing.txt": "same", "src/dup.txt": "old"})
+    copyForTest(t, dest, writeManifestFile(t, src), copyOptions{dedup: "link", backupExt: ".bak"})
+    if got := readFile(t, filepath.Join(dest, "src", "dup.txt")); got != "same" {
+        t.Fatalf("linked dup.txt = %q", got)
+    }
+    if failed := runUndo(dest); failed != 0 {
+        t.Errorf("runUndo() = %d failed", failed)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "dup.txt")); got != "old" {
+        t.Errorf("restored dup.txt = %q, want old", got)
+    }
+}
+
+func TestTrimJournal(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    manifest := writeManifestFile(t, src)
+    dest := t.TempDir()
+    for i := 0; i < undoHistory+3; i++ {
+        writeFiles(t, src, map[string]string{"a.txt": strings.Repeat("a", i+1)})
+        copyForTest(t, dest, manifest, copyOptions{})
+    }
+    copyForTest(t, dest, manifest, copyOptions{sync: true})
+    if runs := strings.Count(readFile(t, filepath.Join(dest, undoJournalName)), `"op":"run"`); runs != undoHistory {
+        t.Errorf("journal has %d runs, want %d", runs, undoHistory)
+    }
+}
+
+func TestReplay(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+    journalPath := filepath.Join(t.TempDir(), "journal")
+    copyForTest(t, t.TempDir(), writeManifestFile(t, src), copyOptions{journal: journalPath})
+    other := t.TempDir()
+    if failed := runReplay(journalPath, other); failed != 0 {
+        t.Errorf("runReplay() = %d failed", failed)
+    }
+    if got := readFile(t, filepath.Join(other, "src", "sub", "b.txt")); got != "b" {
+        t.Errorf("replayed b.txt = %q, want b", got)
+    }
+}
+
+func TestListMemFS(t *testing.T) {
+    m := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "bb"})
+    entries, e := List(context.Background(), ListOptions{FS: m, Directories: []string{"src"}, Recursive: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    paths := []string{}
+    for _, entry := range entries {
+        paths = append(paths, entry.Path)
+    }
+    sort.Strings(paths)
+    if got := strings.Join(paths, ","); got != "src,src/a.txt,src/sub,src/sub/b.txt" {
+        t.Errorf("List() = %s", got)
+    }
+}
+
+func TestCopyMemFS(t *testing.T) {
+    src := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/sub/b.txt": "bb"})
+    dest := NewMemFS()
+    report, e := Copy(context.Background(), CopyOptions{Manifests: []string{writeManifestFile(t, "src")}, Source: src,
+        Dest: dest})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if report.FilesCopied != 2 || report.BytesCopied != 3 || report.Failed != 0 {
+        t.Errorf("Copy() = %+v, want 2 files and 3 bytes copied", report)
+    }
+    if data, e := fs.ReadFile(dest, "src/sub/b.txt"); e != nil || string(data) != "bb" {
+        t.Errorf("copied file = %q, %v", data, e)
+    }
+}
+
+// A sync finds the files it copied up to date by their times, like the
+// command line, and copies a file again when its time differs either way.
+func TestCopyMemFSSync(t *testing.T) {
+    src := writeMemFS(t, map[string]string{"src/a.txt": "a", "src/b.txt": "b"})
+    old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+    src.Chtimes("src/a.txt", old, old)
+    dest := NewMemFS()
+    opts := CopyOptions{Manifests: []string{writeManifestFile(t, "src")}, Source: src, Dest: dest, Sync: true}
+    if _, e := Copy(context.Background(), opts); e != nil {
+        t.Fatal(e)
+    }
+    if info, e := fs.Stat(dest, "src/a.txt"); e != nil || !info.ModTime().Equal(old) {
+        t.Errorf("copied a.txt = %v, %v, want the time of the source", info, e)
+    }
+    report, e := Copy(context.Background(), opts)
+    if e != nil || report.FilesCopied != 0 || report.Skipped != 2 {
+        t.Errorf("second Copy() = %+v, %v, want 2 files up to date", report, e)
+    }
+    // Restored from an older backup, the source is older than its copy.
+    w, _ := src.Create("src/a.txt")
+    w.Write([]byte("z"))
+    w.Close()
+    src.Chtimes("src/a.txt", old.Add(-time.Hour), old.Add(-time.Hour))
+    report, e = Copy(context.Background(), opts)
+    if e != nil || report.FilesCopied != 1 || report.Skipped != 1 {
+        t.Errorf("Copy() of an older source = %+v, %v, want it copied", report, e)
+    }
+    if data, _ := fs.ReadFile(dest, "src/a.txt"); string(data) != "z" {
+        t.Errorf("a.txt = %q, want z", data)
+    }
+}
+
+// stdoutForTest returns what fn writes to the standard output.
+func stdoutForTest(t *testing.T, fn func()) string {
+    t.Helper()
+    f, e := os.CreateTemp(t.TempDir(), "stdout")
+    if e != nil {
+        t.Fatal(e)
+    }
+    defer f.Close()
+    stdout := os.Stdout
+    os.Stdout = f
+    defer func() { os.Stdout = stdout }()
+    fn()
+    data, _ := os.ReadFile(f.Name())
+    return string(data)
+}
+
+// Copy prints nothing and logs only to the logger it is given.
+func TestCopyOutput(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "b.txt": "b"})
+    dest := t.TempDir()
+    writeFiles(t, dest, map[string]string{"src/extra.txt": "x"})
+    blockTargetForTest(t, dest, filepath.Join("src", "b.txt"))
+    manifest := writeManifestFile(t, src)
+    var log bytes.Buffer
+    out := stdoutForTest(t, func() {
+        Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Directory: dest, Sync: true,
+            Delete: true, DryRun: true})
+        report, e := Copy(context.Background(), CopyOptions{Manifests: []string{manifest}, Directory: dest,
+            Sync: true, Delete: true, Logger: slog.New(slog.NewTextHandler(&log, nil))})
+        if e != nil || report.Failed != 1 {
+            t.Errorf("Copy() = %+v, %v, want b.txt failed", report, e)
+        }
+    })
+    if out != "" {
+        t.Errorf("Copy() printed %q", out)
+    }
+    if !strings.Contains(log.String(), "msg=error") {
+        t.Errorf("log = %q, want the error of b.txt", log.String())
+    }
+    if _, e := os.Stat(filepath.Join(dest, "src", "extra.txt")); !os.IsNotExist(e) {
+        t.Errorf("extra.txt = %v, want it deleted", e)
+    }
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+    k := &fileKey{key: bytes.Repeat([]byte{1}, 32)}
+    dir := t.TempDir()
+    for _, size := range []int{0, 10, encryptionChunkSize, 2*encryptionChunkSize + 5} {
+        plain := make([]byte, size)
+        rand.Read(plain)
+        src, enc, dec := filepath.Join(dir, "src"), filepath.Join(dir, "src.enc"), filepath.Join(dir, "dec")
+        if e := os.WriteFile(src, plain, 0644); e != nil {
+            t.Fatal(e)
+        }
+        if e := plainIO.encryptFile(src, enc, "aes-gcm", k); e != nil {
+            t.Fatal(e)
+        }
+        if e := plainIO.decryptFile(enc, dec, "aes-gcm", k); e != nil {
+            t.Fatalf("decryptFile() of %d bytes = %v", size, e)
+        }
+        if got := readFile(t, dec); got != string(plain) {
+            t.Errorf("%d bytes decrypted to %d bytes", size, len(got))
+        }
+    }
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+    k := &fileKey{key: bytes.Repeat([]byte{1}, 32)}
+    dir := t.TempDir()
+    src, enc := filepath.Join(dir, "src"), filepath.Join(dir, "src.enc")
+    if e := os.WriteFile(src, bytes.Repeat([]byte("a"), 2*encryptionChunkSize), 0644); e != nil {
+        t.Fatal(e)
+    }
+    if e := plainIO.encryptFile(src, enc, "aes-gcm", k); e != nil {
+        t.Fatal(e)
+    }
+    data, e := os.ReadFile(enc)
+    if e != nil {
+        t.Fatal(e)
+    }
+    flipped := append([]byte{}, data...)
+    flipped[len(flipped)-1] ^= 1
+    truncated := data[:len(data)-encryptionChunkSize/2]
+    chunk := encryptionChunkSize + gcmTagSize
+    header := len(data) - 2*chunk
+    dropped := append(append([]byte{}, data[:header]...), data[header+chunk:]...)
+    cases := map[string][]byte{"flipped": flipped, "truncated": truncated, "dropped chunk": dropped}
+    for name, tampered := range cases {
+        path := filepath.Join(dir, name+".enc")
+        if e := os.WriteFile(path, tampered, 0644); e != nil {
+            t.Fatal(e)
+        }
+        if e := plainIO.decryptFile(path, filepath.Join(dir, name), "aes-gcm", k); e == nil {
+            t.Errorf("decryptFile() of a %s file succeeded", name)
+        }
+    }
+    other := &fileKey{key: bytes.Repeat([]byte{2}, 32)}
+    if e := plainIO.decryptFile(enc, filepath.Join(dir, "other"), "aes-gcm", other); e == nil {
+        t.Error("decryptFile() with another key succeeded")
+    }
+}
+
+func TestReadManifest(t *testing.T) {
+    manifest := filepath.Join(t.TempDir(), "manifest.txt")
+    content := "/data/a-b.txt - 0.01MB\n\nnot an entry\n/data\t/data/sub - 0.02MB\n{\"path\":\"/data/c.txt\",\"size\":3}\n/data/last - 0.00MB"
+    if e := os.WriteFile(manifest, []byte(content), 0644); e != nil {
+        t.Fatal(e)
+    }
+    entries, e := readManifest(manifest, logger)
+    if e != nil {
+        t.Fatal(e)
+    }
+    paths := []string{}
+    for _, entry := range entries {
+        paths = append(paths, entry.Root+"|"+entry.Path)
+    }
+    if got := strings.Join(paths, ","); got != "|/data/a-b.txt,/data|/data/sub,|/data/c.txt,|/data/last" {
+        t.Errorf("readManifest() = %s", got)
+    }
+    if _, e := readManifest(filepath.Join(t.TempDir(), "missing.txt"), logger); e == nil {
+        t.Error("readManifest() of a missing file succeeded")
+    }
+}
+
+func TestAcquireLock(t *testing.T) {
+    host, _ := os.Hostname()
+    path := filepath.Join(t.TempDir(), lockFileName)
+    defer func() { heldLock = "" }()
+    old := time.Now().Add(-time.Minute)
+    for _, stale := range []string{"", "garbage", "0 " + host, "-1 " + host} {
+        if e := os.WriteFile(path, []byte(stale), 0644); e != nil {
+            t.Fatal(e)
+        }
+        os.Chtimes(path, old, old)
+        if e := acquireLock(path); e != nil {
+            t.Errorf("acquireLock() over %q = %v", stale, e)
+        }
+        os.Remove(path)
+    }
+    for _, held := range []string{fmt.Sprintf("%d %s", os.Getpid(), host), "1 other-host", ""} {
+        if e := os.WriteFile(path, []byte(held), 0644); e != nil {
+            t.Fatal(e)
+        }
+        if e := acquireLock(path); e == nil {
+            t.Errorf("acquireLock() over %q succeeded", held)
+        }
+    }
+}
+
+// TestMainProcess runs Main with the JSON array of arguments of
+// GOPY_TEST_ARGS, for runGopyForTest.
+func TestMainProcess(t *testing.T) {
+    var args []string
+    if e := json.Unmarshal([]byte(os.Getenv("GOPY_TEST_ARGS")), &args); e != nil {
+        t.Skip("run by runGopyForTest")
+    }
+    os.Args = append([]string{"gopy"}, args...)
+    Main()
+}
+
+// runGopyForTest runs gopy with args in a process of its own and returns
+// its output and exit code.
+func runGopyForTest(t *testing.T, args ...string) (string, int) {
+    t.Helper()
+    exe, e := os.Executable()
+    if e != nil {
+        t.Fatal(e)
+    }
+    data, _ := json.Marshal(args)
+    cmd := exec.Command(exe, "-test.run=^TestMainProcess$")
+    cmd.Env = append(os.Environ(), "GOPY_TEST_ARGS="+string(data))
+    output, e := cmd.CombinedOutput()
+    if exitError, ok := e.(*exec.ExitError); ok {
+        return string(output), exitError.ExitCode()
+    } else if e != nil {
+        t.Fatal(e)
+    }
+    return string(output), 0
+}
+
+func TestCopyArchiveLock(t *testing.T) {
+    src := t.TempDir()
+    writeFiles(t, src, map[string]string{"a.txt": "a"})
+    manifest := writeManifestFile(t, filepath.Join(src, "a.txt"))
+    archive := filepath.Join(t.TempDir(), "out.zip")
+    if output, code := runGopyForTest(t, "copy", "-input", manifest, "-directory", archive, "-archive", "zip"); code != 0 {
+        t.Fatalf("copy -archive zip exited with %d: %s", code, output)
+    }
+    if fi, e := os.Stat(archive); e != nil || !fi.Mode().IsRegular() {
+        t.Errorf("archive %s is not a file: %v", archive, e)
+    }
+    if fileExists(archive + lockFileName) {
+        t.Error("lock of the archive left behind")
+    }
+}
+
+func TestLargeFileReportWithFailures(t *testing.T) {
+    src := t.TempDir()
+    writeFiles(t, src, map[string]string{"big.bin": strings.Repeat("x", 4096)})
+    manifest := writeManifestFile(t, filepath.Join(src, "big.bin"), filepath.Join(src, "missing.bin"))
+    report := filepath.Join(t.TempDir(), "large.txt")
+    output, code := runGopyForTest(t, "copy", "-input", manifest, "-directory", t.TempDir(), "-warn-over", "1KB",
+        "-warn-report", report)
+    if code != exitPartial {
+        t.Fatalf("copy with a missing file exited with %d: %s", code, output)
+    }
+    if got := readFile(t, report); !strings.Contains(got, "big.bin") {
+        t.Errorf("large-file report = %q", got)
+    }
+}
+
+func TestImportJobName(t *testing.T) {
+    dir := t.TempDir()
+    configFile := filepath.Join(dir, "config", "gopy.json")
+    os.Mkdir(filepath.Dir(configFile), 0755)
+    for _, job := range []string{"../../x", "..", "a/b", `a\b`, ""} {
+        bundle := filepath.Join(dir, "bundle.json")
+        data, _ := json.Marshal(jobBundle{job, map[string]interface{}{"input": "files.txt"},
+            map[string][]byte{"files.txt": []byte("a.txt - 0.01 MB\n")}})
+        os.WriteFile(bundle, data, 0644)
+        if output, code := runGopyForTest(t, "job", "import", "-input", bundle, "-config", configFile); code != exitUsage {
+            t.Errorf("import of job %q exited with %d: %s", job, code, output)
+        }
+    }
+    entries, _ := os.ReadDir(dir)
+    if len(entries) != 2 || fileExists(configFile) {
+        t.Errorf("import of invalid job names wrote files: %v", entries)
+    }
+}
+
+func TestRemoveStaleLock(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, lockFileName)
+    os.WriteFile(path, []byte("1 host\n"), 0644)
+    if e := removeStaleLock(path, []byte("1 host\n")); e != nil || fileExists(path) {
+        t.Errorf("removeStaleLock() of the stale lock = %v, exists %v", e, fileExists(path))
+    }
+    // Another process took the stale lock over and wrote its own since it
+    // was read.
+    os.WriteFile(path, []byte("2 host\n"), 0644)
+    if e := removeStaleLock(path, []byte("1 host\n")); e != nil {
+        t.Errorf("removeStaleLock() of a new lock = %v", e)
+    }
+    if got := readFile(t, path); got != "2 host\n" {
+        t.Errorf("new lock = %q after removeStaleLock()", got)
+    }
+    if e := removeStaleLock(filepath.Join(dir, "missing"), nil); e != nil {
+        t.Errorf("removeStaleLock() of a missing lock = %v", e)
+    }
+    if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+        t.Errorf("removeStaleLock() left %d files", len(entries))
+    }
+}
+
+func TestWatcher(t *testing.T) {
+    w, e := newWatcher()
+    if e != nil {
+        t.Skip(e)
+    }
+    dir := t.TempDir()
+    if e := w.add(dir); e != nil {
+        t.Fatal(e)
+    }
+    path := filepath.Join(dir, "new")
+    if e := os.WriteFile(path, []byte("x"), 0644); e != nil {
+        t.Fatal(e)
+    }
+    paths, all, e := w.wait()
+    if e != nil {
+        t.Fatal(e)
+    }
+    if all || len(paths) == 0 || paths[0] != path {
+        t.Errorf("wait() = %v, %v, want [%s]", paths, all, path)
+    }
+}
+
+func TestDeltaSyncKeepsBackup(t *testing.T) {
+    for _, inPlace := range []bool{false, true} {
+        old := strings.Repeat("a", 3*deltaBlockSize)
+        changed := old[:deltaBlockSize] + strings.Repeat("b", deltaBlockSize) + old[2*deltaBlockSize:]
+        src := filepath.Join(t.TempDir(), "src")
+        writeFiles(t, src, map[string]string{"big": old})
+        manifest := writeManifestFile(t, src)
+        dest := t.TempDir()
+        copyForTest(t, dest, manifest, copyOptions{sync: true})
+
+        writeFiles(t, src, map[string]string{"big": changed})
+        later := time.Now().Add(time.Hour)
+        os.Chtimes(filepath.Join(src, "big"), later, later)
+        copyForTest(t, dest, manifest, copyOptions{sync: true, delta: true, inPlace: inPlace, backupExt: ".bak"})
+        if got := readFile(t, filepath.Join(dest, "src", "big")); got != changed {
+            t.Fatalf("inPlace %v: synced file differs", inPlace)
+        }
+        if got := readFile(t, filepath.Join(dest, "src", "big.bak")); got != old {
+            t.Errorf("inPlace %v: backup differs from the old file", inPlace)
+        }
+        if failed := runUndo(dest); failed != 0 {
+            t.Errorf("inPlace %v: runUndo() = %d failed", inPlace, failed)
+        }
+        if got := readFile(t, filepath.Join(dest, "src", "big")); got != old {
+            t.Errorf("inPlace %v: undo did not restore the old file", inPlace)
+        }
+    }
+}
+
+func TestTenantCheck(t *testing.T) {
+    root := t.TempDir()
+    outside := t.TempDir()
+    os.Symlink(outside, filepath.Join(root, "escape"))
+    other := t.TempDir()
+    os.WriteFile(filepath.Join(root, "files.txt"), nil, 0644)
+    tn := &tenant{Token: "a", Roots: []string{resolvePath(root), resolvePath(other)}}
+    allowed := []jobRequest{
+        {Command: "copy", Options: map[string]string{"input": filepath.Join(root, "files.txt"),
+            "directory": filepath.Join(root, "new", "backup"), "skip-junk": "true"}},
+        {Command: "list", Args: []string{root, filepath.Join(other, "sub")}, Options: map[string]string{"output": "-"}},
+        {Command: "list", Args: []string{filepath.Join(root, "sub", "..", "a")}},
+    }
+    for _, request := range allowed {
+        if e := tn.check(request); e != nil {
+            t.Errorf("check(%+v) = %v", request, e)
+        }
+    }
+    refused := []jobRequest{
+        {Command: "list", Args: []string{outside}},
+        {Command: "list", Args: []string{filepath.Join(root, "..")}},
+        {Command: "list", Args: []string{filepath.Join(root, "sub", "..", "..")}},
+        {Command: "list", Args: []string{root + "-sibling"}},
+        {Command: "list", Args: []string{"relative"}},
+        {Command: "list", Args: []string{filepath.Join(root, "escape", "sub")}},
+        {Command: "list", Args: []string{root}, Options: map[string]string{"output": filepath.Join(outside, "l.txt")}},
+        {Command: "copy", Options: map[string]string{"directory": outside}},
+        {Command: "copy", Options: map[string]string{"directory": filepath.Join(root, "escape")}},
+        {Command: "copy", Options: map[string]string{"directory": root, "link-dest": outside}},
+        {Command: "copy", Options: map[string]string{"directory": root, "journal": filepath.Join(outside, "j")}},
+        {Command: "copy", Options: map[string]string{"directory": root, "pre-hook": "true"}},
+        {Command: "copy", Options: map[string]string{"directory": root, "config": filepath.Join(root, "c.json")}},
+        {Command: "copy", Options: map[string]string{"directory": root, "s3-endpoint": "http://127.0.0.1"}},
+        {Command: "list", Args: []string{root}, Options: map[string]string{"-output": filepath.Join(outside, "l.txt")}},
+        {Command: "copy", Options: map[string]string{"--directory": outside}},
+        {Command: "copy", Options: map[string]string{"-input": filepath.Join(outside, "files.txt"), "directory": root}},
+        {Command: "copy", Args: []string{"-input=" + filepath.Join(outside, "files.txt")}, Options: map[string]string{"directory": root}},
+        {Command: "list", Args: []string{root}, Options: map[string]string{"links": "follow"}},
+        {Command: "copy", Options: map[string]string{"directory": root, "links": "recreate"}},
+    }
+    for _, request := range refused {
+        if e := tn.check(request); e == nil {
+            t.Errorf("check(%+v) allowed", request)
+        }
+    }
+}
+
+func TestTenantCheckManifest(t *testing.T) {
+    root := t.TempDir()
+    outside := t.TempDir()
+    os.Symlink(outside, filepath.Join(root, "escape"))
+    tn := &tenant{Token: "a", Roots: []string{resolvePath(root)}}
+    manifest := filepath.Join(root, "files.txt")
+    check := func(command string, lines ...string) error {
+        os.WriteFile(manifest, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+        return tn.check(jobRequest{Command: command, Options: map[string]string{"input": manifest,
+            "directory": filepath.Join(root, "copy")}})
+    }
+    inside := filepath.Join(root, "a.txt") + " - 0.01 MB"
+    if e := check("copy", inside, `{"path": "`+filepath.ToSlash(filepath.Join(root, "sub"))+`", "size": 1}`); e != nil {
+        t.Errorf("check of a manifest below the roots = %v", e)
+    }
+    for _, entry := range []string{
+        filepath.Join(outside, "secret.txt") + " - 0.01 MB",
+        `{"path": "` + filepath.ToSlash(filepath.Join(outside, "secret.txt")) + `", "size": 1}`,
+        filepath.Join(root, "..", filepath.Base(outside), "secret.txt") + " - 0.01 MB",
+        filepath.Join(root, "escape", "secret.txt") + " - 0.01 MB",
+        "relative.txt - 0.01 MB",
+        "https://example.com/file.iso - 1.00 MB",
+        "http://169.254.169.254/latest/meta-data/ - 0.01 MB",
+        "user@host:/etc/passwd - 0.01 MB",
+        "s3://bucket/key - 0.01 MB",
+        "gs://bucket/object - 0.01 MB",
+        "az://account/container/blob - 0.01 MB",
+    } {
+        for _, command := range []string{"copy", "sync", "check"} {
+            if e := check(command, inside, entry); e == nil {
+                t.Errorf("%s with manifest entry %s allowed", command, entry)
+            }
+        }
+    }
+    dir := filepath.Join(root, "manifests")
+    os.Mkdir(dir, 0755)
+    os.WriteFile(filepath.Join(dir, "a.txt"), []byte(inside+"\n"), 0644)
+    os.WriteFile(filepath.Join(dir, "b.txt"), []byte(filepath.Join(outside, "secret.txt")+" - 0.01 MB\n"), 0644)
+    if e := tn.check(jobRequest{Command: "copy", Options: map[string]string{"input": dir, "directory": root}}); e == nil {
+        t.Error("copy with a manifest directory listing a file outside the roots allowed")
+    }
+    if e := check("extract", "not a manifest"); e != nil {
+        t.Errorf("extract read its archive as a manifest: %v", e)
+    }
+}
+
+func TestKeepManifest(t *testing.T) {
+    s := &server{}
+    entries := []jsonEntry{{Path: "/data/a.txt", Size: 10240, approximate: true}, {Path: "/data/b.txt", Size: 3}}
+    path, e := s.keepManifest(entries)
+    if e != nil {
+        t.Fatal(e)
+    }
+    defer os.RemoveAll(s.manifests)
+    if !isWithin(path, s.manifests) {
+        t.Errorf("manifest %s kept outside %s", path, s.manifests)
+    }
+    if got, e := readManifest(path, logger); e != nil || !reflect.DeepEqual(got, entries) {
+        t.Errorf("kept manifest = %+v, %v, want %+v", got, e, entries)
+    }
+}
+
+func TestReadTenants(t *testing.T) {
+    dir := t.TempDir()
+    configFile := filepath.Join(dir, "config.json")
+    for _, tenants := range []string{
+        `{"a": {"roots": ["/a"]}}`,
+        `{"a": {"token": "x", "roots": ["/a"]}, "b": {"token": "x", "roots": ["/b"]}}`,
+        `{"a": {"token": "x"}}`,
+    } {
+        os.WriteFile(configFile, []byte(`{"tenants": `+tenants+`}`), 0644)
+        if _, e := readTenants(configFile); e == nil {
+            t.Errorf("readTenants(%s) accepted", tenants)
+        }
+    }
+    os.Symlink(dir, filepath.Join(dir, "link"))
+    os.WriteFile(configFile, []byte(`{"tenants": {"a": {"token": "x", "roots": ["`+
+        filepath.ToSlash(filepath.Join(dir, "link", "data"))+`"]}}}`), 0644)
+    tenants, e := readTenants(configFile)
+    if e != nil {
+        t.Fatal(e)
+    }
+    if got, want := tenants["a"].Roots[0], filepath.Join(resolvePath(dir), "data"); got != want {
+        t.Errorf("root = %s, want %s", got, want)
+    }
+}
+
+func TestServerTenants(t *testing.T) {
+    s := &server{tenants: map[string]*tenant{"a": {Token: "token-a", Roots: []string{t.TempDir()}, MaxJobs: 1},
+        "b": {Token: "token-b", Roots: []string{t.TempDir()}}}}
+    s.jobs = []*serverJob{{ID: 1, State: "running", Tenant: "a"}, {ID: 2, State: "succeeded", Tenant: "b"}}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/jobs", s.authorized(s.handleJobs))
+    mux.HandleFunc("/jobs/", s.authorized(s.handleJob))
+    request := func(method, path, token, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, path, strings.NewReader(body))
+        if token != "" {
+            r.Header.Set("Authorization", "Bearer "+token)
+        }
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, r)
+        return w
+    }
+    if w := request("GET", "/jobs", "", ""); w.Code != http.StatusUnauthorized {
+        t.Errorf("GET /jobs without a token = %d", w.Code)
+    }
+    for _, token := range []string{"token", "token-a ", "token-c", "TOKEN-A"} {
+        if w := request("GET", "/jobs", token, ""); w.Code != http.StatusUnauthorized {
+            t.Errorf("GET /jobs with token %q = %d", token, w.Code)
+        }
+    }
+    for _, header := range []string{"token-a", "Basic token-a", "bearer token-a"} {
+        r := httptest.NewRequest("GET", "/jobs/1", nil)
+        r.Header.Set("Authorization", header)
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, r)
+        if w.Code != http.StatusUnauthorized {
+            t.Errorf("GET /jobs/1 with Authorization %q = %d", header, w.Code)
+        }
+    }
+    if w := request("DELETE", "/jobs/1", "token-b", ""); w.Code != http.StatusNotFound || s.jobs[0].State != "running" {
+        t.Errorf("DELETE /jobs/1 of b = %d, job %s", w.Code, s.jobs[0].State)
+    }
+    var jobs []serverJob
+    if w := request("GET", "/jobs", "token-a", ""); json.Unmarshal(w.Body.Bytes(), &jobs) != nil || len(jobs) != 1 ||
+        jobs[0].ID != 1 {
+        t.Errorf("GET /jobs of a = %s", w.Body)
+    }
+    if w := request("GET", "/jobs/2", "token-a", ""); w.Code != http.StatusNotFound {
+        t.Errorf("GET /jobs/2 of a = %d, want 404", w.Code)
+    }
+    if w := request("POST", "/jobs", "token-b", `{"command":"list","args":["/"]}`); w.Code != http.StatusForbidden {
+        t.Errorf("POST /jobs outside the roots = %d, want 403", w.Code)
+    }
+    body := `{"command":"list","args":["` + filepath.ToSlash(s.tenants["a"].Roots[0]) + `"]}`
+    if w := request("POST", "/jobs", "token-a", body); w.Code != http.StatusTooManyRequests {
+        t.Errorf("POST /jobs over the quota = %d, want 429", w.Code)
+    }
+    body = `{"command":"list","args":["` + filepath.ToSlash(s.tenants["b"].Roots[0]) + `"]}`
+    if w := request("POST", "/jobs", "token-b", body); w.Code != http.StatusAccepted {
+        t.Errorf("POST /jobs of b = %d, want 202", w.Code)
+    } else if links := s.jobs[len(s.jobs)-1].Request.Options["links"]; links != "skip" {
+        t.Errorf("job of b with links %q, want skip", links)
+    }
+}
+
+func TestJobFollow(t *testing.T) {
+    j := &serverJob{done: make(chan struct{})}
+    j.log.Write([]byte("{\"msg\":\"file_copied\"}\n{\"msg\":"))
+    var got []string
+    go func() {
+        time.Sleep(300 * time.Millisecond)
+        j.log.Write([]byte("\"file_failed\"}\n"))
+        close(j.done)
+    }()
+    e := j.follow(context.Background(), func(lines []byte) error {
+        got = append(got, string(lines))
+        return nil
+    })
+    if want := []string{"{\"msg\":\"file_copied\"}\n", "{\"msg\":\"file_failed\"}\n"}; e != nil || !reflect.DeepEqual(got, want) {
+        t.Errorf("follow sent %q, %v, want %q", got, e, want)
+    }
+}
+
+func TestServerToken(t *testing.T) {
+    s := &server{token: "secret"}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/jobs", s.authorized(s.handleJobs))
+    for _, header := range []string{"", "Bearer ", "Bearer other", "secret"} {
+        r := httptest.NewRequest("GET", "/jobs", nil)
+        if header != "" {
+            r.Header.Set("Authorization", header)
+        }
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, r)
+        if w.Code != http.StatusUnauthorized {
+            t.Errorf("GET /jobs with Authorization %q = %d", header, w.Code)
+        }
+    }
+    post := func(body string) int {
+        r := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+        r.Header.Set("Authorization", "Bearer secret")
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, r)
+        return w.Code
+    }
+    for _, option := range []string{"pre-hook", "post-hook", "on-file-hook", "filter-script", "job", "config", "-pre-hook",
+        "--pre-hook", "pre-hook=touch /tmp/x", "recursive", "no-such-option"} {
+        body := `{"command":"copy","options":{"` + option + `":"touch /tmp/x"},"args":["/"]}`
+        if code := post(body); code != http.StatusForbidden || len(s.jobs) != 0 {
+            t.Errorf("POST /jobs with option %s = %d", option, code)
+        }
+    }
+    for _, arg := range []string{"-pre-hook=touch /tmp/x", "--config=/tmp/c.json", "-"} {
+        body := `{"command":"list","args":["` + arg + `", "/"]}`
+        if code := post(body); code != http.StatusForbidden || len(s.jobs) != 0 {
+            t.Errorf("POST /jobs with argument %s = %d", arg, code)
+        }
+    }
+    if _, ok := (&server{}).tenant(httptest.NewRequest("GET", "/jobs", nil)); ok {
+        t.Error("server without a token accepted a request without one")
+    }
+}
+
+// fakeAzure serves the blobs of a container at /account/container, as Azurite
+// does, from a map.
+func fakeAzure(t *testing.T) (*httptest.Server, map[string][]byte) {
+    blobs := map[string][]byte{}
+    modTimes := map[string]time.Time{}
+    var mu sync.Mutex
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey account:") || r.Header.Get("x-ms-date") == "" {
+            w.WriteHeader(http.StatusForbidden)
+            return
+        }
+        name := strings.TrimPrefix(r.URL.Path, "/account/container/")
+        switch {
+        case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+            names := []string{}
+            for name := range blobs {
+                if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+                    names = append(names, name)
+                }
+            }
+            sort.Strings(names)
+            fmt.Fprint(w, "<EnumerationResults><Blobs>")
+            for _, name := range names {
+                fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified>"+
+                    "<Content-Length>%d</Content-Length></Properties></Blob>", name,
+                    modTimes[name].UTC().Format(http.TimeFormat), len(blobs[name]))
+            }
+            fmt.Fprint(w, "</Blobs><NextMarker /></EnumerationResults>")
+        case r.Method == http.MethodPut && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+            data, _ := io.ReadAll(r.Body)
+            blobs[name], modTimes[name] = data, time.Now()
+            w.WriteHeader(http.StatusCreated)
+        case r.Method == http.MethodGet || r.Method == http.MethodHead:
+            data, ok := blobs[name]
+            if !ok {
+                w.WriteHeader(http.StatusNotFound)
+                return
+            }
+            w.Header().Set("Last-Modified", modTimes[name].UTC().Format(http.TimeFormat))
+            w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+            if r.Method == http.MethodGet {
+                w.Write(data)
+            }
+        default:
+            w.WriteHeader(http.StatusBadRequest)
+        }
+    }))
+    t.Cleanup(server.Close)
+    t.Setenv("AZURE_STORAGE_ENDPOINT", server.URL+"/account")
+    t.Setenv("AZURE_STORAGE_KEY", base64.StdEncoding.EncodeToString([]byte("key")))
+    return server, blobs
+}
+
+func TestAWSCredentials(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{
+        "credentials": "[default]\naws_access_key_id = A\naws_secret_access_key = a\n\n[work]\n" +
+            "aws_access_key_id = W\naws_secret_access_key = w\naws_session_token = t\n",
+        "config": "[profile work]\nregion = eu-west-1\n",
+    })
+    for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_REGION", "AWS_DEFAULT_REGION",
+        "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+        t.Setenv(env, "")
+    }
+    t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+    t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+    t.Setenv("AWS_PROFILE", "work")
+    c, e := newS3Client()
+    if e != nil {
+        t.Fatal(e)
+    }
+    if c.region != "eu-west-1" || c.creds.accessKey != "W" || c.creds.secretKey != "w" || c.creds.token != "t" {
+        t.Errorf("profile work gave region %s and %+v", c.region, c.creds)
+    }
+
+    expires := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+    fetches := 0
+    imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+            io.WriteString(w, "session")
+        case r.Header.Get("X-aws-ec2-metadata-token") != "session":
+            w.WriteHeader(http.StatusUnauthorized)
+        case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+            io.WriteString(w, "backup-role\n")
+        case r.URL.Path == "/latest/meta-data/iam/security-credentials/backup-role":
+            fetches++
+            json.NewEncoder(w).Encode(map[string]interface{}{"Code": "Success", "AccessKeyId": "I",
+                "SecretAccessKey": "i", "Token": strconv.Itoa(fetches), "Expiration": expires})
+        default:
+            w.WriteHeader(http.StatusNotFound)
+        }
+    }))
+    defer imds.Close()
+    t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "missing"))
+    t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", imds.URL)
+    if c, e = newS3Client(); e != nil {
+        t.Fatal(e)
+    }
+    creds, e := c.credentials()
+    if e != nil {
+        t.Fatal(e)
+    }
+    if creds.accessKey != "I" || creds.token != "2" || !creds.expires.Equal(expires) {
+        t.Errorf("instance role gave %+v, want credentials fetched again as they expire soon", creds)
+    }
+    t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+    if _, e := newS3Client(); e == nil {
+        t.Error("newS3Client() found credentials with none configured")
+    }
+}
+
+func TestAzureSync(t *testing.T) {
+    _, blobs := fakeAzure(t)
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "bb"})
+    past := time.Now().Add(-time.Hour)
+    os.Chtimes(filepath.Join(src, "a.txt"), past, past)
+    os.Chtimes(filepath.Join(src, "sub", "b.txt"), past, past)
+    manifest := writeManifestFile(t, src)
+    copyForTest(t, "az://account/container/backup", manifest, copyOptions{sync: true})
+    if got := string(blobs["backup/src/sub/b.txt"]); got != "bb" {
+        t.Fatalf("uploaded b.txt = %q", got)
+    }
+
+    writeFiles(t, src, map[string]string{"a.txt": "aaa"})
+    later := time.Now().Add(time.Hour)
+    os.Chtimes(filepath.Join(src, "a.txt"), later, later)
+    result, e := copyManifests("az://account/container/backup", []string{manifest}, copyOptions{sync: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.files != 1 || result.skipped != 1 || string(blobs["backup/src/a.txt"]) != "aaa" {
+        t.Errorf("sync copied %d and skipped %d files, a.txt = %q", result.files, result.skipped, blobs["backup/src/a.txt"])
+    }
+
+    st, e := openStorage("az://account/container/backup")
+    if e != nil {
+        t.Fatal(e)
+    }
+    names := []string{}
+    st.Walk(func(name string, info storageInfo) error {
+        names = append(names, name)
+        return nil
+    })
+    if got := strings.Join(names, ","); got != "src,src/a.txt,src/sub,src/sub/b.txt" {
+        t.Errorf("Walk() = %s", got)
+    }
+    if info, e := st.Stat("src/sub"); e != nil || !info.IsDir {
+        t.Errorf("Stat(src/sub) = %+v, %v", info, e)
+    }
+}
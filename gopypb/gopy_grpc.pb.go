@@ -0,0 +1,237 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: gopy.proto
+
+package gopypb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Gopy_ListFiles_FullMethodName = "/gopy.Gopy/ListFiles"
+	Gopy_CopyFiles_FullMethodName = "/gopy.Gopy/CopyFiles"
+	Gopy_CancelJob_FullMethodName = "/gopy.Gopy/CancelJob"
+)
+
+// GopyClient is the client API for Gopy service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Gopy runs list and copy jobs on a gopy server, like its HTTP API. Every call
+// needs the "authorization" metadata "Bearer <token>" of the HTTP API.
+type GopyClient interface {
+	// ListFiles queues a list job and streams its progress until it finishes.
+	ListFiles(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error)
+	// CopyFiles queues a copy job and streams its progress until it finishes.
+	CopyFiles(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error)
+	// CancelJob cancels a queued or running job and returns it once stopped.
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error)
+}
+
+type gopyClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewGopyClient(cc grpc.ClientConnInterface) GopyClient {
+	return &gopyClient{cc}
+}
+
+func (c *gopyClient) ListFiles(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Gopy_ServiceDesc.Streams[0], Gopy_ListFiles_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[JobRequest, JobProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gopy_ListFilesClient = grpc.ServerStreamingClient[JobProgress]
+
+func (c *gopyClient) CopyFiles(ctx context.Context, in *JobRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[JobProgress], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Gopy_ServiceDesc.Streams[1], Gopy_CopyFiles_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[JobRequest, JobProgress]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gopy_CopyFilesClient = grpc.ServerStreamingClient[JobProgress]
+
+func (c *gopyClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Job)
+	err := c.cc.Invoke(ctx, Gopy_CancelJob_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GopyServer is the server API for Gopy service.
+// All implementations must embed UnimplementedGopyServer
+// for forward compatibility.
+//
+// Gopy runs list and copy jobs on a gopy server, like its HTTP API. Every call
+// needs the "authorization" metadata "Bearer <token>" of the HTTP API.
+type GopyServer interface {
+	// ListFiles queues a list job and streams its progress until it finishes.
+	ListFiles(*JobRequest, grpc.ServerStreamingServer[JobProgress]) error
+	// CopyFiles queues a copy job and streams its progress until it finishes.
+	CopyFiles(*JobRequest, grpc.ServerStreamingServer[JobProgress]) error
+	// CancelJob cancels a queued or running job and returns it once stopped.
+	CancelJob(context.Context, *CancelJobRequest) (*Job, error)
+	mustEmbedUnimplementedGopyServer()
+}
+
+// UnimplementedGopyServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedGopyServer struct{}
+
+func (UnimplementedGopyServer) ListFiles(*JobRequest, grpc.ServerStreamingServer[JobProgress]) error {
+	return status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
+func (UnimplementedGopyServer) CopyFiles(*JobRequest, grpc.ServerStreamingServer[JobProgress]) error {
+	return status.Errorf(codes.Unimplemented, "method CopyFiles not implemented")
+}
+func (UnimplementedGopyServer) CancelJob(context.Context, *CancelJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedGopyServer) mustEmbedUnimplementedGopyServer() {}
+func (UnimplementedGopyServer) testEmbeddedByValue()              {}
+
+// UnsafeGopyServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to GopyServer will
+// result in compilation errors.
+type UnsafeGopyServer interface {
+	mustEmbedUnimplementedGopyServer()
+}
+
+func RegisterGopyServer(s grpc.ServiceRegistrar, srv GopyServer) {
+	// If the following call pancis, it indicates UnimplementedGopyServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Gopy_ServiceDesc, srv)
+}
+
+func _Gopy_ListFiles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(JobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GopyServer).ListFiles(m, &grpc.GenericServerStream[JobRequest, JobProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gopy_ListFilesServer = grpc.ServerStreamingServer[JobProgress]
+
+func _Gopy_CopyFiles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(JobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(GopyServer).CopyFiles(m, &grpc.GenericServerStream[JobRequest, JobProgress]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Gopy_CopyFilesServer = grpc.ServerStreamingServer[JobProgress]
+
+func _Gopy_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(GopyServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Gopy_CancelJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(GopyServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Gopy_ServiceDesc is the grpc.ServiceDesc for Gopy service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Gopy_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gopy.Gopy",
+	HandlerType: (*GopyServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CancelJob",
+			Handler:    _Gopy_CancelJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListFiles",
+			Handler:       _Gopy_ListFiles_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "CopyFiles",
+			Handler:       _Gopy_CopyFiles_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "gopy.proto",
+}
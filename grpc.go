@@ -0,0 +1,142 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+
+package gopy
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/fredyw/gopy/gopypb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcServer serves the jobs of a server over gRPC, with the service of
+// gopypb/gopy.proto, for the same tenants and with the same checks as the
+// HTTP API.
+type grpcServer struct {
+    gopypb.UnimplementedGopyServer
+    s *server
+}
+
+// grpcCodes are the gRPC codes of the HTTP statuses refusing a job.
+var grpcCodes = map[int]codes.Code{http.StatusBadRequest: codes.InvalidArgument, http.StatusForbidden: codes.PermissionDenied,
+    http.StatusTooManyRequests: codes.ResourceExhausted}
+
+// tenant returns the name of the tenant whose token the "authorization"
+// metadata of ctx carries, as server.tenant does for HTTP requests.
+func (g *grpcServer) tenant(ctx context.Context) (string, error) {
+    md, _ := metadata.FromIncomingContext(ctx)
+    for _, value := range md.Get("authorization") {
+        if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+            if name, ok := g.s.tenantOf(token); ok {
+                return name, nil
+            }
+        }
+    }
+    return "", status.Error(codes.Unauthenticated, "missing or unknown token")
+}
+
+func jobMessage(j *serverJob) *gopypb.Job {
+    return &gopypb.Job{Id: int64(j.ID), Command: j.Request.Command, State: j.State, ExitCode: int32(j.ExitCode),
+        FilesDone: int64(j.Files), Output: j.Output}
+}
+
+func (g *grpcServer) ListFiles(request *gopypb.JobRequest, stream gopypb.Gopy_ListFilesServer) error {
+    return g.runJob("list", request, stream)
+}
+
+func (g *grpcServer) CopyFiles(request *gopypb.JobRequest, stream gopypb.Gopy_CopyFilesServer) error {
+    return g.runJob("copy", request, stream)
+}
+
+// runJob queues a job of command and sends the queued job, its events and
+// the finished job to stream.
+func (g *grpcServer) runJob(command string, request *gopypb.JobRequest, stream grpc.ServerStreamingServer[gopypb.JobProgress]) error {
+    name, e := g.tenant(stream.Context())
+    if e != nil {
+        return e
+    }
+    j, code, e := g.s.queue(jobRequest{Command: command, Options: request.Options, Args: request.Args}, name)
+    if e != nil {
+        grpcCode, ok := grpcCodes[code]
+        if !ok {
+            grpcCode = codes.Internal
+        }
+        return status.Error(grpcCode, e.Error())
+    }
+    if e := stream.Send(&gopypb.JobProgress{Progress: &gopypb.JobProgress_Job{Job: jobMessage(j.snapshot())}}); e != nil {
+        return e
+    }
+    e = j.follow(stream.Context(), func(lines []byte) error {
+        for _, line := range bytes.Split(bytes.TrimSuffix(lines, []byte("\n")), []byte("\n")) {
+            var fields map[string]interface{}
+            if json.Unmarshal(line, &fields) != nil {
+                fields = map[string]interface{}{"msg": string(line)}
+            }
+            event, e := structpb.NewStruct(fields)
+            if e != nil {
+                return e
+            }
+            if e := stream.Send(&gopypb.JobProgress{Progress: &gopypb.JobProgress_Event{Event: event}}); e != nil {
+                return e
+            }
+        }
+        return nil
+    })
+    if e != nil {
+        return e
+    }
+    return stream.Send(&gopypb.JobProgress{Progress: &gopypb.JobProgress_Job{Job: jobMessage(j.snapshot())}})
+}
+
+func (g *grpcServer) CancelJob(ctx context.Context, request *gopypb.CancelJobRequest) (*gopypb.Job, error) {
+    name, e := g.tenant(ctx)
+    if e != nil {
+        return nil, e
+    }
+    j := g.s.job(strconv.FormatInt(request.Id, 10))
+    if j == nil || j.Tenant != name {
+        return nil, status.Errorf(codes.NotFound, "no job %d", request.Id)
+    }
+    if !j.cancel() {
+        return nil, status.Error(codes.FailedPrecondition, "job is not queued or running")
+    }
+    <-j.done
+    return jobMessage(j.snapshot()), nil
+}
+
+// serveGRPC serves the jobs of s over gRPC on l.
+func (s *server) serveGRPC(l net.Listener) error {
+    g := grpc.NewServer()
+    gopypb.RegisterGopyServer(g, &grpcServer{s: s})
+    return g.Serve(l)
+}
@@ -0,0 +1,109 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+
+package gopy
+
+import (
+    "context"
+    "net"
+    "path/filepath"
+    "testing"
+
+    "github.com/fredyw/gopy/gopypb"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+    "google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCServer(t *testing.T) {
+    // No slot is ever free, so jobs stay queued until cancelled.
+    s := &server{slots: make(chan struct{}), token: "secret"}
+    l := bufconn.Listen(1 << 20)
+    go s.serveGRPC(l)
+    defer l.Close()
+    conn, e := grpc.NewClient("passthrough:///gopy", grpc.WithTransportCredentials(insecure.NewCredentials()),
+        grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }))
+    if e != nil {
+        t.Fatal(e)
+    }
+    defer conn.Close()
+    client := gopypb.NewGopyClient(conn)
+    ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+    dir := t.TempDir()
+
+    for _, c := range []struct {
+        ctx     context.Context
+        request *gopypb.JobRequest
+        code    codes.Code
+    }{
+        {context.Background(), &gopypb.JobRequest{Args: []string{dir}}, codes.Unauthenticated},
+        {metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer other"),
+            &gopypb.JobRequest{Args: []string{dir}}, codes.Unauthenticated},
+        {ctx, &gopypb.JobRequest{Options: map[string]string{"pre-hook": "touch /tmp/x"}, Args: []string{dir}},
+            codes.PermissionDenied},
+        {ctx, &gopypb.JobRequest{Args: []string{"-config=/tmp/c.json"}}, codes.PermissionDenied},
+    } {
+        stream, e := client.ListFiles(c.ctx, c.request)
+        if e == nil {
+            _, e = stream.Recv()
+        }
+        if status.Code(e) != c.code {
+            t.Errorf("ListFiles(%v) = %v, want %v", c.request, e, c.code)
+        }
+    }
+    if len(s.jobs) != 0 {
+        t.Fatalf("refused requests queued %d jobs", len(s.jobs))
+    }
+
+    output := filepath.Join(dir, "files.txt")
+    stream, e := client.ListFiles(ctx, &gopypb.JobRequest{Options: map[string]string{"output": output}, Args: []string{dir}})
+    if e != nil {
+        t.Fatal(e)
+    }
+    progress, e := stream.Recv()
+    if e != nil {
+        t.Fatal(e)
+    }
+    job := progress.GetJob()
+    if job == nil || job.Command != "list" || job.State != "queued" {
+        t.Fatalf("first progress = %v, want the queued list job", progress)
+    }
+    if _, e := client.CancelJob(context.Background(), &gopypb.CancelJobRequest{Id: job.Id}); status.Code(e) != codes.Unauthenticated {
+        t.Errorf("CancelJob without a token = %v", e)
+    }
+    if _, e := client.CancelJob(ctx, &gopypb.CancelJobRequest{Id: job.Id + 1}); status.Code(e) != codes.NotFound {
+        t.Errorf("CancelJob of no job = %v", e)
+    }
+    cancelled, e := client.CancelJob(ctx, &gopypb.CancelJobRequest{Id: job.Id})
+    if e != nil || cancelled.State != "cancelled" {
+        t.Fatalf("CancelJob = %v, %v", cancelled, e)
+    }
+    if progress, e = stream.Recv(); e != nil || progress.GetJob().GetState() != "cancelled" {
+        t.Errorf("last progress = %v, %v, want the cancelled job", progress, e)
+    }
+    if _, e := client.CancelJob(ctx, &gopypb.CancelJobRequest{Id: job.Id}); status.Code(e) != codes.FailedPrecondition {
+        t.Errorf("CancelJob of a cancelled job = %v", e)
+    }
+}
@@ -0,0 +1,217 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+var postHook = ""
+
+var notifyEnabled = false
+
+var lastSummary *summary
+
+// lastError is the last error printed, by any goroutine.
+var lastError atomic.Value
+
+func shellCommand(command string) *exec.Cmd {
+    if runtime.GOOS == "windows" {
+        return exec.Command("cmd", "/C", command)
+    }
+    return exec.Command("sh", "-c", command)
+}
+
+// runHook runs command through the shell with the GOPY_ variables of the
+// operation, and vars, added to its environment.
+func runHook(command string, vars ...string) error {
+    cmd := shellCommand(command)
+    cmd.Env = append(os.Environ(), "GOPY_OPERATION="+activeOperation(), "GOPY_INPUT="+*inputFile,
+        "GOPY_DIRECTORY="+*directoryPath, "GOPY_OUTPUT="+*outputFile)
+    cmd.Env = append(cmd.Env, vars...)
+    cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+    if e := cmd.Run(); e != nil {
+        return fmt.Errorf("hook %q: %v", command, e)
+    }
+    return nil
+}
+
+func activeOperation() string {
+    for _, c := range commands {
+        if *c.op {
+            return c.name
+        }
+    }
+    return ""
+}
+
+// exit runs the post hook, once, with the exit code and the summary of the
+// operation and exits.
+func exit(exitCode int) {
+    closeRunEvents()
+    if command := postHook; command != "" {
+        postHook = ""
+        vars := []string{"GOPY_EXIT_CODE=" + strconv.Itoa(exitCode)}
+        if s := lastSummary; s != nil {
+            vars = append(vars, "GOPY_FILES="+strconv.Itoa(s.Files), "GOPY_FILES_COPIED="+strconv.Itoa(s.FilesCopied),
+                "GOPY_BYTES_COPIED="+strconv.FormatInt(s.BytesCopied, 10), "GOPY_FAILED="+strconv.Itoa(s.Failed))
+        }
+        if e := runHook(command, vars...); e != nil {
+            printError(e)
+        }
+    }
+    if notifyEnabled {
+        notifyEnabled = false
+        if e := notify(exitCode); e != nil {
+            printError(e)
+        }
+    }
+    if heldLock != "" {
+        os.Remove(heldLock)
+        heldLock = ""
+    }
+    os.Exit(exitCode)
+}
+
+const lockFileName = ".gopy.lock"
+
+var heldLock string
+
+// lockWriteGrace is how long a lock that cannot be read may still be being
+// written by the process creating it, on file systems without hard links.
+const lockWriteGrace = 10 * time.Second
+
+// acquireLock creates a lock file holding the process ID and the host name.
+// A lock left behind by a process of this host that is no longer running is
+// taken over.
+func acquireLock(path string) error {
+    host, _ := os.Hostname()
+    content := fmt.Sprintf("%d %s\n", os.Getpid(), host)
+    for {
+        e := writeLock(path, content)
+        if e == nil {
+            heldLock = path
+            return nil
+        }
+        if !os.IsExist(e) {
+            return e
+        }
+        data, e := ioutil.ReadFile(path)
+        if os.IsNotExist(e) {
+            continue
+        } else if e != nil {
+            return e
+        }
+        var pid int
+        var owner string
+        if n, _ := fmt.Sscan(string(data), &pid, &owner); n == 2 && pid > 0 && (owner != host || processAlive(pid)) {
+            return fmt.Errorf("%s is locked by process %d on %s, remove it if that process is no longer running",
+                path, pid, owner)
+        } else if n != 2 {
+            // A lock that cannot be read was left by an older or broken run
+            // and is stale, unless it is being written.
+            if fi, e := os.Stat(path); e == nil && time.Since(fi.ModTime()) < lockWriteGrace {
+                return fmt.Errorf("%s is being locked by another process", path)
+            }
+        }
+        if e := removeStaleLock(path, data); e != nil {
+            return e
+        }
+        logger.Warn("stale_lock_removed", "path", path, "pid", pid)
+    }
+}
+
+// removeStaleLock removes the lock at path if it still holds the stale
+// content. The lock is renamed to a name of its own first, so that of two
+// processes taking over the same stale lock, the one renaming it second
+// finds the lock the first one wrote, and puts it back instead of removing
+// it.
+func removeStaleLock(path string, stale []byte) error {
+    taken := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+    if e := os.Rename(path, taken); os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return e
+    }
+    data, e := ioutil.ReadFile(taken)
+    if e != nil {
+        return e
+    }
+    if !bytes.Equal(data, stale) {
+        e := os.Link(taken, path)
+        if e != nil && !os.IsExist(e) {
+            // Without hard links, the lock is put back by a rename, which
+            // could only replace a lock written in the meantime.
+            e = os.Rename(taken, path)
+        }
+        os.Remove(taken)
+        if e != nil && !os.IsExist(e) {
+            return e
+        }
+        return nil
+    }
+    return os.Remove(taken)
+}
+
+// writeLock creates the lock file path with content, or fails with an error
+// satisfying os.IsExist if it exists. The content is written to a temporary
+// file first, so the lock is never seen half written, except on file systems
+// without hard links, such as FAT, where the lock is created exclusively and
+// written afterwards.
+func writeLock(path, content string) error {
+    f, e := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".gopy-tmp-")
+    if e != nil {
+        return e
+    }
+    defer os.Remove(f.Name())
+    _, e = f.WriteString(content)
+    if e2 := f.Close(); e == nil {
+        e = e2
+    }
+    if e != nil {
+        return e
+    }
+    if e := os.Link(f.Name(), path); e == nil || os.IsExist(e) {
+        return e
+    }
+    lock, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+    if e != nil {
+        return e
+    }
+    _, e = lock.WriteString(content)
+    if e2 := lock.Close(); e == nil {
+        e = e2
+    }
+    if e != nil {
+        os.Remove(path)
+    }
+    return e
+}
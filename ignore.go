@@ -0,0 +1,145 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+const ignoreFileName = ".gopyignore"
+
+type ignoreRule struct {
+    pattern *regexp.Regexp
+    negate  bool
+    dirOnly bool
+}
+
+// parseIgnoreRule turns a line of a .gopyignore file, in the syntax of
+// .gitignore, into a rule matching slash-separated paths relative to the
+// directory of the file.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+    line = strings.TrimRight(line, " \t\r")
+    if line == "" || line[0] == '#' {
+        return ignoreRule{}, false
+    }
+    rule := ignoreRule{}
+    if line[0] == '!' {
+        rule.negate, line = true, line[1:]
+    } else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+        line = line[1:]
+    }
+    if strings.HasSuffix(line, "/") {
+        rule.dirOnly, line = true, strings.TrimRight(line, "/")
+    }
+    if line == "" {
+        return ignoreRule{}, false
+    }
+    // Without a slash but a trailing one, a pattern matches at any depth.
+    expr := "^(.*/)?"
+    if strings.Contains(line, "/") {
+        expr, line = "^", strings.TrimPrefix(line, "/")
+    }
+    for i := 0; i < len(line); i++ {
+        switch c := line[i]; {
+        case strings.HasPrefix(line[i:], "**/"):
+            expr += "(.*/)?"
+            i += 2
+        case strings.HasPrefix(line[i:], "**"):
+            expr += ".*"
+            i++
+        case c == '*':
+            expr += "[^/]*"
+        case c == '?':
+            expr += "[^/]"
+        case c == '[' && strings.IndexByte(line[i:], ']') > 1:
+            end := i + strings.IndexByte(line[i:], ']')
+            class := line[i+1 : end]
+            if class[0] == '!' {
+                class = "^" + class[1:]
+            }
+            expr += "[" + class + "]"
+            i = end
+        case c == '\\' && i+1 < len(line):
+            i++
+            expr += regexp.QuoteMeta(line[i : i+1])
+        default:
+            expr += regexp.QuoteMeta(line[i : i+1])
+        }
+    }
+    pattern, e := regexp.Compile(expr + "$")
+    if e != nil {
+        return ignoreRule{}, false
+    }
+    rule.pattern = pattern
+    return rule, true
+}
+
+// ignoreFiles holds the rules of the .gopyignore files read so far, by
+// directory, and is nil with -no-ignore.
+type ignoreFiles struct {
+    mu    sync.Mutex
+    rules map[string][]ignoreRule
+}
+
+func (f *ignoreFiles) load(dir string) []ignoreRule {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    rules, ok := f.rules[dir]
+    if !ok {
+        if data, e := ioutil.ReadFile(filepath.Join(dir, ignoreFileName)); e == nil {
+            for _, line := range strings.Split(string(data), "\n") {
+                if rule, ok := parseIgnoreRule(line); ok {
+                    rules = append(rules, rule)
+                }
+            }
+        }
+        f.rules[dir] = rules
+    }
+    return rules
+}
+
+// ignored reports whether path, below root, is excluded by the .gopyignore
+// files of root and of the directories in between, the last matching rule of
+// the deepest file winning.
+func (f *ignoreFiles) ignored(root, path string, info os.FileInfo) bool {
+    rel, e := filepath.Rel(root, path)
+    if f == nil || e != nil || rel == "." || strings.HasPrefix(rel, "..") {
+        return false
+    }
+    ignored := false
+    dir := root
+    for _, name := range strings.Split(rel, string(filepath.Separator)) {
+        sub, _ := filepath.Rel(dir, path)
+        for _, rule := range f.load(dir) {
+            if (!rule.dirOnly || info.IsDir()) && rule.pattern.MatchString(filepath.ToSlash(sub)) {
+                ignored = !rule.negate
+            }
+        }
+        dir = filepath.Join(dir, name)
+    }
+    return ignored
+}
@@ -0,0 +1,289 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+type journalEntry struct {
+    Time   time.Time `json:"time"`
+    Op     string    `json:"op"`
+    Source string    `json:"source,omitempty"`
+    Path   string    `json:"path"`
+}
+
+type journal struct {
+    f   *os.File
+    enc *json.Encoder
+    // run is written before the first operation recorded, so that runs
+    // changing nothing leave no trace.
+    run *journalEntry
+}
+
+func openJournal(path string) (*journal, error) {
+    f, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if e != nil {
+        return nil, e
+    }
+    return &journal{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (j *journal) record(op, source, rel string) error {
+    if j.run != nil {
+        if e := j.enc.Encode(j.run); e != nil {
+            return e
+        }
+        j.run = nil
+    }
+    return j.enc.Encode(journalEntry{time.Now(), op, source, filepath.ToSlash(rel)})
+}
+
+func (j *journal) close() error {
+    return j.f.Close()
+}
+
+type journalDestination struct {
+    copyDestination
+    j *journal
+}
+
+func (d *journalDestination) makeDir(rel string, info os.FileInfo) error {
+    if e := d.copyDestination.makeDir(rel, info); e != nil {
+        return e
+    }
+    return d.j.record("mkdir", "", rel)
+}
+
+func (d *journalDestination) writeFile(src, rel string, info os.FileInfo) error {
+    if e := d.copyDestination.writeFile(src, rel, info); e != nil {
+        return e
+    }
+    absSrc, _ := filepath.Abs(src)
+    return d.j.record("copy", absSrc, rel)
+}
+
+func (d *journalDestination) close() error {
+    e := d.copyDestination.close()
+    if je := d.j.close(); e == nil {
+        e = je
+    }
+    return e
+}
+
+func runReplay(journalPath, directoryPath string) int {
+    failed := 0
+    f, e := os.Open(journalPath)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    defer f.Close()
+    dest := &dirDestination{root: directoryPath, preserveTimes: true, fio: cliIO}
+    dec := json.NewDecoder(f)
+    for {
+        var entry journalEntry
+        if e := dec.Decode(&entry); e == io.EOF {
+            break
+        } else if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        rel := filepath.FromSlash(entry.Path)
+        if _, e := extractPath(directoryPath, entry.Path); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        switch entry.Op {
+        case "mkdir":
+            e = os.MkdirAll(filepath.Join(directoryPath, rel), 0755)
+        case "copy":
+            var info os.FileInfo
+            if info, e = os.Stat(entry.Source); e == nil {
+                os.MkdirAll(filepath.Dir(filepath.Join(directoryPath, rel)), 0755)
+                e = dest.writeFile(entry.Source, rel, info)
+            }
+        case "delete":
+            e = os.RemoveAll(filepath.Join(directoryPath, rel))
+        default:
+            e = fmt.Errorf("unknown journal operation: %s", entry.Op)
+        }
+        if e != nil {
+            printError(e)
+            failed++
+        }
+    }
+    return failed
+}
+
+const undoJournalName = ".gopy-undo"
+
+// undoHistory is the number of runs the undo journal keeps.
+const undoHistory = 10
+
+// openUndoJournal opens the journal of the destination directory, where the
+// mutations of a run are recorded before being made, after dropping the
+// oldest runs beyond undoHistory.
+func openUndoJournal(directoryPath string, fio *fileIO) (*journal, error) {
+    if e := os.MkdirAll(directoryPath, 0755); e != nil {
+        return nil, e
+    }
+    path := filepath.Join(directoryPath, undoJournalName)
+    if e := trimJournal(path, undoHistory-1, fio); e != nil {
+        return nil, e
+    }
+    j, e := openJournal(path)
+    if e != nil {
+        return nil, e
+    }
+    j.run = &journalEntry{Time: time.Now(), Op: "run"}
+    return j, nil
+}
+
+// trimJournal rewrites the journal at path with only its last keep runs.
+func trimJournal(path string, keep int, fio *fileIO) error {
+    data, e := ioutil.ReadFile(path)
+    if os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return e
+    }
+    runs := []int64{}
+    dec := json.NewDecoder(bytes.NewReader(data))
+    for {
+        offset := dec.InputOffset()
+        var entry journalEntry
+        if e := dec.Decode(&entry); e == io.EOF {
+            break
+        } else if e != nil {
+            return fmt.Errorf("%s: %v", path, e)
+        }
+        if entry.Op == "run" {
+            runs = append(runs, offset)
+        }
+    }
+    if len(runs) <= keep {
+        return nil
+    }
+    f, e := fio.createAtomic(path)
+    if e != nil {
+        return e
+    }
+    start := int64(len(data))
+    if keep > 0 {
+        start = runs[len(runs)-keep]
+    }
+    // Offsets are those of the separators before the markers.
+    if _, e := f.Write(bytes.TrimLeft(data[start:], " \t\r\n")); e != nil {
+        f.abort()
+        return e
+    }
+    return f.commit()
+}
+
+// runUndo reverts the last run recorded in the journal of directoryPath, in
+// reverse order: created files and directories are removed, and overwritten
+// and deleted files are restored from their backup or -soft-delete copy when
+// there is one. The run is then dropped from the journal, so that undoing
+// again reverts the run before it. It returns the number of operations that
+// could not be reverted.
+func runUndo(directoryPath string) int {
+    journalPath := filepath.Join(directoryPath, undoJournalName)
+    f, e := os.Open(journalPath)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    // Runs that changed nothing are skipped.
+    var run, last []journalEntry
+    var runOffset, lastOffset int64 = -1, -1
+    dec := json.NewDecoder(f)
+    for {
+        offset := dec.InputOffset()
+        var entry journalEntry
+        if e := dec.Decode(&entry); e == io.EOF {
+            break
+        } else if e != nil {
+            f.Close()
+            printErrorAndExit(e, exitIOError)
+        }
+        if entry.Op != "run" {
+            run = append(run, entry)
+            continue
+        }
+        if len(run) > 0 {
+            last, lastOffset = run, runOffset
+        }
+        run, runOffset = nil, offset
+    }
+    f.Close()
+    if len(run) == 0 {
+        run, runOffset = last, lastOffset
+    }
+    if runOffset < 0 {
+        printErrorAndExit(journalPath + " records no run that changed the directory", exitIOError)
+    }
+    failed := 0
+    for i := len(run) - 1; i >= 0; i-- {
+        entry := run[i]
+        if _, e := extractPath(directoryPath, entry.Path); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        path := filepath.Join(directoryPath, filepath.FromSlash(entry.Path))
+        switch entry.Op {
+        case "mkdir":
+            e = os.Remove(path)
+        case "create":
+            e = os.Remove(path)
+        case "overwrite", "delete":
+            if entry.Source == "" {
+                e = fmt.Errorf("cannot restore %s, it was %s without a backup", path,
+                    map[string]string{"overwrite": "overwritten", "delete": "deleted"}[entry.Op])
+            } else {
+                os.MkdirAll(filepath.Dir(path), 0755)
+                makeWritable(path)
+                if e = os.Rename(entry.Source, path); e != nil {
+                    // The backup directory may be on another file system.
+                    if e = cliIO.copyFile(entry.Source, path); e == nil {
+                        os.Remove(entry.Source)
+                    }
+                }
+            }
+        default:
+            e = fmt.Errorf("unknown journal operation: %s", entry.Op)
+        }
+        if e != nil && !(os.IsNotExist(e) && (entry.Op == "mkdir" || entry.Op == "create")) {
+            printError(e)
+            failed++
+            continue
+        }
+        logger.Info("operation_reverted", "op", entry.Op, "path", path)
+    }
+    if e := os.Truncate(journalPath, runOffset); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    fmt.Printf("%d operations reverted, %d could not be\n", len(run)-failed, failed)
+    return failed
+}
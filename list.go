@@ -0,0 +1,613 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+type checkpoint struct {
+    offset int64
+    path   string
+}
+
+func readCheckpoint(checkpointFile string) (checkpoint, bool) {
+    data, e := ioutil.ReadFile(checkpointFile)
+    if e != nil {
+        return checkpoint{}, false
+    }
+    lines := strings.SplitN(strings.TrimRight(string(data), "\n"), "\n", 2)
+    if len(lines) != 2 {
+        return checkpoint{}, false
+    }
+    offset, e := strconv.ParseInt(lines[0], 10, 64)
+    if e != nil {
+        return checkpoint{}, false
+    }
+    return checkpoint{offset, lines[1]}, true
+}
+
+func writeCheckpoint(checkpointFile string, cp checkpoint) error {
+    tmpFile := checkpointFile + ".tmp"
+    data := fmt.Sprintf("%d\n%s\n", cp.offset, cp.path)
+    if e := ioutil.WriteFile(tmpFile, []byte(data), 0644); e != nil {
+        return e
+    }
+    return os.Rename(tmpFile, checkpointFile)
+}
+
+type stateEntry struct {
+    Size    int64  `json:"size"`
+    ModTime int64  `json:"mtime"`
+    SHA256  string `json:"sha256"`
+}
+
+// scanState keeps the checksums of a listing by path with the size and the
+// modification time they were computed for, so that the next listing only
+// hashes the files that changed.
+type scanState struct {
+    path     string
+    previous map[string]stateEntry
+    mu       sync.Mutex
+    current  map[string]stateEntry
+}
+
+func readScanState(path string) (*scanState, error) {
+    s := &scanState{path: path, previous: map[string]stateEntry{}, current: map[string]stateEntry{}}
+    data, e := ioutil.ReadFile(path)
+    if os.IsNotExist(e) {
+        return s, nil
+    }
+    if e != nil {
+        return nil, e
+    }
+    if e := json.Unmarshal(data, &s.previous); e != nil {
+        return nil, fmt.Errorf("%s: %v", path, e)
+    }
+    return s, nil
+}
+
+func (s *scanState) save() error {
+    data, e := json.Marshal(s.current)
+    if e != nil {
+        return e
+    }
+    f, e := cliIO.createAtomic(s.path)
+    if e != nil {
+        return e
+    }
+    if _, e := f.Write(data); e != nil {
+        f.abort()
+        return e
+    }
+    return f.commit()
+}
+
+type checksumResult struct {
+    sum string
+    err error
+}
+
+// checksummer computes the SHA-256 of the files of a listing for -checksum,
+// with jobs workers ahead of the entry writers, and keeps them in state.
+type checksummer struct {
+    jobs  int
+    state *scanState
+    // ahead holds the checksums computed by hashAhead, by path.
+    ahead sync.Map
+}
+
+// entryChecksum returns the SHA-256 of the file at path, computed ahead by
+// hashAhead or now.
+func (c *checksummer) entryChecksum(path string, fi os.FileInfo) (string, error) {
+    if v, ok := c.ahead.LoadAndDelete(path); ok {
+        return v.(checksumResult).sum, v.(checksumResult).err
+    }
+    return c.computeChecksum(path, fi)
+}
+
+// computeChecksum returns the SHA-256 of the file at path, taken from the
+// state of the previous listing when the file has not changed since.
+func (c *checksummer) computeChecksum(path string, fi os.FileInfo) (string, error) {
+    if c.state == nil {
+        return cliIO.hashFile(path)
+    }
+    entry := stateEntry{Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+    if cached, ok := c.state.previous[path]; ok && cached.Size == entry.Size && cached.ModTime == entry.ModTime {
+        entry.SHA256 = cached.SHA256
+        logger.Debug("file_unchanged", "path", path)
+    } else {
+        var e error
+        if entry.SHA256, e = cliIO.hashFile(path); e != nil {
+            return "", e
+        }
+    }
+    c.state.mu.Lock()
+    c.state.current[path] = entry
+    c.state.mu.Unlock()
+    return entry.SHA256, nil
+}
+
+// hashAhead passes on the entries of a walk in order, each once the checksum
+// of the files that match is computed by a pool of c.jobs workers, so that
+// files are hashed concurrently while the walk goes on.
+func (c *checksummer) hashAhead(entries <-chan walkEntry, match func(walkEntry) bool, done <-chan struct{}) <-chan walkEntry {
+    type pending struct {
+        entry walkEntry
+        ready chan struct{}
+    }
+    queue, work := make(chan pending, 2*c.jobs), make(chan pending)
+    out := make(chan walkEntry)
+    for i := 0; i < c.jobs; i++ {
+        go func() {
+            for p := range work {
+                sum, e := c.computeChecksum(p.entry.path, p.entry.info)
+                c.ahead.Store(p.entry.path, checksumResult{sum, e})
+                close(p.ready)
+            }
+        }()
+    }
+    go func() {
+        defer close(queue)
+        defer close(work)
+        for entry := range entries {
+            p := pending{entry, make(chan struct{})}
+            select {
+            case queue <- p:
+            case <-done:
+                return
+            }
+            if entry.err == nil && entry.info.Mode().IsRegular() && match(entry) {
+                select {
+                case work <- p:
+                case <-done:
+                    return
+                }
+            } else {
+                close(p.ready)
+            }
+        }
+    }()
+    go func() {
+        defer close(out)
+        for p := range queue {
+            select {
+            case <-p.ready:
+            case <-done:
+                return
+            }
+            select {
+            case out <- p.entry:
+            case <-done:
+                return
+            }
+        }
+    }()
+    return out
+}
+
+// listFilters select and annotate the entries of a listing.
+type listFilters struct {
+    // findEmpty keeps only the zero-byte files and the empty directories,
+    // which deleteEmpty then removes.
+    findEmpty   bool
+    deleteEmpty bool
+    // content keeps only the "text" or "binary" files.
+    content string
+    // sums is nil without -checksum.
+    sums *checksummer
+}
+
+type lister struct {
+    listFilters
+    files          int
+    dirs           int
+    bytes          int64
+    f              *os.File
+    w              entryWriter
+    checkpointFile string
+    resume         checkpoint
+    skipping       bool
+    last           string
+    links          map[fileID]bool
+    walker         *walker
+    types          map[string]*typeCount
+    emptyDirs      []string
+}
+
+type typeCount struct {
+    Type  string `json:"type"`
+    Files int    `json:"files"`
+    Bytes int64  `json:"bytes"`
+}
+
+func isEmptyDir(path string) bool {
+    f, e := os.Open(path)
+    if e != nil {
+        return false
+    }
+    defer f.Close()
+    _, e = f.Readdirnames(1)
+    return e == io.EOF
+}
+
+// deleteEmptyDirs removes dirs, deepest first, and then their parents below
+// root left empty by it, like find -empty -delete.
+func deleteEmptyDirs(w *walker, root string, dirs []string) {
+    if !*yesFlag && !confirmDeletion(w, dirs) {
+        return
+    }
+    root, _ = filepath.Abs(root)
+    sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+    for _, dir := range dirs {
+        for dir != root && isWithin(dir, root) && isEmptyDir(dir) {
+            if e := os.Remove(dir); e != nil {
+                printError(e)
+                break
+            }
+            logger.Info("dir_deleted", "path", dir)
+            dir = filepath.Dir(dir)
+        }
+    }
+}
+
+// isTextFile tells text from binary files like git does, by looking for a NUL
+// byte in their first 8000 bytes. UTF-16 text, which is full of them, is
+// recognized by its byte order mark.
+func isTextFile(path string, fio *fileIO) (bool, error) {
+    f, e := fio.openSource(path)
+    if e != nil {
+        return false, e
+    }
+    defer f.Close()
+    buf := make([]byte, 8000)
+    n, e := io.ReadFull(f, buf)
+    if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+        return false, e
+    }
+    buf = buf[:n]
+    if bytes.HasPrefix(buf, []byte{0xff, 0xfe}) || bytes.HasPrefix(buf, []byte{0xfe, 0xff}) {
+        return true, nil
+    }
+    return bytes.IndexByte(buf, 0) < 0, nil
+}
+
+// fileType returns the lower-case extension of path or, with byMime, its
+// MIME type detected from its first bytes.
+func fileType(path string, byMime bool, fio *fileIO) string {
+    if !byMime {
+        if ext := strings.ToLower(filepath.Ext(path)); ext != "" {
+            return ext
+        }
+        return "(none)"
+    }
+    f, e := fio.openSource(path)
+    if e != nil {
+        return "(unreadable)"
+    }
+    defer f.Close()
+    buf := make([]byte, 512)
+    n, _ := io.ReadFull(f, buf)
+    mime := http.DetectContentType(buf[:n])
+    if i := strings.Index(mime, ";"); i >= 0 {
+        mime = mime[:i]
+    }
+    return mime
+}
+
+func (l *lister) countType(path string, size int64) {
+    t := fileType(path, *byMimeFlag, cliIO)
+    if l.types[t] == nil {
+        l.types[t] = &typeCount{Type: t}
+    }
+    l.types[t].Files++
+    l.types[t].Bytes += size
+}
+
+func printTypeReport(types []typeCount, format string) {
+    total := int64(0)
+    for _, t := range types {
+        total += t.Bytes
+    }
+    switch format {
+    case "json":
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "    ")
+        enc.Encode(types)
+    case "csv":
+        w := csv.NewWriter(os.Stdout)
+        w.Write([]string{"type", "files", "bytes"})
+        for _, t := range types {
+            w.Write([]string{t.Type, strconv.Itoa(t.Files), strconv.FormatInt(t.Bytes, 10)})
+        }
+        w.Flush()
+    default:
+        fmt.Printf("%-24s %10s %10s %7s\n", "Type", "Files", "Size", "Share")
+        for _, t := range types {
+            share := 0.0
+            if total > 0 {
+                share = float64(t.Bytes) * 100 / float64(total)
+            }
+            fmt.Printf("%-24s %10d %10s %6.1f%%\n", t.Type, t.Files, formatSize(t.Bytes), share)
+        }
+    }
+}
+
+func (l *lister) saveCheckpoint() error {
+    if e := l.f.Sync(); e != nil {
+        return e
+    }
+    fi, e := l.f.Stat()
+    if e != nil {
+        return e
+    }
+    return writeCheckpoint(l.checkpointFile, checkpoint{fi.Size(), l.last})
+}
+
+func (l *lister) list(dir, root string, recursive, noFile, noDir bool) error {
+    done := make(chan struct{})
+    defer close(done)
+    entries := l.walker.walk(dir, recursive, done)
+    if l.sums != nil && l.sums.jobs > 1 && !l.skipping {
+        entries = l.sums.hashAhead(entries, func(entry walkEntry) bool {
+            return includeEntry(entry.info, noFile, noDir)
+        }, done)
+    }
+    for entry := range entries {
+        if entry.err != nil {
+            if !l.walker.unreadable.add(entry.path, entry.err) {
+                return entry.err
+            }
+            // An unreadable directory is still listed, without its contents.
+            if entry.info == nil {
+                continue
+            }
+        }
+        if l.skipping {
+            if entry.path == l.resume.path {
+                l.skipping = false
+            }
+            continue
+        }
+        if entry.info.IsDir() {
+            l.dirs++
+        } else {
+            l.files++
+            if id, ok := hardLinkID(entry.info); !ok || !l.links[id] {
+                l.bytes += entry.info.Size()
+                if ok {
+                    l.links[id] = true
+                }
+            }
+            if l.types != nil {
+                l.countType(entry.path, entry.info.Size())
+            }
+        }
+        if l.checkpointFile != "" && entry.info.IsDir() && l.last != "" {
+            if e := l.saveCheckpoint(); e != nil {
+                return e
+            }
+        }
+        include := includeEntry(entry.info, noFile, noDir)
+        if include && l.findEmpty {
+            if entry.info.IsDir() {
+                include = isEmptyDir(entry.path)
+                if include {
+                    l.emptyDirs = append(l.emptyDirs, entry.path)
+                }
+            } else {
+                include = entry.info.Size() == 0
+            }
+        }
+        if include && l.content != "" && !entry.info.IsDir() {
+            text, e := isTextFile(entry.path, cliIO)
+            if e != nil && !l.walker.unreadable.add(entry.path, e) {
+                return e
+            }
+            include = e == nil && text == (l.content == "text")
+        }
+        if include {
+            size, e := l.walker.getSize(entry.path)
+            if e != nil {
+                return e
+            }
+            if e := l.w.writeEntry(root, fileInfo{entry.path, size}); e != nil {
+                return e
+            }
+        } else {
+            l.walker.logger.Debug("file_skipped", "path", entry.path, "reason", "excluded")
+        }
+        l.last = entry.path
+    }
+    return nil
+}
+
+// listStorage lists the files of a storage other than the local file system
+// like those of a directory, the size of a directory being that of the files
+// below it.
+func (l *lister) listStorage(location, root string, recursive, noFile, noDir bool) error {
+    st, e := openStorage(location)
+    if e != nil {
+        return e
+    }
+    names, infos := []string{}, map[string]storageInfo{}
+    e = st.Walk(func(name string, info storageInfo) error {
+        if !info.IsDir {
+            for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+                dirInfo := infos[dir]
+                dirInfo.Size += info.Size
+                infos[dir] = dirInfo
+            }
+        }
+        if dirInfo, ok := infos[name]; ok {
+            info.Size = dirInfo.Size
+        }
+        infos[name] = info
+        if recursive || !strings.Contains(name, "/") {
+            names = append(names, name)
+        }
+        return nil
+    })
+    if e != nil {
+        return e
+    }
+    for _, name := range names {
+        info := infos[name]
+        entryPath := strings.TrimRight(location, "/") + "/" + name
+        if info.IsDir {
+            l.dirs++
+        } else {
+            l.files++
+            l.bytes += info.Size
+            if l.types != nil {
+                l.countType(entryPath, info.Size)
+            }
+        }
+        if info.IsDir && noDir || !info.IsDir && noFile {
+            l.walker.logger.Debug("file_skipped", "path", entryPath, "reason", "excluded")
+            continue
+        }
+        if e := l.w.writeEntry(root, fileInfo{entryPath, info.Size}); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func runList(directories []string, outputFile, format string, noFileFlag, noDirFlag, recursiveFlag bool,
+    checkpointFile string, filters listFilters) summary {
+    f := os.Stdout
+    var w entryWriter
+    var e error
+    if format == "sqlite" {
+        w, e = newSQLiteEntryWriter(outputFile, filters.sums)
+    } else {
+        if outputFile != "-" {
+            if f, e = os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+            defer f.Close()
+        }
+        w, e = newEntryWriter(f, format, filters.sums)
+    }
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    if outputFile != "-" {
+        cliWalker.excludeFromWalks(outputFile, directories)
+        if format == "sqlite" {
+            journal, _ := filepath.Abs(outputFile + "-journal")
+            cliWalker.excluded = append(cliWalker.excluded, journal)
+        }
+    }
+    l := &lister{listFilters: filters, f: f, w: w, links: map[fileID]bool{}, walker: cliWalker}
+    if *byExtension != "" {
+        l.types = map[string]*typeCount{}
+    }
+    if recursiveFlag && checkpointFile != "" {
+        l.checkpointFile = checkpointFile
+        if cp, ok := readCheckpoint(checkpointFile); ok {
+            if e := f.Truncate(cp.offset); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+            l.resume, l.skipping, l.last = cp, true, cp.path
+        }
+    }
+    if !l.skipping {
+        if e := w.begin(); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }
+    for _, directoryPath := range directories {
+        root := ""
+        if len(directories) > 1 {
+            root = directoryPath
+        }
+        list := l.list
+        if isCloud(directoryPath) {
+            list = l.listStorage
+        }
+        if e := list(directoryPath, root, recursiveFlag, noFileFlag, noDirFlag); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        if l.deleteEmpty {
+            deleteEmptyDirs(l.walker, directoryPath, l.emptyDirs)
+            l.emptyDirs = nil
+        }
+    }
+    if l.checkpointFile != "" {
+        if l.skipping {
+            printErrorAndExit(fmt.Sprintf("checkpoint entry %s not found, remove %s to restart the listing",
+                l.resume.path, checkpointFile), exitIOError)
+        }
+        os.Remove(checkpointFile)
+    }
+    if e := w.end(); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    if filters.sums != nil && filters.sums.state != nil {
+        if e := filters.sums.state.save(); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }
+    s := summary{Operation: "list", Files: l.files, Directories: l.dirs, TotalBytes: l.bytes}
+    for _, t := range l.types {
+        s.types = append(s.types, *t)
+    }
+    sort.Slice(s.types, func(i, j int) bool {
+        if s.types[i].Bytes != s.types[j].Bytes {
+            return s.types[i].Bytes > s.types[j].Bytes
+        }
+        return s.types[i].Type < s.types[j].Type
+    })
+    return s
+}
+
+func writeLargeFileReport(reportFile string, large []fileInfo, threshold int64) error {
+    w := os.Stdout
+    if reportFile != "" {
+        f, e := os.Create(reportFile)
+        if e != nil {
+            return e
+        }
+        defer f.Close()
+        w = f
+    }
+    fmt.Fprintf(w, "Files larger than %s: %d\n", formatSize(threshold), len(large))
+    for _, i := range large {
+        fmt.Fprintf(w, "%s - %s\n", i.file, formatSize(i.size))
+    }
+    return nil
+}
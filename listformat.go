@@ -0,0 +1,271 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "text/template"
+    "time"
+
+    _ "modernc.org/sqlite"
+)
+
+type entryWriter interface {
+    begin() error
+    writeEntry(root string, i fileInfo) error
+    end() error
+}
+
+type textEntryWriter struct {
+    w     io.Writer
+    color bool
+}
+
+func (t *textEntryWriter) writeEntry(root string, i fileInfo) error {
+    if root != "" {
+        fmt.Fprintf(t.w, "%s\t", root)
+    }
+    file := normalizePath(i.file, pathNormalization)
+    if t.color {
+        if isDirectory(i.file) {
+            file = colored(file, colorBlue, true)
+        } else if highlightOverSize > 0 && i.size > highlightOverSize {
+            file = colored(file, colorYellow, true)
+        }
+    }
+    // TODO: make a more human-readable size, e.g. KB, MB, GB, TB, and not just MB
+    _, e := fmt.Fprintf(t.w, "%s - %.2fMB\n", file, float64(i.size) / float64(1024000))
+    return e
+}
+
+func (t *textEntryWriter) begin() error {
+    return nil
+}
+
+func (t *textEntryWriter) end() error {
+    return nil
+}
+
+type ndjsonEntryWriter struct {
+    enc  *json.Encoder
+    sums *checksummer
+}
+
+func (n *ndjsonEntryWriter) writeEntry(root string, i fileInfo) error {
+    entry := jsonEntry{Root: root, Path: normalizePath(i.file, pathNormalization), Size: i.size}
+    if n.sums != nil {
+        if fi, e := os.Stat(i.file); e == nil && fi.Mode().IsRegular() {
+            if entry.SHA256, e = n.sums.entryChecksum(i.file, fi); e != nil {
+                return e
+            }
+        }
+    }
+    return n.enc.Encode(entry)
+}
+
+func (n *ndjsonEntryWriter) begin() error {
+    return nil
+}
+
+func (n *ndjsonEntryWriter) end() error {
+    return nil
+}
+
+// sqlEntryWriter writes a SQL script that loads the entries into a files
+// table, e.g. with "sqlite3 files.db < files.sql".
+type sqlEntryWriter struct {
+    w    io.Writer
+    sums *checksummer
+}
+
+func sqlString(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+const sqlSchema = "CREATE TABLE IF NOT EXISTS files (root TEXT, path TEXT PRIMARY KEY, size INTEGER, mtime INTEGER, sha256 TEXT);\n" +
+    "CREATE INDEX IF NOT EXISTS files_size ON files (size);\n" +
+    "CREATE INDEX IF NOT EXISTS files_mtime ON files (mtime);\n" +
+    "CREATE INDEX IF NOT EXISTS files_sha256 ON files (sha256);\n"
+
+// sqlEntryValues returns the modification time and the checksum of an entry,
+// nil when the entry cannot be read or has no checksum.
+func sqlEntryValues(file string, sums *checksummer) (mtime, sum interface{}, e error) {
+    fi, e := os.Stat(file)
+    if e != nil {
+        return nil, nil, nil
+    }
+    mtime = fi.ModTime().Unix()
+    if sums != nil && fi.Mode().IsRegular() {
+        h, e := sums.entryChecksum(file, fi)
+        if e != nil {
+            return nil, nil, e
+        }
+        sum = h
+    }
+    return mtime, sum, nil
+}
+
+func (q *sqlEntryWriter) begin() error {
+    _, e := io.WriteString(q.w, "BEGIN TRANSACTION;\n"+sqlSchema)
+    return e
+}
+
+func (q *sqlEntryWriter) writeEntry(root string, i fileInfo) error {
+    mtime, sum, e := sqlEntryValues(i.file, q.sums)
+    if e != nil {
+        return e
+    }
+    mtimeText, sumText := "NULL", "NULL"
+    if mtime != nil {
+        mtimeText = strconv.FormatInt(mtime.(int64), 10)
+    }
+    if sum != nil {
+        sumText = sqlString(sum.(string))
+    }
+    _, e = fmt.Fprintf(q.w, "INSERT OR REPLACE INTO files VALUES (%s, %s, %d, %s, %s);\n",
+        sqlString(root), sqlString(normalizePath(i.file, pathNormalization)), i.size, mtimeText, sumText)
+    return e
+}
+
+func (q *sqlEntryWriter) end() error {
+    _, e := io.WriteString(q.w, "COMMIT;\n")
+    return e
+}
+
+// sqliteEntryWriter writes the entries into the files table of a SQLite
+// database, the table of the sql format, in one transaction.
+type sqliteEntryWriter struct {
+    db   *sql.DB
+    tx   *sql.Tx
+    stmt *sql.Stmt
+    sums *checksummer
+}
+
+func newSQLiteEntryWriter(path string, sums *checksummer) (*sqliteEntryWriter, error) {
+    db, e := sql.Open("sqlite", path)
+    if e != nil {
+        return nil, e
+    }
+    return &sqliteEntryWriter{db: db, sums: sums}, nil
+}
+
+func (q *sqliteEntryWriter) begin() error {
+    tx, e := q.db.Begin()
+    if e != nil {
+        return e
+    }
+    if _, e := tx.Exec(sqlSchema); e != nil {
+        tx.Rollback()
+        return e
+    }
+    stmt, e := tx.Prepare("INSERT OR REPLACE INTO files VALUES (?, ?, ?, ?, ?)")
+    if e != nil {
+        tx.Rollback()
+        return e
+    }
+    q.tx, q.stmt = tx, stmt
+    return nil
+}
+
+func (q *sqliteEntryWriter) writeEntry(root string, i fileInfo) error {
+    mtime, sum, e := sqlEntryValues(i.file, q.sums)
+    if e != nil {
+        return e
+    }
+    _, e = q.stmt.Exec(root, normalizePath(i.file, pathNormalization), i.size, mtime, sum)
+    return e
+}
+
+func (q *sqliteEntryWriter) end() error {
+    defer q.db.Close()
+    q.stmt.Close()
+    return q.tx.Commit()
+}
+
+type templateEntry struct {
+    Root    string
+    Path    string
+    Size    int64
+    ModTime time.Time
+    IsDir   bool
+}
+
+var entryTemplate = ""
+
+type templateEntryWriter struct {
+    w io.Writer
+    t *template.Template
+}
+
+func newTemplateEntryWriter(w io.Writer, text string) (*templateEntryWriter, error) {
+    text = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(text)
+    if !strings.HasSuffix(text, "\n") {
+        text += "\n"
+    }
+    t, e := template.New("entry").Funcs(template.FuncMap{"human": formatSize}).Parse(text)
+    if e != nil {
+        return nil, e
+    }
+    return &templateEntryWriter{w, t}, nil
+}
+
+func (t *templateEntryWriter) begin() error {
+    return nil
+}
+
+func (t *templateEntryWriter) writeEntry(root string, i fileInfo) error {
+    entry := templateEntry{Root: root, Path: normalizePath(i.file, pathNormalization), Size: i.size}
+    if fi, e := os.Stat(i.file); e == nil {
+        entry.ModTime, entry.IsDir = fi.ModTime(), fi.IsDir()
+    }
+    return t.t.Execute(t.w, entry)
+}
+
+func (t *templateEntryWriter) end() error {
+    return nil
+}
+
+// newEntryWriter returns the writer of format, which writes the checksums of
+// sums when it is not nil.
+func newEntryWriter(w io.Writer, format string, sums *checksummer) (entryWriter, error) {
+    switch format {
+    case "", "text":
+        f, ok := w.(*os.File)
+        return &textEntryWriter{w, ok && useColor(f)}, nil
+    case "ndjson":
+        return &ndjsonEntryWriter{json.NewEncoder(w), sums}, nil
+    case "sql":
+        return &sqlEntryWriter{w, sums}, nil
+    case "template":
+        if entryTemplate == "" {
+            return nil, fmt.Errorf("-format template needs -template")
+        }
+        return newTemplateEntryWriter(w, entryTemplate)
+    }
+    return nil, fmt.Errorf("unsupported format: %s", format)
+}
@@ -0,0 +1,136 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+)
+
+var logLevel = new(slog.LevelVar)
+
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// discardLogger is the logger of List and Copy when their options give none.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// runLogger returns l, or discardLogger when it is nil.
+func runLogger(l *slog.Logger) *slog.Logger {
+    if l == nil {
+        return discardLogger
+    }
+    return l
+}
+
+var logEvents = false
+
+// setLogLevel maps -quiet, -v and -vv to a log level. Warnings are logged by
+// default, -v logs every file copied or skipped and -vv adds directories and
+// up-to-date files. Structured logs get every file event by default.
+func setLogLevel(quiet, verbose, veryVerbose bool) {
+    switch {
+    case quiet:
+        logLevel.Set(slog.LevelError)
+    case veryVerbose:
+        logLevel.Set(slog.LevelDebug)
+    case verbose || logEvents:
+        logLevel.Set(slog.LevelInfo)
+    default:
+        logLevel.Set(slog.LevelWarn)
+    }
+}
+
+// setLogOutput sends the log to logFile, or stderr when it is empty, in the
+// given format. Errors are also logged as events when the log is JSON or
+// written to a file.
+func setLogOutput(format, logFile string) error {
+    var w io.Writer = os.Stderr
+    if logFile != "" {
+        f, e := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+        if e != nil {
+            return e
+        }
+        w = f
+    }
+    options := &slog.HandlerOptions{Level: logLevel}
+    switch format {
+    case "text":
+        logger = slog.New(slog.NewTextHandler(w, options))
+    case "json":
+        logger = slog.New(slog.NewJSONHandler(w, options))
+    default:
+        return fmt.Errorf("unsupported log format: %s", format)
+    }
+    logEvents = format == "json" || logFile != ""
+    return nil
+}
+
+var colorMode = new(string)
+
+var highlightOver = new(string)
+
+var highlightOverSize int64
+
+const (
+    colorBlue   = "\x1b[34m"
+    colorRed    = "\x1b[31m"
+    colorYellow = "\x1b[33m"
+    colorReset  = "\x1b[0m"
+)
+
+// useColor reports whether output to f is colored: always, never, or with
+// auto when f is a terminal and NO_COLOR is not set.
+func useColor(f *os.File) bool {
+    switch *colorMode {
+    case "always":
+        return true
+    case "never":
+        return false
+    }
+    if os.Getenv("NO_COLOR") != "" {
+        return false
+    }
+    fi, e := f.Stat()
+    return e == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func colored(s, color string, enabled bool) string {
+    if !enabled {
+        return s
+    }
+    return color + s + colorReset
+}
+
+func printError(msg interface{}) {
+    fmt.Println(colored("Error:", colorRed, useColor(os.Stdout)), msg)
+    if logEvents {
+        logger.Error("error", "error", fmt.Sprint(msg))
+    }
+    lastError.Store(fmt.Sprint(msg))
+}
+
+func printErrorAndExit(msg interface{}, exitCode int) {
+    printError(msg)
+    exit(exitCode)
+}
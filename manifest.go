@@ -0,0 +1,334 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+type jsonEntry struct {
+    Root   string `json:"root,omitempty"`
+    Path   string `json:"path"`
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256,omitempty"`
+
+    // approximate is set for entries of text manifests, whose sizes are
+    // rounded to hundredths of a MB.
+    approximate bool
+}
+
+// readManifest reads the entries of the manifest at inputFile, skipping the
+// blank lines and logging a warning to log for the lines that are not
+// entries.
+func readManifest(inputFile string, log *slog.Logger) ([]jsonEntry, error) {
+    result := []jsonEntry{}
+    f, e := os.Open(inputFile)
+    if e != nil {
+        return nil, e
+    }
+    defer f.Close()
+    r := bufio.NewReader(f)
+    for lineNumber := 1; ; lineNumber++ {
+        line, e := r.ReadString('\n')
+        if e != nil && e != io.EOF {
+            return nil, e
+        }
+        if trimmedLine := strings.TrimSpace(line); trimmedLine != "" {
+            if entry, ok := parseManifestLine(trimmedLine); ok {
+                result = append(result, entry)
+            } else {
+                log.Warn("line_skipped", "manifest", inputFile, "line", lineNumber, "reason", "not an entry")
+            }
+        }
+        if e == io.EOF {
+            return result, nil
+        }
+    }
+}
+
+// parseManifestLine parses a JSON entry or a "path - size" line, with the
+// root before a tab.
+func parseManifestLine(line string) (jsonEntry, bool) {
+    if strings.HasPrefix(line, "{") {
+        var entry jsonEntry
+        return entry, json.Unmarshal([]byte(line), &entry) == nil
+    }
+    root := ""
+    if tabIdx := strings.Index(line, "\t"); tabIdx >= 0 {
+        root, line = line[:tabIdx], line[tabIdx+1:]
+    }
+    endIdx := strings.LastIndex(line, " - ")
+    if endIdx <= 0 {
+        return jsonEntry{}, false
+    }
+    mb, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(line[endIdx+3:]), "MB"), 64)
+    return jsonEntry{Root: root, Path: line[:endIdx], Size: int64(mb * 1024000), approximate: true}, true
+}
+
+// readManifests reads the entries of several manifests, or of every manifest
+// in a directory, leaving out those an earlier manifest already had.
+func readManifests(inputPaths []string, log *slog.Logger) ([]jsonEntry, error) {
+    result := []jsonEntry{}
+    seen := map[[2]string]bool{}
+    for _, inputPath := range inputPaths {
+        files := []string{inputPath}
+        if isDirectory(inputPath) {
+            files = nil
+            fi, e := ioutil.ReadDir(inputPath)
+            if e != nil {
+                return nil, e
+            }
+            for _, info := range fi {
+                if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+                    files = append(files, filepath.Join(inputPath, info.Name()))
+                }
+            }
+        }
+        for _, file := range files {
+            entries, e := readManifest(file, log)
+            if e != nil {
+                return nil, e
+            }
+            for _, entry := range entries {
+                key := [2]string{entry.Root, entry.Path}
+                if seen[key] {
+                    log.Debug("entry_skipped", "path", entry.Path, "manifest", file, "reason", "duplicate")
+                    continue
+                }
+                seen[key] = true
+                result = append(result, entry)
+            }
+        }
+    }
+    return result, nil
+}
+
+func readTextFile(inputFile string) ([]string, error) {
+    entries, e := readManifest(inputFile, logger)
+    if e != nil {
+        return nil, e
+    }
+    result := []string{}
+    for _, entry := range entries {
+        result = append(result, entry.Path)
+    }
+    return result, nil
+}
+
+type manifestChange struct {
+    Change  string `json:"change"`
+    Path    string `json:"path"`
+    OldSize int64  `json:"old_size,omitempty"`
+    NewSize int64  `json:"new_size,omitempty"`
+}
+
+func diffManifestEntries(old, new []jsonEntry) []manifestChange {
+    oldSizes := map[string]int64{}
+    for _, entry := range old {
+        oldSizes[entry.Path] = entry.Size
+    }
+    changes := []manifestChange{}
+    newSizes := map[string]int64{}
+    for _, entry := range new {
+        newSizes[entry.Path] = entry.Size
+        if size, ok := oldSizes[entry.Path]; !ok {
+            changes = append(changes, manifestChange{"added", entry.Path, 0, entry.Size})
+        } else if size != entry.Size {
+            changes = append(changes, manifestChange{"changed", entry.Path, size, entry.Size})
+        }
+    }
+    for _, entry := range old {
+        if _, ok := newSizes[entry.Path]; !ok {
+            changes = append(changes, manifestChange{"removed", entry.Path, entry.Size, 0})
+        }
+    }
+    sort.SliceStable(changes, func(i, j int) bool {
+        return changes[i].Path < changes[j].Path
+    })
+    return changes
+}
+
+// runDiff prints the entries added to, removed from or changed in size between
+// the manifests oldPath and newPath.
+func runDiff(oldPath, newPath, format string) {
+    oldEntries, e := readManifest(oldPath, logger)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    newEntries, e := readManifest(newPath, logger)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    changes := diffManifestEntries(oldEntries, newEntries)
+    if format == "json" {
+        enc := json.NewEncoder(os.Stdout)
+        for _, c := range changes {
+            enc.Encode(c)
+        }
+        return
+    }
+    counts := map[string]int{}
+    for _, c := range changes {
+        switch c.Change {
+        case "added":
+            fmt.Printf("+ %s (%s)\n", c.Path, formatSize(c.NewSize))
+        case "removed":
+            fmt.Printf("- %s (%s)\n", c.Path, formatSize(c.OldSize))
+        case "changed":
+            fmt.Printf("~ %s (%s -> %s)\n", c.Path, formatSize(c.OldSize), formatSize(c.NewSize))
+        }
+        counts[c.Change]++
+    }
+    fmt.Printf("Added: %d, removed: %d, changed: %d\n", counts["added"], counts["removed"], counts["changed"])
+}
+
+// writeManifest writes entries the way they were read, as text lines when
+// their sizes are approximate and as JSON lines otherwise.
+func writeManifest(outputPath string, entries []jsonEntry) error {
+    w := io.Writer(os.Stdout)
+    if outputPath != "" {
+        f, e := os.Create(outputPath)
+        if e != nil {
+            return e
+        }
+        defer f.Close()
+        w = f
+    }
+    text := &textEntryWriter{w: w}
+    enc := json.NewEncoder(w)
+    for _, entry := range entries {
+        var e error
+        if entry.approximate {
+            e = text.writeEntry(entry.Root, fileInfo{entry.Path, entry.Size})
+        } else {
+            e = enc.Encode(entry)
+        }
+        if e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+func filterManifest(entries []jsonEntry, include, exclude []string, minSize, maxSize int64) []jsonEntry {
+    result := []jsonEntry{}
+    for _, entry := range entries {
+        if len(include) > 0 && !matchesAny(entry.Path, include) {
+            continue
+        }
+        if matchesAny(entry.Path, exclude) || entry.Size < minSize || (maxSize > 0 && entry.Size > maxSize) {
+            continue
+        }
+        result = append(result, entry)
+    }
+    return result
+}
+
+// splitManifest spreads entries over n shards of about the same size. An
+// entry inside a directory that is listed too goes with that directory, so
+// no file is copied by two machines. The size of every shard is returned too.
+func splitManifest(entries []jsonEntry, n int) ([][]jsonEntry, []int64) {
+    listed := map[[2]string]int{}
+    for i, entry := range entries {
+        listed[[2]string{entry.Root, entry.Path}] = i
+    }
+    top := make([]int, len(entries))
+    groups := []int{}
+    for i, entry := range entries {
+        top[i] = i
+        for dir := filepath.Dir(entry.Path); ; dir = filepath.Dir(dir) {
+            if j, ok := listed[[2]string{entry.Root, dir}]; ok {
+                top[i] = j
+            }
+            if parent := filepath.Dir(dir); parent == dir {
+                break
+            }
+        }
+        if top[i] == i {
+            groups = append(groups, i)
+        }
+    }
+    sort.SliceStable(groups, func(a, b int) bool {
+        return entries[groups[a]].Size > entries[groups[b]].Size
+    })
+    shardOf := map[int]int{}
+    sizes := make([]int64, n)
+    for _, g := range groups {
+        smallest := 0
+        for i := range sizes {
+            if sizes[i] < sizes[smallest] {
+                smallest = i
+            }
+        }
+        shardOf[g] = smallest
+        sizes[smallest] += entries[g].Size
+    }
+    shards := make([][]jsonEntry, n)
+    for i, entry := range entries {
+        shard := shardOf[top[i]]
+        shards[shard] = append(shards[shard], entry)
+    }
+    return shards, sizes
+}
+
+func shardFileName(name string, i int) string {
+    ext := filepath.Ext(name)
+    return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), i + 1, ext)
+}
+
+func runManifest(action string, inputPaths []string, outputPath string) {
+    entries, e := readManifests(inputPaths, logger)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    switch action {
+    case "filter":
+        entries = filterManifest(entries, splitList(*includePatterns), splitList(*excludePatterns),
+            manifestMinSize, manifestMaxSize)
+    case "split":
+        if outputPath == "" {
+            outputPath = inputPaths[0]
+        }
+        shards, sizes := splitManifest(entries, *shardCount)
+        for i, shard := range shards {
+            name := shardFileName(outputPath, i)
+            if e := writeManifest(name, shard); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+            fmt.Printf("%s: %d entries, %s\n", name, len(shard), formatSize(sizes[i]))
+        }
+        return
+    }
+    if e := writeManifest(outputPath, entries); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+}
@@ -0,0 +1,166 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+type summary struct {
+    Operation   string  `json:"operation"`
+    Files       int     `json:"files_scanned"`
+    Directories int     `json:"directories"`
+    TotalBytes  int64   `json:"total_bytes"`
+    FilesCopied int     `json:"files_copied"`
+    BytesCopied int64   `json:"bytes_copied"`
+    Skipped     int     `json:"skipped"`
+    Failed      int     `json:"failed"`
+    Elapsed     float64 `json:"elapsed_seconds"`
+
+    types []typeCount
+}
+
+// counters are the totals served by the Prometheus endpoint.
+var counters struct {
+    filesCopied atomic.Int64
+    bytesCopied atomic.Int64
+    errors      atomic.Int64
+    watchEvents atomic.Int64
+}
+
+func writePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    for _, c := range []struct {
+        name, help string
+        value      int64
+    }{
+        {"gopy_files_copied_total", "Files copied.", counters.filesCopied.Load()},
+        {"gopy_bytes_copied_total", "Bytes copied.", counters.bytesCopied.Load()},
+        {"gopy_errors_total", "Files that could not be copied.", counters.errors.Load()},
+        {"gopy_watch_events_total", "New or changed files and directories seen by -watch.", counters.watchEvents.Load()},
+    } {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+    }
+}
+
+// serveMetrics serves the counters at /metrics on addr in the background.
+func serveMetrics(addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", writePrometheusMetrics)
+    go func() {
+        if e := http.ListenAndServe(addr, mux); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }()
+}
+
+type metrics struct {
+    Operation        string  `json:"operation"`
+    Files            int     `json:"files_copied"`
+    Bytes            int64   `json:"bytes_copied"`
+    Failed           int     `json:"failed"`
+    Queued           int     `json:"queue_depth"`
+    Workers          int     `json:"workers"`
+    ScanSeconds      float64 `json:"scan_seconds"`
+    CopySeconds      float64 `json:"copy_seconds"`
+    FilesPerSecond   float64 `json:"files_per_second"`
+    MBPerSecond      float64 `json:"mb_per_second"`
+    WriteUtilization float64 `json:"write_utilization"`
+}
+
+// metrics returns the throughput of the copy phase. Files are copied by a
+// single worker, so the queue depth is the number of files planned and the
+// utilization is the share of the copy phase spent writing files.
+func (r copyResult) metrics(operation string) metrics {
+    m := metrics{Operation: operation, Files: r.files, Bytes: r.bytes, Failed: r.failed,
+        Queued: r.scanned - r.skipped, Workers: 1,
+        ScanSeconds: r.scanTime.Seconds(), CopySeconds: r.copyTime.Seconds()}
+    if r.copyTime > 0 {
+        m.FilesPerSecond = float64(r.files) / r.copyTime.Seconds()
+        m.MBPerSecond = float64(r.bytes) / (1 << 20) / r.copyTime.Seconds()
+        m.WriteUtilization = r.writeTime.Seconds() / r.copyTime.Seconds()
+    }
+    return m
+}
+
+func writeMetrics(metricsFile string, m metrics) error {
+    data, e := json.MarshalIndent(m, "", "    ")
+    if e != nil {
+        return e
+    }
+    return ioutil.WriteFile(metricsFile, append(data, '\n'), 0644)
+}
+
+func (r copyResult) summary(operation string) summary {
+    return summary{
+        Operation:   operation,
+        Files:       r.scanned,
+        Directories: r.dirs,
+        TotalBytes:  r.totalBytes,
+        FilesCopied: r.files,
+        BytesCopied: r.bytes,
+        Skipped:     r.skipped,
+        Failed:      r.failed,
+    }
+}
+
+func printSummary(s summary, format string, elapsed time.Duration) {
+    s.Elapsed = elapsed.Seconds()
+    lastSummary = &s
+    logger.Info("summary", "operation", s.Operation, "files_scanned", s.Files, "directories", s.Directories,
+        "total_bytes", s.TotalBytes, "files_copied", s.FilesCopied, "bytes_copied", s.BytesCopied,
+        "skipped", s.Skipped, "failed", s.Failed, "elapsed_seconds", s.Elapsed)
+    switch format {
+    case "text":
+        fmt.Printf("Files scanned: %d, directories: %d, total size: %s\n", s.Files, s.Directories, formatSize(s.TotalBytes))
+        if s.Operation != "list" {
+            fmt.Printf("Files copied: %d (%s), skipped: %d, failed: %d\n",
+                s.FilesCopied, formatSize(s.BytesCopied), s.Skipped, s.Failed)
+        }
+        fmt.Println("Elapsed:", elapsed)
+    case "json":
+        json.NewEncoder(os.Stdout).Encode(s)
+    }
+}
+
+var summaryFormats = []string{"", "none", "text", "json"}
+
+type pricing struct {
+    perGBMonth    float64
+    per1kRequests float64
+}
+
+func (p pricing) enabled() bool {
+    return p.perGBMonth > 0 || p.per1kRequests > 0
+}
+
+func printCostEstimate(result copyResult, p pricing) {
+    gb := float64(result.bytes) / float64(1024*1024*1024)
+    fmt.Printf("Estimated cost: $%.2f storage per month for %s, $%.2f for %d requests\n",
+        gb*p.perGBMonth, formatSize(result.bytes), float64(result.files)/1000*p.per1kRequests, result.files)
+}
@@ -0,0 +1,55 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build linux
+
+package gopy
+
+import (
+    "path/filepath"
+    "syscall"
+    "testing"
+)
+
+func TestOpenSourceNoatime(t *testing.T) {
+    dir := t.TempDir()
+    writeFiles(t, dir, map[string]string{"a.txt": "a"})
+    fio := newFileIO(1<<20, logger)
+    fio.readOnly = true
+    f, e := fio.openSource(filepath.Join(dir, "a.txt"))
+    if e != nil {
+        t.Fatal(e)
+    }
+    defer f.Close()
+    flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+    if errno != 0 {
+        t.Fatal(errno)
+    }
+    if flags&syscall.O_NOATIME == 0 || flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+        t.Errorf("source opened with flags %#x, want O_RDONLY|O_NOATIME", flags)
+    }
+    // Directories are opened like files and must not be refused.
+    d, e := fio.openSource(dir)
+    if e != nil {
+        t.Fatal(e)
+    }
+    d.Close()
+}
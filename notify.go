@@ -0,0 +1,138 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/smtp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type smtpConfig struct {
+    Host     string `json:"host"`
+    Port     int    `json:"port"`
+    Username string `json:"username"`
+    Password string `json:"password"`
+    From     string `json:"from"`
+}
+
+type notification struct {
+    Operation string   `json:"operation"`
+    Status    string   `json:"status"`
+    ExitCode  int      `json:"exit_code"`
+    Input     string   `json:"input,omitempty"`
+    Directory string   `json:"directory,omitempty"`
+    Output    string   `json:"output,omitempty"`
+    Error     string   `json:"error,omitempty"`
+    Summary   *summary `json:"summary,omitempty"`
+}
+
+// webhookPosted is set once the webhook subscriber of a copy or sync has
+// posted its outcome, which exit then leaves out.
+var webhookPosted = false
+
+func notificationData(exitCode int) (notification, []byte, error) {
+    lastErr, _ := lastError.Load().(string)
+    n := notification{Operation: activeOperation(), Status: "succeeded", ExitCode: exitCode, Input: *inputFile,
+        Directory: *directoryPath, Output: *outputFile, Error: lastErr, Summary: lastSummary}
+    if exitCode != exitSuccess {
+        n.Status = "failed"
+    }
+    data, e := json.MarshalIndent(n, "", "    ")
+    return n, data, e
+}
+
+// postWebhook posts the outcome of the operation to -notify-webhook, unless
+// only failures are notified.
+func postWebhook(exitCode int) error {
+    if *notifyOn == "failure" && exitCode == exitSuccess {
+        return nil
+    }
+    _, data, e := notificationData(exitCode)
+    if e != nil {
+        return e
+    }
+    client := &http.Client{Timeout: 30 * time.Second}
+    resp, e := client.Post(*notifyWebhook, "application/json", bytes.NewReader(data))
+    if e != nil {
+        return fmt.Errorf("webhook: %v", e)
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("webhook: %s", resp.Status)
+    }
+    return nil
+}
+
+// notify posts the outcome of the operation to the webhook and mails it to
+// the recipients given, unless only failures are notified.
+func notify(exitCode int) error {
+    if *notifyWebhook != "" && !webhookPosted {
+        if e := postWebhook(exitCode); e != nil {
+            return e
+        }
+    }
+    if *notifyOn == "failure" && exitCode == exitSuccess {
+        return nil
+    }
+    n, data, e := notificationData(exitCode)
+    if e != nil {
+        return e
+    }
+    if *notifyEmail != "" {
+        c, e := readSMTPConfig(*configFile)
+        if e != nil {
+            return e
+        }
+        to := splitList(*notifyEmail)
+        var auth smtp.Auth
+        if c.Username != "" {
+            auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+        }
+        msg := "From: " + c.From + "\r\nTo: " + strings.Join(to, ", ") + "\r\nSubject: gopy " + n.Operation + " " +
+            n.Status + "\r\nContent-Type: application/json\r\n\r\n" + string(data) + "\r\n"
+        if e := smtp.SendMail(net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), auth, c.From, to, []byte(msg)); e != nil {
+            return fmt.Errorf("email: %v", e)
+        }
+    }
+    return nil
+}
+
+func readSMTPConfig(configFile string) (*smtpConfig, error) {
+    c, e := readConfig(configFile)
+    if e != nil {
+        return nil, e
+    }
+    if c.SMTP == nil || c.SMTP.Host == "" || c.SMTP.From == "" {
+        return nil, fmt.Errorf("no smtp host and from address in %s", configFile)
+    }
+    if c.SMTP.Port == 0 {
+        c.SMTP.Port = 25
+    }
+    return c.SMTP, nil
+}
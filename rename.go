@@ -0,0 +1,190 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "log/slog"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// renameRule is one -rename rule: a sed-like regexp substitution, the removal
+// of leading path components or a prefix.
+type renameRule struct {
+    pattern     *regexp.Regexp
+    replacement string
+    global      bool
+    strip       int
+    prefix      string
+}
+
+func parseRenameRule(rule string) (renameRule, error) {
+    if n, ok := strings.CutPrefix(rule, "strip:"); ok {
+        strip, e := strconv.Atoi(n)
+        if e != nil || strip < 1 {
+            return renameRule{}, errors.New("invalid -rename rule: " + rule)
+        }
+        return renameRule{strip: strip}, nil
+    }
+    if prefix, ok := strings.CutPrefix(rule, "prefix:"); ok {
+        return renameRule{prefix: filepath.ToSlash(prefix)}, nil
+    }
+    if len(rule) < 4 || rule[0] != 's' {
+        return renameRule{}, errors.New("invalid -rename rule: " + rule)
+    }
+    // Any delimiter may follow the s, like in sed.
+    parts := strings.Split(rule[2:], rule[1:2])
+    if len(parts) != 3 || (parts[2] != "" && parts[2] != "g") {
+        return renameRule{}, errors.New("invalid -rename rule: " + rule)
+    }
+    pattern, e := regexp.Compile(parts[0])
+    if e != nil {
+        return renameRule{}, errors.New("invalid -rename rule: " + rule + ": " + e.Error())
+    }
+    return renameRule{pattern: pattern, replacement: parts[1], global: parts[2] == "g"}, nil
+}
+
+// rewritePath applies the rules, in order, to a slash-separated rel. An empty
+// result means the path was stripped away.
+func rewritePath(rel string, rules []renameRule) (string, error) {
+    p := filepath.ToSlash(rel)
+    for _, rule := range rules {
+        if rule.strip > 0 {
+            parts := strings.Split(p, "/")
+            if len(parts) <= rule.strip {
+                return "", nil
+            }
+            p = strings.Join(parts[rule.strip:], "/")
+        } else if rule.prefix != "" {
+            p = rule.prefix + "/" + p
+        } else if rule.global {
+            p = rule.pattern.ReplaceAllString(p, rule.replacement)
+        } else if m := rule.pattern.FindStringSubmatchIndex(p); m != nil {
+            p = p[:m[0]] + string(rule.pattern.ExpandString(nil, rule.replacement, p, m)) + p[m[1]:]
+        }
+    }
+    p = path.Clean(p)
+    if p == "." || p == "" {
+        return "", nil
+    }
+    if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+        return "", errors.New(rel + " is renamed to " + p + ", outside of the destination")
+    }
+    return filepath.FromSlash(p), nil
+}
+
+// flattenPath returns the name rel is copied under with the -flatten
+// strategy of opts, taken holding the names given so far and the paths they
+// were given to.
+func flattenPath(rel string, taken map[string]string, opts copyOptions) (string, bool) {
+    name := filepath.Base(rel)
+    if existing, ok := taken[name]; ok {
+        strategy := opts.flatten
+        if strategy == "skip" {
+            opts.printError(rel + " skipped, " + existing + " is already copied as " + name)
+            opts.logger.Warn("file_skipped", "path", rel, "reason", "flatten collision", "other", existing)
+            return "", false
+        }
+        ext := filepath.Ext(name)
+        base := strings.TrimSuffix(name, ext)
+        if strategy == "hash" {
+            sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+            name = base + "~" + hex.EncodeToString(sum[:4]) + ext
+        }
+        for i := 2; taken[name] != ""; i++ {
+            name = base + "~" + strconv.Itoa(i) + ext
+        }
+    }
+    taken[name] = rel
+    return name, true
+}
+
+// caseFolder finds the paths that would collide on a case-insensitive
+// filesystem and applies the -case-collision policy to them. Renamed or
+// skipped directories take their contents along.
+type caseFolder struct {
+    policy     string
+    taken      map[string]string
+    renamed    map[string]string
+    logger     *slog.Logger
+    printError func(msg interface{})
+}
+
+// newCaseFolder returns the caseFolder of the -case-collision policy of
+// opts, which logs and reports the collisions as opts say.
+func newCaseFolder(opts copyOptions) *caseFolder {
+    return &caseFolder{opts.collision, map[string]string{}, map[string]string{}, opts.logger, opts.printError}
+}
+
+// resolve returns the path rel is copied under, or false when it is skipped.
+// With the fail policy, a collision is returned as an error.
+func (c *caseFolder) resolve(rel string, isDir bool) (string, bool, error) {
+    original := rel
+    for dir := filepath.Dir(rel); dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+        if renamed, ok := c.renamed[dir]; ok {
+            if renamed == "" {
+                return "", false, nil
+            }
+            rel = renamed + rel[len(dir):]
+            break
+        }
+    }
+    existing, ok := c.taken[strings.ToLower(rel)]
+    if ok && existing != rel {
+        switch c.policy {
+        case "fail":
+            return "", false, errors.New(rel + " and " + existing + " differ only by case")
+        case "skip":
+            c.printError(rel + " skipped, it differs only by case from " + existing)
+            c.logger.Warn("file_skipped", "path", rel, "reason", "case collision", "other", existing)
+            if isDir {
+                c.renamed[original] = ""
+            }
+            return "", false, nil
+        default:
+            ext := ""
+            if !isDir {
+                ext = filepath.Ext(rel)
+            }
+            base := strings.TrimSuffix(rel, ext)
+            for i := 2; ; i++ {
+                candidate := base + "~" + strconv.Itoa(i) + ext
+                if _, ok := c.taken[strings.ToLower(candidate)]; !ok {
+                    c.logger.Warn("file_renamed", "path", rel, "to", candidate, "reason", "case collision")
+                    rel = candidate
+                    break
+                }
+            }
+            if isDir {
+                c.renamed[original] = rel
+            }
+        }
+    }
+    c.taken[strings.ToLower(rel)] = rel
+    return rel, true, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestRewritePath(t *testing.T) {
+    for _, c := range []struct {
+        rules []string
+        rel   string
+        want  string
+        fails bool
+    }{
+        {[]string{"strip:1"}, "a/b/c.txt", "b/c.txt", false},
+        {[]string{"strip:2"}, "a/b", "", false},
+        {[]string{"strip:3"}, "a/b", "", false},
+        {[]string{"prefix:photos"}, "a/b.jpg", "photos/a/b.jpg", false},
+        {[]string{`s/\.jpeg$/.jpg/`}, "a.jpeg/b.jpeg", "a.jpeg/b.jpg", false},
+        {[]string{"s/a/x/"}, "a/a.txt", "x/a.txt", false},
+        {[]string{"s/a/x/g"}, "a/a.txt", "x/x.txt", false},
+        {[]string{`s|(\w+)/(\w+)|$2/$1|`}, "a/b", "b/a", false},
+        {[]string{"strip:1", "prefix:new"}, "old/a.txt", "new/a.txt", false},
+        // Rules that leave nothing skip the path rather than copy it to the
+        // root of the destination.
+        {[]string{"s/.*//"}, "a/b.txt", "", false},
+        {[]string{"s/a/./"}, "a", "", false},
+        {[]string{"s|^|../|"}, "a.txt", "", true},
+        {[]string{"s|b|../..|"}, "a/b", "", true},
+        {[]string{"s/a/../"}, "a", "", true},
+        {[]string{"s|^|/|"}, "a.txt", "", true},
+        {[]string{"prefix:/abs"}, "a.txt", "", true},
+        {[]string{"prefix:.."}, "a.txt", "", true},
+        // A path going up and back down stays inside.
+        {[]string{"prefix:x/.."}, "a.txt", "a.txt", false},
+    } {
+        rules := []renameRule{}
+        for _, r := range c.rules {
+            rule, e := parseRenameRule(r)
+            if e != nil {
+                t.Fatalf("parseRenameRule(%q) = %v", r, e)
+            }
+            rules = append(rules, rule)
+        }
+        got, e := rewritePath(filepath.FromSlash(c.rel), rules)
+        if (e != nil) != c.fails || filepath.ToSlash(got) != c.want {
+            t.Errorf("rewritePath(%q, %q) = %q, %v, want %q and failure %v", c.rel, c.rules, got, e, c.want, c.fails)
+        }
+    }
+}
+
+func TestParseRenameRuleInvalid(t *testing.T) {
+    for _, rule := range []string{"", "s", "s/a", "s/a/b", "s/a/b/x", "s/(/x/", "strip:0", "strip:x", "x/a/b/"} {
+        if _, e := parseRenameRule(rule); e == nil {
+            t.Errorf("parseRenameRule(%q) succeeded", rule)
+        }
+    }
+}
+
+// Files renamed to the same path fail instead of overwriting each other.
+func TestRenameCollision(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a/x.txt": "a", "b/x.txt": "b", "b/y.txt": "y"})
+    rule, _ := parseRenameRule("s|/[ab]/|/|")
+    dest := t.TempDir()
+    result, e := copyManifests(dest, []string{writeManifestFile(t, src)}, copyOptions{rename: []renameRule{rule}})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.failed != 1 || result.files != 2 {
+        t.Errorf("%d files copied and %d failed, want 2 and the second x.txt", result.files, result.failed)
+    }
+    if got := readFile(t, filepath.Join(dest, "src", "x.txt")); got != "a" {
+        t.Errorf("x.txt = %q, want the first one", got)
+    }
+    if _, e := os.Stat(filepath.Join(dest, "src", "y.txt")); e != nil {
+        t.Error(e)
+    }
+}
+
+func TestNormalizePath(t *testing.T) {
+    for _, c := range []struct {
+        path, form, want string
+    }{
+        {"café/a.txt", "nfc", "café/a.txt"},
+        {"café/a.txt", "nfd", "café/a.txt"},
+        {"café/a.txt", "nfc", "café/a.txt"},
+        {"café/a.txt", "", "café/a.txt"},
+        // Marks are put in canonical order, and Hangul syllables are
+        // composed from their jamo.
+        {"ậ", "nfc", "ậ"},
+        {"ậ", "nfd", "ậ"},
+        {"각", "nfc", "각"},
+        {"각", "nfd", "각"},
+    } {
+        if got := normalizePath(c.path, c.form); got != c.want {
+            t.Errorf("normalizePath(%+q, %q) = %+q, want %+q", c.path, c.form, got, c.want)
+        }
+    }
+}
+
+func TestCopyNormalize(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"café.txt": "a"})
+    dest := t.TempDir()
+    copyForTest(t, dest, writeManifestFile(t, src), copyOptions{normalize: "nfc"})
+    if got := readFile(t, filepath.Join(dest, "src", "café.txt")); got != "a" {
+        t.Errorf("normalized copy = %q", got)
+    }
+}
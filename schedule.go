@@ -0,0 +1,142 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// cronField is the set of values a field of a cron expression matches.
+type cronField uint64
+
+// parseCronField parses a comma-separated list of *, values and ranges, each
+// with an optional /step, of values between min and max.
+func parseCronField(field string, min, max int) (cronField, error) {
+    var set cronField
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, e := strconv.Atoi(part[i+1:])
+            if e != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step in %s", field)
+            }
+            part, step = part[:i], n
+        }
+        from, to := min, max
+        if part != "*" {
+            bounds := strings.SplitN(part, "-", 2)
+            n, e := strconv.Atoi(bounds[0])
+            if e != nil {
+                return 0, fmt.Errorf("invalid value in %s", field)
+            }
+            from, to = n, n
+            if len(bounds) == 2 {
+                if to, e = strconv.Atoi(bounds[1]); e != nil {
+                    return 0, fmt.Errorf("invalid value in %s", field)
+                }
+            } else if step > 1 {
+                to = max
+            }
+        }
+        if from < min || to > max || from > to {
+            return 0, fmt.Errorf("%s is out of range %d-%d", field, min, max)
+        }
+        for v := from; v <= to; v += step {
+            set |= 1 << uint(v)
+        }
+    }
+    return set, nil
+}
+
+func (f cronField) has(v int) bool {
+    return f&(1<<uint(v)) != 0
+}
+
+type schedule struct {
+    spec                           string
+    minute, hour, day, month, week cronField
+    anyDay, anyWeekday             bool
+    request                        jobRequest
+}
+
+// parseSchedule parses "minute hour day month weekday command job", where the
+// job must be a job of configFile.
+func parseSchedule(spec, configFile string) (*schedule, error) {
+    fields := strings.Fields(spec)
+    if len(fields) != 7 {
+        return nil, fmt.Errorf("schedule %q must be \"minute hour day month weekday command job\"", spec)
+    }
+    sched := &schedule{spec: spec, anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+    ranges := []struct {
+        field    *cronField
+        min, max int
+    }{{&sched.minute, 0, 59}, {&sched.hour, 0, 23}, {&sched.day, 1, 31}, {&sched.month, 1, 12}, {&sched.week, 0, 7}}
+    for i, r := range ranges {
+        set, e := parseCronField(fields[i], r.min, r.max)
+        if e != nil {
+            return nil, fmt.Errorf("schedule %q: %v", spec, e)
+        }
+        *r.field = set
+    }
+    if sched.week.has(7) {
+        sched.week |= 1
+    }
+    command, job := fields[5], fields[6]
+    if !serverCommands[command] {
+        return nil, fmt.Errorf("schedule %q: unsupported command %s", spec, command)
+    }
+    c, e := readConfig(configFile)
+    if e != nil {
+        return nil, e
+    }
+    if _, ok := c.Jobs[job]; !ok {
+        return nil, fmt.Errorf("job %s not found in %s", job, configFile)
+    }
+    sched.request = jobRequest{Command: command, Options: map[string]string{"config": configFile, "job": job}}
+    return sched, nil
+}
+
+// next returns the first minute after t matched by the schedule. As in cron,
+// a day matches when either the day of the month or the weekday does if both
+// are restricted.
+func (sched *schedule) next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+        if !sched.month.has(int(t.Month())) || !sched.hour.has(t.Hour()) || !sched.minute.has(t.Minute()) {
+            continue
+        }
+        day, weekday := sched.day.has(t.Day()), sched.week.has(int(t.Weekday()))
+        if (sched.anyDay || sched.anyWeekday) && day && weekday || !sched.anyDay && !sched.anyWeekday && (day || weekday) {
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+type scheduleStatus struct {
+    Schedule string       `json:"schedule"`
+    Next     time.Time    `json:"next"`
+    Runs     []*serverJob `json:"runs"`
+}
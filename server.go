@@ -0,0 +1,814 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type lockedBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+func (b *lockedBuffer) from(offset int) []byte {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]byte(nil), b.buf.Bytes()[offset:]...)
+}
+
+type jobRequest struct {
+    Command string            `json:"command"`
+    Options map[string]string `json:"options"`
+    Args    []string          `json:"args"`
+}
+
+type serverJob struct {
+    ID        int        `json:"id"`
+    Request   jobRequest `json:"request"`
+    State     string     `json:"state"`
+    ExitCode  int        `json:"exit_code"`
+    Submitted time.Time  `json:"submitted"`
+    Started   *time.Time `json:"started,omitempty"`
+    Finished  *time.Time `json:"finished,omitempty"`
+    Files     int        `json:"files_done"`
+    Output    string     `json:"output"`
+    Schedule  string     `json:"schedule,omitempty"`
+    Tenant    string     `json:"tenant,omitempty"`
+
+    mu        sync.Mutex
+    cmd       *exec.Cmd
+    cancelled bool
+    abort     chan struct{}
+    done      chan struct{}
+    out       lockedBuffer
+    log       lockedBuffer
+}
+
+var serverCommands = map[string]bool{"list": true, "copy": true, "sync": true, "extract": true, "check": true}
+
+// run waits for one of the slots and runs the job in a separate gopy process
+// with a JSON log, from which the progress is counted. save is called
+// whenever the state of the job changes.
+func (j *serverJob) run(slots chan struct{}, save func()) {
+    defer save()
+    defer close(j.done)
+    select {
+    case slots <- struct{}{}:
+        defer func() { <-slots }()
+    case <-j.abort:
+    }
+    j.mu.Lock()
+    if j.cancelled {
+        finished := time.Now()
+        j.State, j.Finished = "cancelled", &finished
+        j.mu.Unlock()
+        return
+    }
+    started := time.Now()
+    j.State, j.Started = "running", &started
+    j.mu.Unlock()
+    save()
+    args := []string{j.Request.Command, "-log-format=json", "-v"}
+    names := []string{}
+    for name := range j.Request.Options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        args = append(args, "-"+name+"="+j.Request.Options[name])
+    }
+    args = append(append(args, "--"), j.Request.Args...)
+    executable, e := os.Executable()
+    if e != nil {
+        j.finish(e)
+        return
+    }
+    cmd := exec.Command(executable, args...)
+    cmd.Stdout, cmd.Stderr = &j.out, &j.log
+    // Processes started by the job, such as a filter script, can keep the
+    // output open after the job is killed.
+    cmd.WaitDelay = time.Second
+    j.mu.Lock()
+    j.cmd = cmd
+    e = cmd.Start()
+    j.mu.Unlock()
+    if e == nil {
+        e = cmd.Wait()
+    }
+    j.finish(e)
+}
+
+// finish records the end of the job, which e tells the cause of if it failed.
+func (j *serverJob) finish(e error) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    finished := time.Now()
+    j.State, j.Finished = "succeeded", &finished
+    if exitError, ok := e.(*exec.ExitError); ok {
+        j.State, j.ExitCode = "failed", exitError.ExitCode()
+    } else if e != nil {
+        j.State, j.ExitCode = "failed", exitIOError
+        j.out.Write([]byte(e.Error()))
+    }
+    if j.cancelled {
+        j.State = "cancelled"
+    }
+}
+
+func (j *serverJob) cancel() bool {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if j.State == "queued" && !j.cancelled {
+        j.cancelled = true
+        close(j.abort)
+        return true
+    }
+    if j.State != "running" || j.cmd == nil || j.cmd.Process == nil {
+        return false
+    }
+    j.cancelled = true
+    j.cmd.Process.Kill()
+    return true
+}
+
+// follow calls send with the complete lines of the log of a job as they are
+// written, until the job finishes, ctx is done or send fails.
+func (j *serverJob) follow(ctx context.Context, send func(lines []byte) error) error {
+    offset := 0
+    for {
+        finished := false
+        select {
+        case <-j.done:
+            finished = true
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(200 * time.Millisecond):
+        }
+        lines := j.log.from(offset)
+        if !finished {
+            lines = lines[:bytes.LastIndexByte(lines, '\n')+1]
+        }
+        offset += len(lines)
+        if len(lines) > 0 {
+            if e := send(lines); e != nil {
+                return e
+            }
+        }
+        if finished {
+            return nil
+        }
+    }
+}
+
+// streamEvents writes the log events of a job to w as they happen, one JSON
+// object per line, until the job finishes or the client goes away.
+func (j *serverJob) streamEvents(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    flusher, _ := w.(http.Flusher)
+    if flusher != nil {
+        flusher.Flush()
+    }
+    j.follow(r.Context(), func(lines []byte) error {
+        if _, e := w.Write(lines); e != nil {
+            return e
+        }
+        if flusher != nil {
+            flusher.Flush()
+        }
+        return nil
+    })
+}
+
+func (j *serverJob) snapshot() *serverJob {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    s := &serverJob{ID: j.ID, Request: j.Request, State: j.State, ExitCode: j.ExitCode,
+        Submitted: j.Submitted, Started: j.Started, Finished: j.Finished, Output: j.Output + j.out.String(),
+        Schedule: j.Schedule, Tenant: j.Tenant}
+    s.Files = j.Files + strings.Count(j.log.String(), `"msg":"file_copied"`)
+    return s
+}
+
+// tenant is a team sharing the server. It authenticates with its token, sees
+// only its own jobs, runs them only on paths below its roots, has at most
+// MaxJobs of them queued or running and keeps the last History finished
+// ones, when these are not 0.
+type tenant struct {
+    Token   string   `json:"token"`
+    Roots   []string `json:"roots"`
+    MaxJobs int      `json:"max_jobs,omitempty"`
+    History int      `json:"history,omitempty"`
+}
+
+// refusedOptions run commands, reach other hosts or read the config file of
+// the server, and no job requested over the API may use them. tenantPathOptions
+// name files or directories, which must be below the roots of the tenant like
+// the arguments of the job.
+var refusedOptions = map[string]bool{"config": true, "job": true, "profile": true, "pre-hook": true,
+    "post-hook": true, "on-file-hook": true, "filter-script": true, "ssh-command": true, "notify-webhook": true,
+    "notify-email": true, "metrics-addr": true, "s3-endpoint": true}
+
+// serverOptions holds the options of each of serverCommands. Registering
+// flags resets them to their defaults, so it is filled in when the package is
+// initialized, before the command line is parsed.
+var serverOptions = func() map[string]map[string]bool {
+    options := map[string]map[string]bool{}
+    for name := range serverCommands {
+        options[name] = commandOptionNames(name)
+    }
+    return options
+}()
+
+var tenantPathOptions = map[string]bool{"input": true, "directory": true, "output": true, "backup": true,
+    "link-dest": true, "journal": true, "checkpoint": true, "state": true, "key-file": true, "warn-report": true,
+    "metrics-file": true, "log-file": true, "lock": true}
+
+// readTenants reads the tenants of configFile, if it exists, with their roots
+// made absolute and their symbolic links resolved.
+func readTenants(configFile string) (map[string]*tenant, error) {
+    c, e := readConfig(configFile)
+    if os.IsNotExist(e) {
+        return nil, nil
+    } else if e != nil {
+        return nil, e
+    }
+    tokens := map[string]bool{}
+    for name, t := range c.Tenants {
+        if t.Token == "" || tokens[t.Token] {
+            return nil, fmt.Errorf("tenant %s needs a token of its own", name)
+        }
+        tokens[t.Token] = true
+        if len(t.Roots) == 0 {
+            return nil, fmt.Errorf("tenant %s has no roots", name)
+        }
+        for i, root := range t.Roots {
+            t.Roots[i] = resolvePath(root)
+        }
+    }
+    return c.Tenants, nil
+}
+
+// resolvePath returns path made absolute, with the symbolic links of the part
+// of it that exists resolved.
+func resolvePath(path string) string {
+    path, _ = filepath.Abs(path)
+    for dir, rest := path, ""; ; {
+        if resolved, e := filepath.EvalSymlinks(dir); e == nil {
+            return filepath.Join(resolved, rest)
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return path
+        }
+        dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+    }
+}
+
+// checkRequest tells why request may not be run over the API, or returns nil.
+// Options must be named exactly as the flags of the command, and arguments
+// may not look like flags, or they would set options that are not checked.
+func checkRequest(request jobRequest) error {
+    for key := range request.Options {
+        name := optionName(key)
+        if refusedOptions[name] {
+            return fmt.Errorf("option %s is not allowed", key)
+        }
+        if key != name || !serverOptions[request.Command][name] {
+            return fmt.Errorf("unknown option %s of %s", key, request.Command)
+        }
+    }
+    for _, arg := range request.Args {
+        if strings.HasPrefix(arg, "-") {
+            return fmt.Errorf("argument %s starts with -", arg)
+        }
+    }
+    return nil
+}
+
+// optionName returns the flag that key sets on a command line: the flag
+// package takes one or two leading dashes and reads a value after =.
+func optionName(key string) string {
+    name := strings.TrimPrefix(strings.TrimPrefix(key, "-"), "-")
+    if i := strings.Index(name, "="); i >= 0 {
+        name = name[:i]
+    }
+    return name
+}
+
+// check tells why the tenant may not run request, or returns nil.
+func (t *tenant) check(request jobRequest) error {
+    _, e := t.checkEntries(request)
+    return e
+}
+
+// checkEntries tells why the tenant may not run request, or returns the
+// entries of the manifest the job reads, if any. These must be below the
+// roots too, and may not be URLs, remotes or cloud paths, which the server
+// would fetch with its own network access and credentials. Symbolic links can
+// lead out of the roots, so the job may only skip them.
+func (t *tenant) checkEntries(request jobRequest) ([]jsonEntry, error) {
+    if e := checkRequest(request); e != nil {
+        return nil, e
+    }
+    paths := append([]string{}, request.Args...)
+    for key, value := range request.Options {
+        name := optionName(key)
+        if tenantPathOptions[name] && value != "" && !(name == "output" && value == "-") {
+            paths = append(paths, value)
+        }
+        if name == "links" && value != "skip" {
+            return nil, fmt.Errorf("links %s is not allowed, tenant jobs skip symbolic links", value)
+        }
+    }
+    for _, path := range paths {
+        if !t.within(path) {
+            return nil, fmt.Errorf("%s is not below the roots of the tenant", path)
+        }
+    }
+    input := request.Options["input"]
+    if input == "" || request.Command == "extract" {
+        return nil, nil
+    }
+    entries, e := readManifests([]string{input}, logger)
+    if e != nil {
+        return nil, e
+    }
+    for _, entry := range entries {
+        if isURL(entry.Path) || isRemote(entry.Path) || isCloud(entry.Path) {
+            return nil, fmt.Errorf("%s: URL, remote and cloud entries are not allowed", entry.Path)
+        }
+        if !t.within(entry.Path) {
+            return nil, fmt.Errorf("%s: entry %s is not below the roots of the tenant", input, entry.Path)
+        }
+    }
+    return entries, nil
+}
+
+// within tells whether path, once its symbolic links are resolved, is below
+// one of the roots of the tenant.
+func (t *tenant) within(path string) bool {
+    for _, root := range t.Roots {
+        if isWithin(resolvePath(path), root) {
+            return true
+        }
+    }
+    return false
+}
+
+type server struct {
+    mu        sync.Mutex
+    jobs      []*serverJob
+    slots     chan struct{}
+    stateFile string
+    history   int
+    schedules []*schedule
+    tenants   map[string]*tenant
+    token     string
+    manifests string
+}
+
+// tenant returns the name of the tenant whose token r carries, "" when the
+// server has no tenants and r carries the token of the server, or false when
+// r has no valid token.
+func (s *server) tenant(r *http.Request) (string, bool) {
+    token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if !ok {
+        return "", false
+    }
+    return s.tenantOf(token)
+}
+
+// tenantOf returns the name of the tenant of token, as tenant does.
+func (s *server) tenantOf(token string) (string, bool) {
+    if len(s.tenants) == 0 {
+        return "", s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+    }
+    for name, t := range s.tenants {
+        if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+            return name, true
+        }
+    }
+    return "", false
+}
+
+// authorized serves r with handler for the tenant of r, or refuses it.
+func (s *server) authorized(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        name, ok := s.tenant(r)
+        if !ok {
+            writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or unknown token"})
+            return
+        }
+        handler(w, r, name)
+    }
+}
+
+// tenantJobs returns the snapshots of the jobs of the tenant name.
+func (s *server) tenantJobs(name string) []*serverJob {
+    jobs := []*serverJob{}
+    for _, j := range s.snapshots() {
+        if j.Tenant == name {
+            jobs = append(jobs, j)
+        }
+    }
+    return jobs
+}
+
+func (s *server) snapshots() []*serverJob {
+    s.mu.Lock()
+    jobs := make([]*serverJob, len(s.jobs))
+    copy(jobs, s.jobs)
+    s.mu.Unlock()
+    snapshots := []*serverJob{}
+    for _, j := range jobs {
+        snapshots = append(snapshots, j.snapshot())
+    }
+    return snapshots
+}
+
+// save writes the state of every job to the state file, replacing it.
+func (s *server) save() {
+    if s.stateFile == "" {
+        return
+    }
+    data, e := json.MarshalIndent(s.snapshots(), "", "    ")
+    if e != nil {
+        printError(e)
+        return
+    }
+    f, e := cliIO.createAtomic(s.stateFile)
+    if e != nil {
+        printError(e)
+        return
+    }
+    if _, e := f.Write(data); e != nil {
+        f.abort()
+        printError(e)
+        return
+    }
+    if e := f.commit(); e != nil {
+        printError(e)
+    }
+}
+
+func (s *server) submit(j *serverJob) {
+    j.abort, j.done = make(chan struct{}), make(chan struct{})
+    go j.run(s.slots, s.save)
+}
+
+// load restores the jobs of the state file. Queued jobs are queued again and
+// jobs that were running when the server stopped are marked interrupted.
+func (s *server) load() error {
+    data, e := ioutil.ReadFile(s.stateFile)
+    if os.IsNotExist(e) {
+        return nil
+    } else if e != nil {
+        return e
+    }
+    if e := json.Unmarshal(data, &s.jobs); e != nil {
+        return e
+    }
+    for _, j := range s.jobs {
+        if j.State == "queued" {
+            s.submit(j)
+            continue
+        }
+        if j.State == "running" {
+            finished := time.Now()
+            j.State, j.Finished = "interrupted", &finished
+        }
+        j.done = make(chan struct{})
+        close(j.done)
+    }
+    return nil
+}
+
+func (s *server) job(id string) *serverJob {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    n, e := strconv.Atoi(id)
+    if e != nil {
+        return nil
+    }
+    for _, j := range s.jobs {
+        if j.ID == n {
+            return j
+        }
+    }
+    return nil
+}
+
+// add appends a new job of the tenant name for request and queues it, or
+// returns nil when the tenant already has as many jobs queued or running as
+// it may. Runs of a schedule beyond the last s.history ones, and finished
+// jobs of a tenant beyond its last History ones, are forgotten.
+func (s *server) add(request jobRequest, schedule, name string) *serverJob {
+    s.mu.Lock()
+    if t := s.tenants[name]; t != nil && t.MaxJobs > 0 {
+        active := 0
+        for _, j := range s.jobs {
+            if state := j.snapshot().State; j.Tenant == name && (state == "queued" || state == "running") {
+                active++
+            }
+        }
+        if active >= t.MaxJobs {
+            s.mu.Unlock()
+            return nil
+        }
+    }
+    j := &serverJob{ID: 1, Request: request, State: "queued", Submitted: time.Now(), Schedule: schedule, Tenant: name}
+    if len(s.jobs) > 0 {
+        j.ID = s.jobs[len(s.jobs)-1].ID + 1
+    }
+    s.jobs = append(s.jobs, j)
+    if t := s.tenants[name]; t != nil && t.History > 0 {
+        finished := 0
+        kept := []*serverJob{}
+        for i := len(s.jobs) - 1; i >= 0; i-- {
+            if state := s.jobs[i].snapshot().State; s.jobs[i].Tenant == name && state != "queued" && state != "running" {
+                finished++
+                if finished > t.History {
+                    continue
+                }
+            }
+            kept = append([]*serverJob{s.jobs[i]}, kept...)
+        }
+        s.jobs = kept
+    }
+    if schedule != "" {
+        runs := 0
+        kept := []*serverJob{}
+        for i := len(s.jobs) - 1; i >= 0; i-- {
+            if s.jobs[i].Schedule == schedule {
+                runs++
+                if runs > s.history {
+                    continue
+                }
+            }
+            kept = append([]*serverJob{s.jobs[i]}, kept...)
+        }
+        s.jobs = kept
+    }
+    s.mu.Unlock()
+    s.submit(j)
+    s.save()
+    return j
+}
+
+// keepManifest writes the checked entries of a tenant job to a manifest of
+// the server, which the job reads instead of the one of the tenant, so that
+// the tenant cannot change it once checked.
+func (s *server) keepManifest(entries []jsonEntry) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.manifests == "" {
+        dir, e := ioutil.TempDir("", "gopy-serve-")
+        if e != nil {
+            return "", e
+        }
+        s.manifests = dir
+    }
+    f, e := ioutil.TempFile(s.manifests, "manifest-*.txt")
+    if e != nil {
+        return "", e
+    }
+    f.Close()
+    return f.Name(), writeManifest(f.Name(), entries)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// queue checks request of the tenant name and queues its job, or returns the
+// HTTP status and the error refusing it.
+func (s *server) queue(request jobRequest, name string) (*serverJob, int, error) {
+    if !serverCommands[request.Command] {
+        return nil, http.StatusBadRequest, fmt.Errorf("unsupported command: %s", request.Command)
+    }
+    if e := checkRequest(request); e != nil {
+        return nil, http.StatusForbidden, e
+    }
+    if t := s.tenants[name]; t != nil {
+        entries, e := t.checkEntries(request)
+        if e != nil {
+            return nil, http.StatusForbidden, e
+        }
+        if serverOptions[request.Command]["links"] {
+            if request.Options == nil {
+                request.Options = map[string]string{}
+            }
+            request.Options["links"] = "skip"
+        }
+        if entries != nil {
+            if request.Options["input"], e = s.keepManifest(entries); e != nil {
+                return nil, http.StatusInternalServerError, e
+            }
+        }
+    }
+    j := s.add(request, "", name)
+    if j == nil {
+        return nil, http.StatusTooManyRequests, errors.New("too many jobs queued or running")
+    }
+    return j, http.StatusAccepted, nil
+}
+
+func (s *server) handleJobs(w http.ResponseWriter, r *http.Request, name string) {
+    switch r.Method {
+    case http.MethodGet:
+        writeJSON(w, http.StatusOK, s.tenantJobs(name))
+    case http.MethodPost:
+        var request jobRequest
+        if e := json.NewDecoder(r.Body).Decode(&request); e != nil {
+            writeJSON(w, http.StatusBadRequest, map[string]string{"error": e.Error()})
+            return
+        }
+        j, status, e := s.queue(request, name)
+        if e != nil {
+            writeJSON(w, status, map[string]string{"error": e.Error()})
+            return
+        }
+        writeJSON(w, http.StatusAccepted, j.snapshot())
+    default:
+        w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+}
+
+// handleJob serves /jobs/<id> with the status of a job, cancelling it on
+// DELETE, /jobs/<id>/events with its progress events and /jobs/<id>/manifest
+// with the output file of a finished list job.
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request, name string) {
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+    j := s.job(parts[0])
+    if j == nil || j.Tenant != name || len(parts) > 2 || (len(parts) == 2 && parts[1] != "manifest" && parts[1] != "events") {
+        http.NotFound(w, r)
+        return
+    }
+    if len(parts) == 1 && r.Method == http.MethodDelete {
+        if !j.cancel() {
+            writeJSON(w, http.StatusConflict, map[string]string{"error": "job is not queued or running"})
+            return
+        }
+        <-j.done
+    }
+    if len(parts) == 2 && parts[1] == "events" {
+        j.streamEvents(w, r)
+        return
+    }
+    status := j.snapshot()
+    if len(parts) == 1 {
+        writeJSON(w, http.StatusOK, status)
+        return
+    }
+    output := status.Request.Options["output"]
+    if status.Request.Command != "list" || status.State != "succeeded" || output == "" || output == "-" {
+        writeJSON(w, http.StatusConflict, map[string]string{"error": "no manifest for this job"})
+        return
+    }
+    http.ServeFile(w, r, output)
+}
+
+// runSchedule starts the job of sched at every time it gives, skipping a run
+// while the previous one is still queued or running.
+func (s *server) runSchedule(sched *schedule) {
+    var last *serverJob
+    for {
+        next := sched.next(time.Now())
+        if next.IsZero() {
+            return
+        }
+        time.Sleep(time.Until(next))
+        if last != nil {
+            if state := last.snapshot().State; state == "queued" || state == "running" {
+                logger.Warn("schedule_skipped", "schedule", sched.spec, "reason", "previous run is "+state)
+                continue
+            }
+        }
+        last = s.add(sched.request, sched.spec, "")
+    }
+}
+
+// handleSchedules serves /schedules with the next run and the kept runs of
+// every schedule, most recent first. The runs belong to no tenant.
+func (s *server) handleSchedules(w http.ResponseWriter, r *http.Request, name string) {
+    jobs := s.tenantJobs(name)
+    statuses := []scheduleStatus{}
+    for _, sched := range s.schedules {
+        status := scheduleStatus{Schedule: sched.spec, Next: sched.next(time.Now()), Runs: []*serverJob{}}
+        for i := len(jobs) - 1; i >= 0; i-- {
+            if jobs[i].Schedule == sched.spec {
+                status.Runs = append(status.Runs, jobs[i])
+            }
+        }
+        statuses = append(statuses, status)
+    }
+    writeJSON(w, http.StatusOK, statuses)
+}
+
+// runServe runs an HTTP API on addr: POST /jobs queues a job described by a
+// JSON jobRequest, GET /jobs and GET /jobs/<id> report their status and
+// progress, GET /jobs/<id>/events streams their events, DELETE /jobs/<id>
+// cancels one and GET /jobs/<id>/manifest downloads the output of a list job.
+// The same jobs are served over gRPC on grpcAddr when it is not empty. At
+// most concurrency jobs run at once and the jobs are kept in stateFile. The
+// jobs of schedules are started at the times they give, keeping the last
+// history runs of each. Every request needs the token of a tenant of the
+// config file or, when it has none, token, which is generated and printed
+// when empty.
+func runServe(addr, grpcAddr, token string, concurrency int, stateFile string, schedules []string, history int) {
+    s := &server{slots: make(chan struct{}, concurrency), stateFile: stateFile, history: history, token: token}
+    tenants, e := readTenants(*configFile)
+    if e != nil {
+        printErrorAndExit(e, exitUsage)
+    }
+    s.tenants = tenants
+    if len(s.tenants) == 0 && s.token == "" {
+        random := make([]byte, 16)
+        if _, e := rand.Read(random); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        s.token = hex.EncodeToString(random)
+        fmt.Println("Token:", s.token)
+    }
+    if e := s.load(); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    for _, spec := range schedules {
+        sched, _ := parseSchedule(spec, *configFile)
+        s.schedules = append(s.schedules, sched)
+        startScheduleJournal(sched)
+        go s.runSchedule(sched)
+    }
+    if grpcAddr != "" {
+        l, e := net.Listen("tcp", grpcAddr)
+        if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        fmt.Println("gRPC listening on", grpcAddr)
+        go func() {
+            if e := s.serveGRPC(l); e != nil {
+                printErrorAndExit(e, exitIOError)
+            }
+        }()
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/jobs", s.authorized(s.handleJobs))
+    mux.HandleFunc("/jobs/", s.authorized(s.handleJob))
+    mux.HandleFunc("/schedules", s.authorized(s.handleSchedules))
+    fmt.Println("Listening on", addr)
+    if e := http.ListenAndServe(addr, mux); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+}
@@ -0,0 +1,278 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+
+    "github.com/pkg/sftp"
+)
+
+// isRemote reports whether path is a user@host:/path remote reached with ssh.
+// A user starting with - would be read as an option by ssh.
+func isRemote(path string) bool {
+    at, colon := strings.Index(path, "@"), strings.Index(path, ":")
+    return at > 0 && colon > at+1 && !strings.ContainsAny(path[:colon], `/\`) && !strings.HasPrefix(path, "-")
+}
+
+func splitRemote(remote string) (string, string) {
+    i := strings.Index(remote, ":")
+    return remote[:i], path.Clean(remote[i+1:])
+}
+
+// sshOptions returns the -ssh-command client and the options of every
+// connection, which share one connection between the commands of a run
+// where the client supports it.
+func sshOptions() []string {
+    args := strings.Fields(*sshClient)
+    if runtime.GOOS != "windows" {
+        args = append(args, "-o", "ControlMaster=auto", "-o", "ControlPersist=60",
+            "-o", "ControlPath="+filepath.Join(os.TempDir(), "gopy-ssh-%C"))
+    }
+    return append(args, "-o", "BatchMode=yes")
+}
+
+// sftpClient is an SFTP client of the sftp subsystem of a host, reached with
+// the -ssh-command client so that its keys, agent and ssh_config apply.
+// Requests may be sent from several goroutines, and several may be in flight.
+type sftpClient struct {
+    *sftp.Client
+    host   string
+    cmd    *exec.Cmd
+    stderr lockedBuffer
+}
+
+func dialSFTP(host string) (*sftpClient, error) {
+    args := append(sshOptions(), "-s", "--", host, "sftp")
+    c := &sftpClient{host: host, cmd: exec.Command(args[0], args[1:]...)}
+    c.cmd.Stderr = &c.stderr
+    w, e := c.cmd.StdinPipe()
+    if e != nil {
+        return nil, e
+    }
+    r, e := c.cmd.StdoutPipe()
+    if e != nil {
+        return nil, e
+    }
+    if e := c.cmd.Start(); e != nil {
+        return nil, e
+    }
+    if c.Client, e = sftp.NewClientPipe(r, w, sftp.UseConcurrentWrites(true)); e != nil {
+        w.Close()
+        c.cmd.Process.Kill()
+        c.cmd.Wait()
+        return nil, fmt.Errorf("%s: no SFTP server: %v %s", host, e, strings.TrimSpace(c.stderr.String()))
+    }
+    return c, nil
+}
+
+// rename moves oldPath over newPath, with the POSIX rename extension where
+// the server has it, as plain SFTP renames never replace a file.
+func (c *sftpClient) rename(oldPath, newPath string) error {
+    if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+        return c.PosixRename(oldPath, newPath)
+    }
+    c.Remove(newPath)
+    return c.Rename(oldPath, newPath)
+}
+
+// readDir returns the entries of dir sorted by name.
+func (c *sftpClient) readDir(dir string) ([]os.FileInfo, error) {
+    entries, e := c.ReadDir(dir)
+    if e != nil {
+        return nil, c.pathError(dir, e)
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Name() < entries[j].Name()
+    })
+    return entries, nil
+}
+
+// pathError returns e, which a request about p failed with, with the host
+// and p.
+func (c *sftpClient) pathError(p string, e error) error {
+    if e == nil {
+        return nil
+    }
+    return fmt.Errorf("%s:%s: %v", c.host, p, e)
+}
+
+func (c *sftpClient) close() error {
+    c.Client.Close()
+    return c.cmd.Wait()
+}
+
+// sftpDestination writes copied files below a directory of a remote host
+// over SFTP, each to a temporary file first that is then moved into place.
+type sftpDestination struct {
+    c    *sftpClient
+    root string
+    fio  *fileIO
+
+    mu   sync.Mutex
+    dirs map[string]bool
+}
+
+func (d *sftpDestination) mkdirAll(dir string) error {
+    d.mu.Lock()
+    made := d.dirs[dir]
+    d.mu.Unlock()
+    if made {
+        return nil
+    }
+    if e := d.c.MkdirAll(dir); e != nil {
+        return d.c.pathError(dir, e)
+    }
+    d.mu.Lock()
+    d.dirs[dir] = true
+    d.mu.Unlock()
+    return nil
+}
+
+func (d *sftpDestination) makeDir(rel string, info os.FileInfo) error {
+    return d.mkdirAll(path.Join(d.root, filepath.ToSlash(rel)))
+}
+
+func (d *sftpDestination) writeFile(src, rel string, info os.FileInfo) error {
+    dest := path.Join(d.root, filepath.ToSlash(rel))
+    tmp := path.Join(path.Dir(dest), "."+path.Base(dest)+".gopy-tmp")
+    f, e := d.fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer f.Close()
+    if e := d.mkdirAll(path.Dir(dest)); e != nil {
+        return e
+    }
+    e = d.upload(tmp, f, info)
+    if e == nil {
+        e = d.c.pathError(dest, d.c.rename(tmp, dest))
+    }
+    if e != nil {
+        d.c.Remove(tmp)
+    }
+    return e
+}
+
+// upload writes r to the remote file p with the permissions and modification
+// time of info.
+func (d *sftpDestination) upload(p string, r io.Reader, info os.FileInfo) error {
+    f, e := d.c.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+    if e != nil {
+        return d.c.pathError(p, e)
+    }
+    _, e = f.ReadFrom(r)
+    if e2 := f.Close(); e == nil {
+        e = e2
+    }
+    if e == nil {
+        e = d.c.Chmod(p, info.Mode().Perm())
+    }
+    if e == nil {
+        e = d.c.Chtimes(p, info.ModTime(), info.ModTime())
+    }
+    return d.c.pathError(p, e)
+}
+
+func (d *sftpDestination) close() error {
+    return d.c.close()
+}
+
+// fetchRemote copies a user@host:/path source below directoryPath over
+// SFTP, reporting its progress and failures as opts says.
+func fetchRemote(source, directoryPath string, opts copyOptions, result *copyResult) error {
+    host, remotePath := splitRemote(source)
+    c, e := dialSFTP(host)
+    if e != nil {
+        return e
+    }
+    defer c.close()
+    info, e := c.Lstat(remotePath)
+    if e != nil {
+        return fmt.Errorf("%s: %v", source, e)
+    }
+    var fetch func(remote, name string, info os.FileInfo)
+    fetch = func(remote, name string, info os.FileInfo) {
+        dest, e := extractPath(directoryPath, name)
+        if e != nil {
+            opts.printError(e)
+            result.failed++
+            return
+        }
+        rel, _ := filepath.Rel(directoryPath, dest)
+        switch {
+        case info.IsDir():
+            os.MkdirAll(dest, 0755)
+            result.dirs++
+            entries, e := c.readDir(remote)
+            if e != nil {
+                opts.printError(e)
+                result.failed++
+                opts.progress.report(Event{Kind: Error, Path: rel, Err: e})
+                return
+            }
+            for _, entry := range entries {
+                fetch(path.Join(remote, entry.Name()), path.Join(name, entry.Name()), entry)
+            }
+        case info.Mode().IsRegular():
+            result.scanned++
+            result.totalBytes += info.Size()
+            if e := c.download(remote, dest, info); e != nil {
+                opts.printError(e)
+                result.failed++
+                opts.progress.report(Event{Kind: Error, Path: rel, Err: e})
+                return
+            }
+            result.files++
+            result.bytes += info.Size()
+            opts.progress.report(Event{Kind: FileCopied, Path: rel, Size: info.Size(), Files: result.files,
+                Bytes: result.bytes})
+        default:
+            opts.logger.Info("file_skipped", "path", rel, "reason", "not a regular file")
+        }
+    }
+    fetch(remotePath, path.Base(remotePath), info)
+    return nil
+}
+
+// download copies the remote file p to dest with the permissions and
+// modification time of info.
+func (c *sftpClient) download(p, dest string, info os.FileInfo) error {
+    f, e := c.Open(p)
+    if e != nil {
+        return c.pathError(p, e)
+    }
+    e = extractEntry(dest, f, info.Mode().Perm(), info.ModTime())
+    if e2 := f.Close(); e == nil {
+        e = c.pathError(p, e2)
+    }
+    return e
+}
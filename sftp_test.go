@@ -0,0 +1,163 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "crypto/rand"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/pkg/sftp"
+)
+
+// TestSFTPServerProcess is the sftp subsystem that the ssh client of
+// TestSFTPRemote runs.
+func TestSFTPServerProcess(t *testing.T) {
+    if os.Getenv("GOPY_TEST_SFTP_SERVER") == "" {
+        t.Skip("run by TestSFTPRemote")
+    }
+    server, e := sftp.NewServer(struct {
+        io.Reader
+        io.WriteCloser
+    }{os.Stdin, os.Stdout})
+    if e != nil {
+        t.Fatal(e)
+    }
+    server.Serve()
+    os.Exit(0)
+}
+
+// fakeSSHForTest makes -ssh-command a script that serves SFTP from the local
+// file system with a TestSFTPServerProcess.
+func fakeSSHForTest(t *testing.T) {
+    t.Helper()
+    if runtime.GOOS == "windows" {
+        t.Skip("needs a shell script as the ssh client")
+    }
+    exe, e := os.Executable()
+    if e != nil {
+        t.Fatal(e)
+    }
+    ssh := filepath.Join(t.TempDir(), "ssh")
+    script := fmt.Sprintf("#!/bin/sh\nGOPY_TEST_SFTP_SERVER=1 exec '%s' -test.run='^TestSFTPServerProcess$'\n", exe)
+    if e := os.WriteFile(ssh, []byte(script), 0755); e != nil {
+        t.Fatal(e)
+    }
+    client := *sshClient
+    t.Cleanup(func() { *sshClient = client })
+    *sshClient = ssh
+}
+
+func TestSFTPRemote(t *testing.T) {
+    fakeSSHForTest(t)
+
+    big := make([]byte, 300*1024)
+    rand.Read(big)
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "b", "big.bin": string(big)})
+    modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+    if e := os.Chtimes(filepath.Join(src, "sub", "b.txt"), modTime, modTime); e != nil {
+        t.Fatal(e)
+    }
+
+    remote := t.TempDir()
+    copyForTest(t, "user@host:"+remote, writeManifestFile(t, src), copyOptions{})
+    for name, want := range map[string]string{"a.txt": "a", "sub/b.txt": "b", "big.bin": string(big)} {
+        if got := readFile(t, filepath.Join(remote, "src", name)); got != want {
+            t.Errorf("remote %s: got %d bytes, want %d", name, len(got), len(want))
+        }
+    }
+    if info, e := os.Stat(filepath.Join(remote, "src", "sub", "b.txt")); e != nil || !info.ModTime().Equal(modTime) {
+        t.Errorf("remote sub/b.txt: modification time not kept: %v %v", info, e)
+    }
+
+    // A second copy replaces the files in place.
+    writeFiles(t, src, map[string]string{"a.txt": "changed"})
+    copyForTest(t, "user@host:"+remote, writeManifestFile(t, src), copyOptions{})
+    if got := readFile(t, filepath.Join(remote, "src", "a.txt")); got != "changed" {
+        t.Errorf("remote a.txt after second copy: got %q", got)
+    }
+
+    dest := t.TempDir()
+    copyForTest(t, dest, writeManifestFile(t, "user@host:"+filepath.Join(remote, "src")), copyOptions{})
+    for name, want := range map[string]string{"a.txt": "changed", "sub/b.txt": "b", "big.bin": string(big)} {
+        if got := readFile(t, filepath.Join(dest, "src", name)); got != want {
+            t.Errorf("fetched %s: got %d bytes, want %d", name, len(got), len(want))
+        }
+    }
+    if info, e := os.Stat(filepath.Join(dest, "src", "sub", "b.txt")); e != nil || !info.ModTime().Equal(modTime) {
+        t.Errorf("fetched sub/b.txt: modification time not kept: %v %v", info, e)
+    }
+}
+
+func TestSFTPMissingRemote(t *testing.T) {
+    fakeSSHForTest(t)
+    missing := filepath.Join(t.TempDir(), "missing")
+    result, e := copyManifests(t.TempDir(), []string{writeManifestFile(t, "user@host:"+missing)}, copyOptions{})
+    if e != nil || result.failed != 1 {
+        t.Errorf("copy from a missing remote: %d failed, %v", result.failed, e)
+    }
+}
+
+func TestIsRemote(t *testing.T) {
+    for path, want := range map[string]bool{
+        "user@host:/data":                  true,
+        "user@host:data":                   true,
+        "/data/user@host:x":                false,
+        "@host:/data":                      false,
+        "user@:/data":                      false,
+        "-oProxyCommand=touch x@h:/p":      false,
+        "-oProxyCommand=touch${IFS}x@h:/p": false,
+        `C:\data\user@host:x`:              false,
+    } {
+        if got := isRemote(path); got != want {
+            t.Errorf("isRemote(%q) = %v, want %v", path, got, want)
+        }
+    }
+}
+
+func TestSFTPHostAfterOptions(t *testing.T) {
+    if runtime.GOOS == "windows" {
+        t.Skip("needs a shell script as the ssh client")
+    }
+    dir := t.TempDir()
+    ssh, args := filepath.Join(dir, "ssh"), filepath.Join(dir, "args")
+    if e := os.WriteFile(ssh, []byte("#!/bin/sh\nprintf '%s\\n' \"$@\" > '"+args+"'\n"), 0755); e != nil {
+        t.Fatal(e)
+    }
+    client := *sshClient
+    defer func() { *sshClient = client }()
+    *sshClient = ssh
+    if _, e := dialSFTP("user@host"); e == nil {
+        t.Fatal("dialSFTP() of a client without a server succeeded")
+    }
+    lines := strings.Split(strings.TrimSpace(readFile(t, args)), "\n")
+    if n := len(lines); n < 3 || lines[n-3] != "--" || lines[n-2] != "user@host" || lines[n-1] != "sftp" {
+        t.Errorf("ssh arguments = %q, want the host after --", lines)
+    }
+}
@@ -0,0 +1,238 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const snapshotChunkSize = 1 << 20
+
+type snapshotEntry struct {
+    Path    string      `json:"path"`
+    Mode    os.FileMode `json:"mode"`
+    ModTime time.Time   `json:"mod_time"`
+    Size    int64       `json:"size"`
+    Chunks  []string    `json:"chunks,omitempty"`
+}
+
+type snapshotManifest struct {
+    ID      string          `json:"id"`
+    Created time.Time       `json:"created"`
+    Source  string          `json:"source"`
+    Entries []snapshotEntry `json:"entries"`
+}
+
+func snapshotPath(repository, id string) string {
+    return filepath.Join(repository, "snapshots", id+".json")
+}
+
+func chunkPath(repository, sum string) string {
+    return filepath.Join(repository, "chunks", sum[:2], sum)
+}
+
+// storeChunks splits the file at path in chunks kept under their SHA-256 in
+// repository, writing only the chunks that are not there yet, and returns the
+// chunks and the number of bytes written.
+func storeChunks(repository, path string) ([]string, int64, error) {
+    f, e := cliIO.openSource(path)
+    if e != nil {
+        return nil, 0, e
+    }
+    defer f.Close()
+    sums, stored := []string{}, int64(0)
+    buf := make([]byte, snapshotChunkSize)
+    for {
+        n, e := io.ReadFull(f, buf)
+        if n > 0 {
+            sum := sha256.Sum256(buf[:n])
+            chunk := hex.EncodeToString(sum[:])
+            sums = append(sums, chunk)
+            if dest := chunkPath(repository, chunk); !fileExists(dest) {
+                os.MkdirAll(filepath.Dir(dest), 0755)
+                out, e := cliIO.createAtomic(dest)
+                if e != nil {
+                    return nil, stored, e
+                }
+                if _, e := out.Write(buf[:n]); e != nil {
+                    out.abort()
+                    return nil, stored, e
+                }
+                if e := out.commit(); e != nil {
+                    return nil, stored, e
+                }
+                stored += int64(n)
+            }
+        }
+        if e == io.EOF || e == io.ErrUnexpectedEOF {
+            return sums, stored, nil
+        }
+        if e != nil {
+            return nil, stored, e
+        }
+    }
+}
+
+// runSnapshot stores the files of dir as a new snapshot of repository and
+// returns the number of entries that could not be stored.
+func runSnapshot(repository, dir string) int {
+    root, _ := filepath.Abs(dir)
+    repositoryRoot, _ := filepath.Abs(repository)
+    m := snapshotManifest{Created: time.Now().UTC(), Source: root, Entries: []snapshotEntry{}}
+    failed, files, stored := 0, 0, int64(0)
+    done := make(chan struct{})
+    defer close(done)
+    for entry := range cliWalker.walk(root, true, done) {
+        if entry.err != nil {
+            printError(entry.err)
+            failed++
+            continue
+        }
+        if entry.path == root || entry.path == repositoryRoot ||
+            strings.HasPrefix(entry.path, repositoryRoot+string(filepath.Separator)) {
+            continue
+        }
+        rel, _ := filepath.Rel(root, entry.path)
+        se := snapshotEntry{Path: filepath.ToSlash(rel), Mode: entry.info.Mode(), ModTime: entry.info.ModTime()}
+        if entry.info.Mode().IsRegular() {
+            chunks, n, e := storeChunks(repository, entry.path)
+            stored += n
+            if e != nil {
+                printError(e)
+                failed++
+                continue
+            }
+            se.Size, se.Chunks = entry.info.Size(), chunks
+            files++
+            logger.Info("file_copied", "path", entry.path, "size", se.Size)
+        } else if !entry.info.IsDir() {
+            logger.Info("file_skipped", "path", entry.path, "reason", "not a regular file")
+            continue
+        }
+        m.Entries = append(m.Entries, se)
+    }
+    id := m.Created.Format("20060102T150405Z")
+    m.ID = id
+    for i := 2; fileExists(snapshotPath(repository, m.ID)); i++ {
+        m.ID = fmt.Sprintf("%s-%d", id, i)
+    }
+    data, e := json.MarshalIndent(m, "", "    ")
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    os.MkdirAll(filepath.Join(repository, "snapshots"), 0755)
+    f, e := cliIO.createAtomic(snapshotPath(repository, m.ID))
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    if _, e := f.Write(data); e != nil {
+        f.abort()
+        printErrorAndExit(e, exitIOError)
+    }
+    if e := f.commit(); e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    fmt.Println("Snapshot:", m.ID)
+    fmt.Printf("%d files, %s of new data\n", files, formatSize(stored))
+    return failed
+}
+
+// chunkReader reads the content of a snapshot file from its chunks, checking
+// each one against its SHA-256.
+type chunkReader struct {
+    repository string
+    chunks     []string
+    data       []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+    for len(r.data) == 0 {
+        if len(r.chunks) == 0 {
+            return 0, io.EOF
+        }
+        data, e := ioutil.ReadFile(chunkPath(r.repository, r.chunks[0]))
+        if e != nil {
+            return 0, e
+        }
+        if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != r.chunks[0] {
+            return 0, fmt.Errorf("chunk %s is corrupted", r.chunks[0])
+        }
+        r.data, r.chunks = data, r.chunks[1:]
+    }
+    n := copy(p, r.data)
+    r.data = r.data[n:]
+    return n, nil
+}
+
+// runRestore writes the files of a snapshot of repository to dir and returns the
+// number of entries that could not be restored.
+func runRestore(repository, id, dir string) int {
+    data, e := ioutil.ReadFile(snapshotPath(repository, id))
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    var m snapshotManifest
+    if e := json.Unmarshal(data, &m); e != nil {
+        printErrorAndExit(fmt.Errorf("%s: %v", snapshotPath(repository, id), e), exitIOError)
+    }
+    os.MkdirAll(dir, 0755)
+    failed, files := 0, 0
+    dirs := []snapshotEntry{}
+    for _, entry := range m.Entries {
+        dest, e := extractPath(dir, entry.Path)
+        if e != nil {
+            printError(e)
+            failed++
+            continue
+        }
+        if entry.Mode.IsDir() {
+            os.MkdirAll(dest, 0755)
+            dirs = append(dirs, entry)
+            continue
+        }
+        if e := extractEntry(dest, &chunkReader{repository: repository, chunks: entry.Chunks}, entry.Mode, entry.ModTime); e != nil {
+            os.Remove(dest)
+            printError(fmt.Errorf("%s: %v", dest, e))
+            failed++
+            continue
+        }
+        files++
+        logger.Info("file_copied", "path", dest, "size", entry.Size)
+    }
+    // Directories get their mode and times last, once their files are written.
+    for i := len(dirs) - 1; i >= 0; i-- {
+        dest, _ := extractPath(dir, dirs[i].Path)
+        os.Chmod(dest, dirs[i].Mode.Perm())
+        os.Chtimes(dest, dirs[i].ModTime, dirs[i].ModTime)
+    }
+    fmt.Printf("%d files restored from snapshot %s\n", files, m.ID)
+    return failed
+}
@@ -0,0 +1,58 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build linux
+
+package gopy
+
+import (
+    "errors"
+    "io"
+    "os"
+    "syscall"
+)
+
+const (
+    seekData = 3
+    seekHole = 4
+)
+
+// dataRegions returns the offsets and lengths of the data of f, skipping
+// the holes reported by SEEK_DATA and SEEK_HOLE.
+func dataRegions(f *os.File, size int64) ([][2]int64, error) {
+    regions := [][2]int64{}
+    for offset := int64(0); offset < size; {
+        start, e := f.Seek(offset, seekData)
+        if errors.Is(e, syscall.ENXIO) {
+            break
+        } else if e != nil {
+            return [][2]int64{{0, size}}, nil
+        }
+        end, e := f.Seek(start, seekHole)
+        if e != nil {
+            return nil, e
+        }
+        regions = append(regions, [2]int64{start, end - start})
+        offset = end
+    }
+    _, e := f.Seek(0, io.SeekStart)
+    return regions, e
+}
@@ -0,0 +1,107 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "fmt"
+    "io/ioutil"
+    "path"
+
+    "go.starlark.net/starlark"
+    "go.starlark.net/starlarkstruct"
+    "go.starlark.net/syntax"
+)
+
+// starOptions are the Starlark dialect of filter scripts: Starlark as
+// go.starlark.net runs it, with if and for statements and reassignment at
+// the top level of the file.
+var starOptions = &syntax.FileOptions{TopLevelControl: true, GlobalReassign: true}
+
+// starProgram is a filter script written in Starlark, run inside gopy. Its
+// decide function is called with the metadata of every candidate file and
+// returns True or None to include it, False to exclude it, or a decision as
+// the filter program protocol spells it.
+type starProgram struct {
+    name   string
+    decide *starlark.Function
+}
+
+func loadStarProgram(path string) (*starProgram, error) {
+    src, e := ioutil.ReadFile(path)
+    if e != nil {
+        return nil, e
+    }
+    globals, e := starlark.ExecFileOptions(starOptions, &starlark.Thread{Name: path}, path, src, nil)
+    if e != nil {
+        return nil, starError(e)
+    }
+    // Frozen globals may be read by the calls of decide from any goroutine.
+    globals.Freeze()
+    decide, ok := globals["decide"].(*starlark.Function)
+    if !ok || decide.NumParams() != 1 {
+        return nil, fmt.Errorf("%s: no decide(file) function", path)
+    }
+    return &starProgram{path, decide}, nil
+}
+
+func (p *starProgram) decision(candidate scriptCandidate) (string, error) {
+    file := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+        "path":     starlark.String(candidate.Path),
+        "rel":      starlark.String(candidate.Rel),
+        "name":     starlark.String(path.Base(candidate.Rel)),
+        "ext":      starlark.String(path.Ext(candidate.Rel)),
+        "dir":      starlark.String(path.Dir(candidate.Rel)),
+        "size":     starlark.MakeInt64(candidate.Size),
+        "mod_time": starlark.MakeInt64(candidate.ModTime.Unix()),
+    })
+    v, e := starlark.Call(&starlark.Thread{Name: p.name}, p.decide, starlark.Tuple{file}, nil)
+    if e != nil {
+        return "", fmt.Errorf("filter script: %v", starError(e))
+    }
+    switch v := v.(type) {
+    case starlark.NoneType:
+        return "include", nil
+    case starlark.Bool:
+        if v {
+            return "include", nil
+        }
+        return "exclude", nil
+    case starlark.String:
+        return string(v), nil
+    }
+    return "", fmt.Errorf("filter script: decide returned a %s, want a bool or a string", v.Type())
+}
+
+// starError adds the position in the script of the statement that raised an
+// evaluation error to it.
+func starError(e error) error {
+    ee, ok := e.(*starlark.EvalError)
+    if !ok {
+        return e
+    }
+    for i := len(ee.CallStack) - 1; i >= 0; i-- {
+        if pos := ee.CallStack[i].Pos; pos.IsValid() && pos.Filename() != "<builtin>" {
+            return fmt.Errorf("%s: %s", pos, ee.Msg)
+        }
+    }
+    return e
+}
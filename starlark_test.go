@@ -0,0 +1,139 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestStarFilter(t *testing.T) {
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "b.tmp": "b", "big.txt": "0123456789", "c.JPG": "c",
+        "keep/d.tmp": "d"})
+    manifest := writeManifestFile(t, src)
+    script := filepath.Join(t.TempDir(), "filter.star")
+    writeFiles(t, filepath.Dir(script), map[string]string{"filter.star": `
+JUNK = [".tmp", ".bak"]  # dropped unless kept
+
+def is_junk(file):
+    return file.ext in JUNK and not file.dir.endswith("/keep")
+
+def decide(file):
+    """Decides about one file."""
+    if is_junk(file) or file.size > 5:
+        return False
+    if file.ext.lower() == ".jpg":
+        return "rename " + file.rel[:-len(file.ext)] + ".jpg"
+    total = 0
+    for i in range(3):
+        total += i
+    return None if total == 3 else fail("bad total", total)
+`})
+    dest := t.TempDir()
+    copyForTest(t, dest, manifest, copyOptions{filter: script})
+    got := []string{}
+    filepath.Walk(filepath.Join(dest, "src"), func(path string, info os.FileInfo, err error) error {
+        if err == nil && !info.IsDir() {
+            rel, _ := filepath.Rel(dest, path)
+            got = append(got, filepath.ToSlash(rel))
+        }
+        return nil
+    })
+    sort.Strings(got)
+    want := []string{"src/a.txt", "src/c.jpg", "src/keep/d.tmp"}
+    if strings.Join(got, " ") != strings.Join(want, " ") {
+        t.Errorf("copied %v, want %v", got, want)
+    }
+}
+
+// starProgramForTest loads src as a filter script.
+func starProgramForTest(t *testing.T, src string) (*starProgram, error) {
+    t.Helper()
+    script := filepath.Join(t.TempDir(), "filter.star")
+    if e := os.WriteFile(script, []byte(src), 0644); e != nil {
+        t.Fatal(e)
+    }
+    return loadStarProgram(script)
+}
+
+func TestStarDecision(t *testing.T) {
+    candidate := scriptCandidate{"/src/sub/a.txt", "sub/a.txt", 3, time.Unix(1700000000, 0)}
+    for _, c := range []struct {
+        name, src, want string
+    }{
+        {"none", "def decide(file):\n    pass\n", "include"},
+        {"true", "def decide(file):\n    return True\n", "include"},
+        {"false", "def decide(file):\n    return False\n", "exclude"},
+        {"string", "def decide(file):\n    return \"rename \" + file.dir + \"/b\" + file.ext\n", "rename sub/b.txt"},
+        {"fields", `
+def decide(file):
+    return " ".join([file.path, file.rel, file.name, str(file.size), str(file.mod_time)])
+`, "/src/sub/a.txt sub/a.txt a.txt 3 1700000000"},
+        {"top level control", `
+LIMIT = 0
+for n in [1, 2]:
+    LIMIT += n
+if LIMIT == 3:
+    LIMIT = 2
+def decide(file):
+    return file.size > LIMIT
+`, "include"},
+    } {
+        p, e := starProgramForTest(t, strings.TrimPrefix(c.src, "\n"))
+        if e != nil {
+            t.Errorf("%s: %v", c.name, e)
+            continue
+        }
+        if got, e := p.decision(candidate); e != nil || got != c.want {
+            t.Errorf("%s: decision() = %q, %v, want %q", c.name, got, e, c.want)
+        }
+    }
+}
+
+func TestStarErrors(t *testing.T) {
+    candidate := scriptCandidate{"/src/a.txt", "a.txt", 1, time.Unix(0, 0)}
+    for _, c := range []struct {
+        name, src, want string
+    }{
+        {"syntax", "def decide(file)\n    return True\n", "filter.star:2:1: got newline"},
+        {"no decide", "x = 1\n", "no decide(file) function"},
+        {"decide arguments", "def decide(a, b):\n    return True\n", "no decide(file) function"},
+        {"top level", "x = 1 + \"a\"\n", "filter.star:1:"},
+        {"fail", "def decide(file):\n    fail(\"bad size\", file.size)\n", "filter.star:2:9: fail: bad size 1"},
+        {"recursion", "def f(n):\n    return f(n + 1)\ndef decide(file):\n    return f(0)\n", "recursive"},
+        {"frozen", "SEEN = []\ndef decide(file):\n    SEEN.append(file.rel)\n", "frozen"},
+        {"decision type", "def decide(file):\n    return 1\n", "decide returned a int"},
+    } {
+        p, e := starProgramForTest(t, c.src)
+        if e == nil {
+            _, e = p.decision(candidate)
+        }
+        if e == nil || !strings.Contains(e.Error(), c.want) {
+            t.Errorf("%s: got error %v, want %s", c.name, e, c.want)
+        }
+    }
+}
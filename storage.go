@@ -0,0 +1,254 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/hex"
+    "hash"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "time"
+)
+
+// isCloud tells whether path is below a bucket or a container of a cloud
+// storage rather than a local or remote directory.
+func isCloud(path string) bool {
+    return isS3(path) || isAzure(path) || isGCS(path)
+}
+
+// checkCloud reports a cloud path that is not valid or has no credentials.
+func checkCloud(path string) error {
+    if isS3(path) {
+        if _, _, e := parseS3URL(path); e != nil {
+            return e
+        }
+        _, e := newS3Client()
+        return e
+    }
+    if isGCS(path) {
+        _, e := newGCSStorage(path)
+        return e
+    }
+    _, e := newAzureStorage(path)
+    return e
+}
+
+// uploadWriter buffers a file created in a storage of objects in a
+// temporary file, which is uploaded when it is closed.
+type uploadWriter struct {
+    *os.File
+    storage fileUploader
+    name    string
+}
+
+func newUploadWriter(storage fileUploader, name string) (io.WriteCloser, error) {
+    f, e := ioutil.TempFile("", "gopy-upload-")
+    if e != nil {
+        return nil, e
+    }
+    return &uploadWriter{f, storage, name}, nil
+}
+
+func (w *uploadWriter) Close() error {
+    defer os.Remove(w.Name())
+    defer w.File.Close()
+    size, e := w.Seek(0, io.SeekCurrent)
+    if e != nil {
+        return e
+    }
+    if _, e := w.Seek(0, io.SeekStart); e != nil {
+        return e
+    }
+    return w.storage.uploadFile(w.File, w.name, size)
+}
+
+// walkStorageInfos calls fn for the files of infos and for the "directories"
+// of their names, in the order of their names.
+func walkStorageInfos(infos map[string]storageInfo, fn func(name string, info storageInfo) error) error {
+    for name := range infos {
+        for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+            infos[dir] = storageInfo{IsDir: true}
+        }
+    }
+    names := []string{}
+    for name := range infos {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if e := fn(name, infos[name]); e != nil {
+            return e
+        }
+    }
+    return nil
+}
+
+type storageInfo struct {
+    Size    int64
+    IsDir   bool
+    ModTime time.Time
+}
+
+// storage is a tree of files, on the local file system or in a bucket, whose
+// names are slash-separated paths relative to its root.
+type storage interface {
+    Open(name string) (io.ReadCloser, error)
+    Create(name string) (io.WriteCloser, error)
+    Stat(name string) (storageInfo, error)
+    Walk(fn func(name string, info storageInfo) error) error
+}
+
+// fileUploader is a storage that uploads a local file of size bytes as name
+// straight from the file.
+type fileUploader interface {
+    uploadFile(f *os.File, name string, size int64) error
+}
+
+func openStorage(location string) (storage, error) {
+    if isS3(location) {
+        return newS3Storage(location)
+    }
+    if isAzure(location) {
+        return newAzureStorage(location)
+    }
+    if isGCS(location) {
+        return newGCSStorage(location)
+    }
+    return &localStorage{location}, nil
+}
+
+// storageDestination copies files into a storage, where directories only
+// exist as the prefixes of the names of files.
+type storageDestination struct {
+    st  storage
+    fio *fileIO
+}
+
+func (d *storageDestination) makeDir(rel string, info os.FileInfo) error {
+    return nil
+}
+
+func (d *storageDestination) writeFile(src, rel string, info os.FileInfo) error {
+    f, e := d.fio.openSource(src)
+    if e != nil {
+        return e
+    }
+    defer f.Close()
+    name := filepath.ToSlash(rel)
+    if u, ok := d.st.(fileUploader); ok {
+        return u.uploadFile(f, name, info.Size())
+    }
+    w, e := d.st.Create(name)
+    if e != nil {
+        return e
+    }
+    if _, e := d.fio.copyBuffered(w, f); e != nil {
+        w.Close()
+        return e
+    }
+    return w.Close()
+}
+
+func (d *storageDestination) close() error {
+    return nil
+}
+
+// upToDate tells whether the copy of the file of info at rel has its size
+// and is not older than it: storages keep the time of the copy, not that of
+// the file.
+func (d *storageDestination) upToDate(rel string, info os.FileInfo) bool {
+    copied, e := d.st.Stat(filepath.ToSlash(rel))
+    return e == nil && !copied.IsDir && copied.Size == info.Size() && !copied.ModTime.Before(info.ModTime())
+}
+
+type localStorage struct {
+    root string
+}
+
+func (l *localStorage) path(name string) string {
+    return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *localStorage) Open(name string) (io.ReadCloser, error) {
+    return cliIO.openSource(l.path(name))
+}
+
+// atomicWriter moves the file into place when it is closed.
+type atomicWriter struct {
+    *atomicFile
+}
+
+func (w atomicWriter) Close() error {
+    return w.commit()
+}
+
+func (l *localStorage) Create(name string) (io.WriteCloser, error) {
+    if e := os.MkdirAll(filepath.Dir(l.path(name)), 0755); e != nil {
+        return nil, e
+    }
+    f, e := cliIO.createAtomic(l.path(name))
+    if e != nil {
+        return nil, e
+    }
+    return atomicWriter{f}, nil
+}
+
+func (l *localStorage) Stat(name string) (storageInfo, error) {
+    info, e := os.Stat(l.path(name))
+    if e != nil {
+        return storageInfo{}, e
+    }
+    return storageInfo{info.Size(), info.IsDir(), info.ModTime()}, nil
+}
+
+func (l *localStorage) Walk(fn func(name string, info storageInfo) error) error {
+    return filepath.Walk(l.root,
+        func(path string, info os.FileInfo, err error) error {
+            if err != nil {
+                return err
+            }
+            rel, _ := filepath.Rel(l.root, path)
+            if rel == "." {
+                return nil
+            }
+            return fn(filepath.ToSlash(rel), storageInfo{info.Size(), info.IsDir(), info.ModTime()})
+        })
+}
+
+func hashStorageFile(st storage, name string, newHash func() hash.Hash) (string, error) {
+    cliIO.budget.acquire(1)
+    defer cliIO.budget.release(1)
+    f, e := st.Open(name)
+    if e != nil {
+        return "", e
+    }
+    defer f.Close()
+    h := newHash()
+    if _, e := cliIO.copyBuffered(h, f); e != nil {
+        return "", e
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
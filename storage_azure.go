@@ -0,0 +1,303 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+func isAzure(path string) bool {
+    return strings.HasPrefix(path, "az://")
+}
+
+// azureStorage is the tree of blobs below a prefix of an Azure Blob Storage
+// container, az://account/container/prefix, reached with the shared key of
+// AZURE_STORAGE_KEY or the SAS token of AZURE_STORAGE_SAS_TOKEN.
+// AZURE_STORAGE_ENDPOINT replaces https://account.blob.core.windows.net, e.g.
+// with http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+type azureStorage struct {
+    endpoint  string
+    account   string
+    key       []byte
+    sas       string
+    container string
+    prefix    string
+    http      *http.Client
+}
+
+// Files larger than azureBlockSize are uploaded in blocks of that size.
+const azureBlockSize = 64 << 20
+
+func newAzureStorage(location string) (*azureStorage, error) {
+    parts := strings.SplitN(strings.TrimPrefix(location, "az://"), "/", 3)
+    if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+        return nil, fmt.Errorf("no account or container in %s", location)
+    }
+    a := &azureStorage{endpoint: strings.TrimRight(os.Getenv("AZURE_STORAGE_ENDPOINT"), "/"), account: parts[0],
+        sas: strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"), container: parts[1], http: &http.Client{}}
+    if len(parts) == 3 {
+        a.prefix = strings.Trim(parts[2], "/")
+    }
+    if a.endpoint == "" {
+        a.endpoint = "https://" + a.account + ".blob.core.windows.net"
+    }
+    if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+        k, e := base64.StdEncoding.DecodeString(key)
+        if e != nil {
+            return nil, fmt.Errorf("AZURE_STORAGE_KEY: %v", e)
+        }
+        a.key = k
+    } else if a.sas == "" {
+        return nil, errors.New("AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN must be set for az:// paths")
+    }
+    return a, nil
+}
+
+func (a *azureStorage) blob(name string) string {
+    return strings.TrimPrefix(a.prefix+"/"+name, "/")
+}
+
+// send sends a request for blob, or for the container when blob is "",
+// signed with the shared key or carrying the SAS token, and returns the
+// response, or an error for a response other than 2xx.
+func (a *azureStorage) send(method, blob string, query, header map[string]string, body []byte) (*http.Response, error) {
+    u, e := url.Parse(a.endpoint)
+    if e != nil {
+        return nil, e
+    }
+    path := strings.TrimRight(u.Path, "/") + "/" + a.container
+    if blob != "" {
+        path += "/" + s3Escape(blob, false)
+    }
+    rawQuery := s3Query(query)
+    if a.key == nil {
+        rawQuery = strings.TrimPrefix(rawQuery+"&"+a.sas, "&")
+    }
+    req, e := http.NewRequest(method, u.Scheme+"://"+u.Host+path+"?"+rawQuery, bytes.NewReader(body))
+    if e != nil {
+        return nil, e
+    }
+    req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+    req.Header.Set("x-ms-version", "2021-08-06")
+    for name, value := range header {
+        req.Header.Set(name, value)
+    }
+    if a.key != nil {
+        req.Header.Set("Authorization", "SharedKey "+a.account+":"+a.signature(req, path, query, len(body)))
+    }
+    resp, e := a.http.Do(req)
+    if e != nil {
+        return nil, e
+    }
+    if resp.StatusCode >= 300 {
+        defer resp.Body.Close()
+        data, _ := ioutil.ReadAll(resp.Body)
+        var body struct {
+            Code    string `xml:"Code"`
+            Message string `xml:"Message"`
+        }
+        xml.Unmarshal(data, &body)
+        return nil, fmt.Errorf("azure %s az://%s/%s/%s: %s %s %s", method, a.account, a.container, blob, resp.Status,
+            body.Code, strings.SplitN(body.Message, "\n", 2)[0])
+    }
+    return resp, nil
+}
+
+// signature signs a request with the shared key of the account: the method,
+// the standard headers, the x-ms- headers and the resource with its query.
+func (a *azureStorage) signature(req *http.Request, path string, query map[string]string, length int) string {
+    contentLength := ""
+    if length > 0 {
+        contentLength = strconv.Itoa(length)
+    }
+    fields := []string{req.Method, "", "", contentLength, "", req.Header.Get("Content-Type"), "", "", "", "", "",
+        req.Header.Get("Range")}
+    names := []string{}
+    for name := range req.Header {
+        if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+            names = append(names, name)
+        }
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fields = append(fields, name+":"+strings.TrimSpace(req.Header.Get(name)))
+    }
+    resource := "/" + a.account + path
+    names = names[:0]
+    for name := range query {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        resource += "\n" + strings.ToLower(name) + ":" + query[name]
+    }
+    fields = append(fields, resource)
+    return base64.StdEncoding.EncodeToString(hmacSHA256(a.key, strings.Join(fields, "\n")))
+}
+
+// do sends a request like send and returns the body of the response.
+func (a *azureStorage) do(method, blob string, query, header map[string]string, body []byte) ([]byte, error) {
+    resp, e := a.send(method, blob, query, header, body)
+    if e != nil {
+        return nil, e
+    }
+    defer resp.Body.Close()
+    return ioutil.ReadAll(resp.Body)
+}
+
+type azureBlob struct {
+    Name          string `xml:"Name"`
+    ContentLength int64  `xml:"Properties>Content-Length"`
+    LastModified  string `xml:"Properties>Last-Modified"`
+}
+
+// list returns every blob of the container whose name starts with prefix.
+func (a *azureStorage) list(prefix string) ([]azureBlob, error) {
+    blobs := []azureBlob{}
+    query := map[string]string{"restype": "container", "comp": "list"}
+    if prefix != "" {
+        query["prefix"] = prefix
+    }
+    for {
+        data, e := a.do(http.MethodGet, "", query, nil, nil)
+        if e != nil {
+            return nil, e
+        }
+        var result struct {
+            Blobs      []azureBlob `xml:"Blobs>Blob"`
+            NextMarker string      `xml:"NextMarker"`
+        }
+        if e := xml.Unmarshal(data, &result); e != nil {
+            return nil, e
+        }
+        blobs = append(blobs, result.Blobs...)
+        if result.NextMarker == "" {
+            return blobs, nil
+        }
+        query["marker"] = result.NextMarker
+    }
+}
+
+func (a *azureStorage) Open(name string) (io.ReadCloser, error) {
+    resp, e := a.send(http.MethodGet, a.blob(name), nil, nil, nil)
+    if e != nil {
+        return nil, e
+    }
+    return resp.Body, nil
+}
+
+func (a *azureStorage) Create(name string) (io.WriteCloser, error) {
+    return newUploadWriter(a, name)
+}
+
+// uploadFile uploads f as a single blob or, when it is larger than
+// azureBlockSize, as a list of blocks.
+func (a *azureStorage) uploadFile(f *os.File, name string, size int64) error {
+    blob := a.blob(name)
+    if size <= azureBlockSize {
+        data, e := ioutil.ReadAll(f)
+        if e != nil {
+            return e
+        }
+        _, e = a.do(http.MethodPut, blob, nil, map[string]string{"x-ms-blob-type": "BlockBlob"}, data)
+        return e
+    }
+    ids := []string{}
+    buf := make([]byte, azureBlockSize)
+    for {
+        n, e := io.ReadFull(f, buf)
+        if n > 0 {
+            id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+            if _, e := a.do(http.MethodPut, blob, map[string]string{"comp": "block", "blockid": id}, nil, buf[:n]); e != nil {
+                return e
+            }
+            ids = append(ids, id)
+        }
+        if e == io.EOF || e == io.ErrUnexpectedEOF {
+            break
+        } else if e != nil {
+            return e
+        }
+    }
+    body, e := xml.Marshal(struct {
+        XMLName xml.Name `xml:"BlockList"`
+        Latest  []string `xml:"Latest"`
+    }{Latest: ids})
+    if e != nil {
+        return e
+    }
+    _, e = a.do(http.MethodPut, blob, map[string]string{"comp": "blocklist"}, nil, body)
+    return e
+}
+
+// Stat reports a blob, or a "directory" when blobs have name as a prefix.
+func (a *azureStorage) Stat(name string) (storageInfo, error) {
+    if name == "" {
+        return storageInfo{IsDir: true}, nil
+    }
+    resp, e := a.send(http.MethodHead, a.blob(name), nil, nil, nil)
+    if e == nil {
+        resp.Body.Close()
+        modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+        return storageInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+    }
+    if blobs, le := a.list(a.blob(name) + "/"); le == nil && len(blobs) > 0 {
+        return storageInfo{IsDir: true}, nil
+    }
+    return storageInfo{}, e
+}
+
+// Walk calls fn for every blob and for the "directories" of their names, in
+// the order of their names.
+func (a *azureStorage) Walk(fn func(name string, info storageInfo) error) error {
+    prefix := a.prefix
+    if prefix != "" {
+        prefix += "/"
+    }
+    blobs, e := a.list(prefix)
+    if e != nil {
+        return e
+    }
+    infos := map[string]storageInfo{}
+    for _, b := range blobs {
+        name := strings.TrimPrefix(b.Name, prefix)
+        if name == "" || strings.HasSuffix(name, "/") {
+            continue
+        }
+        modTime, _ := http.ParseTime(b.LastModified)
+        infos[name] = storageInfo{Size: b.ContentLength, ModTime: modTime}
+    }
+    return walkStorageInfos(infos, fn)
+}
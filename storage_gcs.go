@@ -0,0 +1,472 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+func isGCS(path string) bool {
+    return strings.HasPrefix(path, "gs://")
+}
+
+// gcsStorage is the tree of objects below a prefix of a Google Cloud Storage
+// bucket, gs://bucket/prefix, reached with an OAuth 2 access token: that of
+// GOOGLE_OAUTH_ACCESS_TOKEN, or one issued for the service account or user of
+// GOOGLE_APPLICATION_CREDENTIALS or of gcloud auth application-default login,
+// or by the metadata server of the instance gopy runs on.
+// STORAGE_EMULATOR_HOST replaces https://storage.googleapis.com, without
+// credentials, e.g. with localhost:4443 for fake-gcs-server.
+type gcsStorage struct {
+    endpoint  string
+    bucket    string
+    prefix    string
+    chunkSize int64
+    http      *http.Client
+
+    mu      sync.Mutex
+    token   gcsToken
+    refresh func() (gcsToken, error)
+}
+
+type gcsToken struct {
+    value   string
+    expires time.Time
+}
+
+// Files larger than gcsChunkSize, a multiple of 256KB, are uploaded in chunks
+// of that size in a resumable upload.
+var gcsChunkSize int64 = 64 << 20
+
+func newGCSStorage(location string) (*gcsStorage, error) {
+    bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+    if bucket == "" {
+        return nil, fmt.Errorf("no bucket in %s", location)
+    }
+    g := &gcsStorage{endpoint: "https://storage.googleapis.com", bucket: bucket, prefix: strings.Trim(prefix, "/"),
+        chunkSize: gcsChunkSize, http: &http.Client{}}
+    if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+        if !strings.Contains(host, "://") {
+            host = "http://" + host
+        }
+        g.endpoint = strings.TrimRight(host, "/")
+        return g, nil
+    }
+    token, refresh, e := findGCSCredentials()
+    if e != nil {
+        return nil, e
+    }
+    g.token, g.refresh = token, refresh
+    return g, nil
+}
+
+// gcsCredentialsFile is a service account key or the refresh token of a user
+// saved by gcloud.
+type gcsCredentialsFile struct {
+    Type         string `json:"type"`
+    ClientEmail  string `json:"client_email"`
+    PrivateKey   string `json:"private_key"`
+    TokenURI     string `json:"token_uri"`
+    ClientID     string `json:"client_id"`
+    ClientSecret string `json:"client_secret"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+// findGCSCredentials looks for an access token in GOOGLE_OAUTH_ACCESS_TOKEN,
+// the credentials file of GOOGLE_APPLICATION_CREDENTIALS or gcloud, and then
+// the service account of the Google Cloud instance gopy runs on.
+func findGCSCredentials() (gcsToken, func() (gcsToken, error), error) {
+    if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+        return gcsToken{value: token}, nil, nil
+    }
+    file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+    if file == "" {
+        file = gcloudCredentialsFile()
+    }
+    refresh := metadataToken
+    if file != "" {
+        data, e := ioutil.ReadFile(file)
+        if e != nil {
+            return gcsToken{}, nil, e
+        }
+        var creds gcsCredentialsFile
+        if e := json.Unmarshal(data, &creds); e != nil {
+            return gcsToken{}, nil, fmt.Errorf("%s: %v", file, e)
+        }
+        if creds.TokenURI == "" {
+            creds.TokenURI = "https://oauth2.googleapis.com/token"
+        }
+        switch creds.Type {
+        case "service_account":
+            refresh = creds.serviceAccountToken
+        case "authorized_user":
+            refresh = creds.userToken
+        default:
+            return gcsToken{}, nil, fmt.Errorf("%s: unsupported credentials type %q", file, creds.Type)
+        }
+    } else if strings.EqualFold(os.Getenv("NO_GCE_CHECK"), "true") {
+        refresh = nil
+    }
+    if refresh != nil {
+        token, e := refresh()
+        if e == nil {
+            return token, refresh, nil
+        }
+        if file != "" {
+            return gcsToken{}, nil, fmt.Errorf("%s: %v", file, e)
+        }
+    }
+    return gcsToken{}, nil, errors.New("no Google Cloud credentials for gs:// paths: set GOOGLE_APPLICATION_CREDENTIALS " +
+        "or GOOGLE_OAUTH_ACCESS_TOKEN, run gcloud auth application-default login, or run with a service account")
+}
+
+// gcloudCredentialsFile returns the application default credentials saved by
+// gcloud, if there are some.
+func gcloudCredentialsFile() string {
+    dir := os.Getenv("CLOUDSDK_CONFIG")
+    if dir == "" && runtime.GOOS == "windows" {
+        dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+    } else if dir == "" {
+        home, e := os.UserHomeDir()
+        if e != nil {
+            return ""
+        }
+        dir = filepath.Join(home, ".config", "gcloud")
+    }
+    file := filepath.Join(dir, "application_default_credentials.json")
+    if _, e := os.Stat(file); e != nil {
+        return ""
+    }
+    return file
+}
+
+// fetchToken decodes the access token of an OAuth 2 token response.
+func fetchToken(client *http.Client, req *http.Request) (gcsToken, error) {
+    resp, e := client.Do(req)
+    if e != nil {
+        return gcsToken{}, e
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return gcsToken{}, fmt.Errorf("%s: %s", req.URL, resp.Status)
+    }
+    var body struct {
+        AccessToken string `json:"access_token"`
+        ExpiresIn   int    `json:"expires_in"`
+    }
+    if e := json.NewDecoder(resp.Body).Decode(&body); e != nil {
+        return gcsToken{}, fmt.Errorf("%s: %v", req.URL, e)
+    }
+    if body.AccessToken == "" {
+        return gcsToken{}, fmt.Errorf("%s: no access token", req.URL)
+    }
+    return gcsToken{body.AccessToken, time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)}, nil
+}
+
+func postTokenForm(tokenURI string, form url.Values) (gcsToken, error) {
+    req, e := http.NewRequest(http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+    if e != nil {
+        return gcsToken{}, e
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    return fetchToken(http.DefaultClient, req)
+}
+
+// serviceAccountToken exchanges a JWT signed with the key of the service
+// account for an access token.
+func (c gcsCredentialsFile) serviceAccountToken() (gcsToken, error) {
+    block, _ := pem.Decode([]byte(c.PrivateKey))
+    if block == nil {
+        return gcsToken{}, errors.New("no private key")
+    }
+    parsed, e := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if e != nil {
+        if parsed, e = x509.ParsePKCS1PrivateKey(block.Bytes); e != nil {
+            return gcsToken{}, e
+        }
+    }
+    key, ok := parsed.(*rsa.PrivateKey)
+    if !ok {
+        return gcsToken{}, errors.New("the private key is not an RSA key")
+    }
+    now := time.Now()
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+    claims, _ := json.Marshal(map[string]interface{}{"iss": c.ClientEmail, "aud": c.TokenURI,
+        "scope": "https://www.googleapis.com/auth/devstorage.read_write", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+    unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+    sum := sha256.Sum256([]byte(unsigned))
+    signature, e := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+    if e != nil {
+        return gcsToken{}, e
+    }
+    return postTokenForm(c.TokenURI, url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+        "assertion": {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)}})
+}
+
+// userToken exchanges the refresh token of a user for an access token.
+func (c gcsCredentialsFile) userToken() (gcsToken, error) {
+    return postTokenForm(c.TokenURI, url.Values{"grant_type": {"refresh_token"}, "client_id": {c.ClientID},
+        "client_secret": {c.ClientSecret}, "refresh_token": {c.RefreshToken}})
+}
+
+// metadataToken fetches the access token of the service account of the
+// instance from the metadata server, or that of GCE_METADATA_HOST.
+func metadataToken() (gcsToken, error) {
+    host := os.Getenv("GCE_METADATA_HOST")
+    if host == "" {
+        host = "metadata.google.internal"
+    }
+    req, e := http.NewRequest(http.MethodGet,
+        "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+    if e != nil {
+        return gcsToken{}, e
+    }
+    req.Header.Set("Metadata-Flavor", "Google")
+    return fetchToken(metadataClient, req)
+}
+
+// accessToken returns the token to send, fetching it again when it expires
+// within five minutes.
+func (g *gcsStorage) accessToken() (string, error) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.refresh != nil && time.Until(g.token.expires) < 5*time.Minute {
+        token, e := g.refresh()
+        if e != nil {
+            return "", fmt.Errorf("refreshing the Google Cloud access token: %v", e)
+        }
+        g.token = token
+    }
+    return g.token.value, nil
+}
+
+func (g *gcsStorage) object(name string) string {
+    return strings.TrimPrefix(g.prefix+"/"+name, "/")
+}
+
+// objectURL is the URL of the JSON API for object, or for the objects of the
+// bucket when it is "", below base.
+func (g *gcsStorage) objectURL(base, object string, query url.Values) string {
+    u := g.endpoint + base + "/b/" + url.PathEscape(g.bucket) + "/o"
+    if object != "" {
+        u += "/" + url.PathEscape(object)
+    }
+    if len(query) > 0 {
+        u += "?" + query.Encode()
+    }
+    return u
+}
+
+// send sends a request with the access token and returns the response, or
+// an error for a response other than 2xx or the 308 of an incomplete upload.
+func (g *gcsStorage) send(method, rawURL, object string, header map[string]string, body []byte) (*http.Response, error) {
+    req, e := http.NewRequest(method, rawURL, bytes.NewReader(body))
+    if e != nil {
+        return nil, e
+    }
+    for name, value := range header {
+        req.Header.Set(name, value)
+    }
+    token, e := g.accessToken()
+    if e != nil {
+        return nil, e
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    resp, e := g.http.Do(req)
+    if e != nil {
+        return nil, e
+    }
+    if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPermanentRedirect {
+        defer resp.Body.Close()
+        data, _ := ioutil.ReadAll(resp.Body)
+        var body struct {
+            Error struct {
+                Message string `json:"message"`
+            } `json:"error"`
+        }
+        json.Unmarshal(data, &body)
+        return nil, fmt.Errorf("gcs %s gs://%s/%s: %s %s", method, g.bucket, object, resp.Status, body.Error.Message)
+    }
+    return resp, nil
+}
+
+// do sends a request like send and decodes the JSON of the response into v,
+// unless it is nil.
+func (g *gcsStorage) do(method, rawURL, object string, header map[string]string, body []byte, v interface{}) error {
+    resp, e := g.send(method, rawURL, object, header, body)
+    if e != nil {
+        return e
+    }
+    defer resp.Body.Close()
+    if v == nil {
+        _, e = io.Copy(ioutil.Discard, resp.Body)
+        return e
+    }
+    return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type gcsObject struct {
+    Name    string    `json:"name"`
+    Size    string    `json:"size"`
+    Updated time.Time `json:"updated"`
+}
+
+func (o gcsObject) info() storageInfo {
+    size, _ := strconv.ParseInt(o.Size, 10, 64)
+    return storageInfo{Size: size, ModTime: o.Updated}
+}
+
+// list returns every object of the bucket whose name starts with prefix.
+func (g *gcsStorage) list(prefix string) ([]gcsObject, error) {
+    objects := []gcsObject{}
+    query := url.Values{"prefix": {prefix}}
+    for {
+        var result struct {
+            Items         []gcsObject `json:"items"`
+            NextPageToken string      `json:"nextPageToken"`
+        }
+        if e := g.do(http.MethodGet, g.objectURL("/storage/v1", "", query), prefix, nil, nil, &result); e != nil {
+            return nil, e
+        }
+        objects = append(objects, result.Items...)
+        if result.NextPageToken == "" {
+            return objects, nil
+        }
+        query.Set("pageToken", result.NextPageToken)
+    }
+}
+
+func (g *gcsStorage) Open(name string) (io.ReadCloser, error) {
+    object := g.object(name)
+    resp, e := g.send(http.MethodGet, g.objectURL("/storage/v1", object, url.Values{"alt": {"media"}}), object, nil, nil)
+    if e != nil {
+        return nil, e
+    }
+    return resp.Body, nil
+}
+
+func (g *gcsStorage) Create(name string) (io.WriteCloser, error) {
+    return newUploadWriter(g, name)
+}
+
+// uploadFile uploads f in a single request or, when it is larger than
+// chunkSize, in chunks of a resumable upload.
+func (g *gcsStorage) uploadFile(f *os.File, name string, size int64) error {
+    object := g.object(name)
+    if size <= g.chunkSize {
+        data, e := ioutil.ReadAll(f)
+        if e != nil {
+            return e
+        }
+        return g.do(http.MethodPost, g.objectURL("/upload/storage/v1", "", url.Values{"uploadType": {"media"},
+            "name": {object}}), object, nil, data, nil)
+    }
+    resp, e := g.send(http.MethodPost, g.objectURL("/upload/storage/v1", "", url.Values{"uploadType": {"resumable"},
+        "name": {object}}), object, map[string]string{"X-Upload-Content-Length": strconv.FormatInt(size, 10)}, nil)
+    if e != nil {
+        return e
+    }
+    resp.Body.Close()
+    session := resp.Header.Get("Location")
+    if session == "" {
+        return fmt.Errorf("gcs POST gs://%s/%s: no resumable upload session", g.bucket, object)
+    }
+    buf := make([]byte, g.chunkSize)
+    for offset := int64(0); offset < size; {
+        n, e := io.ReadFull(f, buf[:min(g.chunkSize, size-offset)])
+        if e != nil {
+            g.send(http.MethodDelete, session, object, nil, nil)
+            return e
+        }
+        contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(n)-1, size)
+        if e := g.do(http.MethodPut, session, object, map[string]string{"Content-Range": contentRange}, buf[:n],
+            nil); e != nil {
+            g.send(http.MethodDelete, session, object, nil, nil)
+            return e
+        }
+        offset += int64(n)
+    }
+    return nil
+}
+
+// Stat reports an object, or a "directory" when objects have name as a
+// prefix.
+func (g *gcsStorage) Stat(name string) (storageInfo, error) {
+    if name == "" {
+        return storageInfo{IsDir: true}, nil
+    }
+    object := g.object(name)
+    var o gcsObject
+    e := g.do(http.MethodGet, g.objectURL("/storage/v1", object, nil), object, nil, nil, &o)
+    if e == nil {
+        return o.info(), nil
+    }
+    if objects, le := g.list(object + "/"); le == nil && len(objects) > 0 {
+        return storageInfo{IsDir: true}, nil
+    }
+    return storageInfo{}, e
+}
+
+// Walk calls fn for every object and for the "directories" of their names,
+// in the order of their names.
+func (g *gcsStorage) Walk(fn func(name string, info storageInfo) error) error {
+    prefix := g.prefix
+    if prefix != "" {
+        prefix += "/"
+    }
+    objects, e := g.list(prefix)
+    if e != nil {
+        return e
+    }
+    infos := map[string]storageInfo{}
+    for _, o := range objects {
+        name := strings.TrimPrefix(o.Name, prefix)
+        if name == "" || strings.HasSuffix(name, "/") {
+            continue
+        }
+        infos[name] = o.info()
+    }
+    return walkStorageInfos(infos, fn)
+}
@@ -0,0 +1,591 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+func isS3(path string) bool {
+    return strings.HasPrefix(path, "s3://")
+}
+
+// parseS3URL splits s3://bucket/prefix into the bucket and the prefix.
+func parseS3URL(s3URL string) (string, string, error) {
+    bucket, prefix, _ := strings.Cut(strings.TrimPrefix(s3URL, "s3://"), "/")
+    if bucket == "" {
+        return "", "", fmt.Errorf("no bucket in %s", s3URL)
+    }
+    return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// s3PartSize is the -s3-part-size of the command line, and the default of
+// the copies of the API.
+var s3PartSize int64 = 16 << 20
+
+// s3Client talks to S3, or to the S3-compatible service at endpoint, with
+// credentials found where the AWS SDKs look for them.
+type s3Client struct {
+    endpoint string
+    region   string
+    http     *http.Client
+
+    mu      sync.Mutex
+    creds   s3Credentials
+    refresh func() (s3Credentials, error)
+}
+
+// s3Credentials are the keys requests are signed with. Those of a container
+// or instance role expire and are fetched again before they do.
+type s3Credentials struct {
+    accessKey string
+    secretKey string
+    token     string
+    expires   time.Time
+}
+
+func newS3Client() (*s3Client, error) {
+    profile := os.Getenv("AWS_PROFILE")
+    if profile == "" {
+        profile = "default"
+    }
+    c := &s3Client{endpoint: strings.TrimRight(*s3Endpoint, "/"), region: os.Getenv("AWS_REGION"),
+        http: &http.Client{}}
+    if c.region == "" {
+        c.region = os.Getenv("AWS_DEFAULT_REGION")
+    }
+    if c.region == "" {
+        section := "profile " + profile
+        if profile == "default" {
+            section = profile
+        }
+        c.region = readAWSFile("AWS_CONFIG_FILE", "config", section)["region"]
+    }
+    if c.region == "" {
+        c.region = "us-east-1"
+    }
+    creds, refresh, e := findAWSCredentials(profile)
+    if e != nil {
+        return nil, e
+    }
+    c.creds, c.refresh = creds, refresh
+    return c, nil
+}
+
+// findAWSCredentials looks for credentials in the AWS_ environment
+// variables, the profile of the shared credentials file, and then the role
+// of the container or EC2 instance gopy runs on.
+func findAWSCredentials(profile string) (s3Credentials, func() (s3Credentials, error), error) {
+    if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+        creds := s3Credentials{accessKey: key, secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+            token: os.Getenv("AWS_SESSION_TOKEN")}
+        if creds.secretKey == "" {
+            return creds, nil, errors.New("AWS_ACCESS_KEY_ID is set without AWS_SECRET_ACCESS_KEY")
+        }
+        return creds, nil, nil
+    }
+    section := readAWSFile("AWS_SHARED_CREDENTIALS_FILE", "credentials", profile)
+    if section["aws_access_key_id"] != "" {
+        return s3Credentials{accessKey: section["aws_access_key_id"], secretKey: section["aws_secret_access_key"],
+            token: section["aws_session_token"]}, nil, nil
+    }
+    refresh := instanceCredentials
+    if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+        refresh = containerCredentials
+    } else if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+        refresh = nil
+    }
+    if refresh != nil {
+        if creds, e := refresh(); e == nil {
+            return creds, refresh, nil
+        }
+    }
+    return s3Credentials{}, nil, errors.New("no AWS credentials for s3:// paths: set AWS_ACCESS_KEY_ID and " +
+        "AWS_SECRET_ACCESS_KEY, a profile in ~/.aws/credentials, or run with a container or instance role")
+}
+
+// readAWSFile returns the keys of section in the shared AWS file named by
+// the environment variable env, or ~/.aws/name.
+func readAWSFile(env, name, section string) map[string]string {
+    file := os.Getenv(env)
+    if file == "" {
+        home, e := os.UserHomeDir()
+        if e != nil {
+            return nil
+        }
+        file = filepath.Join(home, ".aws", name)
+    }
+    data, e := ioutil.ReadFile(file)
+    if e != nil {
+        return nil
+    }
+    keys := map[string]string{}
+    current := ""
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        switch {
+        case line == "" || line[0] == '#' || line[0] == ';':
+        case line[0] == '[' && line[len(line)-1] == ']':
+            current = strings.TrimSpace(line[1 : len(line)-1])
+        case current == section:
+            if k, v, ok := strings.Cut(line, "="); ok {
+                keys[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+            }
+        }
+    }
+    return keys
+}
+
+// roleCredentials is how the container and instance metadata services
+// return the credentials of a role.
+type roleCredentials struct {
+    AccessKeyID     string `json:"AccessKeyId"`
+    SecretAccessKey string
+    Token           string
+    Expiration      time.Time
+}
+
+// metadataClient is used for the metadata services, which answer at once
+// where they exist.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+func fetchRoleCredentials(req *http.Request) (s3Credentials, error) {
+    resp, e := metadataClient.Do(req)
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return s3Credentials{}, fmt.Errorf("%s: %s", req.URL, resp.Status)
+    }
+    var rc roleCredentials
+    if e := json.NewDecoder(resp.Body).Decode(&rc); e != nil {
+        return s3Credentials{}, fmt.Errorf("%s: %v", req.URL, e)
+    }
+    if rc.AccessKeyID == "" || rc.SecretAccessKey == "" {
+        return s3Credentials{}, fmt.Errorf("%s: no credentials", req.URL)
+    }
+    return s3Credentials{rc.AccessKeyID, rc.SecretAccessKey, rc.Token, rc.Expiration}, nil
+}
+
+// containerCredentials fetches the credentials of the ECS task role.
+func containerCredentials() (s3Credentials, error) {
+    u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+    if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+        u = "http://169.254.170.2" + relative
+    }
+    req, e := http.NewRequest("GET", u, nil)
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+        req.Header.Set("Authorization", token)
+    }
+    return fetchRoleCredentials(req)
+}
+
+// instanceCredentials fetches the credentials of the EC2 instance role
+// through IMDSv2.
+func instanceCredentials() (s3Credentials, error) {
+    endpoint := strings.TrimRight(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+    if endpoint == "" {
+        endpoint = "http://169.254.169.254"
+    }
+    req, e := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+    resp, e := metadataClient.Do(req)
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    token, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return s3Credentials{}, fmt.Errorf("instance metadata token: %s", resp.Status)
+    }
+    get := func(path string) (*http.Request, error) {
+        req, e := http.NewRequest("GET", endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+        if e == nil {
+            req.Header.Set("X-aws-ec2-metadata-token", string(token))
+        }
+        return req, e
+    }
+    req, e = get("")
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    resp, e = metadataClient.Do(req)
+    if e != nil {
+        return s3Credentials{}, e
+    }
+    roles, _ := ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+    if resp.StatusCode != http.StatusOK || role == "" {
+        return s3Credentials{}, errors.New("the instance has no role")
+    }
+    if req, e = get(role); e != nil {
+        return s3Credentials{}, e
+    }
+    return fetchRoleCredentials(req)
+}
+
+// credentials returns the credentials to sign with, fetching those of a role
+// again when they expire within five minutes.
+func (c *s3Client) credentials() (s3Credentials, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.refresh != nil && !c.creds.expires.IsZero() && time.Until(c.creds.expires) < 5*time.Minute {
+        creds, e := c.refresh()
+        if e != nil {
+            return c.creds, fmt.Errorf("refreshing AWS credentials: %v", e)
+        }
+        c.creds = creds
+    }
+    return c.creds, nil
+}
+
+// s3Escape escapes s as S3 signatures expect, keeping slashes unless
+// escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+            c == '-' || c == '.' || c == '_' || c == '~' || c == '/' && !escapeSlash {
+            b.WriteByte(c)
+        } else {
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func s3Query(query map[string]string) string {
+    names := []string{}
+    for name := range query {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    parts := []string{}
+    for _, name := range names {
+        parts = append(parts, s3Escape(name, true)+"="+s3Escape(query[name], true))
+    }
+    return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    h := hmac.New(sha256.New, key)
+    h.Write([]byte(data))
+    return h.Sum(nil)
+}
+
+// send sends a request signed with AWS signature version 4 and returns the
+// response, or an error for a response other than 2xx.
+func (c *s3Client) send(method, bucket, key string, query map[string]string, body []byte) (*http.Response, error) {
+    host, path := bucket+".s3."+c.region+".amazonaws.com", "/"+s3Escape(key, false)
+    scheme := "https"
+    if c.endpoint != "" {
+        u, e := url.Parse(c.endpoint)
+        if e != nil {
+            return nil, e
+        }
+        scheme, host, path = u.Scheme, u.Host, strings.TrimRight(u.Path, "/")+"/"+bucket+path
+    }
+    rawQuery := s3Query(query)
+    req, e := http.NewRequest(method, scheme+"://"+host+path+"?"+rawQuery, bytes.NewReader(body))
+    if e != nil {
+        return nil, e
+    }
+    creds, e := c.credentials()
+    if e != nil {
+        return nil, e
+    }
+    now := time.Now().UTC()
+    amzDate, date := now.Format("20060102T150405Z"), now.Format("20060102")
+    sum := sha256.Sum256(body)
+    payloadHash := hex.EncodeToString(sum[:])
+    req.Header.Set("x-amz-date", amzDate)
+    req.Header.Set("x-amz-content-sha256", payloadHash)
+    headers := "host:" + host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n"
+    signed := "host;x-amz-content-sha256;x-amz-date"
+    if creds.token != "" {
+        req.Header.Set("x-amz-security-token", creds.token)
+        headers += "x-amz-security-token:" + creds.token + "\n"
+        signed += ";x-amz-security-token"
+    }
+    canonical := strings.Join([]string{method, path, rawQuery, headers, signed, payloadHash}, "\n")
+    canonicalSum := sha256.Sum256([]byte(canonical))
+    scope := date + "/" + c.region + "/s3/aws4_request"
+    toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+    signingKey := hmacSHA256(hmacSHA256(hmacSHA256(hmacSHA256([]byte("AWS4"+creds.secretKey), date), c.region), "s3"),
+        "aws4_request")
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.accessKey+"/"+scope+
+        ", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(signingKey, toSign)))
+    resp, e := c.http.Do(req)
+    if e != nil {
+        return nil, e
+    }
+    if resp.StatusCode >= 300 {
+        defer resp.Body.Close()
+        data, _ := ioutil.ReadAll(resp.Body)
+        return nil, s3Error(method, bucket, key, resp.Status, data)
+    }
+    return resp, nil
+}
+
+func s3Error(method, bucket, key, status string, data []byte) error {
+    var body struct {
+        Code    string `xml:"Code"`
+        Message string `xml:"Message"`
+    }
+    xml.Unmarshal(data, &body)
+    return fmt.Errorf("s3 %s s3://%s/%s: %s %s %s", method, bucket, key, status, body.Code, body.Message)
+}
+
+// do sends a request like send and returns the headers and body of the
+// response.
+func (c *s3Client) do(method, bucket, key string, query map[string]string, body []byte) (http.Header, []byte, error) {
+    resp, e := c.send(method, bucket, key, query, body)
+    if e != nil {
+        return nil, nil, e
+    }
+    defer resp.Body.Close()
+    data, e := ioutil.ReadAll(resp.Body)
+    if e != nil {
+        return nil, nil, e
+    }
+    // CompleteMultipartUpload can fail with a 200 response.
+    if bytes.Contains(data, []byte("<Error>")) {
+        return nil, nil, s3Error(method, bucket, key, resp.Status, data)
+    }
+    return resp.Header, data, nil
+}
+
+type s3Object struct {
+    Key          string    `xml:"Key"`
+    Size         int64     `xml:"Size"`
+    LastModified time.Time `xml:"LastModified"`
+}
+
+// list returns every object of bucket whose key starts with prefix.
+func (c *s3Client) list(bucket, prefix string) ([]s3Object, error) {
+    objects := []s3Object{}
+    query := map[string]string{"list-type": "2", "prefix": prefix}
+    for {
+        _, data, e := c.do(http.MethodGet, bucket, "", query, nil)
+        if e != nil {
+            return nil, e
+        }
+        var result struct {
+            Contents              []s3Object `xml:"Contents"`
+            IsTruncated           bool       `xml:"IsTruncated"`
+            NextContinuationToken string     `xml:"NextContinuationToken"`
+        }
+        if e := xml.Unmarshal(data, &result); e != nil {
+            return nil, e
+        }
+        objects = append(objects, result.Contents...)
+        if !result.IsTruncated {
+            return objects, nil
+        }
+        query["continuation-token"] = result.NextContinuationToken
+    }
+}
+
+// s3Storage is the tree of objects below a prefix of a bucket. Files larger
+// than partSize are uploaded in parts, concurrency at a time.
+type s3Storage struct {
+    client      *s3Client
+    bucket      string
+    prefix      string
+    partSize    int64
+    concurrency int
+}
+
+func newS3Storage(s3URL string) (*s3Storage, error) {
+    bucket, prefix, e := parseS3URL(s3URL)
+    if e != nil {
+        return nil, e
+    }
+    client, e := newS3Client()
+    if e != nil {
+        return nil, e
+    }
+    return &s3Storage{client, bucket, prefix, s3PartSize, max(*s3Concurrency, 1)}, nil
+}
+
+func (d *s3Storage) key(name string) string {
+    return strings.TrimPrefix(d.prefix+"/"+name, "/")
+}
+
+func (d *s3Storage) uploadFile(f *os.File, name string, size int64) error {
+    return d.upload(f, d.key(name), size)
+}
+
+func (d *s3Storage) upload(f *os.File, key string, size int64) error {
+    if size <= d.partSize {
+        data, e := ioutil.ReadAll(f)
+        if e != nil {
+            return e
+        }
+        _, _, e = d.client.do(http.MethodPut, d.bucket, key, nil, data)
+        return e
+    }
+    return d.uploadParts(f, key, size)
+}
+
+type s3Part struct {
+    PartNumber int    `xml:"PartNumber"`
+    ETag       string `xml:"ETag"`
+}
+
+func (d *s3Storage) uploadParts(f *os.File, key string, size int64) error {
+    _, data, e := d.client.do(http.MethodPost, d.bucket, key, map[string]string{"uploads": ""}, nil)
+    if e != nil {
+        return e
+    }
+    var upload struct {
+        UploadID string `xml:"UploadId"`
+    }
+    if e := xml.Unmarshal(data, &upload); e != nil {
+        return e
+    }
+    // S3 allows at most 10000 parts.
+    partSize := d.partSize
+    if size > partSize*10000 {
+        partSize = (size + 9999) / 10000
+    }
+    parts := make([]s3Part, (size+partSize-1)/partSize)
+    errs := make(chan error, len(parts))
+    slots := make(chan struct{}, d.concurrency)
+    var wg sync.WaitGroup
+    for i := range parts {
+        wg.Add(1)
+        slots <- struct{}{}
+        go func(i int) {
+            defer wg.Done()
+            defer func() { <-slots }()
+            buf := make([]byte, min(partSize, size-int64(i)*partSize))
+            if _, e := f.ReadAt(buf, int64(i)*partSize); e != nil && e != io.EOF {
+                errs <- e
+                return
+            }
+            header, _, e := d.client.do(http.MethodPut, d.bucket, key,
+                map[string]string{"partNumber": strconv.Itoa(i + 1), "uploadId": upload.UploadID}, buf)
+            if e != nil {
+                errs <- e
+                return
+            }
+            parts[i] = s3Part{i + 1, header.Get("ETag")}
+        }(i)
+    }
+    wg.Wait()
+    close(errs)
+    e = <-errs
+    if e == nil {
+        var body []byte
+        body, e = xml.Marshal(struct {
+            XMLName xml.Name `xml:"CompleteMultipartUpload"`
+            Parts   []s3Part `xml:"Part"`
+        }{Parts: parts})
+        if e == nil {
+            _, _, e = d.client.do(http.MethodPost, d.bucket, key, map[string]string{"uploadId": upload.UploadID}, body)
+        }
+    }
+    if e != nil {
+        d.client.do(http.MethodDelete, d.bucket, key, map[string]string{"uploadId": upload.UploadID}, nil)
+    }
+    return e
+}
+
+func (d *s3Storage) Open(name string) (io.ReadCloser, error) {
+    resp, e := d.client.send(http.MethodGet, d.bucket, d.key(name), nil, nil)
+    if e != nil {
+        return nil, e
+    }
+    return resp.Body, nil
+}
+
+func (d *s3Storage) Create(name string) (io.WriteCloser, error) {
+    return newUploadWriter(d, name)
+}
+
+// Stat reports an object, or a "directory" when objects have name as a
+// prefix.
+func (d *s3Storage) Stat(name string) (storageInfo, error) {
+    if name == "" {
+        return storageInfo{IsDir: true}, nil
+    }
+    resp, e := d.client.send(http.MethodHead, d.bucket, d.key(name), nil, nil)
+    if e == nil {
+        resp.Body.Close()
+        modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+        return storageInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+    }
+    if objects, le := d.client.list(d.bucket, d.key(name)+"/"); le == nil && len(objects) > 0 {
+        return storageInfo{IsDir: true}, nil
+    }
+    return storageInfo{}, e
+}
+
+// Walk calls fn for every object and for the "directories" of their keys, in
+// the order of their names.
+func (d *s3Storage) Walk(fn func(name string, info storageInfo) error) error {
+    prefix := d.prefix
+    if prefix != "" {
+        prefix += "/"
+    }
+    objects, e := d.client.list(d.bucket, prefix)
+    if e != nil {
+        return e
+    }
+    infos := map[string]storageInfo{}
+    for _, o := range objects {
+        name := strings.TrimPrefix(o.Key, prefix)
+        if name == "" || strings.HasSuffix(name, "/") {
+            continue
+        }
+        infos[name] = storageInfo{Size: o.Size, ModTime: o.LastModified}
+    }
+    return walkStorageInfos(infos, fn)
+}
@@ -0,0 +1,431 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "encoding/xml"
+    "flag"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeS3 serves the objects of a bucket at /bucket, as an S3-compatible
+// service with path-style requests does, from a map. It counts the parts of
+// multipart uploads.
+func fakeS3(t *testing.T) (*httptest.Server, map[string][]byte, *int) {
+    objects := map[string][]byte{}
+    modTimes := map[string]time.Time{}
+    uploads := map[string]map[int][]byte{}
+    parts := 0
+    var mu sync.Mutex
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+            r.Header.Get("x-amz-content-sha256") == "" {
+            w.WriteHeader(http.StatusForbidden)
+            return
+        }
+        key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+        query := r.URL.Query()
+        switch {
+        case r.Method == http.MethodGet && query.Get("list-type") == "2":
+            keys := []string{}
+            for key := range objects {
+                if strings.HasPrefix(key, query.Get("prefix")) {
+                    keys = append(keys, key)
+                }
+            }
+            sort.Strings(keys)
+            // Two objects a page, to follow continuation tokens.
+            start, _ := strconv.Atoi(query.Get("continuation-token"))
+            end := min(start+2, len(keys))
+            fmt.Fprint(w, "<ListBucketResult>")
+            for _, key := range keys[start:end] {
+                fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>", key,
+                    len(objects[key]), modTimes[key].UTC().Format(time.RFC3339))
+            }
+            if end < len(keys) {
+                fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+            }
+            fmt.Fprint(w, "</ListBucketResult>")
+        case r.Method == http.MethodPost && query.Has("uploads"):
+            id := strconv.Itoa(len(uploads) + 1)
+            uploads[id] = map[int][]byte{}
+            fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+        case r.Method == http.MethodPut && query.Has("uploadId"):
+            n, _ := strconv.Atoi(query.Get("partNumber"))
+            uploads[query.Get("uploadId")][n], _ = io.ReadAll(r.Body)
+            parts++
+            w.Header().Set("ETag", fmt.Sprintf("\"etag-%d\"", n))
+        case r.Method == http.MethodPost && query.Has("uploadId"):
+            var complete struct {
+                Parts []s3Part `xml:"Part"`
+            }
+            xml.NewDecoder(r.Body).Decode(&complete)
+            data := []byte{}
+            for i, part := range complete.Parts {
+                if part.PartNumber != i+1 || part.ETag != fmt.Sprintf("\"etag-%d\"", i+1) {
+                    fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+                    return
+                }
+                data = append(data, uploads[query.Get("uploadId")][part.PartNumber]...)
+            }
+            objects[key], modTimes[key] = data, time.Now()
+            fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+        case r.Method == http.MethodPut:
+            objects[key], _ = io.ReadAll(r.Body)
+            modTimes[key] = time.Now()
+        case r.Method == http.MethodGet || r.Method == http.MethodHead:
+            data, ok := objects[key]
+            if !ok {
+                w.WriteHeader(http.StatusNotFound)
+                return
+            }
+            w.Header().Set("Last-Modified", modTimes[key].UTC().Format(http.TimeFormat))
+            w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+            if r.Method == http.MethodGet {
+                w.Write(data)
+            }
+        default:
+            w.WriteHeader(http.StatusBadRequest)
+        }
+    }))
+    t.Cleanup(server.Close)
+    return server, objects, &parts
+}
+
+// testCloudTree copies a tree to dest, a directory of a fake cloud storage,
+// then syncs it after changing a file, and checks that the storage lists,
+// walks and verifies like a local directory.
+func testCloudTree(t *testing.T, dest string, objects map[string][]byte) {
+    t.Helper()
+    src := filepath.Join(t.TempDir(), "src")
+    writeFiles(t, src, map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/big.bin": "0123456789abcdef"})
+    past := time.Now().Add(-time.Hour)
+    for _, name := range []string{"a.txt", "sub/b.txt", "sub/big.bin"} {
+        os.Chtimes(filepath.Join(src, filepath.FromSlash(name)), past, past)
+    }
+    manifest := writeManifestFile(t, src)
+    copyForTest(t, dest, manifest, copyOptions{})
+    if got := string(objects["backup/src/sub/big.bin"]); got != "0123456789abcdef" {
+        t.Fatalf("uploaded big.bin = %q", got)
+    }
+
+    writeFiles(t, src, map[string]string{"a.txt": "aaa"})
+    result, e := copyManifests(dest, []string{manifest}, copyOptions{sync: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    if result.files != 1 || result.skipped != 2 || string(objects["backup/src/a.txt"]) != "aaa" {
+        t.Errorf("sync copied %d and skipped %d files, a.txt = %q", result.files, result.skipped, objects["backup/src/a.txt"])
+    }
+
+    st, e := openStorage(dest)
+    if e != nil {
+        t.Fatal(e)
+    }
+    names := []string{}
+    st.Walk(func(name string, info storageInfo) error {
+        names = append(names, name)
+        return nil
+    })
+    if got := strings.Join(names, ","); got != "src,src/a.txt,src/sub,src/sub/b.txt,src/sub/big.bin" {
+        t.Errorf("Walk() = %s", got)
+    }
+    if info, e := st.Stat("src/sub"); e != nil || !info.IsDir {
+        t.Errorf("Stat(src/sub) = %+v, %v", info, e)
+    }
+    if info, e := st.Stat("src/sub/big.bin"); e != nil || info.IsDir || info.Size != 16 {
+        t.Errorf("Stat(src/sub/big.bin) = %+v, %v", info, e)
+    }
+    if _, e := st.Stat("src/missing"); e == nil {
+        t.Error("Stat(src/missing) succeeded")
+    }
+    entries, e := List(context.Background(), ListOptions{Directories: []string{dest}, Recursive: true, NoDirs: true})
+    if e != nil {
+        t.Fatal(e)
+    }
+    sizes := []string{}
+    for _, entry := range entries {
+        sizes = append(sizes, fmt.Sprintf("%s=%d", entry.Path, entry.Size))
+    }
+    want := dest + "/src/a.txt=3," + dest + "/src/sub/b.txt=2," + dest + "/src/sub/big.bin=16"
+    if got := strings.Join(sizes, ","); got != want {
+        t.Errorf("List() = %s, want %s", got, want)
+    }
+    if count := runVerifyTrees(src, dest+"/src", "sha256", 2, ""); count != 0 {
+        t.Errorf("verify-trees found %d mismatches", count)
+    }
+}
+
+func TestS3Tree(t *testing.T) {
+    server, objects, parts := fakeS3(t)
+    t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+    t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+    t.Setenv("AWS_SESSION_TOKEN", "")
+    defer func(endpoint string, partSize int64) { *s3Endpoint, s3PartSize = endpoint, partSize }(*s3Endpoint, s3PartSize)
+    *s3Endpoint, s3PartSize = server.URL, 5
+    testCloudTree(t, "s3://bucket/backup", objects)
+    // big.bin, 16 bytes, is uploaded in 4 parts of 5 bytes at most.
+    if *parts != 4 {
+        t.Errorf("%d parts uploaded, want 4", *parts)
+    }
+}
+
+// fakeGCS serves the objects of a bucket through the JSON API, as
+// fake-gcs-server does, from a map. Requests must carry token, if it is not
+// "". It counts the chunks of resumable uploads.
+func fakeGCS(t *testing.T, token string) (*httptest.Server, map[string][]byte, *int) {
+    objects := map[string][]byte{}
+    modTimes := map[string]time.Time{}
+    type session struct {
+        name string
+        data []byte
+    }
+    sessions := map[string]*session{}
+    chunks := 0
+    var mu sync.Mutex
+    var server *httptest.Server
+    server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        if auth := r.Header.Get("Authorization"); token != "" && auth != "Bearer "+token || token == "" && auth != "" {
+            w.WriteHeader(http.StatusUnauthorized)
+            fmt.Fprint(w, `{"error":{"code":401,"message":"bad token"}}`)
+            return
+        }
+        query := r.URL.Query()
+        metadata := func(name string) map[string]string {
+            return map[string]string{"name": name, "size": strconv.Itoa(len(objects[name])),
+                "updated": modTimes[name].UTC().Format(time.RFC3339Nano)}
+        }
+        path := r.URL.EscapedPath()
+        switch {
+        case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o" && query.Get("uploadType") == "media":
+            name := query.Get("name")
+            objects[name], _ = io.ReadAll(r.Body)
+            modTimes[name] = time.Now()
+            json.NewEncoder(w).Encode(metadata(name))
+        case r.Method == http.MethodPost && path == "/upload/storage/v1/b/bucket/o" && query.Get("uploadType") == "resumable":
+            id := strconv.Itoa(len(sessions) + 1)
+            sessions[id] = &session{name: query.Get("name")}
+            w.Header().Set("Location", server.URL+"/upload/storage/v1/b/bucket/o?uploadType=resumable&upload_id="+id)
+        case r.Method == http.MethodPut && path == "/upload/storage/v1/b/bucket/o" && sessions[query.Get("upload_id")] != nil:
+            s := sessions[query.Get("upload_id")]
+            var first, last, total int
+            fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total)
+            data, _ := io.ReadAll(r.Body)
+            if first != len(s.data) || last-first+1 != len(data) {
+                w.WriteHeader(http.StatusBadRequest)
+                return
+            }
+            s.data = append(s.data, data...)
+            chunks++
+            if len(s.data) < total {
+                w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.data)-1))
+                w.WriteHeader(http.StatusPermanentRedirect)
+                return
+            }
+            objects[s.name], modTimes[s.name] = s.data, time.Now()
+            json.NewEncoder(w).Encode(metadata(s.name))
+        case r.Method == http.MethodGet && path == "/storage/v1/b/bucket/o":
+            names := []string{}
+            for name := range objects {
+                if strings.HasPrefix(name, query.Get("prefix")) {
+                    names = append(names, name)
+                }
+            }
+            sort.Strings(names)
+            // Two objects a page, to follow page tokens.
+            start, _ := strconv.Atoi(query.Get("pageToken"))
+            end := min(start+2, len(names))
+            items := []map[string]string{}
+            for _, name := range names[start:end] {
+                items = append(items, metadata(name))
+            }
+            page := map[string]interface{}{"items": items}
+            if end < len(names) {
+                page["nextPageToken"] = strconv.Itoa(end)
+            }
+            json.NewEncoder(w).Encode(page)
+        case r.Method == http.MethodGet && strings.HasPrefix(path, "/storage/v1/b/bucket/o/"):
+            name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/bucket/o/"))
+            data, ok := objects[name]
+            if !ok || strings.Contains(path[len("/storage/v1/b/bucket/o/"):], "/") {
+                w.WriteHeader(http.StatusNotFound)
+                fmt.Fprint(w, `{"error":{"code":404,"message":"No such object"}}`)
+                return
+            }
+            if query.Get("alt") == "media" {
+                w.Write(data)
+            } else {
+                json.NewEncoder(w).Encode(metadata(name))
+            }
+        default:
+            w.WriteHeader(http.StatusBadRequest)
+        }
+    }))
+    t.Cleanup(server.Close)
+    return server, objects, &chunks
+}
+
+func TestGCSTree(t *testing.T) {
+    server, objects, chunks := fakeGCS(t, "")
+    t.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+    defer func(chunkSize int64) { gcsChunkSize = chunkSize }(gcsChunkSize)
+    gcsChunkSize = 6
+    testCloudTree(t, "gs://bucket/backup", objects)
+    // big.bin, 16 bytes, is uploaded in 3 chunks of 6 bytes at most.
+    if *chunks != 3 {
+        t.Errorf("%d chunks uploaded, want 3", *chunks)
+    }
+}
+
+func TestGCSCredentials(t *testing.T) {
+    key, e := rsa.GenerateKey(rand.Reader, 2048)
+    if e != nil {
+        t.Fatal(e)
+    }
+    der, e := x509.MarshalPKCS8PrivateKey(key)
+    if e != nil {
+        t.Fatal(e)
+    }
+    tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        token := ""
+        switch r.Form.Get("grant_type") {
+        case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+            parts := strings.Split(r.Form.Get("assertion"), ".")
+            signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+            sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+            claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+            if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature) == nil &&
+                strings.Contains(string(claims), `"iss":"backup@project.iam.gserviceaccount.com"`) {
+                token = "service-account"
+            }
+        case "refresh_token":
+            if r.Form.Get("refresh_token") == "refresh" && r.Form.Get("client_secret") == "secret" {
+                token = "user"
+            }
+        }
+        if token == "" {
+            w.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 3600})
+    }))
+    defer tokens.Close()
+    metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Metadata-Flavor") != "Google" ||
+            r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+            w.WriteHeader(http.StatusForbidden)
+            return
+        }
+        json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "instance", "expires_in": 3600})
+    }))
+    defer metadata.Close()
+
+    dir := t.TempDir()
+    serviceAccount, _ := json.Marshal(map[string]string{"type": "service_account",
+        "client_email": "backup@project.iam.gserviceaccount.com", "token_uri": tokens.URL,
+        "private_key": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))})
+    user, _ := json.Marshal(map[string]string{"type": "authorized_user", "client_id": "id", "client_secret": "secret",
+        "refresh_token": "refresh", "token_uri": tokens.URL})
+    writeFiles(t, dir, map[string]string{"service-account.json": string(serviceAccount), "user.json": string(user),
+        "gcloud/application_default_credentials.json": string(user)})
+    t.Setenv("STORAGE_EMULATOR_HOST", "")
+    t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+    t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+    t.Setenv("NO_GCE_CHECK", "")
+    cases := []struct {
+        name, credentials, gcloud, token, want string
+    }{
+        {"access token", "", "", "direct", "direct"},
+        {"service account", filepath.Join(dir, "service-account.json"), "", "", "service-account"},
+        {"user", filepath.Join(dir, "user.json"), "", "", "user"},
+        {"gcloud", "", filepath.Join(dir, "gcloud"), "", "user"},
+        {"metadata server", "", filepath.Join(dir, "none"), "", "instance"},
+    }
+    for _, c := range cases {
+        server, objects, _ := fakeGCS(t, c.want)
+        objects["backup/a.txt"] = []byte("a")
+        t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", c.credentials)
+        t.Setenv("CLOUDSDK_CONFIG", c.gcloud)
+        t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", c.token)
+        st, e := newGCSStorage("gs://bucket/backup")
+        if e != nil {
+            t.Errorf("%s: %v", c.name, e)
+            continue
+        }
+        st.endpoint = server.URL
+        if info, e := st.Stat("a.txt"); e != nil || info.Size != 1 {
+            t.Errorf("%s: Stat() = %+v, %v", c.name, info, e)
+        }
+    }
+    t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+    t.Setenv("NO_GCE_CHECK", "true")
+    if _, e := newGCSStorage("gs://bucket/backup"); e == nil {
+        t.Error("newGCSStorage() found credentials with none configured")
+    }
+}
+
+func TestStorageFlags(t *testing.T) {
+    defer func(c *command) { activeCommand = c }(activeCommand)
+    for _, c := range commands {
+        c := c
+        activeCommand = &c
+        fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+        c.register(fs)
+        endpoint, partSize := fs.Lookup("s3-endpoint") != nil, fs.Lookup("s3-part-size") != nil
+        switch c.name {
+        case "copy", "sync":
+            if !endpoint || !partSize || fs.Lookup("s3-concurrency") == nil {
+                t.Errorf("%s has no s3 upload flags", c.name)
+            }
+        case "list", "verify-trees":
+            if !endpoint {
+                t.Errorf("%s has no -s3-endpoint", c.name)
+            }
+        }
+    }
+}
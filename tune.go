@@ -0,0 +1,202 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "time"
+)
+
+const (
+    tuneSampleBytes = 64 << 20
+    tuneSmallFiles  = 200
+)
+
+type probe struct {
+    bytes    int64
+    files    int
+    duration time.Duration
+}
+
+func (p probe) throughput() float64 {
+    if p.duration <= 0 {
+        return 0
+    }
+    return float64(p.bytes) / p.duration.Seconds()
+}
+
+func (p probe) perFile() time.Duration {
+    if p.files == 0 {
+        return 0
+    }
+    return p.duration / time.Duration(p.files)
+}
+
+// probeSources reads the files of the manifest, up to tuneSampleBytes, and
+// returns the first megabyte read for the compression probe.
+func probeSources(sources []string) (probe, []byte) {
+    var p probe
+    sample := []byte{}
+    buf := make([]byte, 1<<20)
+    start := time.Now()
+    e := cliWalker.walkCopySources(sources, nil, func(item copyItem) {
+        if item.info.IsDir() || p.bytes >= tuneSampleBytes {
+            return
+        }
+        f, e := cliIO.openSource(item.path)
+        if e != nil {
+            return
+        }
+        defer f.Close()
+        for {
+            n, e := f.Read(buf)
+            if len(sample) < len(buf) {
+                sample = append(sample, buf[:min(n, len(buf)-len(sample))]...)
+            }
+            p.bytes += int64(n)
+            if e != nil {
+                break
+            }
+        }
+        p.files++
+    })
+    if e != nil {
+        printError(e)
+    }
+    p.duration = time.Since(start)
+    return p, sample
+}
+
+// probeDestination writes a large file and many small files in a temporary
+// directory of directoryPath.
+func probeDestination(directoryPath string, sample []byte) (probe, probe, error) {
+    var large, small probe
+    dir, e := ioutil.TempDir(directoryPath, ".gopy-tune-")
+    if e != nil {
+        return large, small, e
+    }
+    defer os.RemoveAll(dir)
+    if len(sample) == 0 {
+        sample = make([]byte, 1<<20)
+    }
+
+    start := time.Now()
+    f, e := os.Create(filepath.Join(dir, "large"))
+    if e != nil {
+        return large, small, e
+    }
+    for large.bytes < tuneSampleBytes/4 {
+        n, e := f.Write(sample)
+        large.bytes += int64(n)
+        if e != nil {
+            f.Close()
+            return large, small, e
+        }
+    }
+    e = f.Sync()
+    f.Close()
+    if e != nil {
+        return large, small, e
+    }
+    large.duration, large.files = time.Since(start), 1
+
+    start = time.Now()
+    for i := 0; i < tuneSmallFiles; i++ {
+        if e := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(i)), sample[:min(len(sample), 4096)], 0644); e != nil {
+            return large, small, e
+        }
+    }
+    small.duration, small.files = time.Since(start), tuneSmallFiles
+    return large, small, nil
+}
+
+func probeCompression(sample []byte) probe {
+    var p probe
+    if len(sample) == 0 {
+        return p
+    }
+    start := time.Now()
+    w := gzip.NewWriter(ioutil.Discard)
+    for p.bytes < tuneSampleBytes/4 {
+        n, _ := w.Write(sample)
+        p.bytes += int64(n)
+    }
+    w.Close()
+    p.duration = time.Since(start)
+    return p
+}
+
+func formatRate(bytesPerSecond float64) string {
+    return formatSize(int64(bytesPerSecond)) + "/s"
+}
+
+// runTune measures how fast the sources of the manifest at inputPath can be read
+// and directoryPath can be written, prints the measurements with recommended
+// copy options and, when job is given, saves them to that job in configFile.
+func runTune(inputPath, directoryPath, configFile, job string) {
+    paths, e := readTextFile(inputPath)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    source, sample := probeSources(paths)
+    large, small, e := probeDestination(directoryPath, sample)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    compression := probeCompression(sample)
+
+    fmt.Printf("Source read: %s (%d files, %s)\n", formatRate(source.throughput()), source.files, formatSize(source.bytes))
+    fmt.Println("Destination write:", formatRate(large.throughput()))
+    fmt.Println("Destination small-file cost:", small.perFile(), "per file")
+    fmt.Println("gzip compression:", formatRate(compression.throughput()))
+
+    options := map[string]interface{}{"input": inputPath, "directory": directoryPath}
+    if small.perFile() > 5*time.Millisecond {
+        // Slow file creation usually means a network filesystem, where
+        // transient errors are common.
+        options["retries"] = 3
+    }
+    if compression.throughput() > 2*large.throughput() {
+        fmt.Println("The destination is much slower than compression, consider -compress gzip")
+    }
+    names := []string{}
+    for name := range options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    fmt.Println("Recommended options:")
+    for _, name := range names {
+        fmt.Printf("  -%s=%v\n", name, options[name])
+    }
+    if job != "" {
+        if e := saveJobOptions(configFile, job, options, false); e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        fmt.Println("Saved to job", job, "in", configFile)
+    }
+}
@@ -0,0 +1,157 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "sync"
+)
+
+type mismatch struct {
+    Path        string `json:"path"`
+    Reason      string `json:"reason"`
+    Source      string `json:"source_hash,omitempty"`
+    Destination string `json:"destination_hash,omitempty"`
+}
+
+func treeFiles(st storage) (map[string]int64, error) {
+    files := map[string]int64{}
+    e := st.Walk(func(name string, info storageInfo) error {
+        if !info.IsDir && name != undoJournalName {
+            files[name] = info.Size
+        }
+        return nil
+    })
+    return files, e
+}
+
+// runVerifyTrees compares every file of src with the file at the same path in
+// dest, hashing up to jobs pairs concurrently, and returns the number of
+// mismatches. Mismatches are printed as they are found and, when reportFile
+// is given, written to it as JSON lines.
+func runVerifyTrees(src, dest, algorithm string, jobs int, reportFile string) int {
+    srcStorage, e := openStorage(src)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    destStorage, e := openStorage(dest)
+    if e != nil {
+        printErrorAndExit(e, exitIOError)
+    }
+    var srcFiles, destFiles map[string]int64
+    var srcErr, destErr error
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() { defer wg.Done(); srcFiles, srcErr = treeFiles(srcStorage) }()
+    go func() { defer wg.Done(); destFiles, destErr = treeFiles(destStorage) }()
+    wg.Wait()
+    for _, e := range []error{srcErr, destErr} {
+        if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+    }
+
+    var report *json.Encoder
+    if reportFile != "" {
+        f, e := os.Create(reportFile)
+        if e != nil {
+            printErrorAndExit(e, exitIOError)
+        }
+        defer f.Close()
+        report = json.NewEncoder(f)
+    }
+    mismatches := make(chan mismatch)
+    printed := make(chan int)
+    go func() {
+        count := 0
+        for m := range mismatches {
+            fmt.Printf("Mismatch: %s (%s)\n", m.Path, m.Reason)
+            if report != nil {
+                if e := report.Encode(m); e != nil {
+                    printErrorAndExit(e, exitIOError)
+                }
+            }
+            count++
+        }
+        printed <- count
+    }()
+
+    paths := make(chan string)
+    newHash := hashAlgorithms[algorithm]
+    for i := 0; i < jobs; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for rel := range paths {
+                srcHash, e := hashStorageFile(srcStorage, rel, newHash)
+                if e != nil {
+                    mismatches <- mismatch{Path: rel, Reason: e.Error()}
+                    continue
+                }
+                destHash, e := hashStorageFile(destStorage, rel, newHash)
+                if e != nil {
+                    mismatches <- mismatch{Path: rel, Reason: e.Error()}
+                    continue
+                }
+                if srcHash != destHash {
+                    mismatches <- mismatch{rel, "content differs", srcHash, destHash}
+                } else {
+                    logger.Info("file_verified", "path", rel, "hash", srcHash)
+                }
+            }
+        }()
+    }
+    rels := []string{}
+    for rel := range srcFiles {
+        rels = append(rels, rel)
+    }
+    sort.Strings(rels)
+    for _, rel := range rels {
+        size, ok := destFiles[rel]
+        if !ok {
+            mismatches <- mismatch{Path: rel, Reason: "missing in destination"}
+        } else if size != srcFiles[rel] {
+            mismatches <- mismatch{Path: rel, Reason: "size differs"}
+        } else {
+            paths <- rel
+        }
+    }
+    close(paths)
+    rels = rels[:0]
+    for rel := range destFiles {
+        if _, ok := srcFiles[rel]; !ok {
+            rels = append(rels, rel)
+        }
+    }
+    sort.Strings(rels)
+    for _, rel := range rels {
+        mismatches <- mismatch{Path: rel, Reason: "missing in source"}
+    }
+    wg.Wait()
+    close(mismatches)
+    count := <-printed
+    fmt.Printf("Files verified: %d, mismatches: %d\n", len(srcFiles), count)
+    return count
+}
@@ -0,0 +1,142 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build linux
+
+package gopy
+
+import (
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO |
+    syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+// watcher reports the files created, changed, moved or deleted in the
+// directories added to it, using inotify.
+type watcher struct {
+    fd      int
+    mu      sync.Mutex
+    dirs    map[int32]string
+    watches map[string]int32
+    events  chan []string
+    errs    chan error
+}
+
+func newWatcher() (*watcher, error) {
+    fd, e := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+    if e != nil {
+        return nil, os.NewSyscallError("inotify_init1", e)
+    }
+    w := &watcher{
+        fd:      fd,
+        dirs:    map[int32]string{},
+        watches: map[string]int32{},
+        events:  make(chan []string, 16),
+        errs:    make(chan error, 1),
+    }
+    go w.read()
+    return w, nil
+}
+
+func (w *watcher) add(dir string) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if _, ok := w.watches[dir]; ok {
+        return nil
+    }
+    wd, e := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+    if e != nil {
+        return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: e}
+    }
+    w.dirs[int32(wd)] = dir
+    w.watches[dir] = int32(wd)
+    return nil
+}
+
+// read sends the paths named by each batch of events, or nil when the
+// kernel queue overflowed and changes were lost.
+func (w *watcher) read() {
+    buf := make([]byte, 64*1024)
+    for {
+        n, e := syscall.Read(w.fd, buf)
+        if e == syscall.EINTR {
+            continue
+        }
+        if e != nil {
+            w.errs <- os.NewSyscallError("read", e)
+            return
+        }
+        paths := []string{}
+        for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+            wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+            mask := binary.NativeEndian.Uint32(buf[offset+4:])
+            length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+            offset += syscall.SizeofInotifyEvent
+            name := strings.TrimRight(string(buf[offset:offset+length]), "\x00")
+            offset += length
+            if mask&syscall.IN_Q_OVERFLOW != 0 {
+                paths = nil
+                break
+            }
+            w.mu.Lock()
+            dir, ok := w.dirs[wd]
+            if mask&syscall.IN_IGNORED != 0 {
+                delete(w.dirs, wd)
+                delete(w.watches, dir)
+            }
+            w.mu.Unlock()
+            if ok && name != "" {
+                paths = append(paths, filepath.Join(dir, name))
+            }
+        }
+        w.events <- paths
+    }
+}
+
+// wait blocks until something changes and returns the changed paths,
+// gathered for a moment so that a burst of changes makes one batch. all is
+// set when changes were lost and everything has to be rescanned.
+func (w *watcher) wait() (paths []string, all bool, e error) {
+    select {
+    case batch := <-w.events:
+        all = batch == nil
+        paths = batch
+    case e := <-w.errs:
+        return nil, false, e
+    }
+    settle := time.After(100 * time.Millisecond)
+    for {
+        select {
+        case batch := <-w.events:
+            all = all || batch == nil
+            paths = append(paths, batch...)
+        case <-settle:
+            return paths, all, nil
+        }
+    }
+}
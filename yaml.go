@@ -0,0 +1,141 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "sort"
+
+    "gopkg.in/yaml.v3"
+)
+
+// parseYAML parses a YAML document into the maps, slices and scalars that
+// encoding/json marshals, so that config files in YAML are decoded like
+// their JSON equivalent. An empty document is an empty mapping.
+func parseYAML(data []byte) (interface{}, error) {
+    var v interface{}
+    if e := yaml.Unmarshal(data, &v); e != nil {
+        return nil, e
+    }
+    if v == nil {
+        return map[string]interface{}{}, nil
+    }
+    return jsonValue(v), nil
+}
+
+// jsonValue returns v with the keys of its mappings turned into strings, as
+// YAML keys may be numbers or booleans.
+func jsonValue(v interface{}) interface{} {
+    switch v := v.(type) {
+    case map[string]interface{}:
+        for k, x := range v {
+            v[k] = jsonValue(x)
+        }
+    case map[interface{}]interface{}:
+        m := make(map[string]interface{}, len(v))
+        for k, x := range v {
+            m[fmt.Sprint(k)] = jsonValue(x)
+        }
+        return m
+    case []interface{}:
+        for i, x := range v {
+            v[i] = jsonValue(x)
+        }
+    }
+    return v
+}
+
+// setYAMLJob merges options into job in the YAML document data, or replaces
+// the job, creating either when they don't exist. The rest of the document
+// and its comments are kept, though it is written back with 2-space indents.
+func setYAMLJob(data []byte, job string, options map[string]interface{}, replace bool) ([]byte, error) {
+    var doc yaml.Node
+    if e := yaml.Unmarshal(data, &doc); e != nil {
+        return nil, e
+    }
+    if doc.Kind == 0 {
+        doc = yaml.Node{Kind: yaml.DocumentNode}
+    }
+    if len(doc.Content) == 0 {
+        doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+    }
+    root := doc.Content[0]
+    if root.Kind != yaml.MappingNode {
+        return nil, errors.New("the document is not a mapping")
+    }
+    existing := yamlMapping(yamlMapping(root, "jobs", false), job, replace)
+    names := []string{}
+    for name := range options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        value := &yaml.Node{}
+        if e := value.Encode(options[name]); e != nil {
+            return nil, e
+        }
+        yamlSet(existing, name, value)
+    }
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(2)
+    if e := enc.Encode(&doc); e != nil {
+        return nil, e
+    }
+    if e := enc.Close(); e != nil {
+        return nil, e
+    }
+    return buf.Bytes(), nil
+}
+
+// yamlMapping returns the mapping at key in m, adding an empty one when there
+// is none, or when replace is set or the value is not a mapping.
+func yamlMapping(m *yaml.Node, key string, replace bool) *yaml.Node {
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        if m.Content[i].Value == key {
+            if v := m.Content[i+1]; v.Kind == yaml.MappingNode && !replace {
+                return v
+            }
+            m.Content[i+1] = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+            return m.Content[i+1]
+        }
+    }
+    v := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+    return v
+}
+
+// yamlSet sets key in the mapping m to value, keeping the comments of the
+// value it replaces.
+func yamlSet(m *yaml.Node, key string, value *yaml.Node) {
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        if m.Content[i].Value == key {
+            old := m.Content[i+1]
+            value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+            m.Content[i+1] = value
+            return
+        }
+    }
+    m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
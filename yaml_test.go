@@ -0,0 +1,176 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "encoding/json"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestReadYAMLConfig(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "gopy.yaml")
+    writeFiles(t, filepath.Dir(path), map[string]string{"gopy.yaml": `# nightly runs
+jobs:
+  photos:
+    input: photos.txt
+    directory: "/backup/my photos"   # quoted
+    skip-junk: true
+    workers: 4
+    exclude: ['*.tmp', "*.bak"]
+    include:
+    - '*.jpg'
+    - 'it''s.png'
+smtp: {host: mail.example.com, from: gopy@example.com}
+tenants:
+  alice:
+    token: secret
+    roots:
+      - /data/alice
+`})
+    c, e := readConfig(path)
+    if e != nil {
+        t.Fatal(e)
+    }
+    got, _ := json.Marshal(c.Jobs["photos"])
+    want := `{"directory":"/backup/my photos","exclude":["*.tmp","*.bak"],"include":["*.jpg","it's.png"],` +
+        `"input":"photos.txt","skip-junk":true,"workers":4}`
+    if string(got) != want {
+        t.Errorf("job = %s, want %s", got, want)
+    }
+    if c.SMTP == nil || c.SMTP.Host != "mail.example.com" || c.SMTP.From != "gopy@example.com" {
+        t.Errorf("smtp = %+v", c.SMTP)
+    }
+    if a := c.Tenants["alice"]; a == nil || a.Token != "secret" || len(a.Roots) != 1 || a.Roots[0] != "/data/alice" {
+        t.Errorf("tenants = %+v", c.Tenants)
+    }
+    for _, bad := range []string{"jobs:\n  a: 1\n  a: 2\n", "a:\n    b: 1\n  c: 2\n"} {
+        if _, e := parseYAML([]byte(bad)); e == nil {
+            t.Errorf("parseYAML(%q) succeeded", bad)
+        }
+    }
+}
+
+func TestParseYAML(t *testing.T) {
+    for _, c := range []struct {
+        name, yaml, want string
+    }{
+        {"empty", "# nothing\n", `{}`},
+        {"document start", "---\na: 1\n", `{"a":1}`},
+        {"scalars", "int: -12\nfloat: 1.5\nyes: true\nno: False\nnothing: ~\nnone:\nword: hello world\nurl: http://x:80/a\n",
+            `{"float":1.5,"int":-12,"no":false,"none":null,"nothing":null,"url":"http://x:80/a","word":"hello world","yes":true}`},
+        {"numbers", "hex: 0x1F\nversion: 1.2.3\nunderscore: 1_000\n",
+            `{"hex":31,"underscore":1000,"version":"1.2.3"}`},
+        {"double quotes", `a: "tab\there"` + "\n" + `b: "caf\u00e9 \"x\""` + "\n" + `c: "# not a comment"` + "\n" +
+            `d: "key: value"` + "\n" + `e: "42"` + "\n" + `f: ""` + "\n",
+            `{"a":"tab\there","b":"café \"x\"","c":"# not a comment","d":"key: value","e":"42","f":""}`},
+        {"single quotes", "a: 'it''s'\nb: 'no \\escape'\nc: '# kept' # dropped\nd: ''\n",
+            `{"a":"it's","b":"no \\escape","c":"# kept","d":""}`},
+        {"quoted keys", "\"a key\": 1\n'b: c': 2\n\"3\": x\n", `{"3":"x","a key":1,"b: c":2}`},
+        {"comments", "# top\na: b#c # comment\n  # indented comment\nd: e\n", `{"a":"b#c","d":"e"}`},
+        {"nested mappings", "a:\n  b:\n    c: 1\n    d: 2\n  e: 3\nf: 4\n", `{"a":{"b":{"c":1,"d":2},"e":3},"f":4}`},
+        {"block list", "a:\n  - x\n  - 2\n  -\n  - 'y'\n", `{"a":["x",2,null,"y"]}`},
+        {"list at key indent", "a:\n- x\n- y\nb: z\n", `{"a":["x","y"],"b":"z"}`},
+        {"list of mappings", "jobs:\n  - name: a\n    dirs: [x, y]\n  - name: b\n    deep:\n      k: v\n",
+            `{"jobs":[{"dirs":["x","y"],"name":"a"},{"deep":{"k":"v"},"name":"b"}]}`},
+        {"nested lists", "a:\n  -\n    - 1\n    - 2\n  -\n    - 3\n", `{"a":[[1,2],[3]]}`},
+        {"top-level list", "- a\n- b: c\n", `["a",{"b":"c"}]`},
+        {"flow collections", "a: []\nb: {}\nc: [1, 'x, y', \"z\"]\nd: {k: v, 'q: r': 2}\n",
+            `{"a":[],"b":{},"c":[1,"x, y","z"],"d":{"k":"v","q: r":2}}`},
+        {"json", `{"a": [1, {"b": null}]}`, `{"a":[1,{"b":null}]}`},
+        {"windows line endings", "a:\r\n  b: 1\r\n", `{"a":{"b":1}}`},
+        {"block scalars", "a: |\n  two\n  lines\nb: >\n  folded\n  line\n", `{"a":"two\nlines\n","b":"folded line\n"}`},
+        {"anchors", "base: &base {workers: 4}\njob: *base\n", `{"base":{"workers":4},"job":{"workers":4}}`},
+        {"keys that are not strings", "1: a\ntrue: b\n", `{"1":"a","true":"b"}`},
+    } {
+        v, e := parseYAML([]byte(c.yaml))
+        if e != nil {
+            t.Errorf("%s: %v", c.name, e)
+            continue
+        }
+        if got, _ := json.Marshal(v); string(got) != c.want {
+            t.Errorf("%s: parseYAML() = %s, want %s", c.name, got, c.want)
+        }
+    }
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+    for _, c := range []struct {
+        yaml, err string
+    }{
+        {"a: 1\na: 2\n", `line 2: mapping key "a" already defined`},
+        {"a:\n\tb: 1\n", "line 2: found character that cannot start any token"},
+        {"a: \"open\n", "found unexpected end of stream"},
+        {"a: [1, 2\n", "line 1: did not find expected ',' or ']'"},
+        {"a:\n    b: 1\n  c: 2\n", "line 2: did not find expected key"},
+    } {
+        _, e := parseYAML([]byte(c.yaml))
+        if e == nil || !strings.Contains(e.Error(), c.err) {
+            t.Errorf("parseYAML(%q) = %v, want %s", c.yaml, e, c.err)
+        }
+    }
+}
+
+func TestSaveJobYAML(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "gopy.yaml")
+    writeFiles(t, dir, map[string]string{"gopy.yaml": `# nightly runs
+jobs:
+  photos:
+    input: photos.txt # the manifest
+    workers: 2
+smtp: {host: mail.example.com}
+`})
+    if e := saveJobOptions(path, "photos", map[string]interface{}{"workers": 8, "buffer-size": "4MB"}, false); e != nil {
+        t.Fatal(e)
+    }
+    if e := saveJobOptions(path, "music", map[string]interface{}{"input": "music.txt", "skip-junk": true}, true); e != nil {
+        t.Fatal(e)
+    }
+    text := readFile(t, path)
+    if strings.HasPrefix(text, "{") || !strings.Contains(text, "# nightly runs") || !strings.Contains(text, "# the manifest") {
+        t.Errorf("saved config lost its YAML or comments:\n%s", text)
+    }
+    c, e := readConfig(path)
+    if e != nil {
+        t.Fatal(e)
+    }
+    for job, want := range map[string]string{
+        "photos": `{"buffer-size":"4MB","input":"photos.txt","workers":8}`,
+        "music":  `{"input":"music.txt","skip-junk":true}`,
+    } {
+        if got, _ := json.Marshal(c.Jobs[job]); string(got) != want {
+            t.Errorf("job %s = %s, want %s", job, got, want)
+        }
+    }
+    if c.SMTP == nil || c.SMTP.Host != "mail.example.com" {
+        t.Errorf("smtp = %+v", c.SMTP)
+    }
+    created := filepath.Join(dir, "new.yml")
+    if e := saveJobOptions(created, "a", map[string]interface{}{"input": "a.txt"}, false); e != nil {
+        t.Fatal(e)
+    }
+    if got := readFile(t, created); got != "jobs:\n  a:\n    input: a.txt\n" {
+        t.Errorf("new config = %q", got)
+    }
+}
@@ -0,0 +1,48 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "io"
+
+    "github.com/klauspost/compress/zstd"
+)
+
+// zstdMaxWindowSize is the largest window decoded, as with the zstd command
+// by default, so that a file cannot make -decompress take gigabytes of memory.
+const zstdMaxWindowSize = 1 << 27
+
+// newZstdWriter returns a writer of a single zstd frame with a checksum to w.
+// Files are compressed one per goroutine, so the frame is too.
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+    return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// newZstdReader returns a reader of the zstd frames of r, which must be
+// closed.
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+    d, e := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+    if e != nil {
+        return nil, e
+    }
+    return d.IOReadCloser(), nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2012 Fredy Wijaya
+//
+// Permission is hereby granted, free of charge, to any person obtaining
+// a copy of this software and associated documentation files (the
+// "Software"), to deal in the Software without restriction, including
+// without limitation the rights to use, copy, modify, merge, publish,
+// distribute, sublicense, and/or sell copies of the Software, and to
+// permit persons to whom the Software is furnished to do so, subject to
+// the following conditions:
+//
+// The above copyright notice and this permission notice shall be
+// included in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+// EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+// NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+// LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+// OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+// WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package gopy
+
+import (
+    "bytes"
+    "encoding/base64"
+    "io"
+    "math/rand"
+    "os/exec"
+    "strings"
+    "testing"
+)
+
+// zstdReferenceFrame is zstdReferenceText compressed by zstd -19, with
+// Huffman-coded literals and coded distributions of the sequences.
+const zstdReferenceFrame = "KLUv/WTcBK0JAHKDCxHAawym7naRjaRyJf9/6UcTBp///5mPsFRbDSNBi4fG4DhcCo6hk2owiSt5FgSAlqhhX5C0vwEwRKBQGZkH" +
+    "EbgJIpCglKZaA8hI1BeBPmnw5RWxnaKwgZBxUUxKMSKg/woLXtlPy4glOzAlNKcN0LV1FnYqV5ACpGCklNWW9RHoOp6AH8XryxAY" +
+    "mNHtqzCeYELgWuGmQ50DORBVYKUx2aGO0xt5kFbTA0vsUoUYi0pESApgz2AII54RQ0WQmbDq0Cbac4iOprjuYsZFJ5P8D6zFYn9C" +
+    "Z3Cx/eBgBo7wTmnQ7rJuNqjuoePiGlUtv35ExAjE2LoWOwZnAq8MoEebMJH0d5cIapcTAvUTCHceNaAZyB+nEAvzMxdvJuNlseLK" +
+    "OyhVUJq9ETUflpQpJdXLn6KoAbZUGV8="
+
+// zstdText returns at least n bytes of words picked at random.
+func zstdText(n int) []byte {
+    words := []string{"alpha", "beta", "gamma", "delta", "gopy", "copy", "zstd", "frame", "block", "\n"}
+    var b []string
+    for x, size := 12345, 0; size < n; {
+        x = (x*1103515245 + 12345) % (1 << 31)
+        b = append(b, words[(x>>16)%len(words)])
+        size += len(b[len(b)-1]) + 1
+    }
+    return []byte(strings.Join(b, " "))
+}
+
+func zstdCompress(t *testing.T, data []byte, chunk int) []byte {
+    t.Helper()
+    var b bytes.Buffer
+    w, e := newZstdWriter(&b)
+    if e != nil {
+        t.Fatal(e)
+    }
+    for len(data) > 0 {
+        n := min(chunk, len(data))
+        if _, e := w.Write(data[:n]); e != nil {
+            t.Fatal(e)
+        }
+        data = data[n:]
+    }
+    if e := w.Close(); e != nil {
+        t.Fatal(e)
+    }
+    return b.Bytes()
+}
+
+func zstdDecompress(data []byte) ([]byte, error) {
+    r, e := newZstdReader(bytes.NewReader(data))
+    if e != nil {
+        return nil, e
+    }
+    defer r.Close()
+    return io.ReadAll(r)
+}
+
+func TestZstd(t *testing.T) {
+    random := make([]byte, 300000)
+    rand.New(rand.NewSource(1)).Read(random)
+    inputs := map[string][]byte{
+        "empty":         nil,
+        "byte":          {'a'},
+        "short":         []byte("hello, hello, hello"),
+        "text":          zstdText(1 << 20),
+        "random":        random,
+        "zeros":         make([]byte, 300000),
+        "block":         zstdText(128 << 10)[:128<<10],
+        "block+1":       zstdText(128<<10 + 1)[:128<<10+1],
+        "beyond window": zstdText(5 << 22 / 2),
+    }
+    for name, data := range inputs {
+        compressed := zstdCompress(t, data, 100000)
+        got, e := zstdDecompress(compressed)
+        if e != nil || !bytes.Equal(got, data) {
+            t.Errorf("%s: decompressed %d bytes of %d: %v", name, len(got), len(data), e)
+        }
+        if name == "text" && len(compressed) > len(data)/5 {
+            t.Errorf("text compressed to %d bytes of %d", len(compressed), len(data))
+        }
+    }
+}
+
+func TestZstdReference(t *testing.T) {
+    frame, _ := base64.StdEncoding.DecodeString(zstdReferenceFrame)
+    text := zstdText(1500)
+    if got, e := zstdDecompress(frame); e != nil || !bytes.Equal(got, text) {
+        t.Fatalf("decompressed %q: %v", got, e)
+    }
+    // Frames follow each other, skippable frames being skipped.
+    stream := append([]byte{0x5A, 0x2A, 0x4D, 0x18, 3, 0, 0, 0, 1, 2, 3}, frame...)
+    stream = append(stream, zstdCompress(t, text, len(text))...)
+    if got, e := zstdDecompress(stream); e != nil || !bytes.Equal(got, append(text, text...)) {
+        t.Fatalf("decompressed %d bytes: %v", len(got), e)
+    }
+}
+
+func TestZstdCommand(t *testing.T) {
+    if _, e := exec.LookPath("zstd"); e != nil {
+        t.Skip(e)
+    }
+    text := zstdText(1 << 20)
+    for _, level := range []string{"-1", "-19"} {
+        cmd := exec.Command("zstd", level, "-c")
+        cmd.Stdin = bytes.NewReader(text)
+        compressed, e := cmd.Output()
+        if e != nil {
+            t.Fatal(e)
+        }
+        if got, e := zstdDecompress(compressed); e != nil || !bytes.Equal(got, text) {
+            t.Errorf("zstd %s: decompressed %d bytes: %v", level, len(got), e)
+        }
+    }
+    cmd := exec.Command("zstd", "-d", "-c")
+    cmd.Stdin = bytes.NewReader(zstdCompress(t, text, 4096))
+    if got, e := cmd.Output(); e != nil || !bytes.Equal(got, text) {
+        t.Errorf("zstd -d: %d bytes: %v", len(got), e)
+    }
+}
+
+func TestZstdCorrupt(t *testing.T) {
+    frame, _ := base64.StdEncoding.DecodeString(zstdReferenceFrame)
+    for _, n := range []int{3, 5, 20, len(frame) - 1} {
+        if _, e := zstdDecompress(frame[:n]); e == nil {
+            t.Errorf("%d bytes of %d decompressed", n, len(frame))
+        }
+    }
+    if _, e := zstdDecompress([]byte("not compressed")); e == nil {
+        t.Error("plain text decompressed")
+    }
+    checksum := append([]byte{}, frame...)
+    checksum[len(checksum)-1] ^= 1
+    if _, e := zstdDecompress(checksum); e == nil {
+        t.Errorf("wrong checksum: %v", e)
+    }
+    // Damage anywhere is an error, not a panic.
+    for i := 4; i < len(frame); i++ {
+        for _, mask := range []byte{1, 0x10, 0x80, 0xFF} {
+            damaged := append([]byte{}, frame...)
+            damaged[i] ^= mask
+            zstdDecompress(damaged)
+        }
+    }
+}
+
+func TestZstdMaxWindow(t *testing.T) {
+    // A frame of one raw block of "a" with a window of 2^(10+e>>3).
+    frame := func(e byte) []byte { return []byte{0x28, 0xB5, 0x2F, 0xFD, 0, e, 9, 0, 0, 'a'} }
+    if got, e := zstdDecompress(frame(17 << 3)); e != nil || string(got) != "a" {
+        t.Errorf("window of %d: decompressed %q: %v", zstdMaxWindowSize, got, e)
+    }
+    if _, e := zstdDecompress(frame(18 << 3)); e == nil {
+        t.Errorf("window of %d decompressed", 2*zstdMaxWindowSize)
+    }
+}